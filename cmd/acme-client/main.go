@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"golang.org/x/crypto/acme"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var options struct {
+	URL        string `short:"u" long:"url" description:"ACME directory URL e.g. https://acme.example.org/directory" required:"true"`
+
+	AccountKey string `short:"a" long:"account-key" description:"Account private key, PEM format, default is a new key"`
+	CsrFile    string `short:"r" long:"certificate-request" description:"CSR file, PEM format" required:"true"`
+
+	HTTPListen string `short:"l" long:"http-listen" description:"Address to answer http-01 challenges on e.g. :80"`
+	DNSRecords string `long:"dns-records" description:"File to append dns-01 TXT records to, NAME VALUE per line, for acme-server --dns-records"`
+
+	Timeout    int64  `short:"t" long:"timeout" description:"Time to wait for the order (seconds)" default:"60"`
+}
+
+// Answers http-01 challenges with their key authorizations.
+type responder struct {
+	sync.Mutex
+	responses map[string]string
+}
+
+func (h *responder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	resp, ok := h.responses[r.URL.Path]
+	h.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(resp))
+}
+
+func (h *responder) add(path, resp string) {
+	h.Lock()
+	h.responses[path] = resp
+	h.Unlock()
+}
+
+// Appends a dns-01 record in the format acme-server --dns-records reads.
+func addDNSRecord(file, domain, value string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "_acme-challenge.%s %s\n", domain, value)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// The names to order are the request's DNS names and common name.
+func requestNames(csr *x509.CertificateRequest) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, n := range append([]string{csr.Subject.CommonName}, csr.DNSNames...) {
+		n = strings.ToLower(n)
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+		names = append(names, n)
+	}
+	return names
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if options.HTTPListen == "" && options.DNSRecords == "" {
+		log.Fatalf("one of --http-listen or --dns-records is needed " +
+			"to answer challenges")
+	}
+
+	csr, err := cert_tools.ReadCSRFromFile(options.CsrFile)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	names := requestNames(csr)
+	if len(names) == 0 {
+		log.Fatalf("certificate request has no names to order")
+	}
+
+	var key *cert_tools.Key
+	if options.AccountKey != "" {
+		key, err = cert_tools.ReadKeyFromFile(options.AccountKey)
+	} else {
+		key, err = cert_tools.NewKey()
+	}
+	if err != nil {
+		log.Fatalf("failed to read account key: %s", err)
+	}
+
+	client := &acme.Client{
+		Key:          key.Signer(),
+		DirectoryURL: options.URL,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(options.Timeout)*time.Second)
+	defer cancel()
+
+	_, err = client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		log.Fatalf("failed to register account: %s", err)
+	}
+
+	http01 := &responder{responses: map[string]string{}}
+	if options.HTTPListen != "" {
+		ln, err := net.Listen("tcp", options.HTTPListen)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		defer ln.Close()
+		go http.Serve(ln, http01)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		log.Fatalf("failed to create order: %s", err)
+	}
+
+	for _, u := range order.AuthzURLs {
+
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			log.Fatalf("failed to fetch authorization: %s", err)
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+
+		// http-01 is preferred when both are possible.
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == "http-01" && options.HTTPListen != "" {
+				chal = c
+				break
+			}
+			if c.Type == "dns-01" && options.DNSRecords != "" {
+				chal = c
+			}
+		}
+		if chal == nil {
+			log.Fatalf("%s: no challenge this client can answer",
+				z.Identifier.Value)
+		}
+
+		switch chal.Type {
+		case "http-01":
+			resp, err := client.HTTP01ChallengeResponse(chal.Token)
+			if err != nil {
+				log.Fatalf("%s", err)
+			}
+			http01.add(client.HTTP01ChallengePath(chal.Token), resp)
+		case "dns-01":
+			rec, err := client.DNS01ChallengeRecord(chal.Token)
+			if err != nil {
+				log.Fatalf("%s", err)
+			}
+			err = addDNSRecord(options.DNSRecords, z.Identifier.Value, rec)
+			if err != nil {
+				log.Fatalf("failed to write DNS record: %s", err)
+			}
+		}
+
+		if _, err := client.Accept(ctx, chal); err != nil {
+			log.Fatalf("failed to accept %s challenge: %s", chal.Type, err)
+		}
+		if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+			log.Fatalf("%s: %s failed: %s", z.Identifier.Value,
+				chal.Type, err)
+		}
+
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		log.Fatalf("order failed: %s", err)
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr.Raw, true)
+	if err != nil {
+		log.Fatalf("failed to finalize order: %s", err)
+	}
+
+	for _, der := range chain {
+		cert_tools.OutputPem(os.Stdout, der, "CERTIFICATE")
+	}
+
+}
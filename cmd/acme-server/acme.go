@@ -0,0 +1,1051 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACME objects, RFC 8555 section 7.1.
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+type account struct {
+	ID         string
+	Key        crypto.PublicKey
+	Thumbprint string
+	Contact    []string
+	Orders     []string
+}
+
+type order struct {
+	ID          string
+	AccountID   string
+	Status      string
+	Expires     time.Time
+	Identifiers []identifier
+	Authzs      []string
+	Error       *problem
+	Cert        []byte
+}
+
+type authz struct {
+	ID         string
+	AccountID  string
+	Identifier identifier
+	Wildcard   bool
+	Status     string
+	Expires    time.Time
+	Challenges []*challenge
+}
+
+type challenge struct {
+	ID        string
+	AuthzID   string
+	Type      string
+	Token     string
+	Status    string
+	Validated *time.Time
+	Error     *problem
+}
+
+const errPrefix = "urn:ietf:params:acme:error:"
+
+// The ACME server state.  Everything is held in memory, issued
+// certificates are optionally written out.
+type server struct {
+	issuer   *cert_tools.Issuer
+	opts     cert_tools.IssueOptions
+	resolver txtResolver
+
+	nonceMutex sync.Mutex
+	nonces     map[string]time.Time
+	nonceOrder []string
+
+	mutex    sync.Mutex
+	accounts map[string]*account
+	byKey    map[string]*account
+	orders   map[string]*order
+	authzs   map[string]*authz
+	chals    map[string]*challenge
+}
+
+func newServer(issuer *cert_tools.Issuer, opts cert_tools.IssueOptions,
+	resolver txtResolver) *server {
+	return &server{
+		issuer:   issuer,
+		opts:     opts,
+		resolver: resolver,
+		nonces:   map[string]time.Time{},
+		accounts: map[string]*account{},
+		byKey:    map[string]*account{},
+		orders:   map[string]*order{},
+		authzs:   map[string]*authz{},
+		chals:    map[string]*challenge{},
+	}
+}
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", s.directory)
+	mux.HandleFunc("/new-nonce", s.newNonce)
+	mux.HandleFunc("/new-account", s.newAccount)
+	mux.HandleFunc("/account/", s.getAccount)
+	mux.HandleFunc("/orders/", s.listOrders)
+	mux.HandleFunc("/new-order", s.newOrder)
+	mux.HandleFunc("/order/", s.getOrder)
+	mux.HandleFunc("/authz/", s.getAuthz)
+	mux.HandleFunc("/chall/", s.postChallenge)
+	mux.HandleFunc("/finalize/", s.finalize)
+	mux.HandleFunc("/cert/", s.getCert)
+	return mux
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("failed to read random: %s", err)
+	}
+	return b64.EncodeToString(b)
+}
+
+// Base URL the client sees, for building resource URLs.
+func baseURL(r *http.Request) string {
+	if options.BaseURL != "" {
+		return strings.TrimSuffix(options.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// Nonces are forgotten after a while, and the oldest once there are too
+// many, so clients polling newNonce can't grow them without bound.
+const (
+	nonceLifetime = time.Hour
+	maxNonces     = 10000
+)
+
+func (s *server) nonce() string {
+
+	n := randomID()
+	now := time.Now()
+
+	s.nonceMutex.Lock()
+	defer s.nonceMutex.Unlock()
+
+	s.nonces[n] = now
+	s.nonceOrder = append(s.nonceOrder, n)
+
+	// Nonces are in the order given, used ones are dropped as they're
+	// reached.
+	for len(s.nonceOrder) > 0 {
+		old := s.nonceOrder[0]
+		at, ok := s.nonces[old]
+		if ok && len(s.nonces) <= maxNonces &&
+			now.Sub(at) < nonceLifetime {
+			break
+		}
+		delete(s.nonces, old)
+		s.nonceOrder = s.nonceOrder[1:]
+	}
+
+	return n
+
+}
+
+// Every response carries a fresh nonce and a link to the directory.
+func (s *server) headers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.nonce())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Link", fmt.Sprintf("<%s/directory>;rel=\"index\"",
+		baseURL(r)))
+}
+
+func (s *server) writeJSON(w http.ResponseWriter, r *http.Request,
+	status int, v interface{}) {
+	s.headers(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *server) writeProblem(w http.ResponseWriter, r *http.Request,
+	status int, typ, detail string) {
+	s.headers(w, r)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type: errPrefix + typ, Detail: detail, Status: status,
+	})
+}
+
+func (s *server) directory(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"newNonce":   base + "/new-nonce",
+		"newAccount": base + "/new-account",
+		"newOrder":   base + "/new-order",
+	})
+}
+
+func (s *server) newNonce(w http.ResponseWriter, r *http.Request) {
+	s.headers(w, r)
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Checks the JWS on a POST, RFC 8555 section 6.  New accounts are signed
+// with a jwk, everything else with the kid of an existing account.
+// Returns the payload, which is empty for POST-as-GET.
+func (s *server) authenticate(w http.ResponseWriter, r *http.Request,
+	newAccount bool) (*account, *jwk, crypto.PublicKey, []byte, bool) {
+
+	if r.Method != http.MethodPost {
+		s.writeProblem(w, r, http.StatusMethodNotAllowed, "malformed",
+			"POST required")
+		return nil, nil, nil, nil, false
+	}
+
+	if r.Header.Get("Content-Type") != "application/jose+json" {
+		s.writeProblem(w, r, http.StatusUnsupportedMediaType,
+			"malformed", "Content-Type must be application/jose+json")
+		return nil, nil, nil, nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+			"failed to read body")
+		return nil, nil, nil, nil, false
+	}
+
+	var msg jwsMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+			"body is not a flattened JWS")
+		return nil, nil, nil, nil, false
+	}
+
+	protected, err := b64.DecodeString(msg.Protected)
+	if err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+			"invalid protected header encoding")
+		return nil, nil, nil, nil, false
+	}
+
+	var hdr jwsHeader
+	if err := json.Unmarshal(protected, &hdr); err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+			"invalid protected header")
+		return nil, nil, nil, nil, false
+	}
+
+	// Nonces are single use.
+	s.nonceMutex.Lock()
+	at, valid := s.nonces[hdr.Nonce]
+	valid = valid && time.Since(at) < nonceLifetime
+	delete(s.nonces, hdr.Nonce)
+	s.nonceMutex.Unlock()
+	if !valid {
+		s.writeProblem(w, r, http.StatusBadRequest, "badNonce",
+			"unknown or reused nonce")
+		return nil, nil, nil, nil, false
+	}
+
+	if hdr.URL != baseURL(r)+r.URL.Path {
+		s.writeProblem(w, r, http.StatusUnauthorized, "unauthorized",
+			"url header doesn't match request")
+		return nil, nil, nil, nil, false
+	}
+
+	var acct *account
+	var key *jwk
+	var pub crypto.PublicKey
+
+	if newAccount {
+		if len(hdr.JWK) == 0 || hdr.Kid != "" {
+			s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+				"new account must be signed with a jwk")
+			return nil, nil, nil, nil, false
+		}
+		pub, key, err = parseJWK(hdr.JWK)
+		if err != nil {
+			s.writeProblem(w, r, http.StatusBadRequest,
+				"badPublicKey", err.Error())
+			return nil, nil, nil, nil, false
+		}
+	} else {
+		if hdr.Kid == "" || len(hdr.JWK) != 0 {
+			s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+				"request must be signed with a kid")
+			return nil, nil, nil, nil, false
+		}
+		id := strings.TrimPrefix(hdr.Kid, baseURL(r)+"/account/")
+		s.mutex.Lock()
+		acct = s.accounts[id]
+		s.mutex.Unlock()
+		if acct == nil {
+			s.writeProblem(w, r, http.StatusBadRequest,
+				"accountDoesNotExist", "unknown account")
+			return nil, nil, nil, nil, false
+		}
+		pub = acct.Key
+	}
+
+	sig, err := b64.DecodeString(msg.Signature)
+	if err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+			"invalid signature encoding")
+		return nil, nil, nil, nil, false
+	}
+
+	err = verifyJWS(hdr.Alg, pub, []byte(msg.Protected+"."+msg.Payload),
+		sig)
+	if err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest,
+			"badSignatureAlgorithm", err.Error())
+		return nil, nil, nil, nil, false
+	}
+
+	payload, err := b64.DecodeString(msg.Payload)
+	if err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+			"invalid payload encoding")
+		return nil, nil, nil, nil, false
+	}
+
+	return acct, key, pub, payload, true
+
+}
+
+func (s *server) accountJSON(r *http.Request, a *account) interface{} {
+	return map[string]interface{}{
+		"status":  "valid",
+		"contact": a.Contact,
+		"orders":  baseURL(r) + "/orders/" + a.ID,
+	}
+}
+
+func (s *server) newAccount(w http.ResponseWriter, r *http.Request) {
+
+	_, key, pub, payload, ok := s.authenticate(w, r, true)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+			"invalid account request")
+		return
+	}
+
+	thumb := key.thumbprint()
+
+	s.mutex.Lock()
+	acct := s.byKey[thumb]
+	s.mutex.Unlock()
+
+	// An existing key gets its existing account.
+	if acct != nil {
+		w.Header().Set("Location", baseURL(r)+"/account/"+acct.ID)
+		s.writeJSON(w, r, http.StatusOK, s.accountJSON(r, acct))
+		return
+	}
+
+	if req.OnlyReturnExisting {
+		s.writeProblem(w, r, http.StatusBadRequest,
+			"accountDoesNotExist", "no account for this key")
+		return
+	}
+
+	acct = &account{
+		ID: randomID(), Key: pub, Thumbprint: thumb,
+		Contact: req.Contact,
+	}
+
+	s.mutex.Lock()
+	s.accounts[acct.ID] = acct
+	s.byKey[thumb] = acct
+	s.mutex.Unlock()
+
+	log.Printf("new account %s %v", acct.ID, acct.Contact)
+
+	w.Header().Set("Location", baseURL(r)+"/account/"+acct.ID)
+	s.writeJSON(w, r, http.StatusCreated, s.accountJSON(r, acct))
+
+}
+
+func (s *server) getAccount(w http.ResponseWriter, r *http.Request) {
+
+	acct, _, _, payload, ok := s.authenticate(w, r, false)
+	if !ok {
+		return
+	}
+
+	if strings.TrimPrefix(r.URL.Path, "/account/") != acct.ID {
+		s.writeProblem(w, r, http.StatusUnauthorized, "unauthorized",
+			"not your account")
+		return
+	}
+
+	// Contact updates are the only change supported.
+	var req struct {
+		Contact []string `json:"contact"`
+	}
+	if len(payload) > 0 && json.Unmarshal(payload, &req) == nil &&
+		req.Contact != nil {
+		s.mutex.Lock()
+		acct.Contact = req.Contact
+		s.mutex.Unlock()
+	}
+
+	s.writeJSON(w, r, http.StatusOK, s.accountJSON(r, acct))
+
+}
+
+func (s *server) listOrders(w http.ResponseWriter, r *http.Request) {
+
+	acct, _, _, _, ok := s.authenticate(w, r, false)
+	if !ok {
+		return
+	}
+
+	if strings.TrimPrefix(r.URL.Path, "/orders/") != acct.ID {
+		s.writeProblem(w, r, http.StatusUnauthorized, "unauthorized",
+			"not your account")
+		return
+	}
+
+	urls := []string{}
+	s.mutex.Lock()
+	for _, id := range acct.Orders {
+		urls = append(urls, baseURL(r)+"/order/"+id)
+	}
+	s.mutex.Unlock()
+
+	s.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"orders": urls,
+	})
+
+}
+
+// Marks an authorization expired once it's past its expiry time, RFC
+// 8555 section 7.1.6.  Called with the mutex held.
+func (s *server) expireAuthz(a *authz) {
+	if (a.Status == "pending" || a.Status == "valid") &&
+		time.Now().After(a.Expires) {
+		a.Status = "expired"
+	}
+}
+
+// Works out order status from its expiry and authorizations.  Called
+// with the mutex held.
+func (s *server) updateOrder(o *order) {
+
+	if o.Status != "pending" && o.Status != "ready" {
+		return
+	}
+
+	fail := func(detail string) {
+		o.Status = "invalid"
+		o.Error = &problem{
+			Type:   errPrefix + "unauthorized",
+			Detail: detail,
+		}
+	}
+
+	if time.Now().After(o.Expires) {
+		fail("order has expired")
+		return
+	}
+
+	ready := true
+	for _, id := range o.Authzs {
+		a := s.authzs[id]
+		s.expireAuthz(a)
+		switch a.Status {
+		case "invalid":
+			fail("authorization failed")
+			return
+		case "expired":
+			fail("authorization has expired")
+			return
+		case "valid":
+		default:
+			ready = false
+		}
+	}
+
+	if ready {
+		o.Status = "ready"
+	}
+
+}
+
+// Called with the mutex held.
+func (s *server) orderJSON(r *http.Request, o *order) interface{} {
+
+	s.updateOrder(o)
+
+	base := baseURL(r)
+	authzs := []string{}
+	for _, id := range o.Authzs {
+		authzs = append(authzs, base+"/authz/"+id)
+	}
+
+	obj := map[string]interface{}{
+		"status":         o.Status,
+		"expires":        o.Expires.Format(time.RFC3339),
+		"identifiers":    o.Identifiers,
+		"authorizations": authzs,
+		"finalize":       base + "/finalize/" + o.ID,
+	}
+	if o.Error != nil {
+		obj["error"] = o.Error
+	}
+	if o.Cert != nil {
+		obj["certificate"] = base + "/cert/" + o.ID
+	}
+
+	return obj
+
+}
+
+func (s *server) newOrder(w http.ResponseWriter, r *http.Request) {
+
+	acct, _, _, payload, ok := s.authenticate(w, r, false)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil ||
+		len(req.Identifiers) == 0 {
+		s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+			"invalid order request")
+		return
+	}
+
+	expires := time.Now().UTC().Add(7 * 24 * time.Hour)
+
+	o := &order{
+		ID: randomID(), AccountID: acct.ID, Status: "pending",
+		Expires: expires,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, id := range req.Identifiers {
+
+		if id.Type != "dns" {
+			s.writeProblem(w, r, http.StatusBadRequest,
+				"unsupportedIdentifier",
+				"only dns identifiers are supported")
+			return
+		}
+
+		value := strings.ToLower(id.Value)
+		if err := checkDNSIdentifier(value); err != nil {
+			s.writeProblem(w, r, http.StatusBadRequest,
+				"rejectedIdentifier", err.Error())
+			return
+		}
+		o.Identifiers = append(o.Identifiers,
+			identifier{Type: "dns", Value: value})
+
+		a := &authz{
+			ID: randomID(), AccountID: acct.ID, Status: "pending",
+			Expires: expires,
+		}
+
+		// Wildcards can only be proved with dns-01.
+		types := []string{"http-01", "dns-01"}
+		if strings.HasPrefix(value, "*.") {
+			a.Wildcard = true
+			value = value[2:]
+			types = []string{"dns-01"}
+		}
+		a.Identifier = identifier{Type: "dns", Value: value}
+
+		for _, t := range types {
+			c := &challenge{
+				ID: randomID(), AuthzID: a.ID, Type: t,
+				Token: randomID(), Status: "pending",
+			}
+			a.Challenges = append(a.Challenges, c)
+			s.chals[c.ID] = c
+		}
+
+		s.authzs[a.ID] = a
+		o.Authzs = append(o.Authzs, a.ID)
+
+	}
+
+	s.orders[o.ID] = o
+	acct.Orders = append(acct.Orders, o.ID)
+
+	log.Printf("new order %s for %v", o.ID, o.Identifiers)
+
+	w.Header().Set("Location", baseURL(r)+"/order/"+o.ID)
+	s.writeJSON(w, r, http.StatusCreated, s.orderJSON(r, o))
+
+}
+
+func (s *server) getOrder(w http.ResponseWriter, r *http.Request) {
+
+	acct, _, _, _, ok := s.authenticate(w, r, false)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	o := s.orders[strings.TrimPrefix(r.URL.Path, "/order/")]
+	if o == nil || o.AccountID != acct.ID {
+		s.writeProblem(w, r, http.StatusNotFound, "malformed",
+			"no such order")
+		return
+	}
+
+	s.writeJSON(w, r, http.StatusOK, s.orderJSON(r, o))
+
+}
+
+// Called with the mutex held.
+func (s *server) challengeJSON(r *http.Request, c *challenge) interface{} {
+	obj := map[string]interface{}{
+		"type":   c.Type,
+		"url":    baseURL(r) + "/chall/" + c.ID,
+		"status": c.Status,
+		"token":  c.Token,
+	}
+	if c.Validated != nil {
+		obj["validated"] = c.Validated.Format(time.RFC3339)
+	}
+	if c.Error != nil {
+		obj["error"] = c.Error
+	}
+	return obj
+}
+
+func (s *server) getAuthz(w http.ResponseWriter, r *http.Request) {
+
+	acct, _, _, _, ok := s.authenticate(w, r, false)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	a := s.authzs[strings.TrimPrefix(r.URL.Path, "/authz/")]
+	if a == nil || a.AccountID != acct.ID {
+		s.writeProblem(w, r, http.StatusNotFound, "malformed",
+			"no such authorization")
+		return
+	}
+	s.expireAuthz(a)
+
+	chals := []interface{}{}
+	for _, c := range a.Challenges {
+		chals = append(chals, s.challengeJSON(r, c))
+	}
+
+	obj := map[string]interface{}{
+		"identifier": a.Identifier,
+		"status":     a.Status,
+		"expires":    a.Expires.Format(time.RFC3339),
+		"challenges": chals,
+	}
+	if a.Wildcard {
+		obj["wildcard"] = true
+	}
+
+	s.writeJSON(w, r, http.StatusOK, obj)
+
+}
+
+// A POST with a payload of {} asks for the challenge to be validated,
+// POST-as-GET just returns it.  Validation happens in the background and
+// the client polls.
+func (s *server) postChallenge(w http.ResponseWriter, r *http.Request) {
+
+	acct, _, _, payload, ok := s.authenticate(w, r, false)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := s.chals[strings.TrimPrefix(r.URL.Path, "/chall/")]
+	if c == nil || s.authzs[c.AuthzID].AccountID != acct.ID {
+		s.writeProblem(w, r, http.StatusNotFound, "malformed",
+			"no such challenge")
+		return
+	}
+	a := s.authzs[c.AuthzID]
+	s.expireAuthz(a)
+
+	if len(payload) > 0 && c.Status == "pending" &&
+		a.Status == "pending" {
+		c.Status = "processing"
+		keyAuth := c.Token + "." + acct.Thumbprint
+		go s.validate(a, c, keyAuth)
+	}
+
+	w.Header().Add("Link", fmt.Sprintf("<%s/authz/%s>;rel=\"up\"",
+		baseURL(r), a.ID))
+	s.writeJSON(w, r, http.StatusOK, s.challengeJSON(r, c))
+
+}
+
+func (s *server) validate(a *authz, c *challenge, keyAuth string) {
+
+	var err error
+	switch c.Type {
+	case "http-01":
+		err = s.validateHTTP01(a.Identifier.Value, c.Token, keyAuth)
+	case "dns-01":
+		err = s.validateDNS01(a.Identifier.Value, keyAuth)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Too late if it expired while being validated.
+	s.expireAuthz(a)
+	if a.Status == "expired" {
+		c.Status = "invalid"
+		c.Error = &problem{Type: errPrefix + "unauthorized",
+			Detail: "authorization has expired"}
+		return
+	}
+
+	if err != nil {
+		log.Printf("%s challenge for %s failed: %s", c.Type,
+			a.Identifier.Value, err)
+		c.Status = "invalid"
+		c.Error = &problem{Type: errPrefix + "unauthorized",
+			Detail: err.Error()}
+		a.Status = "invalid"
+		return
+	}
+
+	log.Printf("%s challenge for %s passed", c.Type, a.Identifier.Value)
+
+	now := time.Now().UTC()
+	c.Status = "valid"
+	c.Validated = &now
+	a.Status = "valid"
+
+}
+
+func (s *server) finalize(w http.ResponseWriter, r *http.Request) {
+
+	acct, _, _, payload, ok := s.authenticate(w, r, false)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "malformed",
+			"invalid finalize request")
+		return
+	}
+
+	der, err := b64.DecodeString(req.CSR)
+	if err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "badCSR",
+			"invalid CSR encoding")
+		return
+	}
+
+	csr, err := cert_tools.ParseCSR(der)
+	if err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, "badCSR",
+			err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+
+	o := s.orders[strings.TrimPrefix(r.URL.Path, "/finalize/")]
+	if o == nil || o.AccountID != acct.ID {
+		s.mutex.Unlock()
+		s.writeProblem(w, r, http.StatusNotFound, "malformed",
+			"no such order")
+		return
+	}
+
+	s.updateOrder(o)
+	if o.Status != "ready" {
+		status := o.Status
+		s.mutex.Unlock()
+		s.writeProblem(w, r, http.StatusForbidden, "orderNotReady",
+			"order is "+status)
+		return
+	}
+
+	// What's signed is built from the order's identifiers, the request
+	// only gives the key.
+	signed, err := orderRequest(csr, o.Identifiers)
+	if err != nil {
+		s.mutex.Unlock()
+		s.writeProblem(w, r, http.StatusBadRequest, "badCSR",
+			err.Error())
+		return
+	}
+
+	// Signing can be slow, so it's done without the lock.  The order
+	// is processing meanwhile, so it can't be finalized twice.
+	o.Status = "processing"
+	s.mutex.Unlock()
+
+	issued, err := s.issuer.Issue(signed, s.opts)
+
+	// Nothing is returned unless it's audited.
+	aerr := cert_tools.AuditIssue(options.AuditLog, cert_tools.AuditRecord{
+		Operation: "acme-server finalize",
+		Requester: acct.ID,
+		Profiles:  options.Profiles,
+	}, s.issuer.Cert, signed, issued, err)
+	if aerr != nil {
+		log.Printf("%s", aerr)
+		err = fmt.Errorf("failed to audit")
+		issued = nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if issued == nil || err != nil {
+		o.Status = "invalid"
+		o.Error = &problem{Type: errPrefix + "badCSR",
+			Detail: err.Error()}
+		s.writeProblem(w, r, http.StatusBadRequest, "badCSR",
+			err.Error())
+		return
+	}
+
+	o.Cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: issued.Raw})
+	o.Cert = append(o.Cert, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: s.issuer.Cert.Raw})...)
+	o.Status = "valid"
+
+	log.Printf("issued %X for %v", issued.Certificate.SerialNumber,
+		signed.DNSNames)
+
+	if options.OutputDir != "" {
+		file := filepath.Join(options.OutputDir,
+			fmt.Sprintf("%X.pem", issued.Certificate.SerialNumber))
+		err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: issued.Raw}), 0644)
+		if err != nil {
+			log.Printf("failed to write %s: %s", file, err)
+		}
+	}
+
+	w.Header().Set("Location", baseURL(r)+"/order/"+o.ID)
+	s.writeJSON(w, r, http.StatusOK, s.orderJSON(r, o))
+
+}
+
+// The request to sign for an order: the CSR's key, a subject of just the
+// common name and SANs of the order's DNS names.  A CSR asking for other
+// subject attributes or SAN types is refused.
+func orderRequest(csr *x509.CertificateRequest, ids []identifier) (*x509.CertificateRequest, error) {
+
+	var rdns pkix.RDNSequence
+	rest, err := asn1.Unmarshal(csr.RawSubject, &rdns)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("invalid CSR subject")
+	}
+	cns := 0
+	for _, rdn := range rdns {
+		for _, atv := range rdn {
+			if !atv.Type.Equal(oidCommonName) {
+				return nil, fmt.Errorf("only a common name can "+
+					"be requested in the subject, not %s",
+					atv.Type)
+			}
+			cns++
+		}
+	}
+	if cns > 1 {
+		return nil, fmt.Errorf("only one common name can be requested")
+	}
+
+	sans, err := cert_tools.SANsFromExtensions(csr.Extensions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSR SANs: %s", err)
+	}
+	if sans == nil {
+		sans = &cert_tools.SANs{}
+	}
+	if len(sans.IPAddresses) > 0 || len(sans.EmailAddresses) > 0 ||
+		len(sans.URIs) > 0 || len(sans.OtherNames) > 0 ||
+		len(sans.Raw) > 0 {
+		return nil, fmt.Errorf("only DNS names can be requested")
+	}
+
+	// The request must name exactly the order's identifiers.
+	cn := strings.ToLower(csr.Subject.CommonName)
+	if err := checkCSRNames(cn, sans.DNSNames, ids); err != nil {
+		return nil, err
+	}
+
+	names := &cert_tools.SANs{}
+	for _, id := range ids {
+		names.DNSNames = append(names.DNSNames, id.Value)
+	}
+	subject := pkix.Name{CommonName: cn}
+	raw, err := asn1.Marshal(subject.ToRDNSequence())
+	if err != nil {
+		return nil, err
+	}
+	ext, err := names.Extension(cn == "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &x509.CertificateRequest{
+		Subject:            subject,
+		RawSubject:         raw,
+		PublicKey:          csr.PublicKey,
+		PublicKeyAlgorithm: csr.PublicKeyAlgorithm,
+		DNSNames:           names.DNSNames,
+		Extensions:         []pkix.Extension{ext},
+	}, nil
+
+}
+
+var oidCommonName = asn1.ObjectIdentifier{2, 5, 4, 3}
+
+// Checks a dns identifier is a host name, RFC 1123, optionally with a
+// leading wildcard label.  It goes into validation URLs and certificates,
+// so nothing else is allowed.
+func checkDNSIdentifier(name string) error {
+
+	host := strings.TrimPrefix(name, "*.")
+
+	if net.ParseIP(host) != nil {
+		return fmt.Errorf("%q is an IP address, not a DNS name", name)
+	}
+	if len(host) == 0 || len(host) > 253 {
+		return fmt.Errorf("%q is not a valid DNS name", name)
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		valid := len(label) > 0 && len(label) <= 63 &&
+			label[0] != '-' && label[len(label)-1] != '-'
+		for _, c := range label {
+			valid = valid && (c >= 'a' && c <= 'z' ||
+				c >= '0' && c <= '9' || c == '-')
+		}
+		if !valid {
+			return fmt.Errorf("%q is not a valid DNS name", name)
+		}
+	}
+
+	return nil
+
+}
+
+// Checks the CSR's names are exactly the order identifiers.  The common
+// name, if any, must be one of them.
+func checkCSRNames(cn string, dnsNames []string, ids []identifier) error {
+
+	want := []string{}
+	for _, id := range ids {
+		want = append(want, id.Value)
+	}
+	sort.Strings(want)
+
+	got := map[string]bool{}
+	for _, n := range dnsNames {
+		got[strings.ToLower(n)] = true
+	}
+	if cn != "" {
+		got[strings.ToLower(cn)] = true
+	}
+	names := []string{}
+	for n := range got {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		return fmt.Errorf("CSR names %v don't match order %v", names,
+			want)
+	}
+
+	return nil
+
+}
+
+func (s *server) getCert(w http.ResponseWriter, r *http.Request) {
+
+	acct, _, _, _, ok := s.authenticate(w, r, false)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	o := s.orders[strings.TrimPrefix(r.URL.Path, "/cert/")]
+	s.mutex.Unlock()
+
+	if o == nil || o.AccountID != acct.ID || o.Cert == nil {
+		s.writeProblem(w, r, http.StatusNotFound, "malformed",
+			"no such certificate")
+		return
+	}
+
+	s.headers(w, r)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(o.Cert)
+
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// A flattened JWS as used by ACME, RFC 8555 section 6.2.
+type jwsMessage struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	JWK   json.RawMessage `json:"jwk"`
+	Kid   string          `json:"kid"`
+}
+
+// Public key in JWK form, RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// Parses a JWK to a public key.
+func parseJWK(raw json.RawMessage) (crypto.PublicKey, *jwk, error) {
+
+	var k jwk
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return nil, nil, fmt.Errorf("invalid JWK: %s", err)
+	}
+
+	switch k.Kty {
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid JWK x")
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid JWK y")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, nil, fmt.Errorf("JWK point not on curve")
+		}
+		return pub, &k, nil
+
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid JWK n")
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, nil, fmt.Errorf("invalid JWK e")
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if pub.N.BitLen() < 2048 {
+			return nil, nil, fmt.Errorf("RSA key too small")
+		}
+		return pub, &k, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, nil, fmt.Errorf("invalid JWK x")
+		}
+		return ed25519.PublicKey(x), &k, nil
+
+	}
+
+	return nil, nil, fmt.Errorf("unsupported key type %q", k.Kty)
+
+}
+
+// JWK thumbprint, RFC 7638: SHA-256 of the required members in
+// lexicographic order.
+func (k *jwk) thumbprint() string {
+
+	var s string
+	switch k.Kty {
+	case "EC":
+		s = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`,
+			k.Crv, k.X, k.Y)
+	case "RSA":
+		s = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "OKP":
+		s = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, k.Crv, k.X)
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	return b64.EncodeToString(sum[:])
+
+}
+
+// Checks a JWS signature over the signing input.
+func verifyJWS(alg string, pub crypto.PublicKey, input, sig []byte) error {
+
+	switch key := pub.(type) {
+
+	case *ecdsa.PublicKey:
+		var digest []byte
+		size := (key.Curve.Params().BitSize + 7) / 8
+		switch {
+		case alg == "ES256" && size == 32:
+			sum := sha256.Sum256(input)
+			digest = sum[:]
+		case alg == "ES384" && size == 48:
+			sum := sha512.Sum384(input)
+			digest = sum[:]
+		case alg == "ES512" && size == 66:
+			sum := sha512.Sum512(input)
+			digest = sum[:]
+		default:
+			return fmt.Errorf("algorithm %s doesn't suit key", alg)
+		}
+		if len(sig) != 2*size {
+			return fmt.Errorf("bad signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("signature check failed")
+		}
+		return nil
+
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %s doesn't suit key", alg)
+		}
+		sum := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig)
+
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("algorithm %s doesn't suit key", alg)
+		}
+		if !ed25519.Verify(key, input, sig) {
+			return fmt.Errorf("signature check failed")
+		}
+		return nil
+
+	}
+
+	return fmt.Errorf("unsupported key type %T", pub)
+
+}
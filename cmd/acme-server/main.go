@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+var options struct {
+	Validity int64  `short:"v" long:"validity" description:"Certificate validity period (days)" default:"90"`
+
+	KeyFile  string `short:"k" long:"key" description:"CA private key, PEM format, or a pkcs11:, plugin:, unix: or shares: key" required:"true"`
+	CaFile   string `short:"c" long:"ca-certificate" description:"CA cert file, PEM format" required:"true"`
+
+	Profiles []string `short:"p" long:"profile" description:"Certificate profile for issued certificates" default:"server"`
+
+	CrlUri   []string `short:"d" long:"crl-distribution" description:"CRL Distribution URI" required:"false"`
+	CaUri    []string `short:"i" long:"ca-issuers-distribution" description:"CA Issuer Chain (p7c)" required:"false"`
+
+	SignatureAlgorithm string `short:"g" long:"signature-algorithm" description:"Signature algorithm e.g. ECDSA-SHA384, SHA256-RSAPSS, default follows the CA key type"`
+
+	Listen   string `short:"l" long:"listen" description:"Address to listen on" default:":4000"`
+	BaseURL  string `short:"u" long:"base-url" description:"External URL of the server, default is taken from the request"`
+	TLSCert  string `long:"tls-certificate" description:"Server TLS certificate, PEM format, default is plain HTTP"`
+	TLSKey   string `long:"tls-key" description:"Server TLS private key, PEM format"`
+
+	HTTPPort    int    `long:"http-port" description:"Port http-01 challenges are fetched from" default:"80"`
+	DNSResolver string `long:"dns-resolver" description:"DNS server for dns-01 lookups, host:port, default is the system resolver"`
+	DNSRecords  string `long:"dns-records" description:"File of TXT records for dns-01 lookups, NAME VALUE per line, for testing"`
+
+	OutputDir string `short:"o" long:"output-directory" description:"Directory to write issued certificates to"`
+	AuditLog  string `long:"audit-log" env:"CERT_TOOLS_AUDIT_LOG" description:"Hash-chained audit log to append to"`
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	// Key is EC, RSA or PKCS #8.
+	issuer, err := cert_tools.ReadIssuer(options.KeyFile, options.CaFile)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	profiles, err := cert_tools.GetProfiles(options.Profiles)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	// Fail now rather than on the first order.
+	_, err = cert_tools.SignatureAlgorithm(issuer.Key.Public(),
+		options.SignatureAlgorithm)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	opts := cert_tools.IssueOptions{
+		Validity:           time.Duration(options.Validity*24) * time.Hour,
+		Profiles:           profiles,
+		SignatureAlgorithm: options.SignatureAlgorithm,
+		CrlUri:             options.CrlUri,
+		CaUri:              options.CaUri,
+	}
+
+	// dns-01 lookups.
+	var resolver txtResolver = net.DefaultResolver
+	if options.DNSRecords != "" {
+		resolver = &fileResolver{file: options.DNSRecords}
+	} else if options.DNSResolver != "" {
+		resolver = newServerResolver(options.DNSResolver)
+	}
+
+	s := newServer(issuer, opts, resolver)
+
+	srv := &http.Server{
+		Addr:              options.Listen,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("ACME server listening on %s", options.Listen)
+
+	if options.TLSCert != "" {
+		err = srv.ListenAndServeTLS(options.TLSCert, options.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	log.Fatalf("%s", err)
+
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Looks up TXT records for dns-01.  net.Resolver satisfies this, tests
+// use a static file.
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Resolver which dials a specific DNS server.
+func newServerResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Resolver which reads TXT records from a file on each lookup, one record
+// per line as NAME VALUE.  Lets tests run without DNS.
+type fileResolver struct {
+	file string
+}
+
+func (f *fileResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+
+	file, err := os.Open(f.file)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	txt := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n := strings.TrimSuffix(strings.ToLower(fields[0]), ".")
+		if n == name {
+			txt = append(txt, fields[1])
+		}
+	}
+
+	return txt, scanner.Err()
+
+}
+
+// Validates an http-01 challenge, RFC 8555 section 8.3.
+func (s *server) validateHTTP01(domain, token, keyAuth string) error {
+
+	url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s",
+		net.JoinHostPort(domain, fmt.Sprint(options.HTTPPort)), token)
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: status %d", url,
+			resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", url, err)
+	}
+
+	if strings.TrimSpace(string(body)) != keyAuth {
+		return fmt.Errorf("key authorization from %s doesn't match",
+			url)
+	}
+
+	return nil
+
+}
+
+// Validates a dns-01 challenge, RFC 8555 section 8.4.
+func (s *server) validateDNS01(domain, keyAuth string) error {
+
+	sum := sha256.Sum256([]byte(keyAuth))
+	want := b64.EncodeToString(sum[:])
+
+	name := "_acme-challenge." + domain
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Second)
+	defer cancel()
+
+	txt, err := s.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to look up TXT %s: %s", name, err)
+	}
+
+	for _, t := range txt {
+		if t == want {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no matching TXT record at %s", name)
+
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var options struct {
+	Warning  int64  `short:"w" long:"warning" description:"Warn about certificates and CRLs expiring within this many days" default:"30"`
+	Critical int64  `short:"c" long:"critical" description:"Critical alert for certificates and CRLs expiring within this many days" default:"7"`
+	RevFile  string `short:"r" long:"revoked" description:"List of revoked certificates, form is SERIAL,TIME, revoked certificates aren't checked"`
+	Verbose  bool   `short:"v" long:"verbose" description:"Report everything checked, not just alerts"`
+
+	Listen   string `short:"l" long:"listen" description:"Run as a daemon serving Prometheus metrics at /metrics on this address, e.g. :9115"`
+}
+
+// Alert levels, which are also the exit status.  Errors are unknown, so
+// monitoring can tell a failed check from an alert.
+const (
+	levelOK       = 0
+	levelWarning  = 1
+	levelCritical = 2
+	levelUnknown  = 3
+)
+
+var levelNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+func fatal(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	os.Exit(levelUnknown)
+}
+
+// The outcome of checking one certificate or CRL.
+type result struct {
+	level   int
+	path    string
+	message string
+}
+
+// What a scan found, without duplicates or revoked certificates.
+type found struct {
+	certs   []*cert_tools.FoundCertificate
+	crls    []*cert_tools.FoundCRL
+	results []result
+}
+
+func main() {
+
+	// Parse flags
+	paths, err := flags.Parse(&options)
+	if err != nil {
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			os.Exit(levelOK)
+		}
+		os.Exit(levelUnknown)
+	}
+
+	if len(paths) == 0 {
+		fatal("no files or directories to check")
+	}
+
+	if options.Listen != "" {
+		http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			f, err := check(paths)
+			if err != nil {
+				log.Printf("%s", err)
+				http.Error(w, err.Error(),
+					http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type",
+				"text/plain; version=0.0.4")
+			f.metrics(w)
+		})
+		log.Printf("serving metrics on %s", options.Listen)
+		fatal("%s", http.ListenAndServe(options.Listen, nil))
+	}
+
+	f, err := check(paths)
+	if err != nil {
+		fatal("%s", err)
+	}
+
+	status := levelOK
+	for _, r := range f.results {
+		if r.level > status {
+			status = r.level
+		}
+		if r.level > levelOK || options.Verbose {
+			fmt.Printf("%-8s %s: %s\n", levelNames[r.level], r.path,
+				r.message)
+		}
+	}
+
+	os.Exit(status)
+
+}
+
+// Scans the paths and checks what's found.
+func check(paths []string) (*found, error) {
+
+	scan := &cert_tools.Scan{
+		Warn: func(path string, err error) {
+			log.Printf("skipped %s: %s", path, err)
+		},
+	}
+	if err := scan.Paths(paths); err != nil {
+		return nil, err
+	}
+
+	revoked := map[string]bool{}
+	if options.RevFile != "" {
+		list, err := cert_tools.ReadRevoked(options.RevFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read revoked file: %s",
+				err)
+		}
+		for _, r := range list {
+			revoked[r.SerialNumber.String()] = true
+		}
+	}
+
+	f := &found{}
+
+	// Chains and bundles repeat certificates.
+	for _, c := range scan.UniqueCertificates() {
+		if !revoked[c.Certificate.SerialNumber.String()] {
+			f.certs = append(f.certs, c)
+		}
+	}
+	f.crls = scan.UniqueCRLs()
+
+	now := time.Now()
+
+	for _, c := range f.certs {
+
+		cert := c.Certificate
+		level, when := expiry(cert.NotAfter, now, "expires", "expired")
+		f.results = append(f.results, result{level, c.Path,
+			fmt.Sprintf("certificate %s, serial %X, %s",
+				cert.Subject, cert.SerialNumber, when)})
+
+		// A certificate is no use once its issuer expires.
+		for _, ca := range f.certs {
+			if ca == c || !ca.Certificate.IsCA ||
+				!bytes.Equal(cert.RawIssuer, ca.Certificate.RawSubject) ||
+				cert.CheckSignatureFrom(ca.Certificate) != nil {
+				continue
+			}
+			if ca.Certificate.NotAfter.Before(cert.NotAfter) {
+				f.results = append(f.results, result{
+					levelWarning, c.Path,
+					fmt.Sprintf("certificate %s, serial %X, "+
+						"outlives its issuer %s, which "+
+						"expires %s", cert.Subject,
+						cert.SerialNumber,
+						ca.Certificate.Subject,
+						ca.Certificate.NotAfter.UTC().Format(time.RFC3339)),
+				})
+			}
+		}
+
+	}
+
+	for _, c := range f.crls {
+		level, when := expiry(c.CRL.NextUpdate, now, "next update due",
+			"next update overdue since")
+		f.results = append(f.results, result{level, c.Path,
+			fmt.Sprintf("CRL from %s, %s", c.CRL.Issuer, when)})
+	}
+
+	return f, nil
+
+}
+
+// How close a time is, against the thresholds, described as due or
+// past.
+func expiry(t time.Time, now time.Time, due, past string) (int, string) {
+
+	left := t.Sub(now)
+	days := int64(left.Hours() / 24)
+	at := t.UTC().Format(time.RFC3339)
+
+	switch {
+	case left <= 0:
+		return levelCritical, fmt.Sprintf("%s %s", past, at)
+	case left < time.Duration(options.Critical*24)*time.Hour:
+		return levelCritical, fmt.Sprintf("%s in %d days, %s",
+			due, days, at)
+	case left < time.Duration(options.Warning*24)*time.Hour:
+		return levelWarning, fmt.Sprintf("%s in %d days, %s",
+			due, days, at)
+	}
+
+	return levelOK, fmt.Sprintf("%s in %d days, %s", due, days, at)
+
+}
+
+// Escapes a Prometheus label value.
+func label(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// Writes metrics in the Prometheus text format.
+func (f *found) metrics(w io.Writer) {
+
+	fmt.Fprintf(w, "# HELP cert_not_after_seconds When the certificate "+
+		"expires, seconds since the epoch.\n")
+	fmt.Fprintf(w, "# TYPE cert_not_after_seconds gauge\n")
+	for _, c := range f.certs {
+		cert := c.Certificate
+		fmt.Fprintf(w, "cert_not_after_seconds{subject=\"%s\","+
+			"serial=\"%X\",issuer=\"%s\",path=\"%s\"} %d\n",
+			label(cert.Subject.String()), cert.SerialNumber,
+			label(cert.Issuer.String()), label(c.Path),
+			cert.NotAfter.Unix())
+	}
+
+	fmt.Fprintf(w, "# HELP crl_next_update_seconds When the CRL is due "+
+		"to be replaced, seconds since the epoch.\n")
+	fmt.Fprintf(w, "# TYPE crl_next_update_seconds gauge\n")
+	for _, c := range f.crls {
+		fmt.Fprintf(w, "crl_next_update_seconds{issuer=\"%s\","+
+			"path=\"%s\"} %d\n", label(c.CRL.Issuer.String()),
+			label(c.Path), c.CRL.NextUpdate.Unix())
+	}
+
+	counts := make([]int, len(levelNames))
+	for _, r := range f.results {
+		counts[r.level]++
+	}
+	fmt.Fprintf(w, "# HELP check_expiry_alerts Certificates and CRLs "+
+		"near or past expiry, by level.\n")
+	fmt.Fprintf(w, "# TYPE check_expiry_alerts gauge\n")
+	for _, l := range []int{levelWarning, levelCritical} {
+		fmt.Fprintf(w, "check_expiry_alerts{level=\"%s\"} %d\n",
+			strings.ToLower(levelNames[l]), counts[l])
+	}
+
+}
@@ -7,8 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/asn1"
 	"encoding/pem"
-	"github.com/jessevdk/go-flags"
-	"io/ioutil"
+	"github.com/cybermaggedon/certificate-tools/pkg"
 	"log"
 	"github.com/google/uuid"
 	"math/big"
@@ -19,7 +18,7 @@ import (
 
 var options struct {
 	Validity int64  `short:"v" long:"validity" description:"Certificate validity period (days)" default:"90"`
-	KeyFile  string `short:"k" long:"key" description:"CA Private key, PEM format" required:"true"`
+	KeyFile  string `short:"k" long:"key" description:"CA Private key, PEM format, or a pkcs11:, plugin:, unix: or shares: key" required:"true"`
 
 	EmailAddress       []string `short:"E" long:"email" description:"Email Address" required:"true"`
 	
@@ -30,11 +29,21 @@ var options struct {
 	Locality           []string `short:"L" long:"locality" description:"Locality"`
 	OrganizationalUnit []string `short:"U" long:"organisational-unit" description:"Organizational Unit"`
 	Organization       []string `short:"O" long:"organisation" description:"Organization"`
-	CommonName         string `short:"N" long:"common-name" description:"Common Name" required:"true"`
+	CommonName         string `short:"N" long:"common-name" description:"Common Name"`
+
+	Subject            string `short:"s" long:"subject" description:"Subject as an RFC 4514 string e.g. CN=foo,O=Example,DC=example,DC=org"`
+	Attributes         []string `short:"a" long:"attr" description:"Extra subject attribute, form is OID=VALUE or NAME=VALUE"`
+	Extensions         []string `short:"x" long:"extension" description:"Extra extension, form is OID[,critical]=HEX or OID[,critical]=TYPE:VALUE"`
 
 	CrlUri      []string `short:"d" long:"crl-distribution" description:"CRL Distribution URI" required:"false"`
 	CaUri       []string `short:"i" long:"ca-issuers-distribution" description:"CA Issuer Chains (p7c)" required:"false"`
 
+	SignatureAlgorithm string `short:"g" long:"signature-algorithm" description:"Signature algorithm e.g. ECDSA-SHA384, SHA256-RSAPSS, default follows the CA key type"`
+
+	AuditLog string `long:"audit-log" env:"CERT_TOOLS_AUDIT_LOG" description:"Hash-chained audit log to append to"`
+	Requester string `long:"requester" description:"Who the CA is for, recorded in the audit log"`
+
+	cert_tools.ConfigOptions
 }
 
 // OID of email address.
@@ -43,27 +52,23 @@ var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
 func main() {
 
 	// Parse flags.
-	_, err := flags.Parse(&options)
+	err := cert_tools.ParseWithConfig("create-ca-cert", &options,
+		&options.ConfigOptions)
 	if err != nil {
 		os.Exit(1)
 	}
 
-	// Read keyfile
-	raw, err := ioutil.ReadFile(options.KeyFile)
+	// Read key file, EC, RSA or PKCS #8, or a key on a token.
+	key, err := cert_tools.ReadKey(options.KeyFile)
 	if err != nil {
-		log.Fatalf("failed to read key file: %s", err)
+		log.Fatalf("failed to read key: %s", err)
 	}
 
-	// Parse PEM in keyfile
-	keyPem, _ := pem.Decode([]byte(raw))
-	if keyPem == nil {
-		log.Fatalf("failed to parse PEM key")
-	}
-
-	// Parse key from PEM.
-	key, err := x509.ParseECPrivateKey(keyPem.Bytes)
+	// Signature algorithm follows the key unless overridden.
+	sigAlg, err := cert_tools.SignatureAlgorithm(key.Public(),
+		options.SignatureAlgorithm)
 	if err != nil {
-		log.Fatalf("failed to read key file: %s", err)
+		log.Fatalf("%s", err)
 	}
 
 	// Certificate validity period starts now.
@@ -113,12 +118,33 @@ func main() {
 		subject.CommonName = options.CommonName
 	}
 
+	// Add the RFC 4514 subject and extra attributes.
+	rdns, err := cert_tools.BuildSubject(options.Subject, subject,
+		options.Attributes)
+	if err != nil {
+		log.Fatalf("failed to parse subject: %s", err)
+	}
+	if len(rdns) == 0 {
+		log.Fatalf("CA certificate needs a subject")
+	}
+	rawSubject, err := asn1.Marshal(rdns)
+	if err != nil {
+		log.Fatalf("failed to encode subject: %s", err)
+	}
+	subject.FillFromRDNSequence(&rdns)
+
+	// Custom extensions.
+	extensions, err := cert_tools.ParseExtensions(options.Extensions)
+	if err != nil {
+		log.Fatalf("failed to parse extension: %s", err)
+	}
 
 	// Create populated certificate template
 	template := x509.Certificate{
-		SignatureAlgorithm: x509.ECDSAWithSHA512,
+		SignatureAlgorithm: sigAlg,
 		
 		SerialNumber:   serial,
+		RawSubject:     rawSubject,
 		Subject:        subject,
 
 
@@ -136,6 +162,8 @@ func main() {
 		BasicConstraintsValid: true,
 
 		EmailAddresses: options.EmailAddress,
+
+		ExtraExtensions: extensions,
 		
 	}
 
@@ -175,7 +203,29 @@ func main() {
 	
 	// Sign the certificate.
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template,
-		&template, &key.PublicKey, key)
+		&template, key.Public(), key.Signer())
+
+	// The key isn't needed again.
+	key.Zeroise()
+
+	// Audit the outcome, nothing is output if that fails.
+	if options.AuditLog != "" {
+		rec := cert_tools.AuditRecord{
+			Operation: "create-ca-cert",
+			Requester: options.Requester,
+			Subject:   subject.String(),
+		}
+		if err == nil {
+			cert, _ := x509.ParseCertificate(derBytes)
+			rec.SetCA(cert)
+			rec.SetCertificate(cert)
+		}
+		rec.SetResult(err)
+		if err := cert_tools.AppendAudit(options.AuditLog, &rec); err != nil {
+			log.Fatalf("failed to write audit log: %s", err)
+		}
+	}
+
 	if err != nil {
 		log.Fatalf("Failed to create certificate: %s", err)
 	}
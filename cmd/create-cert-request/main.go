@@ -6,18 +6,18 @@ import (
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/pem"
-	"github.com/jessevdk/go-flags"
-	"io/ioutil"
+	"github.com/cybermaggedon/certificate-tools/pkg"
 	"log"
-	"net"
 	"os"
 )
 
 var options struct {
-	KeyFile string `short:"k" long:"key" description:"New cert private key, PEM format" required:"true"`
+	KeyFile string `short:"k" long:"key" description:"New cert private key, PEM format, or a pkcs11:, plugin:, unix: or shares: key" required:"true"`
 	
 	Hosts              []string `short:"H" long:"hosts" description:"DNS name or IP address"`
-	EmailAddress       []string `short:"E" long:"email" description:"Email address" required:"true"`
+	EmailAddress       []string `short:"E" long:"email" description:"Email address"`
+	URIs               []string `short:"u" long:"uri" description:"URI SAN e.g. spiffe://example.org/ns/foo/sa/bar"`
+	OtherNames         []string `short:"o" long:"other-name" description:"otherName SAN, form is upn=VALUE or OID=VALUE"`
 	
 	Country            []string `short:"C" long:"country" description:"Country"`
 	Province           []string `short:"P" long:"province" description:"Province"`
@@ -25,7 +25,19 @@ var options struct {
 	OrganizationalUnit []string `short:"U" long:"organisational-unit" description:"Organizational Unit"`
 	Organization       []string `short:"O" long:"organisation" description:"Organization"`
 	
-	CommonName         string `short:"N" long:"common-name" description:"Common Name" required:"true"`
+	CommonName         string `short:"N" long:"common-name" description:"Common Name"`
+
+	Subject            string `short:"s" long:"subject" description:"Subject as an RFC 4514 string e.g. CN=foo,O=Example,DC=example,DC=org"`
+	Attributes         []string `short:"a" long:"attr" description:"Extra subject attribute, form is OID=VALUE or NAME=VALUE"`
+	Extensions         []string `short:"x" long:"extension" description:"Extension to request, form is OID[,critical]=HEX or OID[,critical]=TYPE:VALUE"`
+
+	SignatureAlgorithm string `short:"g" long:"signature-algorithm" description:"Signature algorithm e.g. ECDSA-SHA384, SHA256-RSAPSS, default follows the private key type"`
+
+	ChallengePassword  string `short:"w" long:"challenge-password" description:"Challenge password, for SCEP enrollment"`
+
+	Certificate        string `short:"c" long:"certificate" description:"Certificate to renew, PEM format: its subject, SANs and usages are requested, subject options replace the subject and SAN options add SANs"`
+
+	cert_tools.ConfigOptions
 }
 
 // OID of email address.
@@ -34,27 +46,24 @@ var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
 func main() {
 
 	// Parse flags.
-	_, err := flags.Parse(&options)
+	err := cert_tools.ParseWithConfig("create-cert-request", &options,
+		&options.ConfigOptions)
 	if err != nil {
 		os.Exit(1)
 	}
 
-	// Read key file
-	raw, err := ioutil.ReadFile(options.KeyFile)
+	// Read key file, EC, RSA or PKCS #8, or a key on a token.
+	key, err := cert_tools.ReadKey(options.KeyFile)
 	if err != nil {
-		log.Fatalf("failed to read key file: %s", err)
-	}
-
-	// Parse KEY PEM.
-	keyPem, _ := pem.Decode([]byte(raw))
-	if keyPem == nil {
-		log.Fatalf("failed to read key file")
+		log.Fatalf("failed to read key: %s", err)
 	}
+	priv := key.Signer()
 
-	// Parse key for private key.
-	priv, err := x509.ParseECPrivateKey(keyPem.Bytes)
+	// Signature algorithm follows the key unless overridden.
+	sigAlg, err := cert_tools.SignatureAlgorithm(key.Public(),
+		options.SignatureAlgorithm)
 	if err != nil {
-		log.Fatalf("failed to read key file: %s", err)
+		log.Fatalf("%s", err)
 	}
 
 	// Create a certificate subject and populate based on fields.
@@ -79,31 +88,135 @@ func main() {
 		subject.CommonName = options.CommonName
 	}
 
+	// Add the RFC 4514 subject and extra attributes.
+	rdns, err := cert_tools.BuildSubject(options.Subject, subject,
+		options.Attributes)
+	if err != nil {
+		log.Fatalf("failed to parse subject: %s", err)
+	}
+
+	// Custom extensions.
+	extensions, err := cert_tools.ParseExtensions(options.Extensions)
+	if err != nil {
+		log.Fatalf("failed to parse extension: %s", err)
+	}
+
+	// Subject alternative names.
+	sans := cert_tools.SANs{}
+
+	// Renewing a certificate keeps its identity and usages.
+	if options.Certificate != "" {
+
+		cert, err := cert_tools.ReadCertificateFromFile(
+			options.Certificate)
+		if err != nil {
+			log.Fatalf("failed to read certificate: %s", err)
+		}
+
+		if len(rdns) == 0 {
+			_, err := asn1.Unmarshal(cert.RawSubject, &rdns)
+			if err != nil {
+				log.Fatalf("failed to parse certificate "+
+					"subject: %s", err)
+			}
+		}
+
+		certSANs, err := cert_tools.SANsFromExtensions(cert.Extensions)
+		if err != nil {
+			log.Fatalf("failed to parse certificate SANs: %s", err)
+		}
+		if certSANs != nil {
+			sans = *certSANs
+		}
+
+		for _, e := range cert_tools.UsageExtensions(cert) {
+			extensions, err = cert_tools.AddExtension(extensions, e)
+			if err != nil {
+				log.Fatalf("%s", err)
+			}
+		}
+
+	}
+
+	rawSubject, err := asn1.Marshal(rdns)
+	if err != nil {
+		log.Fatalf("failed to encode subject: %s", err)
+	}
+	subject.FillFromRDNSequence(&rdns)
+
 	// Start populating certificate request template.
 	template := x509.CertificateRequest{
+		RawSubject:         rawSubject,
 		Subject:            subject,
 
-		EmailAddresses:     options.EmailAddress,
-		
-		SignatureAlgorithm: x509.ECDSAWithSHA512,
+		ExtraExtensions:    extensions,
+
+		SignatureAlgorithm: sigAlg,
 	}
 
-	// Populate optional hosts field for DNS names and IP addresses.
-	if len(options.Hosts) > 0 {
-		for _, h := range options.Hosts {
-			ip := net.ParseIP(h)
-            if ip != nil {
-				template.IPAddresses =
-					append(template.IPAddresses, ip)
-			} else {
-				template.DNSNames = append(template.DNSNames, h)
-			}
+	// Add SANs given here, hosts field holds DNS names and IP addresses.
+	sans.EmailAddresses = append(sans.EmailAddresses,
+		options.EmailAddress...)
+	sans.AddHosts(options.Hosts)
+	if err := sans.AddURIs(options.URIs); err != nil {
+		log.Fatalf("failed to parse URI: %s", err)
+	}
+	if err := sans.AddOtherNames(options.OtherNames); err != nil {
+		log.Fatalf("failed to parse other name: %s", err)
+	}
+
+	if len(sans.OtherNames) > 0 || len(sans.Raw) > 0 {
+
+		// crypto/x509 can't encode otherName and drops other
+		// GeneralName types, so build the whole extension here.
+		ext, err := sans.Extension(len(rdns) == 0)
+		if err != nil {
+			log.Fatalf("failed to encode SANs: %s", err)
+		}
+		template.ExtraExtensions, err = cert_tools.AddExtension(
+			template.ExtraExtensions, ext)
+		if err != nil {
+			log.Fatalf("%s", err)
 		}
+
+	} else {
+
+		template.EmailAddresses = sans.EmailAddresses
+		template.DNSNames = sans.DNSNames
+		template.IPAddresses = sans.IPAddresses
+		template.URIs = sans.URIs
+
+	}
+
+	if subject.CommonName == "" && sans.Empty() {
+		log.Fatalf("request needs a common name or at least one SAN")
 	}
 
 	// Create certificate request.
-	csrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &template,
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template,
 		priv)
+	if err != nil {
+		log.Fatalf("failed to create certificate request: %s", err)
+	}
+
+	// crypto/x509 can't add a challengePassword attribute.
+	if options.ChallengePassword != "" {
+		attr, err := cert_tools.NewAttribute(
+			cert_tools.OidChallengePassword,
+			options.ChallengePassword)
+		if err != nil {
+			log.Fatalf("failed to encode challenge password: %s",
+				err)
+		}
+		csrBytes, err = cert_tools.AddRequestAttributes(csrBytes, priv,
+			[]cert_tools.Attribute{attr})
+		if err != nil {
+			log.Fatalf("failed to add challenge password: %s", err)
+		}
+	}
+
+	// The key isn't needed again.
+	key.Zeroise()
 
 	// Write CSR in PEM format.
 	pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE REQUEST",
@@ -1,18 +1,11 @@
 package main
 
 import (
-	"crypto/rand"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"crypto/sha256"
-	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
-	"github.com/jessevdk/go-flags"
-	"io/ioutil"
+	"github.com/cybermaggedon/certificate-tools/pkg"
 	"log"
-	"github.com/google/uuid"
-	"math/big"
 	"os"
 	"time"
 )
@@ -20,7 +13,7 @@ import (
 var options struct {
 	Validity    int64  `short:"v" long:"validity" description:"Certificate validity period (days)" default:"90"`
 	
-	KeyFile     string `short:"k" long:"key" description:"CA private key, PEM format" required:"true"`
+	KeyFile     string `short:"k" long:"key" description:"CA private key, PEM format, or a pkcs11:, plugin:, unix: or shares: key" required:"true"`
 	CaFile      string `short:"c" long:"ca-certificate" description:"CA cert file, PEM format" required:"true"`
 	CsrFile     string `short:"r" long:"certificate-request" description:"CSR file, PEM format" required:"true"`
 	
@@ -29,229 +22,174 @@ var options struct {
 	CodeSigning bool   `short:"N" long:"code-signing" description:"Create a code signing certificate"`
 	CaUsage     bool   `short:"A" long:"ca-usage" description:"Create a CA certificate"`
 	CRLUsage    bool   `short:"R" long:"crl-usage" description:"Create a CRL issuer certificate"`
+	Profiles    []string `short:"p" long:"profile" description:"Certificate profile: server, client, device, code-signing, ca, crl, spiffe"`
+	EmailInSubject string `short:"m" long:"email-in-subject" description:"Add the request's email address to the subject, default depends on the profile" choice:"yes" choice:"no"`
+
+	Extensions     []string `short:"x" long:"extension" description:"Extra extension, form is OID[,critical]=HEX or OID[,critical]=TYPE:VALUE"`
+	CopyExtensions bool     `short:"X" long:"copy-extensions" description:"Copy custom extensions from the request, if the profile allows"`
+	ReportExtensions bool   `short:"e" long:"report-extensions" description:"Report accepted request extensions as well as modified and rejected ones"`
+	StrictExtensions bool   `short:"E" long:"strict-extensions" description:"Fail if any requested extension can't be honoured as asked"`
 	
 	CrlUri      []string `short:"d" long:"crl-distribution" description:"CRL Distribution URI" required:"false"`
 	CaUri       []string `short:"i" long:"ca-issuers-distribution" description:"CA Issuer Chain (p7c)" required:"false"`
-}
 
-var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+	SignatureAlgorithm string `short:"g" long:"signature-algorithm" description:"Signature algorithm e.g. ECDSA-SHA384, SHA256-RSAPSS, default follows the CA key type"`
 
-func main() {
-
-	// Parse flags
-	_, err := flags.Parse(&options)
-	if err != nil {
-		os.Exit(1)
-	}
+	Precertificate bool   `long:"precertificate" description:"Output a CT precertificate, with the poison extension, instead of a certificate"`
+	CTLogs      []string `long:"ct-log" description:"Log the precertificate to an RFC 6962 CT log and embed the SCT, form is URL[,LOG-PUBLIC-KEY-FILE], the key is used to check the SCT"`
 
-	// ----- CA key ------
+	Lint        string `long:"lint" description:"Lint the certificate before signing, refusing to sign if anything is found at this level or worse" choice:"error" choice:"warning" choice:"notice"`
 
-	// Read key file
-	raw, err := ioutil.ReadFile(options.KeyFile)
-	if err != nil {
-		log.Fatalf("failed to read key file: %s", err)
-	}
+	AuditLog    string `long:"audit-log" env:"CERT_TOOLS_AUDIT_LOG" description:"Hash-chained audit log to append to"`
+	Requester   string `long:"requester" description:"Who the certificate is for, recorded in the audit log"`
 
-	// Parse key for PEM.
-	keyPem, _ := pem.Decode([]byte(raw))
-	if keyPem == nil {
-		log.Fatalf("failed to read key file")
-	}
-
-	// Parse for ECDSA key.
-	priv, err := x509.ParseECPrivateKey(keyPem.Bytes)
-	if err != nil {
-		log.Fatalf("failed to read key file: %s", err)
-	}
-
-	// ----- Get CSR -----
-
-	// Read CSR file
-	raw, err = ioutil.ReadFile(options.CsrFile)
-	if err != nil {
-		log.Fatalf("failed to read CSR file: %s", err)
-	}
-
-	// Parse CSR for PEM
-	csrPem, _ := pem.Decode([]byte(raw))
-	if csrPem == nil {
-		log.Fatalf("failed to read CSR file")
-	}
-
-	// Parse PEM for certificate request.
-	clientCSR, err := x509.ParseCertificateRequest(csrPem.Bytes)
-	if err != nil {
-		log.Fatalf("failed to parse certificate request: %s\n", err)
-	}
-	if err = clientCSR.CheckSignature(); err != nil {
-		log.Fatalf("failed to check certificate request signing: %s\n",
-			err)
-	}
-
-	// ----- Get CA cert -----
-
-	// Read CA cert file
-	raw, err = ioutil.ReadFile(options.CaFile)
-	if err != nil {
-		log.Fatalf("failed to read certificate file: %s", err)
-	}
-
-	// Read CA cert
-	caPem, _ := pem.Decode([]byte(raw))
-	if caPem == nil {
-		log.Fatalf("failed to read certificate file")
-	}
+	cert_tools.ConfigOptions
+}
 
-	// Parse certificate
-	caCert, err := x509.ParseCertificate(caPem.Bytes)
-	if err != nil {
-		log.Fatalf("failed to parse certificate: %s\n", err)
-	}
+func main() {
 
-	// Work out certificate start time
-	notBefore := time.Now().UTC()
+	// Parse flags
+	err := cert_tools.ParseWithConfig("create-cert", &options,
+		&options.ConfigOptions)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse creation date: %s\n",
-			err)
 		os.Exit(1)
 	}
 
-	// Work out certificate expiry
-	duration := time.Duration(options.Validity*24) * time.Hour
-	notAfter := notBefore.Add(duration)
-
-	// Make up a random serial number.
-
-	uuidVal, err := uuid.NewRandom()
-	if err != nil {
-		log.Fatalf("failed to generate uuid: %s", err)
-	}
-	
-	uuidBytes,err := uuidVal.MarshalBinary()
+	// ----- CA key and cert ------
 
+	// Key is EC, RSA or PKCS #8.
+	issuer, err := cert_tools.ReadIssuer(options.KeyFile, options.CaFile)
 	if err != nil {
-		log.Fatalf("failed to generate serial: %s", err)
+		log.Fatalf("%s", err)
 	}
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serial            := serialNumberLimit.SetBytes(uuidBytes)
-
-	// Populate client certificate template
-	template := x509.Certificate{
-		Signature:          clientCSR.Signature,
-		SignatureAlgorithm: clientCSR.SignatureAlgorithm,
-
-		PublicKeyAlgorithm: clientCSR.PublicKeyAlgorithm,
-		PublicKey:          clientCSR.PublicKey,
-
-		SerialNumber: serial,
-		Issuer:       caCert.Subject,
-
-	        Subject:      clientCSR.Subject,
-		
-		NotBefore:    notBefore,
-		NotAfter:     notAfter,
-
-		KeyUsage: x509.KeyUsageDigitalSignature,
-		
-		ExtKeyUsage: []x509.ExtKeyUsage{},
-
-		BasicConstraintsValid: true,
-		IsCA: false,
-
-
-		DNSNames:       clientCSR.DNSNames,
-		IPAddresses:    clientCSR.IPAddresses,
-		EmailAddresses: clientCSR.EmailAddresses,
-
-
-	}
+	// ----- Get CSR -----
 
-	pk, err :=  x509.MarshalPKIXPublicKey(template.PublicKey)
+	clientCSR, err := cert_tools.ReadCSRFromFile(options.CsrFile)
 	if err != nil {
-		log.Fatalf("failed to get Public Key bytes: %s", err)
+		log.Fatalf("failed to read CSR file: %s", err)
 	}
 
-	pkSum := sha256.Sum256(pk)
-	template.SubjectKeyId = pkSum[:]
-	
-	// Add server usage if required
+	// Work out which profiles apply, the usage flags are shorthand for
+	// the profiles of the same name.
+	profileNames := options.Profiles
 	if options.ServerUsage {
-		template.ExtKeyUsage = append(template.ExtKeyUsage,
-			x509.ExtKeyUsageServerAuth)
-		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+		profileNames = append(profileNames, "server")
 	}
-
-	// Add client usage if required
 	if options.ClientUsage {
-		template.ExtKeyUsage = append(template.ExtKeyUsage,
-			x509.ExtKeyUsageClientAuth)
-		template.KeyUsage |= x509.KeyUsageKeyEncipherment
-
-		rawSubj := clientCSR.Subject.ToRDNSequence()
-		rawSubj = append(rawSubj, []pkix.AttributeTypeAndValue{
-			{Type: oidEmailAddress, Value: clientCSR.EmailAddresses[0]},
-		})
-		asn1Subj, _ := asn1.Marshal(rawSubj)
-
-		template.RawSubject = asn1Subj
+		profileNames = append(profileNames, "client")
 	}
-
-	// Add client usage if required
 	if options.CodeSigning {
-		template.ExtKeyUsage = append(template.ExtKeyUsage,
-			x509.ExtKeyUsageCodeSigning)
-		template.KeyUsage |= x509.KeyUsageKeyEncipherment
-
-		rawSubj := clientCSR.Subject.ToRDNSequence()
-		rawSubj = append(rawSubj, []pkix.AttributeTypeAndValue{
-			{Type: oidEmailAddress, Value: clientCSR.EmailAddresses[0]},
-		})
-		asn1Subj, _ := asn1.Marshal(rawSubj)
-
-		template.RawSubject = asn1Subj
+		profileNames = append(profileNames, "code-signing")
 	}
-
-	// Set CA attributes in certificate if required.
 	if options.CaUsage {
-		template.IsCA = true
-		template.KeyUsage |= x509.KeyUsageCertSign
-		template.KeyUsage |= x509.KeyUsageCRLSign
+		profileNames = append(profileNames, "ca")
 	}
-
-	// Set CRL attributes in certificate if required
 	if options.CRLUsage {
-		template.KeyUsage |= x509.KeyUsageCRLSign
+		profileNames = append(profileNames, "crl")
 	}
 
-	if len(options.CrlUri) > 0 {
-
-		template.CRLDistributionPoints = options.CrlUri
-
-	} else {
-
-		template.CRLDistributionPoints = caCert.CRLDistributionPoints
+	profiles, err := cert_tools.GetProfiles(profileNames)
+	if err != nil {
+		log.Fatalf("%s", err)
 	}
 
-	if len(options.CaUri) > 0 {
-
-		template.IssuingCertificateURL = options.CaUri
-		
-	} else {
-
-		template.IssuingCertificateURL = caCert.IssuingCertificateURL
+	// Extensions given on the command line.
+	extensions, err := cert_tools.ParseExtensions(options.Extensions)
+	if err != nil {
+		log.Fatalf("failed to parse extension: %s", err)
+	}
+
+	// CT logs to submit the precertificate to.
+	ctLogs := []*cert_tools.CTLog{}
+	for _, v := range options.CTLogs {
+		l, err := cert_tools.ParseCTLog(v)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		ctLogs = append(ctLogs, l)
+	}
+
+	if options.Precertificate && len(ctLogs) > 0 {
+		log.Fatalf("--precertificate and --ct-log can't be used together")
+	}
+
+	// Lint findings are all reported, those at the level asked for stop
+	// signing.
+	var lint func(cert *x509.Certificate) error
+	if options.Lint != "" {
+		failAt := cert_tools.LintLevel(options.Lint)
+		lint = func(cert *x509.Certificate) error {
+			failed := 0
+			for _, f := range cert_tools.LintCertificate(cert) {
+				log.Printf("lint %s", f)
+				if f.Level.AtLeast(failAt) {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("certificate fails %d lint checks",
+					failed)
+			}
+			return nil
+		}
+	}
+
+	// Sign the certificate.
+	issued, err := issuer.Issue(clientCSR, cert_tools.IssueOptions{
+		Validity: time.Duration(options.Validity*24) * time.Hour,
+		Profiles: profiles,
+		SignatureAlgorithm: options.SignatureAlgorithm,
+		EmailInSubject: options.EmailInSubject,
+		Extensions: extensions,
+		CopyExtensions: options.CopyExtensions,
+		StrictExtensions: options.StrictExtensions,
+		CrlUri: options.CrlUri,
+		CaUri: options.CaUri,
+		Precertificate: options.Precertificate,
+		CTLogs: ctLogs,
+		Lint: lint,
+	})
+
+	// The key isn't needed again.
+	issuer.Zeroise()
+
+	// Report what was done with requested extensions, even if signing
+	// failed because of them.
+	if issued != nil {
+		for _, r := range issued.Extensions {
+			if r.Decision != cert_tools.ExtensionAccepted ||
+				options.ReportExtensions {
+				log.Printf("requested extension %s", r)
+			}
+		}
+		for _, w := range issued.Warnings {
+			log.Printf("%s", w)
+		}
+		for _, s := range issued.SCTs {
+			log.Printf("embedded SCT from %s", s)
+		}
+	}
+
+	// Audit the outcome, nothing is output if that fails.
+	operation := "create-cert"
+	if options.Precertificate {
+		operation = "create-cert precertificate"
+	}
+	aerr := cert_tools.AuditIssue(options.AuditLog, cert_tools.AuditRecord{
+		Operation: operation,
+		Requester: options.Requester,
+		Profiles:  profileNames,
+	}, issuer.Cert, clientCSR, issued, err)
+	if aerr != nil {
+		log.Fatalf("%s", aerr)
 	}
 
-
-	
-	// create client certificate from template and CA public key
-	clientCRTRaw, err := x509.CreateCertificate(rand.Reader, &template,
-		caCert, clientCSR.PublicKey, priv)
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %s", err)
+		log.Fatalf("%s", err)
 	}
 
 	pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE",
-		Bytes: clientCRTRaw})
+		Bytes: issued.Raw})
 
 }
@@ -2,27 +2,25 @@ package main
 
 import (
 
-	"crypto/rand"
-	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/binary"
-	"encoding/csv"
 	"encoding/pem"
 	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
 	"github.com/jessevdk/go-flags"
-	"io/ioutil"
 	"log"
-	"math/big"
 	"os"
 	"time"
 )
 
 var options struct {
-	KeyFile string `short:"k" long:"key" description:"CA private key, PEM format" required:"true"`
+	KeyFile string `short:"k" long:"key" description:"CA private key, PEM format, or a pkcs11:, plugin:, unix: or shares: key" required:"true"`
 	CaFile  string `short:"c" long:"ca-certificate" description:"CA cert file, PEM format" required:"true"`
-	RevFile string `short:"r" long:"revoked" description:"List of revoked certificates, form is SERIAL<space>TIME" required:"true"`
+	RevFile string `short:"r" long:"revoked" description:"List of revoked certificates, form is SERIAL,TIME or SERIAL,TIME,REASON" required:"true"`
 	BinaryOut bool `short:"b" long:"binary" description:"Output the CRL in binary form" required:"false"`
+
+	AuditLog string `long:"audit-log" env:"CERT_TOOLS_AUDIT_LOG" description:"Hash-chained audit log to append to"`
+	Requester string `long:"requester" description:"Who asked for the CRL, recorded in the audit log"`
 }
 
 
@@ -37,92 +35,48 @@ func main() {
 		os.Exit(1)
 	}
 
-	// ----- CA key ------
-
-	// Read key file
-	raw, err := ioutil.ReadFile(options.KeyFile)
-	if err != nil {
-		log.Fatalf("failed to read key file: %s", err)
-	}
-
-	// Parse key for PEM.
-	keyPem, _ := pem.Decode([]byte(raw))
-	if keyPem == nil {
-		log.Fatalf("failed to read key file")
-	}
-
-	// Parse for ECDSA key.
-	priv, err := x509.ParseECPrivateKey(keyPem.Bytes)
-	if err != nil {
-		log.Fatalf("failed to read key file: %s", err)
-	}
-
-	// ----- Get CA cert -----
-
-	// Read CA cert file
-	raw, err = ioutil.ReadFile(options.CaFile)
-	if err != nil {
-		log.Fatalf("failed to read certificate file: %s", err)
-	}
-
-	// Read CA cert
-	caPem, _ := pem.Decode([]byte(raw))
-	if caPem == nil {
-		log.Fatalf("failed to read certificate file")
-	}
+	// ----- CA key and cert ------
 
-	// Parse certificate
-	caCert, err := x509.ParseCertificate(caPem.Bytes)
+	// Key is EC, RSA or PKCS #8.
+	issuer, err := cert_tools.ReadIssuer(options.KeyFile, options.CaFile)
 	if err != nil {
-		log.Fatalf("failed to parse certificate: %s\n", err)
+		log.Fatalf("%s", err)
 	}
 
 	// ----- Get revoked certs -----
 
-	// Read revoked file
-	revFile, err := os.Open(options.RevFile)
+	revoked, err := cert_tools.ReadRevoked(options.RevFile)
 	if err != nil {
-		log.Fatalf("failed to open file: %s", err)
-	}
-
-	csvReader := csv.NewReader(revFile)
-	csvReader.FieldsPerRecord = 2
-
-	records, err := csvReader.ReadAll()
-	if err != nil {
-		log.Fatalf("failed to read file: %s", err)
-	}
-
-	revoked := []pkix.RevokedCertificate{}
-
-	for _, v := range records {
-
-		serial := big.NewInt(0)
-
-		fmt.Sscanf(v[0], "%X", serial)
-
-		tm, _ := time.Parse(time.RFC3339, v[1])
-
-		revoked = append(revoked,
-			pkix.RevokedCertificate{
-				SerialNumber:   serial,
-				RevocationTime: tm,
-			})
-
+		log.Fatalf("failed to read revoked file: %s", err)
 	}
 
 	// Generate a new CRL
 
+	crl, err := issuer.CreateCRL(revoked, 100*24*time.Hour)
+
+	// The key isn't needed again.
+	issuer.Zeroise()
+
+	// Audit the outcome, nothing is output if that fails.
+	if options.AuditLog != "" {
+		rec := cert_tools.AuditRecord{
+			Operation: "create-crl",
+			Requester: options.Requester,
+		}
+		rec.SetCA(issuer.Cert)
+		for _, r := range revoked {
+			rec.Revoked = append(rec.Revoked,
+				fmt.Sprintf("%X", r.SerialNumber))
+		}
+		rec.SetResult(err)
+		if err := cert_tools.AppendAudit(options.AuditLog, &rec); err != nil {
+			log.Fatalf("failed to write audit log: %s", err)
+		}
+	}
 
-	t := time.Now().UTC()
-	crl, err := caCert.CreateCRL(rand.Reader, priv, revoked,
-		t, t.Add(100*24*time.Hour))
-	
 	if err != nil {
 		log.Fatalf("failed to generate CRL: %s\n",err);
 	}
-	
-
 
 	if options.BinaryOut {
 		err = binary.Write(os.Stdout, binary.LittleEndian, crl)
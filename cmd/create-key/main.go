@@ -1,33 +1,84 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/x509"
-	"encoding/pem"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
 	"log"
 	"os"
+	"strings"
 )
 
+var options struct {
+	Algorithm string `short:"a" long:"algorithm" description:"Key algorithm: ecdsa-p256, ecdsa-p384, ecdsa-p521, rsa-2048, rsa-3072, rsa-4096, ed25519" default:"ecdsa-p256"`
+	Token     string `short:"t" long:"token" description:"Generate the key on a PKCS #11 token, pkcs11: URI naming the object, and output the public key"`
+
+	Shares      int    `short:"n" long:"shares" description:"Split the key into this many shares instead of outputting it, and output the public key"`
+	Threshold   int    `short:"m" long:"threshold" description:"Number of shares needed to recover the key"`
+	SharePrefix string `short:"o" long:"share-prefix" description:"Shares are written to PREFIX-N.share" default:"key"`
+}
+
 func main() {
 
-	// Generate a key.
-	c := elliptic.P256()
+	// Parse flags.
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
 
-	priv, err := ecdsa.GenerateKey(c, rand.Reader)
+	// The private key never leaves a token, only the public key is
+	// output.
+	if options.Token != "" {
+		pub, err := cert_tools.GeneratePKCS11Key(options.Token,
+			options.Algorithm)
+		if err != nil {
+			log.Fatalf("failed to generate key: %s", err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			log.Fatalf("failed to marshal key: %s", err)
+		}
+		err = cert_tools.OutputPem(os.Stdout, der, "PUBLIC KEY")
+		if err != nil {
+			log.Fatalf("failed to marshal key: %s", err)
+		}
+		return
+	}
+
+	// Generate a key.
+	key, err := cert_tools.GenerateKey(options.Algorithm)
 	if err != nil {
-		log.Fatalf("failed to generate private number: %s", err)
+		log.Fatalf("failed to generate key: %s", err)
+	}
+
+	// The whole key is never written, only its shares.
+	if options.Shares > 0 {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			log.Fatalf("failed to marshal key: %s", err)
+		}
+		shares, err := key.Split(options.Shares, options.Threshold)
+		key.Zeroise()
+		if err != nil {
+			log.Fatalf("failed to split key: %s", err)
+		}
+		files, err := cert_tools.WriteShares(options.SharePrefix, shares)
+		if err != nil {
+			log.Fatalf("failed to write shares: %s", err)
+		}
+		log.Printf("wrote %s, %d needed to recover the key",
+			strings.Join(files, ", "), options.Threshold)
+		err = cert_tools.OutputPem(os.Stdout, der, "PUBLIC KEY")
+		if err != nil {
+			log.Fatalf("failed to marshal key: %s", err)
+		}
+		return
 	}
 
 	// Output to stdout as PEM.
-	b, err := x509.MarshalECPrivateKey(priv)
+	err = key.OutputPem(os.Stdout)
 	if err != nil {
 		log.Fatalf("failed to marshal key: %s", err)
 	}
 
-	pem.Encode(os.Stdout, &pem.Block{Type: "EC PRIVATE KEY",
-		Bytes: b})
-
 }
-
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"log"
+	"os"
+)
+
+var options struct {
+	Manifest  string `short:"m" long:"manifest" description:"Manifest describing the hierarchy, YAML or JSON" required:"true"`
+	Plan      bool   `short:"n" long:"plan" description:"Print what would be done and stop"`
+
+	AuditLog  string `long:"audit-log" env:"CERT_TOOLS_AUDIT_LOG" description:"Hash-chained audit log to append to"`
+	Requester string `long:"requester" description:"Who the hierarchy is for, recorded in the audit log"`
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	manifest, err := cert_tools.ReadManifest(options.Manifest)
+	if err != nil {
+		log.Fatalf("failed to read manifest: %s", err)
+	}
+
+	plan, err := manifest.Plan()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	// The plan goes to stdout before anything is changed.
+	for _, a := range plan.Actions {
+		fmt.Printf("%s\n", a)
+	}
+	fmt.Printf("%d changes\n", len(plan.Actions))
+
+	if options.Plan || len(plan.Actions) == 0 {
+		plan.Zeroise()
+		os.Exit(0)
+	}
+
+	// Whatever was done is audited, even if a later step fails.
+	done, err := plan.Apply()
+
+	// The keys aren't needed again.
+	plan.Zeroise()
+
+	for _, a := range plan.Actions[:done] {
+
+		if a.Issuer == nil || options.AuditLog == "" {
+			continue
+		}
+
+		rec := cert_tools.AuditRecord{
+			Operation: "create-pki",
+			Requester: options.Requester,
+			Profiles:  a.Profiles,
+		}
+		rec.SetCA(a.Issuer)
+		if a.Certificate == nil {
+			rec.Operation = "create-pki crl"
+			rec.Revoked = a.Revoked
+		} else if a.Action == "revoke" {
+			rec.Operation = "create-pki revoke"
+			rec.Subject = a.Certificate.Subject.String()
+			rec.Revoked = []string{
+				fmt.Sprintf("%X", a.Certificate.SerialNumber),
+			}
+		} else {
+			rec.SetCertificate(a.Certificate)
+		}
+		rec.SetResult(nil)
+		if err := cert_tools.AppendAudit(options.AuditLog, &rec); err != nil {
+			log.Fatalf("failed to write audit log: %s", err)
+		}
+
+	}
+
+	if err != nil {
+		log.Fatalf("failed after %d of %d changes: %s", done,
+			len(plan.Actions), err)
+	}
+
+	log.Printf("applied %d changes", done)
+
+	os.Exit(0)
+
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var options struct {
+	KeyFile   string `short:"k" long:"key" description:"Log private key, ECDSA or RSA, PEM format" required:"true"`
+	Roots     string `short:"r" long:"roots" description:"CA certs the log accepts chains to, PEM format" required:"true"`
+	PublicKey string `short:"P" long:"public-key" description:"Write the log's public key to a file, PEM format"`
+
+	Listen    string `short:"l" long:"listen" description:"Address to listen on" default:":6962"`
+	TLSCert   string `long:"tls-certificate" description:"Server TLS certificate, PEM format, default is plain HTTP"`
+	TLSKey    string `long:"tls-key" description:"Server TLS private key, PEM format"`
+}
+
+// A logged certificate or precertificate.
+type entry struct {
+	leaf  []byte
+	extra []byte
+	sct   *cert_tools.SCT
+}
+
+// A test log, entries are kept in memory and go when it stops.
+type ctLog struct {
+	key   *cert_tools.Key
+	roots []*x509.Certificate
+
+	mutex   sync.Mutex
+	entries []*entry
+	hashes  [][32]byte
+
+	// Submissions already logged, by hash of the submitted leaf.
+	seen map[[32]byte]*entry
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	key, err := cert_tools.ReadKeyFromFile(options.KeyFile)
+	if err != nil {
+		log.Fatalf("failed to read key file: %s", err)
+	}
+
+	roots, err := cert_tools.ReadCertificatesFromFile(options.Roots)
+	if err != nil {
+		log.Fatalf("failed to read roots: %s", err)
+	}
+
+	l := &ctLog{
+		key:   key,
+		roots: roots,
+		seen:  map[[32]byte]*entry{},
+	}
+
+	// Fail now on key types logs can't use.
+	if _, err := l.treeHead(); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	if options.PublicKey != "" {
+		pub, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		f, err := os.Create(options.PublicKey)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		cert_tools.OutputPem(f, pub, "PUBLIC KEY")
+		if err := f.Close(); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ct/v1/add-chain", l.addChain)
+	mux.HandleFunc("/ct/v1/add-pre-chain", l.addPreChain)
+	mux.HandleFunc("/ct/v1/get-sth", l.getSTH)
+	mux.HandleFunc("/ct/v1/get-roots", l.getRoots)
+	mux.HandleFunc("/ct/v1/get-entries", l.getEntries)
+
+	srv := &http.Server{
+		Addr:              options.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("CT log listening on %s", options.Listen)
+
+	if options.TLSCert != "" {
+		err = srv.ListenAndServeTLS(options.TLSCert, options.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	log.Fatalf("%s", err)
+
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// The submitted chain completed to a root, checking each certificate is
+// signed by the next.
+func (l *ctLog) verifyChain(raw [][]byte) ([]*x509.Certificate, error) {
+
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("chain is empty")
+	}
+
+	chain := []*x509.Certificate{}
+	for _, r := range raw {
+		c, err := x509.ParseCertificate(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %s",
+				err)
+		}
+		chain = append(chain, c)
+	}
+
+	for i := 0; i < len(chain)-1; i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return nil, fmt.Errorf("chain certificate %d: %s", i, err)
+		}
+	}
+
+	last := chain[len(chain)-1]
+	for _, root := range l.roots {
+		if root.Equal(last) {
+			if len(chain) < 2 {
+				return nil, fmt.Errorf("roots can't be logged")
+			}
+			return chain, nil
+		}
+	}
+	for _, root := range l.roots {
+		if last.CheckSignatureFrom(root) == nil {
+			return append(chain, root), nil
+		}
+	}
+
+	return nil, fmt.Errorf("chain doesn't lead to an accepted root")
+
+}
+
+func hasPoison(c *x509.Certificate) bool {
+	for _, e := range c.Extensions {
+		if e.Id.Equal(cert_tools.OidCTPoison) && e.Critical {
+			return true
+		}
+	}
+	return false
+}
+
+// TLS encoding of a list of certificates.
+func certList(chain []*x509.Certificate) []byte {
+	var list bytes.Buffer
+	for _, c := range chain {
+		putUint24(&list, c.Raw)
+	}
+	var b bytes.Buffer
+	putUint24(&b, list.Bytes())
+	return b.Bytes()
+}
+
+func putUint24(b *bytes.Buffer, v []byte) {
+	n := len(v)
+	b.Write([]byte{byte(n >> 16), byte(n >> 8), byte(n)})
+	b.Write(v)
+}
+
+func (l *ctLog) addChain(w http.ResponseWriter, r *http.Request) {
+	l.add(w, r, false)
+}
+
+func (l *ctLog) addPreChain(w http.ResponseWriter, r *http.Request) {
+	l.add(w, r, true)
+}
+
+// Handles add-chain and add-pre-chain, RFC 6962 sections 4.1 and 4.2.
+func (l *ctLog) add(w http.ResponseWriter, r *http.Request, precert bool) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req cert_tools.CTAddChainRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		http.Error(w, "failed to parse request", http.StatusBadRequest)
+		return
+	}
+
+	chain, err := l.verifyChain(req.Chain)
+	if err != nil {
+		log.Printf("rejected: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	leaf, issuer := chain[0], chain[1]
+
+	var e *cert_tools.CTEntry
+	var extra []byte
+
+	if precert {
+		if !hasPoison(leaf) {
+			http.Error(w, "precertificate has no poison extension",
+				http.StatusBadRequest)
+			return
+		}
+		for _, u := range issuer.UnknownExtKeyUsage {
+			if u.Equal(cert_tools.OidCTPrecertSigning) {
+				http.Error(w, "precertificate signing "+
+					"certificates aren't supported",
+					http.StatusBadRequest)
+				return
+			}
+		}
+		e, err = cert_tools.NewCTPrecertEntry(leaf.Raw, issuer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var b bytes.Buffer
+		putUint24(&b, leaf.Raw)
+		b.Write(certList(chain[1:]))
+		extra = b.Bytes()
+	} else {
+		if hasPoison(leaf) {
+			http.Error(w, "precertificates go to add-pre-chain",
+				http.StatusBadRequest)
+			return
+		}
+		e = cert_tools.NewCTEntry(leaf.Raw)
+		extra = certList(chain[1:])
+	}
+
+	sct, err := l.log(leaf.Raw, e, extra)
+	if err != nil {
+		log.Printf("failed to sign SCT: %s", err)
+		http.Error(w, "failed to sign SCT",
+			http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("logged %s serial %X", leaf.Subject, leaf.SerialNumber)
+
+	writeJSON(w, sct.Response())
+
+}
+
+// Adds an entry, or returns the SCT it was given before.
+func (l *ctLog) log(raw []byte, e *cert_tools.CTEntry, extra []byte) (*cert_tools.SCT, error) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	id := sha256.Sum256(raw)
+	if prev, ok := l.seen[id]; ok {
+		return prev.sct, nil
+	}
+
+	sct, err := cert_tools.SignSCT(l.key.Signer(), e, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ent := &entry{
+		leaf:  e.Leaf(sct.Timestamp),
+		extra: extra,
+		sct:   sct,
+	}
+	l.entries = append(l.entries, ent)
+	l.hashes = append(l.hashes, cert_tools.CTLeafHash(ent.leaf))
+	l.seen[id] = ent
+
+	return sct, nil
+
+}
+
+// Entries are added to the tree as soon as they're logged.
+func (l *ctLog) treeHead() (*cert_tools.CTTreeHead, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return cert_tools.SignTreeHead(l.key.Signer(), l.hashes, time.Now())
+}
+
+func (l *ctLog) getSTH(w http.ResponseWriter, r *http.Request) {
+
+	sth, err := l.treeHead()
+	if err != nil {
+		log.Printf("failed to sign tree head: %s", err)
+		http.Error(w, "failed to sign tree head",
+			http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, sth)
+
+}
+
+func (l *ctLog) getRoots(w http.ResponseWriter, r *http.Request) {
+
+	certs := [][]byte{}
+	for _, c := range l.roots {
+		certs = append(certs, c.Raw)
+	}
+
+	writeJSON(w, map[string][][]byte{"certificates": certs})
+
+}
+
+type entryResponse struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// Handles get-entries, RFC 6962 section 4.6.
+func (l *ctLog) getEntries(w http.ResponseWriter, r *http.Request) {
+
+	start, err1 := strconv.Atoi(r.URL.Query().Get("start"))
+	end, err2 := strconv.Atoi(r.URL.Query().Get("end"))
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		http.Error(w, "invalid start or end", http.StatusBadRequest)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if start >= len(l.entries) {
+		http.Error(w, "start is beyond the tree",
+			http.StatusBadRequest)
+		return
+	}
+	if end >= len(l.entries) {
+		end = len(l.entries) - 1
+	}
+
+	resp := []entryResponse{}
+	for _, e := range l.entries[start : end+1] {
+		resp = append(resp, entryResponse{e.leaf, e.extra})
+	}
+
+	writeJSON(w, map[string][]entryResponse{"entries": resp})
+
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var options struct {
+	Validity int64  `short:"v" long:"validity" description:"Certificate validity period (days)" default:"90"`
+
+	KeyFile  string `short:"k" long:"key" description:"CA private key, PEM format, or a pkcs11:, plugin:, unix: or shares: key" required:"true"`
+	CaFile   string `short:"c" long:"ca-certificate" description:"CA cert file, PEM format" required:"true"`
+	Chain    string `short:"C" long:"chain" description:"Further CA certs to return from /cacerts, PEM format"`
+
+	Profiles []string `short:"p" long:"profile" description:"Certificate profile for issued certificates" default:"device"`
+
+	CrlUri   []string `short:"d" long:"crl-distribution" description:"CRL Distribution URI" required:"false"`
+	CaUri    []string `short:"i" long:"ca-issuers-distribution" description:"CA Issuer Chain (p7c)" required:"false"`
+
+	SignatureAlgorithm string `short:"g" long:"signature-algorithm" description:"Signature algorithm e.g. ECDSA-SHA384, SHA256-RSAPSS, default follows the CA key type"`
+
+	Listen   string `short:"l" long:"listen" description:"Address to listen on" default:":8443"`
+	TLSCert  string `long:"tls-certificate" description:"Server TLS certificate, PEM format" required:"true"`
+	TLSKey   string `long:"tls-key" description:"Server TLS private key, PEM format" required:"true"`
+	ClientCAs string `long:"client-ca" description:"CA certs trusted for TLS client authentication, PEM format, default is the CA cert"`
+
+	Users    string `short:"u" long:"users" description:"HTTP basic authentication users, USER:BCRYPT-HASH per line, as hash-password or htpasswd -B make"`
+
+	OutputDir string `short:"o" long:"output-directory" description:"Directory to write issued certificates to"`
+	AuditLog  string `long:"audit-log" env:"CERT_TOOLS_AUDIT_LOG" description:"Hash-chained audit log to append to"`
+}
+
+const estPath = "/.well-known/est/"
+
+type server struct {
+	issuer *cert_tools.Issuer
+	opts   cert_tools.IssueOptions
+
+	// CA cert and chain, as a certs-only PKCS #7.
+	cacerts []byte
+
+	// Basic auth users to SHA-256 password hashes.
+	users map[string][]byte
+}
+
+// Reads the basic authentication users file.
+func readUsers(file string) (map[string][]byte, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string][]byte{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid users line %q", line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid password hash for %s: %s",
+				user, err)
+		}
+		users[user] = []byte(hash)
+	}
+
+	return users, scanner.Err()
+
+}
+
+// Compared against for unknown users, so they take as long as known
+// ones.
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown"),
+	bcrypt.DefaultCost)
+
+// Checks HTTP basic authentication.
+func (s *server) basicAuth(r *http.Request) (string, bool) {
+
+	user, pass, ok := r.BasicAuth()
+	if !ok || s.users == nil {
+		return "", false
+	}
+
+	hash, known := s.users[user]
+	if !known {
+		hash = unknownUserHash
+	}
+
+	// bcrypt compares in constant time.
+	err := bcrypt.CompareHashAndPassword(hash, []byte(pass))
+	if err != nil || !known {
+		return "", false
+	}
+
+	return user, true
+
+}
+
+// The verified TLS client certificate, if there is one.
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Writes a base64 PKCS #7 response, RFC 7030 section 4.1.3.
+func writePKCS7(w http.ResponseWriter, der []byte, smimeType string) {
+
+	enc := base64.StdEncoding.EncodeToString(der)
+
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type="+
+		smimeType)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+
+	for len(enc) > 64 {
+		fmt.Fprintf(w, "%s\r\n", enc[:64])
+		enc = enc[64:]
+	}
+	fmt.Fprintf(w, "%s\r\n", enc)
+
+}
+
+func (s *server) getCACerts(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writePKCS7(w, s.cacerts, "certs-only")
+
+}
+
+func (s *server) simpleEnroll(w http.ResponseWriter, r *http.Request) {
+	s.enroll(w, r, false)
+}
+
+func (s *server) simpleReenroll(w http.ResponseWriter, r *http.Request) {
+	s.enroll(w, r, true)
+}
+
+// Handles simpleenroll and simplereenroll, RFC 7030 sections 4.2.1 and
+// 4.2.2.  Enrollment needs a trusted client certificate or basic
+// authentication, re-enrollment needs the client certificate being
+// renewed.
+func (s *server) enroll(w http.ResponseWriter, r *http.Request, renew bool) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cert := clientCert(r)
+	user, basicOK := s.basicAuth(r)
+
+	who := user
+	if cert != nil {
+		who = cert.Subject.String()
+	}
+
+	if (renew && cert == nil) || (!renew && cert == nil && !basicOK) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="EST"`)
+		http.Error(w, "authentication required",
+			http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	csr, err := parseCSRBody(body)
+	if err != nil {
+		log.Printf("%s: %s", who, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Renewal keeps the identity of the certificate being renewed.
+	if renew {
+		if err := checkRenewal(cert, csr); err != nil {
+			log.Printf("%s: %s", who, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	issued, err := s.issuer.Issue(csr, s.opts)
+	if issued != nil {
+		for _, res := range issued.Extensions {
+			if res.Decision != cert_tools.ExtensionAccepted {
+				log.Printf("%s: requested extension %s", who, res)
+			}
+		}
+	}
+
+	// Nothing is returned unless it's audited.
+	op, done := "enroll", "enrolled"
+	if renew {
+		op, done = "re-enroll", "re-enrolled"
+	}
+	aerr := cert_tools.AuditIssue(options.AuditLog, cert_tools.AuditRecord{
+		Operation: "est-server " + op,
+		Requester: who,
+		Profiles:  options.Profiles,
+	}, s.issuer.Cert, csr, issued, err)
+	if aerr != nil {
+		log.Printf("%s: %s", who, aerr)
+		http.Error(w, "failed to audit", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("%s: %s", who, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("%s: %s %X %s", who, done, issued.Certificate.SerialNumber,
+		issued.Certificate.Subject)
+
+	if options.OutputDir != "" {
+		file := filepath.Join(options.OutputDir,
+			fmt.Sprintf("%X.pem", issued.Certificate.SerialNumber))
+		err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: issued.Raw}), 0644)
+		if err != nil {
+			log.Printf("failed to write %s: %s", file, err)
+		}
+	}
+
+	p7, err := cert_tools.CertsOnly([]*x509.Certificate{
+		issued.Certificate,
+	})
+	if err != nil {
+		http.Error(w, "failed to encode response",
+			http.StatusInternalServerError)
+		return
+	}
+
+	writePKCS7(w, p7, "certs-only")
+
+}
+
+// The request body is a base64 DER PKCS #10, PEM is accepted too.
+func parseCSRBody(body []byte) (*x509.CertificateRequest, error) {
+
+	if block, _ := pem.Decode(body); block != nil {
+		return cert_tools.ParseCSR(block.Bytes)
+	}
+
+	clean := strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, string(body))
+
+	der, err := base64.StdEncoding.DecodeString(clean)
+	if err != nil {
+		return nil, fmt.Errorf("request is not base64: %s", err)
+	}
+
+	return cert_tools.ParseCSR(der)
+
+}
+
+// RFC 7030 section 4.2.2: the subject and SANs of a renewal request must
+// match the certificate being renewed.
+func checkRenewal(cert *x509.Certificate, csr *x509.CertificateRequest) error {
+
+	if string(cert.RawSubject) != string(csr.RawSubject) {
+		return fmt.Errorf("renewal subject %s doesn't match %s",
+			csr.Subject, cert.Subject)
+	}
+
+	// SANs of every type are compared as sets, order doesn't matter.
+	same, err := cert_tools.SameSANs(cert.Extensions, csr.Extensions)
+	if err != nil {
+		return fmt.Errorf("failed to parse SANs: %s", err)
+	}
+	if !same {
+		return fmt.Errorf("renewal SANs don't match the certificate " +
+			"being renewed")
+	}
+
+	return nil
+
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	// Key is EC, RSA or PKCS #8.
+	issuer, err := cert_tools.ReadIssuer(options.KeyFile, options.CaFile)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	profiles, err := cert_tools.GetProfiles(options.Profiles)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	// Fail now rather than on the first enrollment.
+	_, err = cert_tools.SignatureAlgorithm(issuer.Key.Public(),
+		options.SignatureAlgorithm)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	s := &server{
+		issuer: issuer,
+		opts: cert_tools.IssueOptions{
+			Validity: time.Duration(options.Validity*24) *
+				time.Hour,
+			Profiles:           profiles,
+			SignatureAlgorithm: options.SignatureAlgorithm,
+			CrlUri:             options.CrlUri,
+			CaUri:              options.CaUri,
+		},
+	}
+
+	// CA certs served by /cacerts.
+	chain := []*x509.Certificate{issuer.Cert}
+	if options.Chain != "" {
+		extra, err := cert_tools.ReadCertificatesFromFile(options.Chain)
+		if err != nil {
+			log.Fatalf("failed to read chain: %s", err)
+		}
+		chain = append(chain, extra...)
+	}
+	s.cacerts, err = cert_tools.CertsOnly(chain)
+	if err != nil {
+		log.Fatalf("failed to encode CA certs: %s", err)
+	}
+
+	if options.Users != "" {
+		s.users, err = readUsers(options.Users)
+		if err != nil {
+			log.Fatalf("failed to read users: %s", err)
+		}
+	}
+
+	// Client certificates are optional, basic auth is the alternative.
+	clientCAs := x509.NewCertPool()
+	if options.ClientCAs != "" {
+		certs, err := cert_tools.ReadCertificatesFromFile(options.ClientCAs)
+		if err != nil {
+			log.Fatalf("failed to read client CAs: %s", err)
+		}
+		for _, c := range certs {
+			clientCAs.AddCert(c)
+		}
+	} else {
+		clientCAs.AddCert(issuer.Cert)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(estPath+"cacerts", s.getCACerts)
+	mux.HandleFunc(estPath+"simpleenroll", s.simpleEnroll)
+	mux.HandleFunc(estPath+"simplereenroll", s.simpleReenroll)
+
+	srv := &http.Server{
+		Addr:              options.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  clientCAs,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	log.Printf("EST server listening on %s", options.Listen)
+
+	err = srv.ListenAndServeTLS(options.TLSCert, options.TLSKey)
+	log.Fatalf("%s", err)
+
+}
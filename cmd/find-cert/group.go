@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"sort"
+	"strings"
+)
+
+// Keys certificates are grouped by for -l and -L, besides the query
+// fields.
+var groupKeys = map[string]func(cert *x509.Certificate, email string) []string{
+
+	// The email address found, or the subject without one.
+	"email": func(cert *x509.Certificate, email string) []string {
+		if email == "" {
+			return []string{cert.Subject.String()}
+		}
+		return []string{email}
+	},
+	"subject": func(cert *x509.Certificate, email string) []string {
+		return []string{cert.Subject.String()}
+	},
+	"sans": func(cert *x509.Certificate, email string) []string {
+		s, err := cert_tools.SANsFromExtensions(cert.Extensions)
+		if err != nil || s == nil {
+			return nil
+		}
+		return s.Strings()
+	},
+	"key": func(cert *x509.Certificate, email string) []string {
+		return queryFields["fingerprint"](cert)
+	},
+}
+
+// Parses a comma-separated list of group keys.
+func parseGroupBy(s string) ([]string, error) {
+
+	keys := strings.Split(s, ",")
+	for i, k := range keys {
+		k = strings.ToLower(strings.TrimSpace(k))
+		_, isKey := groupKeys[k]
+		_, isField := queryFields[k]
+		if !isKey && !isField {
+			return nil, fmt.Errorf("unknown group key %q, keys "+
+				"are %s", k, strings.Join(groupKeyNames(), ", "))
+		}
+		keys[i] = k
+	}
+
+	return keys, nil
+
+}
+
+// The group a certificate is in, the values of each key, with sets of
+// values such as SANs sorted so their order doesn't matter.
+func groupOf(cert *x509.Certificate, email string, keys []string) string {
+
+	parts := []string{}
+	for _, k := range keys {
+
+		var values []string
+		if f, ok := groupKeys[k]; ok {
+			values = f(cert, email)
+		} else {
+			values = queryFields[k](cert)
+		}
+
+		set := []string{}
+		for _, v := range values {
+			set = append(set, strings.ToLower(v))
+		}
+		sort.Strings(set)
+		parts = append(parts, strings.Join(set, ";"))
+
+	}
+
+	return strings.Join(parts, "|")
+
+}
+
+func groupKeyNames() []string {
+	names := []string{}
+	for n := range groupKeys {
+		names = append(names, n)
+	}
+	for n := range queryFields {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,39 +1,51 @@
 package main
 
 import (
+	"bytes"
 	//	"crypto/rand"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/asn1"
 	//	"encoding/binary"
 	//	"encoding/csv"
-	"encoding/pem"
 	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
 	"github.com/jessevdk/go-flags"
-	"io/ioutil"
 	"log"
 	//	"math/big"
 	"os"
+	"sort"
 	"time"
+	"strconv"
 	"strings"
 )
 
 var options struct {
 	Email string `short:"e" long:"email" description:"E-mail to locate in a cert" default:"" required:"false"`
 	Subject string`short:"s" long:"subject" description:"Subject substring to match" default:"" required:"false"`
-	CertPrefix  string `short:"p" long:"prefix" description:"Prefix of Cert file, PEM format" required:"true"`
-	CertDir string `short:"d" long:"directory" description:"Directory to search" required:"true"`
+	Query []string `short:"q" long:"query" description:"Query to match e.g. 'dns~example.org and not expired', more than one must all match" required:"false"`
+	CertPrefix  string `short:"p" long:"prefix" description:"Prefix of Cert file names in directories" required:"false"`
+	Names []string `short:"n" long:"name" description:"Glob pattern file names in directories must match e.g. '*.crt'" required:"false"`
+	CertDir string `short:"d" long:"directory" description:"Directory to search, as well as any files, directories and glob patterns given as arguments" required:"false"`
+	Passwords []string `long:"p12-password" description:"Password to try for p12 files, as well as an empty password" required:"false"`
 	Verbose []bool `short:"v" long:"verbose" description:"Verbosity" required:"false"`
 	Extended bool `short:"x" long:"extended" description:"Extended Output" required:"false"` 
 	ExceptLatest bool `short:"l" long:"exceptlatest" description:"Show all but latest certificate" required:"false"`
 	OnlyLatest bool `short:"L" long:"onlylatest" description:"Show only latest certificate" required:"false"`
+	GroupBy string `short:"g" long:"group-by" description:"What -l and -L group certificates by, comma-separated list of email, subject, cn, sans, key or other query fields" default:"email" required:"false"`
+	CaFile string `short:"c" long:"ca-certificate" description:"Only certificates issued by this CA, checked by signature, PEM format" required:"false"`
+	Reason string `short:"R" long:"reason" description:"Revocation reason added to each line, default is superseded with -l" required:"false"`
+	RevTime string `short:"t" long:"revocation-time" description:"Revocation time, RFC 3339, default is when the latest certificate was issued with -l, otherwise now" required:"false"`
+	Output string `short:"o" long:"output" description:"Output format, rather than SERIAL,TIME lines" choice:"json" choice:"csv" choice:"table" required:"false"`
 }
 
 var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
 
 type certtab struct {
+	Index int
+	Path string
 	Cert *x509.Certificate
 	Issued time.Time
+	Superseded time.Time
 	Email string
 	Revoke bool
 }
@@ -48,103 +60,143 @@ type certtab struct {
 //	ExtraNames []AttributeTypeAndValue
 //}
 
-func stringListContains(l []string, s string) bool {
-	for _, le := range l {
-		if strings.Contains(le,s) {
-			return true
-		}
+func main() {
+
+	// Parse flags
+	paths, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
 	}
-	return false
-}
 
-func nameContains(n pkix.Name, s string) bool {
+	if options.CertDir != "" {
+		paths = append([]string{options.CertDir}, paths...)
+	}
+	if len(paths) == 0 {
+		log.Fatalf("no directory or files to search")
+	}
 
-	return 	strings.Contains(n.CommonName,s) ||
-		stringListContains(n.OrganizationalUnit,s) ||
-		stringListContains(n.Organization,s) ||
-		stringListContains(n.Country,s) ||
-		stringListContains(n.Locality,s) ||
-		stringListContains(n.Province,s) ||
-		stringListContains(n.PostalCode,s) ||
-		stringListContains(n.StreetAddress,s)
-}
+	// -e and -s are shorthand for queries
+	queries := options.Query
+	if options.Email != "" {
+		queries = append(queries, "email=" + strconv.Quote(options.Email))
+	}
+	if options.Subject != "" {
+		queries = append(queries, "subject~" + strconv.Quote(options.Subject))
+	}
 
-func main() {
+	matchers := []matcher{}
+	for _, q := range queries {
+		m, err := parseQuery(q, time.Now())
+		if err != nil {
+			log.Fatalf("invalid query %q: %s", q, err)
+		}
+		matchers = append(matchers, m)
+	}
 
-	// Parse flags
-	_, err := flags.Parse(&options)
+	groupBy, err := parseGroupBy(options.GroupBy)
 	if err != nil {
-		os.Exit(1)
+		log.Fatalf("%s", err)
 	}
 
+	// Certificates must have been signed by the CA, not just have its
+	// name as issuer
+	var ca *x509.Certificate
+	if options.CaFile != "" {
+		ca, err = cert_tools.ReadCertificateFromFile(options.CaFile)
+		if err != nil {
+			log.Fatalf("failed to read CA certificate: %s", err)
+		}
+	}
+
+	reason := options.Reason
+	if reason == "" && options.ExceptLatest {
+		reason = "superseded"
+	}
+	if reason != "" {
+		if _, err := cert_tools.RevocationReason(reason); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+
+	revocationTime := time.Now()
+	if options.RevTime != "" {
+		revocationTime, err = time.Parse(time.RFC3339, options.RevTime)
+		if err != nil {
+			log.Fatalf("invalid revocation time %q", options.RevTime)
+		}
+	}
 
-	files,err := ioutil.ReadDir(options.CertDir)
+	// Files which can't be read are skipped, not fatal, so whole trees
+	// can be searched
+	scan := &cert_tools.Scan{
+		Names: options.Names,
+		Passwords: options.Passwords,
+		Warn: func(path string, err error) {
+			log.Printf("skipped %s: %s", path, err)
+		},
+	}
+	if options.CertPrefix != "" {
+		scan.Names = append(scan.Names, options.CertPrefix + "*")
+	}
+	err = scan.Paths(paths)
 	if err != nil {
-		log.Fatalf("Failed to read certificate directory: %s", err)
+		log.Fatalf("failed to search: %s", err)
 	}
 
 	certMap := map[string][]certtab{}
 	
-	
-	for _, certFile := range files {
+	for index, found := range scan.UniqueCertificates() {
 
-		// Temporarily hold the filename that we are examining
-		tmpName :=  certFile.Name()
-
-		// Verify that the prefix matches
-		if strings.HasPrefix(tmpName,options.CertPrefix) {
-			
-			// Read cert file
-			raw, err := ioutil.ReadFile(options.CertDir + "/" + tmpName)
-			if err != nil {
-				log.Fatalf("failed to read certificate file: %s", err)
-			}
-			
-			// Read cert
-			testPem, _ := pem.Decode([]byte(raw))
-			if testPem == nil {
-				log.Fatalf("failed to read certificate file")
-			}
-			
-			// Parse certificate
-			testCert, err := x509.ParseCertificate(testPem.Bytes)
-			if err != nil {
-				log.Fatalf("failed to parse certificate: %s\n", err)
-			}
+		testCert := found.Certificate
 
+		if ca != nil && (bytes.Equal(testCert.Raw, ca.Raw) ||
+			!bytes.Equal(testCert.RawIssuer, ca.RawSubject) ||
+			testCert.CheckSignatureFrom(ca) != nil) {
+			continue
+		}
 
-			// Look through the array of email addresses in the Cert for a Match
-			// then optionally look for the provided Subject substring in the Cert Subject field
-			for _,email := range testCert.EmailAddresses {
-				if (options.Email == "" || email == options.Email) &&
-					(options.Subject == "" || nameContains(testCert.Subject,options.Subject)) {
+		// Every query must match
+		matched := true
+		for _, m := range matchers {
+			matched = matched && m(testCert)
+		}
+		if !matched {
+			continue
+		}
 
-					// Everything matched, print out file name and go on to the next file
-					if len(options.Verbose) > 0 {
-						fmt.Printf("%s|%d|%d|%s\n",
-							tmpName,
-							testCert.NotBefore.Unix(),
-							testCert.NotAfter.Unix(),
-							email)
-					}
-					certMap[email] = append(certMap[email],
-						certtab{
-							Cert: testCert,
-							Issued: testCert.NotBefore,
-							Revoke: true,
-							Email: email,
-						})
-					break
-				}
+		// The email address asked for if there is one
+		email := ""
+		for _, e := range testCert.EmailAddresses {
+			if options.Email == "" || strings.EqualFold(e, options.Email) {
+				email = e
+				break
 			}
+		}
+		group := groupOf(testCert, email, groupBy)
 
-			
-			
+		// Everything matched, print out file name and go on to the next
+		// file.  Debug goes to stderr, so it doesn't spoil the output.
+		if len(options.Verbose) > 0 {
+			log.Printf("%s|%d|%d|%s",
+				found.Path,
+				testCert.NotBefore.Unix(),
+				testCert.NotAfter.Unix(),
+				email)
 		}
+		certMap[group] = append(certMap[group],
+			certtab{
+				Index: index,
+				Path: found.Path,
+				Cert: testCert,
+				Issued: testCert.NotBefore,
+				Revoke: true,
+				Email: email,
+			})
 	}
 
 	// -- Check to see if the user wants to keep the latest issued certificate
 
+	selected := []certtab{}
 	
 	for email,certs := range certMap {
 		if options.ExceptLatest || options.OnlyLatest {
@@ -152,14 +204,14 @@ func main() {
 			latestIssued := time.Unix(0,0)
 			for i,c :=range certs {
 				if len(options.Verbose) > 0 {
-					fmt.Printf("? %s|%X|%s\n",
+					log.Printf("? %s|%X|%s",
 						email,c.Cert.SerialNumber,
 						c.Issued.UTC().Format(time.RFC3339))
 				}
 				
 				if c.Issued.After(latestIssued) {
 					if len(options.Verbose) > 0 {
-						fmt.Printf("?>%s|%X|%s\n",
+						log.Printf("?>%s|%X|%s",
 							email,c.Cert.SerialNumber,
 							c.Issued.UTC().Format(time.RFC3339))
 					}
@@ -169,33 +221,76 @@ func main() {
 				}
 			}
 			if len(options.Verbose) > 0 {
-				fmt.Printf("?*%s|%X|%s\n",
+				log.Printf("?*%s|%X|%s",
 					email,
 					certs[latest].Cert.SerialNumber,
 					certs[latest].Issued.UTC().Format(time.RFC3339))
 			}
 			
 			certs[latest].Revoke = false
+
+			// The others were superseded when the latest was issued
+			for i := range certs {
+				if i != latest {
+					certs[i].Superseded = certs[latest].Issued
+				}
+			}
 		}
 
 
-		// -- Output the list of certificates in the form: filename,Serial,Now
-		
 		for _, c := range certs {
 
 			if ( options.OnlyLatest && !c.Revoke) ||
 				(options.ExceptLatest && c.Revoke) ||
 				(!options.ExceptLatest && !options.OnlyLatest && c.Revoke) {
-				
-				if options.Extended {
-					fmt.Printf("%016X,%s,%s,%s,%s,%s\n",c.Cert.SerialNumber.Bytes(),c.Email,
-						c.Cert.Subject.Organization, c.Cert.Subject.OrganizationalUnit,
-						c.Cert.Subject.CommonName,c.Issued.UTC().Format(time.RFC3339))
-				} else {
-					fmt.Printf("%016X,%s\n",c.Cert.SerialNumber.Bytes(),time.Now().UTC().Format(time.RFC3339))
-				}
-				
+				selected = append(selected, c)
+			}
+		}
+	}
+
+	// -- Output in the order found, not the order of the groups
+	
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Index < selected[j].Index
+	})
+
+	records := []certRecord{}
+	for _, c := range selected {
+		records = append(records, newCertRecord(c.Path, c.Cert))
+	}
+
+	switch options.Output {
+	case "json":
+		err = writeJSON(os.Stdout, records)
+	case "csv":
+		err = writeCSV(os.Stdout, records)
+	case "table":
+		err = writeTable(os.Stdout, records)
+	default:
+
+		// -- Output the list of certificates in the form: Serial,Time[,Reason]
+
+		for _, c := range selected {
+			if options.Extended {
+				fmt.Printf("%016X,%s,%s,%s,%s,%s\n",c.Cert.SerialNumber.Bytes(),c.Email,
+					c.Cert.Subject.Organization, c.Cert.Subject.OrganizationalUnit,
+					c.Cert.Subject.CommonName,c.Issued.UTC().Format(time.RFC3339))
+				continue
+			}
+			when := revocationTime
+			if options.RevTime == "" && !c.Superseded.IsZero() {
+				when = c.Superseded
+			}
+			if reason == "" {
+				fmt.Printf("%X,%s\n", c.Cert.SerialNumber,
+					when.UTC().Format(time.RFC3339))
+			} else {
+				fmt.Printf("%X,%s,%s\n", c.Cert.SerialNumber,
+					when.UTC().Format(time.RFC3339), reason)
 			}
 		}
 	}
+	if err != nil {
+		log.Fatalf("failed to write output: %s", err)
+	}
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A certificate found, in the form output as JSON, CSV or a table.  The
+// columns are in a fixed order, new ones are only added at the end.
+type certRecord struct {
+	Path      string    `json:"path"`
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	SANs      []string  `json:"sans"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+var outputColumns = []string{
+	"path", "serial", "subject", "issuer", "sans", "not_before",
+	"not_after",
+}
+
+func newCertRecord(path string, cert *x509.Certificate) certRecord {
+
+	sans := []string{}
+	if s, err := cert_tools.SANsFromExtensions(cert.Extensions); err == nil && s != nil {
+		sans = s.Strings()
+	}
+
+	return certRecord{
+		Path:      path,
+		Serial:    fmt.Sprintf("%X", cert.SerialNumber),
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		SANs:      sans,
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+	}
+
+}
+
+// The record's columns as strings, SANs joined by sep.
+func (r certRecord) fields(sep string) []string {
+	return []string{
+		r.Path, r.Serial, r.Subject, r.Issuer,
+		strings.Join(r.SANs, sep),
+		r.NotBefore.Format(time.RFC3339),
+		r.NotAfter.Format(time.RFC3339),
+	}
+}
+
+// Writes the records as a JSON array.
+func writeJSON(w io.Writer, records []certRecord) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
+
+// Writes the records as CSV with a header line, SANs separated by
+// semicolons.
+func writeCSV(w io.Writer, records []certRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write(outputColumns)
+	for _, r := range records {
+		cw.Write(r.fields(";"))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Writes the records as a table for people to read.
+func writeTable(w io.Writer, records []certRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(outputColumns, "\t")))
+	for _, r := range records {
+		fmt.Fprintln(tw, strings.Join(r.fields(", "), "\t"))
+	}
+	return tw.Flush()
+}
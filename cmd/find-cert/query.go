@@ -0,0 +1,498 @@
+package main
+
+// Queries select certificates with terms combined by and, or, not and
+// brackets, e.g.
+//
+//   dns~example.org and (usage=client-auth or profile=server) and not expired
+//
+// A term is FIELD=VALUE for an exact match, FIELD~VALUE for a substring,
+// or a flag.  Values with spaces or brackets are quoted Go-style, e.g.
+// subject~"Example Ltd".  Matching ignores case.
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type matcher func(cert *x509.Certificate) bool
+
+// Fields matched against a list of strings from the certificate.
+var queryFields = map[string]func(cert *x509.Certificate) []string{
+	"serial": func(cert *x509.Certificate) []string {
+		return []string{fmt.Sprintf("%X", cert.SerialNumber)}
+	},
+	"subject": func(cert *x509.Certificate) []string {
+		return nameStrings(cert.Subject.String(), cert.Subject.Names)
+	},
+	"issuer": func(cert *x509.Certificate) []string {
+		return nameStrings(cert.Issuer.String(), cert.Issuer.Names)
+	},
+	"cn": func(cert *x509.Certificate) []string {
+		return []string{cert.Subject.CommonName}
+	},
+	"email": func(cert *x509.Certificate) []string {
+		return cert.EmailAddresses
+	},
+	"dns": func(cert *x509.Certificate) []string {
+		return cert.DNSNames
+	},
+	"ip": func(cert *x509.Certificate) []string {
+		ips := []string{}
+		for _, ip := range cert.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		return ips
+	},
+	"uri": func(cert *x509.Certificate) []string {
+		uris := []string{}
+		for _, u := range cert.URIs {
+			uris = append(uris, u.String())
+		}
+		return uris
+	},
+	"usage": usageNames,
+	"profile": func(cert *x509.Certificate) []string {
+		profiles := []string{}
+		for _, name := range cert_tools.ProfileNames() {
+			if hasProfile(cert, cert_tools.Profiles[name]) {
+				profiles = append(profiles, name)
+			}
+		}
+		return profiles
+	},
+	"fingerprint": func(cert *x509.Certificate) []string {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return []string{hex.EncodeToString(sum[:])}
+	},
+	"ski": func(cert *x509.Certificate) []string {
+		return []string{hex.EncodeToString(cert.SubjectKeyId)}
+	},
+	"aki": func(cert *x509.Certificate) []string {
+		return []string{hex.EncodeToString(cert.AuthorityKeyId)}
+	},
+}
+
+// Fields compared with a date.
+var queryDates = map[string]func(cert *x509.Certificate, t time.Time) bool{
+	"expires-before": func(cert *x509.Certificate, t time.Time) bool {
+		return cert.NotAfter.Before(t)
+	},
+	"expires-after": func(cert *x509.Certificate, t time.Time) bool {
+		return cert.NotAfter.After(t)
+	},
+	"issued-before": func(cert *x509.Certificate, t time.Time) bool {
+		return cert.NotBefore.Before(t)
+	},
+	"issued-after": func(cert *x509.Certificate, t time.Time) bool {
+		return cert.NotBefore.After(t)
+	},
+}
+
+var keyUsageNames = []struct {
+	name  string
+	usage x509.KeyUsage
+}{
+	{"digital-signature", x509.KeyUsageDigitalSignature},
+	{"content-commitment", x509.KeyUsageContentCommitment},
+	{"key-encipherment", x509.KeyUsageKeyEncipherment},
+	{"data-encipherment", x509.KeyUsageDataEncipherment},
+	{"key-agreement", x509.KeyUsageKeyAgreement},
+	{"cert-sign", x509.KeyUsageCertSign},
+	{"crl-sign", x509.KeyUsageCRLSign},
+	{"encipher-only", x509.KeyUsageEncipherOnly},
+	{"decipher-only", x509.KeyUsageDecipherOnly},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "server-auth",
+	x509.ExtKeyUsageClientAuth:      "client-auth",
+	x509.ExtKeyUsageCodeSigning:     "code-signing",
+	x509.ExtKeyUsageEmailProtection: "email-protection",
+	x509.ExtKeyUsageTimeStamping:    "time-stamping",
+	x509.ExtKeyUsageOCSPSigning:     "ocsp-signing",
+}
+
+// The DN string and each attribute value, so a substring of a single
+// attribute matches without DN escaping getting in the way.
+func nameStrings(dn string, names []pkix.AttributeTypeAndValue) []string {
+	values := []string{dn}
+	for _, n := range names {
+		values = append(values, fmt.Sprint(n.Value))
+	}
+	return values
+}
+
+// Names of the key usages and extended key usages a certificate has.
+func usageNames(cert *x509.Certificate) []string {
+	names := []string{}
+	for _, u := range keyUsageNames {
+		if cert.KeyUsage&u.usage != 0 {
+			names = append(names, u.name)
+		}
+	}
+	for _, u := range cert.ExtKeyUsage {
+		if name, ok := extKeyUsageNames[u]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func knownUsage(name string) bool {
+	for _, u := range keyUsageNames {
+		if u.name == name {
+			return true
+		}
+	}
+	for _, n := range extKeyUsageNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a certificate has the usages a profile grants.
+func hasProfile(cert *x509.Certificate, p *cert_tools.Profile) bool {
+	if cert.KeyUsage&p.KeyUsage != p.KeyUsage || (p.IsCA && !cert.IsCA) {
+		return false
+	}
+	for _, u := range p.ExtKeyUsage {
+		found := false
+		for _, v := range cert.ExtKeyUsage {
+			found = found || u == v
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses a date, RFC 3339, YYYY-MM-DD or days from now as +N or -N.
+func parseDate(s string, now time.Time) (time.Time, error) {
+
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		days, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid days %q", s)
+		}
+		return now.Add(time.Duration(days*24) * time.Hour), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid date %q, use RFC 3339, "+
+		"YYYY-MM-DD or days from now as +N or -N", s)
+
+}
+
+// Hex values compare without colons.
+func normaliseHex(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, ":", ""))
+}
+
+type queryParser struct {
+	tokens []string
+	pos    int
+	now    time.Time
+}
+
+// Parses a query, dates relative to now.
+func parseQuery(s string, now time.Time) (matcher, error) {
+
+	tokens, err := queryTokens(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens, now: now}
+	m, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	return m, nil
+
+}
+
+// Splits a query into brackets and words, unquoting quoted parts of
+// words.
+func queryTokens(s string) ([]string, error) {
+
+	tokens := []string{}
+
+	for i := 0; i < len(s); {
+
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+			continue
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+			continue
+		}
+
+		word := ""
+		for i < len(s) && !strings.ContainsRune(" \t\n()", rune(s[i])) {
+			if s[i] != '"' {
+				word += s[i : i+1]
+				i++
+				continue
+			}
+			prefix, err := strconv.QuotedPrefix(s[i:])
+			if err != nil {
+				return nil, fmt.Errorf("unterminated quote in %q",
+					s[i:])
+			}
+			value, _ := strconv.Unquote(prefix)
+			word += value
+			i += len(prefix)
+		}
+		tokens = append(tokens, word)
+
+	}
+
+	return tokens, nil
+
+}
+
+func (p *queryParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) keyword(k string) bool {
+	if strings.EqualFold(p.next(), k) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) or() (matcher, error) {
+
+	terms := []matcher{}
+	for {
+		m, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, m)
+		if !p.keyword("or") {
+			break
+		}
+	}
+
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return func(cert *x509.Certificate) bool {
+		for _, m := range terms {
+			if m(cert) {
+				return true
+			}
+		}
+		return false
+	}, nil
+
+}
+
+func (p *queryParser) and() (matcher, error) {
+
+	terms := []matcher{}
+	for {
+		m, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, m)
+		if !p.keyword("and") {
+			break
+		}
+	}
+
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return func(cert *x509.Certificate) bool {
+		for _, m := range terms {
+			if !m(cert) {
+				return false
+			}
+		}
+		return true
+	}, nil
+
+}
+
+func (p *queryParser) not() (matcher, error) {
+
+	if p.keyword("not") {
+		m, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(cert *x509.Certificate) bool {
+			return !m(cert)
+		}, nil
+	}
+
+	if p.keyword("(") {
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return m, nil
+	}
+
+	return p.term()
+
+}
+
+func (p *queryParser) term() (matcher, error) {
+
+	word := p.next()
+	switch strings.ToLower(word) {
+	case "", ")", "and", "or":
+		if word == "" {
+			return nil, fmt.Errorf("query ends too soon")
+		}
+		return nil, fmt.Errorf("unexpected %q", word)
+	}
+	p.pos++
+
+	// Flags
+	now := p.now
+	switch strings.ToLower(word) {
+	case "expired":
+		return func(cert *x509.Certificate) bool {
+			return now.After(cert.NotAfter)
+		}, nil
+	case "valid":
+		return func(cert *x509.Certificate) bool {
+			return !now.Before(cert.NotBefore) &&
+				!now.After(cert.NotAfter)
+		}, nil
+	case "ca":
+		return func(cert *x509.Certificate) bool {
+			return cert.IsCA
+		}, nil
+	}
+
+	op := strings.IndexAny(word, "=~")
+	if op < 1 {
+		return nil, fmt.Errorf("invalid term %q, form is FIELD=VALUE, "+
+			"FIELD~VALUE or a flag, fields are %s", word,
+			strings.Join(queryFieldNames(), ", "))
+	}
+	field := strings.ToLower(word[:op])
+	exact := word[op] == '='
+	value := word[op+1:]
+
+	if dateMatch, ok := queryDates[field]; ok {
+		if !exact {
+			return nil, fmt.Errorf("%s needs =", field)
+		}
+		t, err := parseDate(value, now)
+		if err != nil {
+			return nil, err
+		}
+		return func(cert *x509.Certificate) bool {
+			return dateMatch(cert, t)
+		}, nil
+	}
+
+	values, ok := queryFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q, fields are %s",
+			field, strings.Join(queryFieldNames(), ", "))
+	}
+
+	// Values are checked and put in the form the certificate gives.
+	switch field {
+	case "usage":
+		if exact && !knownUsage(strings.ToLower(value)) {
+			return nil, fmt.Errorf("unknown usage %q", value)
+		}
+	case "profile":
+		if _, err := cert_tools.GetProfile(strings.ToLower(value)); exact && err != nil {
+			return nil, err
+		}
+	case "serial":
+		if exact {
+			serial, ok := new(big.Int).SetString(normaliseHex(value), 16)
+			if !ok {
+				return nil, fmt.Errorf("invalid serial %q", value)
+			}
+			value = fmt.Sprintf("%X", serial)
+		}
+	case "fingerprint", "ski", "aki":
+		value = normaliseHex(value)
+	case "ip":
+		if _, network, err := net.ParseCIDR(value); err == nil && exact {
+			return func(cert *x509.Certificate) bool {
+				for _, ip := range cert.IPAddresses {
+					if network.Contains(ip) {
+						return true
+					}
+				}
+				return false
+			}, nil
+		}
+		if ip := net.ParseIP(value); ip != nil && exact {
+			value = ip.String()
+		}
+	}
+
+	value = strings.ToLower(value)
+	return func(cert *x509.Certificate) bool {
+		for _, v := range values(cert) {
+			v = strings.ToLower(v)
+			if (exact && v == value) ||
+				(!exact && strings.Contains(v, value)) {
+				return true
+			}
+		}
+		return false
+	}, nil
+
+}
+
+// Sorted names of fields and flags, for errors.
+func queryFieldNames() []string {
+	names := []string{"expired", "valid", "ca"}
+	for n := range queryFields {
+		names = append(names, n)
+	}
+	for n := range queryDates {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"os"
+	"strings"
+)
+
+var options struct {
+	User string `short:"u" long:"user" description:"User name, output is USER:HASH as est-server -u reads"`
+	Cost int    `short:"c" long:"cost" description:"bcrypt cost" default:"10"`
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	// The password is the first line of stdin, so it isn't on the
+	// command line.
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("failed to read password: %s", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		log.Fatalf("password is empty")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), options.Cost)
+	if err != nil {
+		log.Fatalf("failed to hash password: %s", err)
+	}
+
+	if options.User != "" {
+		if strings.Contains(options.User, ":") {
+			log.Fatalf("user name can't contain ':'")
+		}
+		fmt.Printf("%s:%s\n", options.User, hash)
+	} else {
+		fmt.Printf("%s\n", hash)
+	}
+
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"log"
+	"os"
+	"strings"
+)
+
+var options struct {
+	Level  string   `short:"l" long:"level" description:"Only report findings at this level or worse" choice:"error" choice:"warning" choice:"notice" default:"notice"`
+	Skip   []string `short:"x" long:"skip" description:"Check to skip, may be repeated"`
+	Output string   `short:"o" long:"output" description:"Output format, the default is a line per finding" choice:"json"`
+}
+
+// A finding, with what it was found in.
+type record struct {
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Subject string `json:"subject"`
+	Serial  string `json:"serial,omitempty"`
+	cert_tools.LintFinding
+}
+
+// Exit status when files can't be linted, beyond those for findings.
+const statusFailed = 3
+
+func fatal(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	os.Exit(statusFailed)
+}
+
+func main() {
+
+	// Parse flags
+	paths, err := flags.Parse(&options)
+	if err != nil {
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(statusFailed)
+	}
+
+	if len(paths) == 0 {
+		fatal("no certificate or request files to lint")
+	}
+
+	minLevel := cert_tools.LintLevel(options.Level)
+	skip := map[string]bool{}
+	for _, s := range options.Skip {
+		skip[s] = true
+	}
+
+	// Requests are read without checking their signature, that's one of
+	// the lint checks.
+	failed := false
+	scan := &cert_tools.Scan{
+		Warn: func(path string, err error) {
+			log.Printf("skipped %s: %s", path, err)
+			failed = true
+		},
+	}
+	if err := scan.Paths(paths); err != nil {
+		fatal("%s", err)
+	}
+
+	records := []record{}
+	add := func(r record, findings []cert_tools.LintFinding) {
+		for _, f := range findings {
+			if skip[f.Check] || !f.Level.AtLeast(minLevel) {
+				continue
+			}
+			r.LintFinding = f
+			records = append(records, r)
+		}
+	}
+
+	// Chains and bundles repeat certificates.
+	for _, c := range scan.UniqueCertificates() {
+		add(record{
+			Path:    c.Path,
+			Type:    "certificate",
+			Subject: c.Certificate.Subject.String(),
+			Serial:  fmt.Sprintf("%X", c.Certificate.SerialNumber),
+		}, cert_tools.LintCertificate(c.Certificate))
+	}
+
+	for _, r := range scan.Requests {
+		add(record{
+			Path:    r.Path,
+			Type:    "request",
+			Subject: r.Request.Subject.String(),
+		}, cert_tools.LintRequest(r.Request))
+	}
+
+	if options.Output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(records); err != nil {
+			fatal("failed to write JSON: %s", err)
+		}
+	} else {
+		for _, r := range records {
+			fmt.Printf("%-8s %s: %s %s: %s: %s\n",
+				strings.ToUpper(string(r.Level)), r.Path, r.Type,
+				r.Subject, r.Check, r.Message)
+		}
+	}
+
+	if failed {
+		os.Exit(statusFailed)
+	}
+
+	// Exit status is 2 for errors, 1 for warnings.
+	findings := []cert_tools.LintFinding{}
+	for _, r := range records {
+		findings = append(findings, r.LintFinding)
+	}
+	switch cert_tools.WorstLint(findings) {
+	case cert_tools.LintError:
+		os.Exit(2)
+	case cert_tools.LintWarning:
+		os.Exit(1)
+	}
+
+}
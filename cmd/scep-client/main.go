@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/asn1"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var options struct {
+	URL        string `short:"u" long:"url" description:"SCEP server URL e.g. http://scep.example.org/scep" required:"true"`
+
+	KeyFile    string `short:"k" long:"key" description:"Private key of the request, RSA, PEM format" required:"true"`
+	CsrFile    string `short:"r" long:"certificate-request" description:"CSR file, PEM format" required:"true"`
+
+	CaFile     string `short:"c" long:"ca-certificate" description:"Expected CA cert, PEM format, default trusts the server's"`
+
+	SignerCert string `short:"s" long:"signer-certificate" description:"Certificate being renewed, PEM format, sends a RenewalReq"`
+	SignerKey  string `long:"signer-key" description:"Private key of the certificate being renewed, default is --key"`
+}
+
+var client = http.Client{Timeout: 30 * time.Second}
+
+// Runs a SCEP operation with GET.
+func get(operation string) ([]byte, string, error) {
+
+	u := fmt.Sprintf("%s?operation=%s", options.URL, operation)
+
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: status %d: %s", operation,
+			resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return body, resp.Header.Get("Content-Type"), nil
+
+}
+
+// Sends a pkiMessage, POST if the server supports it.
+func pkiOperation(msg []byte, post bool) ([]byte, error) {
+
+	var resp *http.Response
+	var err error
+
+	if post {
+		resp, err = client.Post(options.URL+"?operation=PKIOperation",
+			"application/x-pki-message", bytes.NewReader(msg))
+	} else {
+		resp, err = client.Get(fmt.Sprintf(
+			"%s?operation=PKIOperation&message=%s", options.URL,
+			url.QueryEscape(base64.StdEncoding.EncodeToString(msg))))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("PKIOperation: status %d: %s",
+			resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+
+}
+
+// Self-signed certificate to sign a PKCSReq with, RFC 8894 section
+// 2.3.
+func selfSigned(csr *x509.CertificateRequest, key crypto.Signer) (*x509.Certificate, error) {
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		RawSubject:   csr.RawSubject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(raw)
+
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	key, err := cert_tools.ReadKeyFromFile(options.KeyFile)
+	if err != nil {
+		log.Fatalf("failed to read key file: %s", err)
+	}
+
+	csr, err := cert_tools.ReadCSRFromFile(options.CsrFile)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(csr.PublicKey) {
+		log.Fatalf("key doesn't match the certificate request")
+	}
+
+	// Server capabilities decide the algorithms.
+	raw, _, err := get("GetCACaps")
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	caps := map[string]bool{}
+	for _, c := range strings.Fields(string(raw)) {
+		caps[strings.ToUpper(c)] = true
+	}
+
+	hash := crypto.SHA1
+	if caps["SHA-512"] {
+		hash = crypto.SHA512
+	} else if caps["SHA-256"] || caps["SCEPSTANDARD"] {
+		hash = crypto.SHA256
+	}
+
+	var alg asn1.ObjectIdentifier
+	if caps["AES"] || caps["SCEPSTANDARD"] {
+		alg = cert_tools.OidAES128CBC
+	} else if caps["DES3"] {
+		alg = cert_tools.OidDESEDE3CBC
+	} else {
+		log.Fatalf("server supports neither AES nor DES3")
+	}
+
+	post := caps["POSTPKIOPERATION"] || caps["SCEPSTANDARD"]
+
+	// The CA cert, or an RA cert and the CA cert.
+	raw, contentType, err := get("GetCACert")
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	var certs []*x509.Certificate
+	if strings.HasPrefix(contentType, "application/x-x509-ca-ra-cert") {
+		certs, err = cert_tools.ParseCertsOnly(raw)
+	} else {
+		certs, err = x509.ParseCertificates(raw)
+	}
+	if err != nil || len(certs) == 0 {
+		log.Fatalf("failed to parse CA certs: %v", err)
+	}
+
+	// Requests are encrypted to the RA if there is one.
+	var ca, recipient *x509.Certificate
+	for _, c := range certs {
+		if c.IsCA && ca == nil {
+			ca = c
+		} else if !c.IsCA && recipient == nil {
+			recipient = c
+		}
+	}
+	if ca == nil {
+		ca = certs[0]
+	}
+	if recipient == nil {
+		recipient = ca
+	}
+
+	fingerprint := sha256.Sum256(ca.Raw)
+	if options.CaFile != "" {
+		expected, err := cert_tools.ReadCertificateFromFile(
+			options.CaFile)
+		if err != nil {
+			log.Fatalf("failed to read CA cert: %s", err)
+		}
+		if !ca.Equal(expected) {
+			log.Fatalf("server's CA cert doesn't match %s",
+				options.CaFile)
+		}
+	} else {
+		log.Printf("CA %s, SHA-256 fingerprint %s", ca.Subject,
+			hex.EncodeToString(fingerprint[:]))
+	}
+
+	// PKCSReq is signed with a self-signed cert, RenewalReq with the
+	// cert being renewed.
+	msgType := cert_tools.SCEPPKCSReq
+	signerKey := key.Signer()
+	var signer *x509.Certificate
+
+	if options.SignerCert != "" {
+		msgType = cert_tools.SCEPRenewalReq
+		signer, err = cert_tools.ReadCertificateFromFile(
+			options.SignerCert)
+		if err != nil {
+			log.Fatalf("failed to read signer certificate: %s", err)
+		}
+		if options.SignerKey != "" {
+			k, err := cert_tools.ReadKeyFromFile(options.SignerKey)
+			if err != nil {
+				log.Fatalf("failed to read signer key: %s", err)
+			}
+			signerKey = k.Signer()
+		}
+	} else {
+		signer, err = selfSigned(csr, signerKey)
+		if err != nil {
+			log.Fatalf("failed to create signer certificate: %s",
+				err)
+		}
+	}
+
+	// The reply is encrypted to the signer.
+	if _, ok := signerKey.Public().(*rsa.PublicKey); !ok {
+		log.Fatalf("SCEP needs an RSA key")
+	}
+
+	env, err := cert_tools.Envelope(csr.Raw, recipient, alg)
+	if err != nil {
+		log.Fatalf("failed to encrypt request: %s", err)
+	}
+
+	// Transaction ID is a hash of the public key.
+	spki := sha256.Sum256(csr.RawSubjectPublicKeyInfo)
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	req := &cert_tools.SCEPMessage{
+		MessageType:   msgType,
+		TransactionID: strings.ToUpper(hex.EncodeToString(spki[:])),
+		SenderNonce:   nonce,
+		Envelope:      env,
+	}
+
+	msg, err := req.Marshal(signer, signerKey, hash)
+	if err != nil {
+		log.Fatalf("failed to sign request: %s", err)
+	}
+
+	raw, err = pkiOperation(msg, post)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	rep, err := cert_tools.ParseSCEPMessage(raw, certs)
+	if err != nil {
+		log.Fatalf("failed to parse reply: %s", err)
+	}
+
+	signedByServer := false
+	for _, c := range certs {
+		if c.Equal(rep.Signer) {
+			signedByServer = true
+		}
+	}
+	if !signedByServer {
+		log.Fatalf("reply isn't signed by the CA or RA")
+	}
+	if rep.MessageType != cert_tools.SCEPCertRep ||
+		rep.TransactionID != req.TransactionID ||
+		!bytes.Equal(rep.RecipientNonce, nonce) {
+		log.Fatalf("reply doesn't match the request")
+	}
+
+	switch rep.PKIStatus {
+	case cert_tools.SCEPSuccess:
+	case cert_tools.SCEPPending:
+		log.Fatalf("request is pending, polling isn't supported")
+	default:
+		log.Fatalf("request failed: %s",
+			cert_tools.SCEPFailInfoName(rep.FailInfo))
+	}
+
+	p7, _, err := cert_tools.OpenEnvelope(rep.Envelope, signer,
+		signerKey.(crypto.Decrypter))
+	if err != nil {
+		log.Fatalf("failed to decrypt reply: %s", err)
+	}
+
+	issued, err := cert_tools.ParseCertsOnly(p7)
+	if err != nil || len(issued) == 0 {
+		log.Fatalf("failed to parse issued certificate: %v", err)
+	}
+
+	// Write cert in PEM format.
+	cert_tools.OutputPem(os.Stdout, issued[0].Raw, "CERTIFICATE")
+
+	os.Exit(0)
+
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var options struct {
+	Validity int64  `short:"v" long:"validity" description:"Certificate validity period (days)" default:"365"`
+
+	KeyFile  string `short:"k" long:"key" description:"CA private key, PEM format, or a pkcs11:, plugin:, unix: or shares: key" required:"true"`
+	CaFile   string `short:"c" long:"ca-certificate" description:"CA cert file, PEM format" required:"true"`
+
+	RaKeyFile  string `long:"ra-key" description:"RA private key, RSA, PEM format, default is the CA key"`
+	RaCertFile string `long:"ra-certificate" description:"RA cert file, PEM format"`
+
+	Profiles []string `short:"p" long:"profile" description:"Certificate profile for issued certificates" default:"device"`
+
+	CrlUri   []string `short:"d" long:"crl-distribution" description:"CRL Distribution URI" required:"false"`
+	CaUri    []string `short:"i" long:"ca-issuers-distribution" description:"CA Issuer Chain (p7c)" required:"false"`
+
+	SignatureAlgorithm string `short:"g" long:"signature-algorithm" description:"Signature algorithm e.g. ECDSA-SHA384, SHA256-RSAPSS, default follows the CA key type"`
+
+	Challenges string `short:"P" long:"challenge-passwords" description:"File of challenge passwords, one per line, read on each request"`
+	OneTime    bool   `long:"one-time" description:"Each challenge password can be used once, used ones are kept in the challenge passwords file with .used added"`
+
+	Listen   string `short:"l" long:"listen" description:"Address to listen on" default:":8080"`
+	TLSCert  string `long:"tls-certificate" description:"Server TLS certificate, PEM format, default is plain HTTP"`
+	TLSKey   string `long:"tls-key" description:"Server TLS private key, PEM format"`
+
+	OutputDir string `short:"o" long:"output-directory" description:"Directory to write issued certificates to"`
+	AuditLog  string `long:"audit-log" env:"CERT_TOOLS_AUDIT_LOG" description:"Hash-chained audit log to append to"`
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	// Key is EC, RSA or PKCS #8.
+	issuer, err := cert_tools.ReadIssuer(options.KeyFile, options.CaFile)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	profiles, err := cert_tools.GetProfiles(options.Profiles)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	// Fail now rather than on the first request.
+	_, err = cert_tools.SignatureAlgorithm(issuer.Key.Public(),
+		options.SignatureAlgorithm)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	s := &server{
+		issuer: issuer,
+		opts: cert_tools.IssueOptions{
+			Validity: time.Duration(options.Validity*24) *
+				time.Hour,
+			Profiles:           profiles,
+			SignatureAlgorithm: options.SignatureAlgorithm,
+			CrlUri:             options.CrlUri,
+			CaUri:              options.CaUri,
+		},
+		raCert: issuer.Cert,
+		raKey:  issuer.Key,
+		challenges: &challenges{
+			file:    options.Challenges,
+			oneTime: options.OneTime,
+		},
+	}
+
+	// SCEP messages are encrypted to the RA, or the CA if there isn't
+	// one.
+	if options.RaKeyFile != "" || options.RaCertFile != "" {
+		ra, err := cert_tools.ReadIssuer(options.RaKeyFile,
+			options.RaCertFile)
+		if err != nil {
+			log.Fatalf("failed to read RA: %s", err)
+		}
+		s.raCert, s.raKey, s.ra = ra.Cert, ra.Key, true
+	}
+
+	if _, ok := s.raKey.Public().(*rsa.PublicKey); !ok {
+		log.Fatalf("SCEP needs an RSA key to decrypt requests, use " +
+			"--ra-key and --ra-certificate")
+	}
+	// Token and plugin keys only sign.
+	decrypter, ok := s.raKey.(crypto.Decrypter)
+	if !ok {
+		log.Fatalf("the key can't decrypt SCEP requests, use " +
+			"--ra-key and --ra-certificate")
+	}
+	s.decrypter = decrypter
+
+	if options.Challenges == "" {
+		log.Printf("no challenge passwords, only renewals are accepted")
+	}
+
+	srv := &http.Server{
+		Addr:              options.Listen,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("SCEP server listening on %s", options.Listen)
+
+	if options.TLSCert != "" {
+		err = srv.ListenAndServeTLS(options.TLSCert, options.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	log.Fatalf("%s", err)
+
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Capabilities returned by GetCACaps, RFC 8894 section 3.5.2.
+var caps = []string{
+	"AES", "DES3", "POSTPKIOperation", "Renewal", "SCEPStandard",
+	"SHA-1", "SHA-256", "SHA-512",
+}
+
+type server struct {
+	issuer *cert_tools.Issuer
+	opts   cert_tools.IssueOptions
+
+	// Requests are encrypted to, and replies signed by, the RA or the
+	// CA.
+	raCert    *x509.Certificate
+	raKey     crypto.Signer
+	decrypter crypto.Decrypter
+	ra        bool
+
+	challenges *challenges
+}
+
+// Challenge passwords for PKCSReq.  The file is read on each request so
+// an MDM can add passwords without a restart.
+type challenges struct {
+	file    string
+	oneTime bool
+
+	// Serialises checks so a one-time password can't be used twice at
+	// once.
+	mutex sync.Mutex
+}
+
+// One-time passwords which have been used are kept in a file next to the
+// challenges file, as SHA-256 hex, so they stay used across restarts.
+func (c *challenges) usedFile() string {
+	return c.file + ".used"
+}
+
+func (c *challenges) isUsed(password string) (bool, error) {
+
+	f, err := os.Open(c.usedFile())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sum := sha256.Sum256([]byte(password))
+	want := hex.EncodeToString(sum[:])
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == want {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+
+}
+
+func (c *challenges) markUsed(password string) error {
+
+	f, err := os.OpenFile(c.usedFile(),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	_, err = fmt.Fprintf(f, "%x\n", sum)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record used challenge password: %s",
+			err)
+	}
+
+	return nil
+
+}
+
+func (c *challenges) check(password string) error {
+
+	if c.file == "" {
+		return fmt.Errorf("enrollment needs a challenge password, " +
+			"none are configured")
+	}
+	if password == "" {
+		return fmt.Errorf("request has no challenge password")
+	}
+
+	f, err := os.Open(c.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(line),
+			[]byte(password)) != 1 {
+			continue
+		}
+		if c.oneTime {
+			used, err := c.isUsed(password)
+			if err != nil {
+				return err
+			}
+			if used {
+				return fmt.Errorf("challenge password has " +
+					"already been used")
+			}
+			return c.markUsed(password)
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("challenge password is wrong")
+
+}
+
+// SCEP uses a single URL with the operation in the query string, so any
+// path is accepted.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	switch op := r.URL.Query().Get("operation"); op {
+	case "GetCACaps":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s\n", strings.Join(caps, "\n"))
+	case "GetCACert":
+		s.getCACert(w, r)
+	case "PKIOperation":
+		s.pkiOperation(w, r)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported operation %q", op),
+			http.StatusBadRequest)
+	}
+
+}
+
+// RFC 8894 section 4.2.  With an RA the reply is a certs-only PKCS #7
+// holding the RA and CA certs, otherwise it's the DER CA cert.
+func (s *server) getCACert(w http.ResponseWriter, r *http.Request) {
+
+	if !s.ra {
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Write(s.issuer.Cert.Raw)
+		return
+	}
+
+	p7, err := cert_tools.CertsOnly([]*x509.Certificate{
+		s.raCert, s.issuer.Cert,
+	})
+	if err != nil {
+		http.Error(w, "failed to encode CA certs",
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+	w.Write(p7)
+
+}
+
+// RFC 8894 section 4.3, the message is POSTed as DER or sent base64 in
+// the query string.
+func (s *server) pkiOperation(w http.ResponseWriter, r *http.Request) {
+
+	var der []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodPost:
+		der, err = io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	case http.MethodGet:
+		// '+' becomes a space if the client didn't escape it.
+		msg := strings.ReplaceAll(r.URL.Query().Get("message"), " ",
+			"+")
+		der, err = base64.StdEncoding.DecodeString(msg)
+	default:
+		http.Error(w, "GET or POST required",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to read message", http.StatusBadRequest)
+		return
+	}
+
+	// Nothing can be signed back without a verified request.
+	req, err := cert_tools.ParseSCEPMessage(der, nil)
+	if err != nil {
+		log.Printf("bad SCEP message: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	rep := &cert_tools.SCEPMessage{
+		MessageType:    cert_tools.SCEPCertRep,
+		TransactionID:  req.TransactionID,
+		SenderNonce:    nonce,
+		RecipientNonce: req.SenderNonce,
+		PKIStatus:      cert_tools.SCEPSuccess,
+	}
+
+	switch req.MessageType {
+	case cert_tools.SCEPPKCSReq, cert_tools.SCEPRenewalReq:
+		env, failInfo, err := s.enroll(req)
+		if err != nil {
+			log.Printf("%s: %s", req.TransactionID, err)
+			rep.PKIStatus = cert_tools.SCEPFailure
+			rep.FailInfo = failInfo
+		}
+		rep.Envelope = env
+	default:
+		log.Printf("%s: unsupported message type %s",
+			req.TransactionID, req.MessageType)
+		rep.PKIStatus = cert_tools.SCEPFailure
+		rep.FailInfo = cert_tools.SCEPBadRequest
+	}
+
+	raw, err := rep.Marshal(s.raCert, s.raKey, req.Hash)
+	if err != nil {
+		log.Printf("%s: failed to sign reply: %s", req.TransactionID,
+			err)
+		http.Error(w, "failed to sign reply",
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pki-message")
+	w.Write(raw)
+
+}
+
+// Handles PKCSReq and RenewalReq.  Returns the reply's pkcsPKIEnvelope,
+// or the failInfo and an error.
+func (s *server) enroll(req *cert_tools.SCEPMessage) ([]byte, string, error) {
+
+	der, alg, err := cert_tools.OpenEnvelope(req.Envelope, s.raCert,
+		s.decrypter)
+	if err != nil {
+		return nil, cert_tools.SCEPBadMessageCheck, err
+	}
+
+	csr, err := cert_tools.ParseCSR(der)
+	if err != nil {
+		return nil, cert_tools.SCEPBadRequest, err
+	}
+
+	if req.MessageType == cert_tools.SCEPPKCSReq {
+
+		password, err := cert_tools.ChallengePassword(csr)
+		if err != nil {
+			return nil, cert_tools.SCEPBadRequest, err
+		}
+		if err := s.challenges.check(password); err != nil {
+			return nil, cert_tools.SCEPBadRequest, err
+		}
+
+	} else {
+
+		// Renewals are signed by the certificate being renewed, and
+		// keep its subject and SANs.
+		roots := x509.NewCertPool()
+		roots.AddCert(s.issuer.Cert)
+		_, err := req.Signer.Verify(x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return nil, cert_tools.SCEPBadCertId,
+				fmt.Errorf("renewal isn't signed by a valid "+
+					"certificate: %s", err)
+		}
+		if string(req.Signer.RawSubject) != string(csr.RawSubject) {
+			return nil, cert_tools.SCEPBadRequest,
+				fmt.Errorf("renewal subject %s doesn't match %s",
+					csr.Subject, req.Signer.Subject)
+		}
+		same, err := cert_tools.SameSANs(req.Signer.Extensions,
+			csr.Extensions)
+		if err != nil {
+			return nil, cert_tools.SCEPBadRequest,
+				fmt.Errorf("failed to parse SANs: %s", err)
+		}
+		if !same {
+			return nil, cert_tools.SCEPBadRequest,
+				fmt.Errorf("renewal SANs don't match the " +
+					"certificate being renewed")
+		}
+
+	}
+
+	issued, err := s.issuer.Issue(csr, s.opts)
+	if issued != nil {
+		for _, res := range issued.Extensions {
+			if res.Decision != cert_tools.ExtensionAccepted {
+				log.Printf("%s: requested extension %s",
+					req.TransactionID, res)
+			}
+		}
+	}
+
+	// Nothing is returned unless it's audited.
+	op, done := "enroll", "enrolled"
+	if req.MessageType == cert_tools.SCEPRenewalReq {
+		op, done = "renew", "renewed"
+	}
+	aerr := cert_tools.AuditIssue(options.AuditLog, cert_tools.AuditRecord{
+		Operation: "scep-server " + op,
+		Requester: req.TransactionID,
+		Profiles:  options.Profiles,
+	}, s.issuer.Cert, csr, issued, err)
+	if aerr != nil {
+		return nil, cert_tools.SCEPBadRequest, aerr
+	}
+	if err != nil {
+		return nil, cert_tools.SCEPBadRequest, err
+	}
+
+	log.Printf("%s: %s %X %s", req.TransactionID, done,
+		issued.Certificate.SerialNumber, issued.Certificate.Subject)
+
+	if options.OutputDir != "" {
+		file := filepath.Join(options.OutputDir,
+			fmt.Sprintf("%X.pem", issued.Certificate.SerialNumber))
+		err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: issued.Raw}), 0644)
+		if err != nil {
+			log.Printf("failed to write %s: %s", file, err)
+		}
+	}
+
+	p7, err := cert_tools.CertsOnly([]*x509.Certificate{
+		issued.Certificate,
+	})
+	if err != nil {
+		return nil, cert_tools.SCEPBadRequest, err
+	}
+
+	// Encrypted to the request's signer, with the cipher it used.
+	env, err := cert_tools.Envelope(p7, req.Signer, alg)
+	if err != nil {
+		return nil, cert_tools.SCEPBadAlg, err
+	}
+
+	return env, "", nil
+
+}
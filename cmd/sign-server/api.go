@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type server struct {
+	issuer *cert_tools.Issuer
+
+	// CA cert and any further chain, returned with issued certs.
+	chain []*x509.Certificate
+
+	// Client CN to permissions: profile names, "revoke" and "*".
+	clients map[string]map[string]bool
+
+	// Serialises revocation list updates and the CRL cache.
+	mutex sync.Mutex
+
+	// Last CRL made, the revocation list it was made from and when it
+	// should be remade even if the list hasn't changed.
+	crlDER    []byte
+	crlSource []byte
+	crlRenew  time.Time
+}
+
+type signRequest struct {
+	CSR     string `json:"csr"`
+	Profile string `json:"profile"`
+}
+
+type signResponse struct {
+	Serial      string   `json:"serial"`
+	Certificate string   `json:"certificate"`
+	Chain       string   `json:"chain"`
+	Extensions  []string `json:"extensions,omitempty"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+type revokeRequest struct {
+	Serial string `json:"serial"`
+}
+
+type certInfo struct {
+	Serial      string    `json:"serial"`
+	Subject     string    `json:"subject"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	Emails      []string  `json:"emails,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	URIs        []string  `json:"uris,omitempty"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Revoked     bool      `json:"revoked"`
+}
+
+// Reads the clients file, each line is a client certificate CN followed
+// by what it may do.
+func readClients(file string) (map[string]map[string]bool, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	clients := map[string]map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		perms := map[string]bool{}
+		for _, p := range fields[1:] {
+			if p != "*" && p != "revoke" {
+				if _, err := cert_tools.GetProfile(p); err != nil {
+					return nil, fmt.Errorf("client %s: %s",
+						fields[0], err)
+				}
+			}
+			perms[p] = true
+		}
+		clients[fields[0]] = perms
+	}
+
+	return clients, scanner.Err()
+
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sign", s.sign)
+	mux.HandleFunc("/v1/revoke", s.revoke)
+	mux.HandleFunc("/v1/crl", s.crl)
+	mux.HandleFunc("/v1/certs", s.list)
+	return mux
+}
+
+// Writes an audit record to the hash-chained audit log, or stderr if
+// there isn't one.
+func (s *server) record(rec cert_tools.AuditRecord, err error) error {
+
+	rec.Operation = "sign-server " + rec.Operation
+	rec.SetCA(s.issuer.Cert)
+	rec.SetResult(err)
+
+	if options.AuditLog == "" {
+		raw, _ := json.Marshal(rec)
+		log.Printf("%s", raw)
+		return nil
+	}
+
+	if err := cert_tools.AppendAudit(options.AuditLog, &rec); err != nil {
+		log.Printf("failed to write audit log: %s", err)
+		return err
+	}
+
+	return nil
+
+}
+
+// The client's CN and permissions.  Requests without a client
+// certificate from a known client are refused.
+func (s *server) client(w http.ResponseWriter, r *http.Request) (string, map[string]bool, bool) {
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "client certificate required",
+			http.StatusUnauthorized)
+		return "", nil, false
+	}
+
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	perms, ok := s.clients[name]
+	if !ok {
+		s.record(cert_tools.AuditRecord{Requester: name,
+			Operation: "connect"},
+			fmt.Errorf("unknown client"))
+		http.Error(w, "unknown client", http.StatusForbidden)
+		return "", nil, false
+	}
+
+	return name, perms, true
+
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func pemCerts(certs []*x509.Certificate) string {
+	b := strings.Builder{}
+	for _, c := range certs {
+		pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return b.String()
+}
+
+// POST /v1/sign takes a JSON signRequest, or a PEM CSR with the profile
+// in the query string.  The reply is JSON, or PEM if asked for.
+func (s *server) sign(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, perms, ok := s.client(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	req := signRequest{Profile: r.URL.Query().Get("profile")}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.CSR = string(body)
+	}
+
+	rec := cert_tools.AuditRecord{Requester: client, Operation: "sign",
+		Profiles: []string{req.Profile}}
+
+	fail := func(status int, err error) {
+		s.record(rec, err)
+		http.Error(w, err.Error(), status)
+	}
+
+	if req.Profile == "" {
+		fail(http.StatusBadRequest, fmt.Errorf("no profile given"))
+		return
+	}
+	if !perms[req.Profile] && !perms["*"] {
+		fail(http.StatusForbidden, fmt.Errorf("profile %s isn't "+
+			"allowed for %s", req.Profile, client))
+		return
+	}
+	profile, err := cert_tools.GetProfile(req.Profile)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil {
+		fail(http.StatusBadRequest, fmt.Errorf("no PEM CSR"))
+		return
+	}
+	csr, err := cert_tools.ParseCSR(block.Bytes)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	rec.Subject = csr.Subject.String()
+
+	// Clients are known by CN, so no one gets a certificate which would
+	// let them act as a client.
+	if s.isClient(csr.Subject.CommonName) {
+		fail(http.StatusForbidden, fmt.Errorf("%s is the name of a "+
+			"client", csr.Subject.CommonName))
+		return
+	}
+
+	issued, err := s.issuer.Issue(csr, cert_tools.IssueOptions{
+		Validity: time.Duration(options.Validity*24) *
+			time.Hour,
+		Profiles:           []*cert_tools.Profile{profile},
+		SignatureAlgorithm: options.SignatureAlgorithm,
+		CrlUri:             options.CrlUri,
+		CaUri:              options.CaUri,
+	})
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	serial := fmt.Sprintf("%X", issued.Certificate.SerialNumber)
+	rec.SetCertificate(issued.Certificate)
+
+	file := filepath.Join(options.OutputDir, serial+".pem")
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: issued.Raw}), 0644)
+	if err != nil {
+		fail(http.StatusInternalServerError,
+			fmt.Errorf("failed to store certificate: %s", err))
+		return
+	}
+
+	// An issued certificate which isn't audited isn't handed out or
+	// kept.
+	if err := s.record(rec, nil); err != nil {
+		if err := os.Remove(file); err != nil {
+			log.Printf("%s", err)
+		}
+		http.Error(w, "failed to write audit log",
+			http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/x-pem-file") {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		fmt.Fprint(w, pemCerts(append([]*x509.Certificate{
+			issued.Certificate}, s.chain...)))
+		return
+	}
+
+	resp := signResponse{
+		Serial:      serial,
+		Certificate: pemCerts([]*x509.Certificate{issued.Certificate}),
+		Chain:       pemCerts(s.chain),
+		Warnings:    issued.Warnings,
+	}
+	for _, e := range issued.Extensions {
+		if e.Decision != cert_tools.ExtensionAccepted {
+			resp.Extensions = append(resp.Extensions, e.String())
+		}
+	}
+
+	writeJSON(w, resp)
+
+}
+
+// POST /v1/revoke adds an issued certificate to the revocation list.
+func (s *server) revoke(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, perms, ok := s.client(w, r)
+	if !ok {
+		return
+	}
+
+	var req revokeRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<12)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	rec := cert_tools.AuditRecord{Requester: client, Operation: "revoke",
+		Serial: req.Serial}
+
+	fail := func(status int, err error) {
+		s.record(rec, err)
+		http.Error(w, err.Error(), status)
+	}
+
+	if !perms["revoke"] {
+		fail(http.StatusForbidden, fmt.Errorf("%s may not revoke",
+			client))
+		return
+	}
+
+	serial, ok := new(big.Int).SetString(req.Serial, 16)
+	if !ok {
+		fail(http.StatusBadRequest, fmt.Errorf("invalid serial"))
+		return
+	}
+
+	cert, err := cert_tools.ReadCertificateFromFile(filepath.Join(
+		options.OutputDir, fmt.Sprintf("%X.pem", serial)))
+	if err != nil {
+		fail(http.StatusNotFound, fmt.Errorf("certificate %X wasn't "+
+			"issued here", serial))
+		return
+	}
+	rec.Serial = fmt.Sprintf("%X", serial)
+	rec.Subject = cert.Subject.String()
+
+	s.mutex.Lock()
+	revoked, err := s.revoked()
+	if err == nil && revoked[rec.Serial] {
+		err = fmt.Errorf("certificate %s is already revoked", rec.Serial)
+	} else if err == nil {
+		err = cert_tools.AppendRevoked(options.RevFile, serial,
+			time.Now())
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		fail(http.StatusConflict, err)
+		return
+	}
+
+	s.record(rec, nil)
+
+	writeJSON(w, map[string]string{"serial": rec.Serial,
+		"status": "revoked"})
+
+}
+
+// Serials in the revocation list, in upper case hex.
+func (s *server) revoked() (map[string]bool, error) {
+
+	list, err := cert_tools.ReadRevoked(options.RevFile)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := map[string]bool{}
+	for _, r := range list {
+		revoked[fmt.Sprintf("%X", r.SerialNumber)] = true
+	}
+
+	return revoked, nil
+
+}
+
+// True if a CN names a client in the clients file.
+func (s *server) isClient(cn string) bool {
+	for name := range s.clients {
+		if strings.EqualFold(name, cn) {
+			return true
+		}
+	}
+	return false
+}
+
+// The CRL for the revocation list.  Anyone can ask for it, so it's only
+// signed again when the list changes or it's half way to its next
+// update.
+func (s *server) currentCRL() ([]byte, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	source, err := os.ReadFile(options.RevFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revoked file: %s", err)
+	}
+
+	if s.crlDER != nil && bytes.Equal(source, s.crlSource) &&
+		time.Now().Before(s.crlRenew) {
+		return s.crlDER, nil
+	}
+
+	revoked, err := cert_tools.ReadRevoked(options.RevFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revoked file: %s", err)
+	}
+
+	validity := time.Duration(options.CrlValidity*24) * time.Hour
+	crl, err := s.issuer.CreateCRL(revoked, validity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CRL: %s", err)
+	}
+
+	s.crlDER, s.crlSource = crl, source
+	s.crlRenew = time.Now().Add(validity / 2)
+
+	return crl, nil
+
+}
+
+// GET /v1/crl returns a CRL made from the revocation list as create-crl
+// does, PEM unless ?format=der.  It needs no client certificate.
+func (s *server) crl(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	crl, err := s.currentCRL()
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, "failed to generate CRL",
+			http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "der" {
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(crl)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "X509 CRL", Bytes: crl})
+
+}
+
+// GET /v1/certs lists issued certificates, optionally filtered like
+// find-cert by ?email= and ?subject= substring.
+func (s *server) list(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, _, ok := s.client(w, r)
+	if !ok {
+		return
+	}
+
+	email := r.URL.Query().Get("email")
+	subject := r.URL.Query().Get("subject")
+
+	rec := cert_tools.AuditRecord{Requester: client, Operation: "list"}
+
+	revoked, err := s.revoked()
+	if err != nil {
+		s.record(rec, err)
+		http.Error(w, "failed to read revocation list",
+			http.StatusInternalServerError)
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(options.OutputDir, "*.pem"))
+	if err != nil {
+		s.record(rec, err)
+		http.Error(w, "failed to list certificates",
+			http.StatusInternalServerError)
+		return
+	}
+
+	certs := []certInfo{}
+	for _, file := range files {
+
+		cert, err := cert_tools.ReadCertificateFromFile(file)
+		if err != nil {
+			log.Printf("%s: %s", file, err)
+			continue
+		}
+
+		if email != "" && !contains(cert.EmailAddresses, email) {
+			continue
+		}
+		if subject != "" &&
+			!strings.Contains(cert.Subject.String(), subject) {
+			continue
+		}
+
+		info := certInfo{
+			Serial:    fmt.Sprintf("%X", cert.SerialNumber),
+			Subject:   cert.Subject.String(),
+			DNSNames:  cert.DNSNames,
+			Emails:    cert.EmailAddresses,
+			NotBefore: cert.NotBefore.UTC(),
+			NotAfter:  cert.NotAfter.UTC(),
+		}
+		for _, ip := range cert.IPAddresses {
+			info.IPAddresses = append(info.IPAddresses, ip.String())
+		}
+		for _, u := range cert.URIs {
+			info.URIs = append(info.URIs, u.String())
+		}
+		info.Revoked = revoked[info.Serial]
+
+		certs = append(certs, info)
+
+	}
+
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].NotBefore.Before(certs[j].NotBefore)
+	})
+
+	s.record(rec, nil)
+
+	writeJSON(w, certs)
+
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var options struct {
+	Validity int64  `short:"v" long:"validity" description:"Certificate validity period (days)" default:"365"`
+
+	KeyFile  string `short:"k" long:"key" description:"CA private key, PEM format, or a pkcs11:, plugin:, unix: or shares: key" required:"true"`
+	CaFile   string `short:"c" long:"ca-certificate" description:"CA cert file, PEM format" required:"true"`
+	Chain    string `short:"C" long:"chain" description:"Further CA certs to return with issued certs, PEM format"`
+
+	CrlUri   []string `short:"d" long:"crl-distribution" description:"CRL Distribution URI" required:"false"`
+	CaUri    []string `short:"i" long:"ca-issuers-distribution" description:"CA Issuer Chain (p7c)" required:"false"`
+
+	SignatureAlgorithm string `short:"g" long:"signature-algorithm" description:"Signature algorithm e.g. ECDSA-SHA384, SHA256-RSAPSS, default follows the CA key type"`
+
+	OutputDir   string `short:"o" long:"output-directory" description:"Directory issued certificates are kept in" required:"true"`
+	RevFile     string `short:"r" long:"revoked" description:"List of revoked certificates, form is SERIAL,TIME" required:"true"`
+	CrlValidity int64  `long:"crl-validity" description:"CRL validity period (days)" default:"100"`
+
+	Clients  string `short:"a" long:"clients" description:"Client permissions, CLIENT-CN followed by profile names, revoke or * per line" required:"true"`
+	AuditLog string `short:"L" long:"audit-log" env:"CERT_TOOLS_AUDIT_LOG" description:"Hash-chained audit log to append to, default is stderr"`
+
+	Listen    string `short:"l" long:"listen" description:"Address to listen on" default:":8443"`
+	TLSCert   string `long:"tls-certificate" description:"Server TLS certificate, PEM format" required:"true"`
+	TLSKey    string `long:"tls-key" description:"Server TLS private key, PEM format" required:"true"`
+	ClientCAs string `long:"client-ca" description:"CA certs trusted for TLS client authentication, PEM format, not the signing CA" required:"true"`
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	// Key is EC, RSA or PKCS #8.
+	issuer, err := cert_tools.ReadIssuer(options.KeyFile, options.CaFile)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	// Fail now rather than on the first request.
+	_, err = cert_tools.SignatureAlgorithm(issuer.Key.Public(),
+		options.SignatureAlgorithm)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	chain := []*x509.Certificate{issuer.Cert}
+	if options.Chain != "" {
+		extra, err := cert_tools.ReadCertificatesFromFile(options.Chain)
+		if err != nil {
+			log.Fatalf("failed to read chain: %s", err)
+		}
+		chain = append(chain, extra...)
+	}
+
+	clients, err := readClients(options.Clients)
+	if err != nil {
+		log.Fatalf("failed to read clients: %s", err)
+	}
+
+	// The revocation list must be readable before anything is revoked.
+	if _, err := os.Stat(options.RevFile); os.IsNotExist(err) {
+		if err := os.WriteFile(options.RevFile, nil, 0644); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if _, err := cert_tools.ReadRevoked(options.RevFile); err != nil {
+		log.Fatalf("failed to read revoked file: %s", err)
+	}
+
+	s := &server{
+		issuer:  issuer,
+		chain:   chain,
+		clients: clients,
+	}
+
+	clientCAs := x509.NewCertPool()
+	certs, err := cert_tools.ReadCertificatesFromFile(options.ClientCAs)
+	if err != nil {
+		log.Fatalf("failed to read client CAs: %s", err)
+	}
+	for _, c := range certs {
+		clientCAs.AddCert(c)
+	}
+
+	// Clients are known by CN, and any client can get certificates from
+	// the signing CA, so they mustn't be trusted as client certificates.
+	_, err = issuer.Cert.Verify(x509.VerifyOptions{
+		Roots:     clientCAs,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err == nil {
+		log.Fatalf("client CAs must not include or issue the signing CA")
+	}
+
+	srv := &http.Server{
+		Addr:              options.Listen,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  clientCAs,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	log.Printf("sign server listening on %s", options.Listen)
+
+	err = srv.ListenAndServeTLS(options.TLSCert, options.TLSKey)
+	log.Fatalf("%s", err)
+
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"log"
+	"net"
+	"os"
+)
+
+// Reference signer plugin, holding a key from a file.  Run by the tools
+// as plugin:signer-plugin -k FILE it talks on stdin and stdout, with -l
+// it serves a Unix socket for unix:PATH.
+var options struct {
+	KeyFile string `short:"k" long:"key" description:"Private key, PEM format" required:"true"`
+	Listen  string `short:"l" long:"listen" description:"Unix socket to serve on, default is stdin and stdout"`
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	key, err := cert_tools.ReadKeyFromFile(options.KeyFile)
+	if err != nil {
+		log.Fatalf("failed to read key file: %s", err)
+	}
+
+	if options.Listen == "" {
+		err := cert_tools.ServePlugin(os.Stdin, os.Stdout, key.Signer())
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	}
+
+	// Only the owner can connect.
+	restrictSockets()
+
+	os.Remove(options.Listen)
+	l, err := net.Listen("unix", options.Listen)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	log.Printf("signer listening on %s", options.Listen)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		go func() {
+			defer conn.Close()
+			err := cert_tools.ServePlugin(conn, conn, key.Signer())
+			if err != nil {
+				log.Printf("%s", err)
+			}
+		}()
+	}
+
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// There's no umask, socket access is left to the directory it's in.
+func restrictSockets() {
+}
@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+)
+
+// Only the owner can connect to sockets created after this.
+func restrictSockets() {
+	syscall.Umask(0077)
+}
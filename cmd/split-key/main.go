@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"log"
+	"os"
+	"strings"
+)
+
+var options struct {
+	KeyFile     string `short:"k" long:"key" description:"Private key to split, PEM format" required:"true"`
+	Shares      int    `short:"n" long:"shares" description:"Number of shares" required:"true"`
+	Threshold   int    `short:"m" long:"threshold" description:"Number of shares needed to recover the key" required:"true"`
+	SharePrefix string `short:"o" long:"share-prefix" description:"Shares are written to PREFIX-N.share" default:"key"`
+}
+
+func main() {
+
+	// Parse flags.
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	// Read key file, EC, RSA or PKCS #8.
+	key, err := cert_tools.ReadKeyFromFile(options.KeyFile)
+	if err != nil {
+		log.Fatalf("failed to read key file: %s", err)
+	}
+
+	shares, err := key.Split(options.Shares, options.Threshold)
+	key.Zeroise()
+	if err != nil {
+		log.Fatalf("failed to split key: %s", err)
+	}
+
+	files, err := cert_tools.WriteShares(options.SharePrefix, shares)
+	if err != nil {
+		log.Fatalf("failed to write shares: %s", err)
+	}
+
+	// The key file is left for the user to destroy.
+	log.Printf("wrote %s, %d needed to recover the key",
+		strings.Join(files, ", "), options.Threshold)
+
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cybermaggedon/certificate-tools/pkg"
+	"github.com/jessevdk/go-flags"
+	"log"
+	"os"
+)
+
+var options struct {
+	AuditLog string `short:"f" long:"audit-log" description:"Audit log to check" required:"true"`
+	Head     string `short:"H" long:"head" description:"Expected hash of the last record, detects records removed from the end"`
+	Records  uint64 `short:"n" long:"records" description:"Expected minimum number of records"`
+}
+
+func main() {
+
+	// Parse flags
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	f, err := os.Open(options.AuditLog)
+	if err != nil {
+		log.Fatalf("failed to open audit log: %s", err)
+	}
+	defer f.Close()
+
+	sum, err := cert_tools.VerifyAudit(f)
+	if err != nil {
+		log.Fatalf("audit log is damaged: %s", err)
+	}
+
+	// The chain can't show records cut off the end, a head hash kept
+	// elsewhere can.
+	if options.Head != "" && sum.Head != options.Head {
+		log.Fatalf("audit log head is %s, expected %s", sum.Head,
+			options.Head)
+	}
+	if sum.Records < options.Records {
+		log.Fatalf("audit log has %d records, expected at least %d",
+			sum.Records, options.Records)
+	}
+
+	fmt.Printf("%d records, head %s\n", sum.Records, sum.Head)
+
+	os.Exit(0)
+
+}
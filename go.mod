@@ -5,4 +5,9 @@ go 1.21.4
 require (
 	github.com/google/uuid v1.4.0
 	github.com/jessevdk/go-flags v1.5.0
+	github.com/miekg/pkcs11 v1.1.1
+	golang.org/x/crypto v0.11.0
+	golang.org/x/sys v0.10.0
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
@@ -0,0 +1,285 @@
+package cert_tools
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"time"
+)
+
+// One CA operation in the audit log.  Records are JSON lines, each
+// carrying the hash of the one before, so editing, removing or reordering
+// records breaks the chain.
+type AuditRecord struct {
+	Seq       uint64   `json:"seq"`
+	Time      string   `json:"time"`
+	Operation string   `json:"operation"`
+	Operator  string   `json:"operator"`
+	Requester string   `json:"requester,omitempty"`
+	CA        string   `json:"ca,omitempty"`
+	CAKeyId   string   `json:"ca_key_id,omitempty"`
+	Serial    string   `json:"serial,omitempty"`
+	Subject   string   `json:"subject,omitempty"`
+	SANs      []string `json:"sans,omitempty"`
+	Profiles  []string `json:"profiles,omitempty"`
+	NotBefore string   `json:"not_before,omitempty"`
+	NotAfter  string   `json:"not_after,omitempty"`
+	Revoked   []string `json:"revoked,omitempty"`
+	Result    string   `json:"result"`
+	Error     string   `json:"error,omitempty"`
+	Prev      string   `json:"prev"`
+}
+
+const auditHashField = `,"hash":"`
+
+// Who is running the command, user@host.
+func Operator() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+// Records the CA which did the operation.
+func (r *AuditRecord) SetCA(ca *x509.Certificate) {
+	r.CA = ca.Subject.String()
+	r.CAKeyId = hex.EncodeToString(ca.SubjectKeyId)
+}
+
+// Records the certificate which was issued.
+func (r *AuditRecord) SetCertificate(cert *x509.Certificate) {
+	r.Serial = fmt.Sprintf("%X", cert.SerialNumber)
+	r.Subject = cert.Subject.String()
+	r.SANs = []string{}
+	for _, n := range cert.DNSNames {
+		r.SANs = append(r.SANs, "DNS:"+n)
+	}
+	for _, e := range cert.EmailAddresses {
+		r.SANs = append(r.SANs, "email:"+e)
+	}
+	for _, ip := range cert.IPAddresses {
+		r.SANs = append(r.SANs, "IP:"+ip.String())
+	}
+	for _, u := range cert.URIs {
+		r.SANs = append(r.SANs, "URI:"+u.String())
+	}
+	r.NotBefore = cert.NotBefore.UTC().Format(time.RFC3339)
+	r.NotAfter = cert.NotAfter.UTC().Format(time.RFC3339)
+}
+
+// Records the outcome.
+func (r *AuditRecord) SetResult(err error) {
+	r.Result = "success"
+	r.Error = ""
+	if err != nil {
+		r.Result = "failure"
+		r.Error = err.Error()
+	}
+}
+
+// Audits issuing a certificate for a request, whether it succeeded or
+// not.  The record gives the operation, requester and profiles, the rest
+// is filled in.  Nothing is written if there's no log file.
+func AuditIssue(file string, rec AuditRecord, ca *x509.Certificate,
+	csr *x509.CertificateRequest, issued *Issued, err error) error {
+
+	if file == "" {
+		return nil
+	}
+
+	rec.Subject = csr.Subject.String()
+	rec.SetCA(ca)
+	if issued != nil && issued.Certificate != nil {
+		rec.SetCertificate(issued.Certificate)
+	}
+	rec.SetResult(err)
+
+	if err := AppendAudit(file, &rec); err != nil {
+		return fmt.Errorf("failed to write audit log: %s", err)
+	}
+
+	return nil
+
+}
+
+// Encodes a record as a log line.  The hash is over the JSON without the
+// hash field, which is added last.
+func (r *AuditRecord) line() ([]byte, string, error) {
+
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:])
+
+	line := append(raw[:len(raw)-1:len(raw)-1], auditHashField...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+
+	return line, hash, nil
+
+}
+
+// Checks one log line, returning the record and its hash.
+func parseAuditLine(line []byte) (*AuditRecord, string, error) {
+
+	i := bytes.LastIndex(line, []byte(auditHashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte("\"}")) {
+		return nil, "", fmt.Errorf("record has no hash")
+	}
+	hash := string(line[i+len(auditHashField) : len(line)-2])
+
+	body := append(line[:i:i], '}')
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, "", fmt.Errorf("record hash doesn't match")
+	}
+
+	var rec AuditRecord
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rec); err != nil {
+		return nil, "", fmt.Errorf("failed to parse record: %s", err)
+	}
+
+	return &rec, hash, nil
+
+}
+
+// Appends a record to an audit log, filling in the sequence number,
+// time, operator and previous hash.  The file is locked so concurrent
+// commands chain correctly.
+func AppendAudit(file string, rec *AuditRecord) error {
+
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock audit log: %s", err)
+	}
+
+	last, err := lastLine(f)
+	if err != nil {
+		return err
+	}
+
+	rec.Seq = 1
+	rec.Prev = ""
+	if last != nil {
+		prev, hash, err := parseAuditLine(last)
+		if err != nil {
+			return fmt.Errorf("audit log is damaged, last %s", err)
+		}
+		rec.Seq = prev.Seq + 1
+		rec.Prev = hash
+	}
+	rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	rec.Operator = Operator()
+
+	line, _, err := rec.line()
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+
+	return f.Sync()
+
+}
+
+// The last line of a file without its newline, nil if the file is empty.
+func lastLine(f *os.File) ([]byte, error) {
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := []byte{}
+	pos := end
+	for pos > 0 {
+		n := int64(4096)
+		if pos < n {
+			n = pos
+		}
+		pos -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, pos); err != nil {
+			return nil, err
+		}
+		buf = append(chunk, buf...)
+		trimmed := bytes.TrimRight(buf, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+
+	trimmed := bytes.TrimRight(buf, "\n")
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	return trimmed, nil
+
+}
+
+// The result of checking an audit log.
+type AuditSummary struct {
+	Records uint64
+	Head    string
+}
+
+// Checks every record's hash, that each refers to the one before and
+// that sequence numbers have no gaps.  Returns the number of records and
+// the hash of the last.
+func VerifyAudit(r io.Reader) (*AuditSummary, error) {
+
+	sum := &AuditSummary{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+
+		rec, hash, err := parseAuditLine(scanner.Bytes())
+		if err != nil {
+			return sum, fmt.Errorf("line %d: %s", sum.Records+1, err)
+		}
+
+		if rec.Seq != sum.Records+1 {
+			return sum, fmt.Errorf("line %d: sequence number is %d, "+
+				"expected %d", sum.Records+1, rec.Seq,
+				sum.Records+1)
+		}
+		if rec.Prev != sum.Head {
+			return sum, fmt.Errorf("line %d: previous hash doesn't "+
+				"match, records are missing or reordered",
+				sum.Records+1)
+		}
+
+		sum.Records++
+		sum.Head = hash
+
+	}
+
+	return sum, scanner.Err()
+
+}
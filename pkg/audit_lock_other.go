@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package cert_tools
+
+import (
+	"os"
+)
+
+// There's no file locking, so concurrent commands can break the chain.
+func lockFile(f *os.File) error {
+	return nil
+}
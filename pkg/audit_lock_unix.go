@@ -0,0 +1,13 @@
+//go:build unix
+
+package cert_tools
+
+import (
+	"os"
+	"syscall"
+)
+
+// Locks a file until it's closed.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package cert_tools
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Locks a file until it's closed.
+func lockFile(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{})
+}
@@ -0,0 +1,300 @@
+package cert_tools
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v3"
+)
+
+// Options of commands which read a config file.  Embed in the command's
+// options struct.
+type ConfigOptions struct {
+	ConfigFile  string `long:"config" env:"CERT_TOOLS_CONFIG" description:"Config file of default settings, options given here override it" no-ini:"true"`
+	PrintConfig bool   `long:"print-config" description:"Print the effective settings in config file form and exit" no-ini:"true"`
+}
+
+// A config file is a YAML mapping of option settings, LONG-NAME: VALUE,
+// with a list of values for options taking several.  Settings at the top
+// level apply to every command which has that option, settings in a
+// COMMAND: mapping apply to that command only and replace the shared
+// ones.
+type Config struct {
+	file     string
+	shared   map[string][]configValue
+	sections map[string]map[string][]configValue
+
+	// Where each section starts.
+	sectionLines map[string]int
+}
+
+type configValue struct {
+	value string
+	line  int
+}
+
+// Reads a config file.
+func ReadConfig(file string) (*Config, error) {
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{
+		file:         file,
+		shared:       map[string][]configValue{},
+		sections:     map[string]map[string][]configValue{},
+		sectionLines: map[string]int{},
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if len(doc.Content) == 0 {
+		return c, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: expected a mapping of settings",
+			file, root.Line)
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+
+		name, value := root.Content[i].Value, root.Content[i+1]
+
+		if value.Kind != yaml.MappingNode {
+			if err := c.add(c.shared, name, value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		section := c.sections[name]
+		if section == nil {
+			section = map[string][]configValue{}
+			c.sections[name] = section
+			c.sectionLines[name] = root.Content[i].Line
+		}
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			err := c.add(section, value.Content[j].Value,
+				value.Content[j+1])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	}
+
+	return c, nil
+
+}
+
+// Adds a setting, a value or a list of values.  Empty settings are
+// ignored.
+func (c *Config) add(section map[string][]configValue, name string, n *yaml.Node) error {
+
+	switch {
+	case n.Kind == yaml.ScalarNode && n.Tag == "!!null":
+		return nil
+	case n.Kind == yaml.ScalarNode:
+		section[name] = []configValue{{n.Value, n.Line}}
+		return nil
+	case n.Kind == yaml.SequenceNode:
+		values := []configValue{}
+		for _, v := range n.Content {
+			if v.Kind != yaml.ScalarNode {
+				return fmt.Errorf("%s:%d: %s should be a list of "+
+					"values", c.file, v.Line, name)
+			}
+			values = append(values, configValue{v.Value, v.Line})
+		}
+		section[name] = values
+		return nil
+	}
+
+	return fmt.Errorf("%s:%d: %s should be a value or a list of values",
+		c.file, n.Line, name)
+
+}
+
+// Options a config file can set, in the order the command has them.  Call
+// before parsing, which adds the help options.
+func configOptions(p *flags.Parser) []*flags.Option {
+	opts := []*flags.Option{}
+	var walk func(g *flags.Group)
+	walk = func(g *flags.Group) {
+		for _, o := range g.Options() {
+			if o.LongName != "" && o.Field().Tag.Get("no-ini") == "" {
+				opts = append(opts, o)
+			}
+		}
+		for _, sub := range g.Groups() {
+			walk(sub)
+		}
+	}
+	walk(p.Command.Group)
+	return opts
+}
+
+// Command line arguments setting the config's values for a command's
+// options, leaving out options already set.
+func (c *Config) args(command string, opts map[string]*flags.Option) ([]string, error) {
+
+	// Sections are for other commands, not this command's options.
+	for name := range c.sections {
+		if _, ok := opts[name]; ok {
+			return nil, fmt.Errorf("%s:%d: %s should be a value or "+
+				"a list of values", c.file, c.sectionLines[name], name)
+		}
+	}
+
+	settings := map[string][]configValue{}
+	for name, values := range c.shared {
+		if _, ok := opts[name]; ok {
+			settings[name] = values
+		}
+	}
+	for name, values := range c.sections[command] {
+		if _, ok := opts[name]; !ok {
+			return nil, fmt.Errorf("%s:%d: %s has no %s option", c.file,
+				values[0].line, command, name)
+		}
+		settings[name] = values
+	}
+
+	args := []string{}
+	for name, values := range settings {
+
+		// The command line wins, options only set by their default
+		// don't count.
+		o := opts[name]
+		if o.IsSet() && !o.IsSetDefault() {
+			continue
+		}
+
+		for _, v := range values {
+			if o.Field().Type.Kind() != reflect.Bool {
+				args = append(args, "--"+name+"="+v.value)
+				continue
+			}
+			set, err := strconv.ParseBool(v.value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s should be true "+
+					"or false", c.file, v.line, name)
+			}
+			if set {
+				args = append(args, "--"+name)
+			}
+		}
+
+	}
+
+	return args, nil
+
+}
+
+// Parses the command line, taking settings the command line doesn't give
+// from the config file, if there is one.  With --print-config, prints the
+// effective settings and exits.  Errors have already been reported.
+func ParseWithConfig(command string, data interface{}, config *ConfigOptions) error {
+
+	p := flags.NewParser(data, flags.Default)
+	list := configOptions(p)
+	opts := map[string]*flags.Option{}
+
+	// Required options may come from the config, so are only checked
+	// once it's read.
+	required := []*flags.Option{}
+	for _, o := range list {
+		opts[o.LongName] = o
+		if o.Required {
+			required = append(required, o)
+			o.Required = false
+		}
+	}
+
+	if _, err := p.Parse(); err != nil {
+		return err
+	}
+
+	args := []string{}
+	if config.ConfigFile != "" {
+		c, err := ReadConfig(config.ConfigFile)
+		if err == nil {
+			args, err = c.args(command, opts)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read config: %s\n", err)
+			return err
+		}
+	}
+
+	if !config.PrintConfig {
+		for _, o := range required {
+			o.Required = true
+		}
+	}
+
+	if _, err := p.ParseArgs(args); err != nil {
+		return err
+	}
+
+	if config.PrintConfig {
+		WriteConfig(os.Stdout, command, list)
+		os.Exit(0)
+	}
+
+	return nil
+
+}
+
+// Writes a command's settings as a config file section.  Unset options
+// are written commented out.
+func WriteConfig(w io.Writer, command string, opts []*flags.Option) {
+
+	fmt.Fprintf(w, "%s:\n", command)
+	for _, o := range opts {
+		writeConfigValue(w, o.LongName, reflect.ValueOf(o.Value()))
+	}
+
+}
+
+func writeConfigValue(w io.Writer, name string, v reflect.Value) {
+
+	switch {
+	case v.Kind() == reflect.Slice && v.Len() == 0,
+		v.Kind() == reflect.String && v.String() == "":
+		fmt.Fprintf(w, "  # %s:\n", name)
+	case v.Kind() == reflect.Slice:
+		fmt.Fprintf(w, "  %s:\n", name)
+		for i := 0; i < v.Len(); i++ {
+			fmt.Fprintf(w, "    - %s\n", configScalar(v.Index(i)))
+		}
+	default:
+		fmt.Fprintf(w, "  %s: %s\n", name, configScalar(v))
+	}
+
+}
+
+// A value as a YAML scalar, quoted if it would otherwise read back as
+// something else.
+func configScalar(v reflect.Value) string {
+	raw, err := yaml.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprint(v.Interface())
+	}
+	scalar := strings.TrimSuffix(string(raw), "\n")
+	if strings.Contains(scalar, "\n") {
+		return strconv.Quote(v.String())
+	}
+	return scalar
+}
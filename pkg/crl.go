@@ -0,0 +1,178 @@
+package cert_tools
+
+import (
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reads a revocation list, lines of SERIAL,TIME with the serial in hex
+// and the time in RFC 3339 form, as written by find-cert.  A third field
+// gives the reason, one of RevocationReasons.
+func ReadRevoked(file string) ([]pkix.RevokedCertificate, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseRevoked(f)
+
+}
+
+func parseRevoked(r io.Reader) ([]pkix.RevokedCertificate, error) {
+
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := []pkix.RevokedCertificate{}
+
+	for _, v := range records {
+
+		if len(v) != 2 && len(v) != 3 {
+			return nil, fmt.Errorf("invalid entry %q, form is "+
+				"SERIAL,TIME or SERIAL,TIME,REASON",
+				strings.Join(v, ","))
+		}
+
+		serial, ok := new(big.Int).SetString(v[0], 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %q", v[0])
+		}
+
+		tm, err := time.Parse(time.RFC3339, v[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid revocation time %q",
+				v[1])
+		}
+
+		entry := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: tm,
+		}
+
+		if len(v) == 3 {
+			ext, err := ReasonExtension(v[2])
+			if err != nil {
+				return nil, err
+			}
+			if ext != nil {
+				entry.Extensions = []pkix.Extension{*ext}
+			}
+		}
+
+		revoked = append(revoked, entry)
+
+	}
+
+	return revoked, nil
+
+}
+
+// CRL entry reason codes, RFC 5280 section 5.3.1.  removeFromCRL is
+// left out, it's only for delta CRLs.
+var RevocationReasons = map[string]int{
+	"unspecified":            0,
+	"key-compromise":         1,
+	"ca-compromise":          2,
+	"affiliation-changed":    3,
+	"superseded":             4,
+	"cessation-of-operation": 5,
+	"certificate-hold":       6,
+	"privilege-withdrawn":    9,
+	"aa-compromise":          10,
+}
+
+var oidReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// Looks up a reason code by name.
+func RevocationReason(name string) (int, error) {
+	code, ok := RevocationReasons[name]
+	if !ok {
+		names := []string{}
+		for n := range RevocationReasons {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("unknown revocation reason %q, reasons "+
+			"are %s", name, strings.Join(names, ", "))
+	}
+	return code, nil
+}
+
+// The CRL entry extension giving a revocation reason, nil for
+// unspecified, which RFC 5280 says is left out rather than given.
+func ReasonExtension(name string) (*pkix.Extension, error) {
+
+	code, err := RevocationReason(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if code == RevocationReasons["unspecified"] {
+		return nil, nil
+	}
+
+	value, err := asn1.Marshal(asn1.Enumerated(code))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pkix.Extension{Id: oidReasonCode, Value: value}, nil
+
+}
+
+// The reason code of a revocation list entry, 0 if there isn't one.
+func entryReason(entry pkix.RevokedCertificate) int {
+	for _, ext := range entry.Extensions {
+		var code asn1.Enumerated
+		if ext.Id.Equal(oidReasonCode) {
+			if _, err := asn1.Unmarshal(ext.Value, &code); err == nil {
+				return int(code)
+			}
+		}
+	}
+	return 0
+}
+
+// Appends an entry to a revocation list.
+func AppendRevoked(file string, serial *big.Int, tm time.Time) error {
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%X,%s\n", serial, tm.UTC().Format(time.RFC3339))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+
+}
+
+// Creates a DER CRL valid for the given period.
+func (i *Issuer) CreateCRL(revoked []pkix.RevokedCertificate,
+	validity time.Duration) ([]byte, error) {
+
+	t := time.Now().UTC()
+	return i.Cert.CreateCRL(rand.Reader, i.Key, revoked, t,
+		t.Add(validity))
+
+}
@@ -1,26 +1,76 @@
-
 package cert_tools
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"io"
 	"encoding/pem"
+	"sort"
+	"strings"
 )
 
 type Key struct {
-	key *ecdsa.PrivateKey
+	key crypto.Signer
+}
+
+// Key algorithms create-key can generate.
+var KeyAlgorithms = map[string]func() (crypto.Signer, error){
+	"ecdsa-p256": func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	},
+	"ecdsa-p384": func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	},
+	"ecdsa-p521": func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	},
+	"rsa-2048": func() (crypto.Signer, error) {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	},
+	"rsa-3072": func() (crypto.Signer, error) {
+		return rsa.GenerateKey(rand.Reader, 3072)
+	},
+	"rsa-4096": func() (crypto.Signer, error) {
+		return rsa.GenerateKey(rand.Reader, 4096)
+	},
+	"ed25519": func() (crypto.Signer, error) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	},
+}
+
+// Sorted list of key algorithm names.
+func KeyAlgorithmNames() []string {
+	names := []string{}
+	for n := range KeyAlgorithms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func NewKey() (*Key, error) {
+	return GenerateKey("ecdsa-p256")
+}
 
-	// Generate a key.
-	c := elliptic.P256()
+func GenerateKey(algorithm string) (*Key, error) {
 
-	priv, err := ecdsa.GenerateKey(c, rand.Reader)
+	gen, ok := KeyAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown key algorithm %q, known "+
+			"algorithms: %s", algorithm,
+			strings.Join(KeyAlgorithmNames(), ", "))
+	}
+
+	// Generate a key.
+	priv, err := gen()
 	if err != nil {
 		return nil, err
 	}
@@ -29,34 +79,122 @@ func NewKey() (*Key, error) {
 
 }
 
+// Reads a private key, from a token if the name is a pkcs11: URI, a
+// signer plugin if it's plugin: or unix:, key shares if it's shares:,
+// otherwise from a PEM file.
+func ReadKey(name string) (*Key, error) {
+
+	if IsSharesKey(name) {
+		return ReadKeyFromShares(name)
+	}
+
+	if IsPluginKey(name) {
+		signer, err := OpenPluginSigner(name)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{signer}, nil
+	}
+
+	if IsPKCS11URI(name) {
+		signer, err := OpenPKCS11Signer(name)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{signer}, nil
+	}
+
+	return ReadKeyFromFile(name)
+
+}
+
 func ReadKeyFromFile(file string) (*Key, error) {
-	
+
 	// Read keyfile
 	raw, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
 
+	return ParseKey(raw)
+
+}
+
+// Parses a PEM private key, SEC 1 EC, PKCS #1 RSA or PKCS #8.
+func ParseKey(raw []byte) (*Key, error) {
+
 	// Parse PEM in keyfile
-	keyPem, _ := pem.Decode([]byte(raw))
+	keyPem, _ := pem.Decode(raw)
 	if keyPem == nil {
-		return nil, err
+		return nil, fmt.Errorf("no PEM data in key file")
 	}
 
-	// Parse key from PEM.
-	key, err := x509.ParseECPrivateKey(keyPem.Bytes)
-	if err != nil {
-		return nil, err
+	return parseKeyDER(keyPem.Type, keyPem.Bytes)
+
+}
+
+// Parses a DER private key of a PEM type.
+func parseKeyDER(typ string, der []byte) (*Key, error) {
+
+	switch typ {
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{key}, nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{key}, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return &Key{signer}, nil
 	}
 
-	return &Key{key}, nil
+	return nil, fmt.Errorf("unsupported PEM type %q", typ)
 
 }
 
+// The key as a crypto.Signer.
+func (k *Key) Signer() crypto.Signer {
+	return k.key
+}
+
+func (k *Key) Public() crypto.PublicKey {
+	return k.key.Public()
+}
+
+// PEM type for the key's encoding.
+func (k *Key) PemType() string {
+	switch k.key.(type) {
+	case *ecdsa.PrivateKey:
+		return "EC PRIVATE KEY"
+	case *rsa.PrivateKey:
+		return "RSA PRIVATE KEY"
+	}
+	return "PRIVATE KEY"
+}
+
 func (k *Key) ToPem() ([]byte, error) {
 
 	// Marshal as PEM
-	return x509.MarshalECPrivateKey(k.key)
+	switch key := k.key.(type) {
+	case *ecdsa.PrivateKey:
+		return x509.MarshalECPrivateKey(key)
+	case *rsa.PrivateKey:
+		return x509.MarshalPKCS1PrivateKey(key), nil
+	}
+	return x509.MarshalPKCS8PrivateKey(k.key)
 
 }
 
@@ -65,10 +203,112 @@ func (k *Key) OutputPem(out io.Writer) error {
 	if err != nil {
 		return err
 	}
-	return OutputPem(out, b, "EC PRIVATE KEY")
+	return OutputPem(out, b, k.PemType())
 }
 
 func OutputPem(out io.Writer, b []byte, header string) error {
 	return pem.Encode(out, &pem.Block{Type: header, Bytes: b})
 }
 
+// Signature algorithms which can be given on the command line, by their
+// crypto/x509 names.
+var signatureAlgorithms = []x509.SignatureAlgorithm{
+	x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+	x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS,
+	x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512,
+	x509.PureEd25519,
+}
+
+// Works out the signature algorithm for a signing key.  The default
+// follows the key type: ECDSA with SHA-512, RSA with SHA-256 and Ed25519.
+// An override is one of the crypto/x509 names, e.g. ECDSA-SHA384 or
+// SHA256-RSAPSS, and must suit the key.
+func SignatureAlgorithm(pub crypto.PublicKey, override string) (x509.SignatureAlgorithm, error) {
+
+	var keyAlg x509.PublicKeyAlgorithm
+	var def x509.SignatureAlgorithm
+
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		keyAlg, def = x509.ECDSA, x509.ECDSAWithSHA512
+	case *rsa.PublicKey:
+		keyAlg, def = x509.RSA, x509.SHA256WithRSA
+	case ed25519.PublicKey:
+		keyAlg, def = x509.Ed25519, x509.PureEd25519
+	default:
+		return x509.UnknownSignatureAlgorithm,
+			fmt.Errorf("unsupported key type %T", pub)
+	}
+
+	if override == "" {
+		return def, nil
+	}
+
+	names := []string{}
+	for _, alg := range signatureAlgorithms {
+		if !strings.EqualFold(alg.String(), override) {
+			names = append(names, alg.String())
+			continue
+		}
+		if signatureKeyAlgorithm(alg) != keyAlg {
+			return x509.UnknownSignatureAlgorithm,
+				fmt.Errorf("signature algorithm %s can't be used "+
+					"with an %s key", alg, keyAlg)
+		}
+		return alg, nil
+	}
+
+	return x509.UnknownSignatureAlgorithm,
+		fmt.Errorf("unknown signature algorithm %q, known "+
+			"algorithms: %s", override, strings.Join(names, ", "))
+
+}
+
+func signatureKeyAlgorithm(alg x509.SignatureAlgorithm) x509.PublicKeyAlgorithm {
+	switch alg {
+	case x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+		return x509.ECDSA
+	case x509.PureEd25519:
+		return x509.Ed25519
+	}
+	return x509.RSA
+}
+
+// Signs DER with a crypto/x509 signature algorithm, for structures
+// crypto/x509 can't build itself.
+func signTBS(key crypto.Signer, alg x509.SignatureAlgorithm, tbs []byte) ([]byte, error) {
+
+	var hash crypto.Hash
+	pss := false
+
+	switch alg {
+	case x509.SHA256WithRSA, x509.ECDSAWithSHA256:
+		hash = crypto.SHA256
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		hash = crypto.SHA512
+	case x509.SHA256WithRSAPSS:
+		hash, pss = crypto.SHA256, true
+	case x509.SHA384WithRSAPSS:
+		hash, pss = crypto.SHA384, true
+	case x509.SHA512WithRSAPSS:
+		hash, pss = crypto.SHA512, true
+	case x509.PureEd25519:
+		return key.Sign(rand.Reader, tbs, crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %s", alg)
+	}
+
+	h := hash.New()
+	h.Write(tbs)
+
+	var opts crypto.SignerOpts = hash
+	if pss {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash: hash}
+	}
+
+	return key.Sign(rand.Reader, h.Sum(nil), opts)
+
+}
@@ -0,0 +1,615 @@
+package cert_tools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Certificate Transparency, RFC 6962.
+var (
+	OidCTPoison  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	OidCTSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+	// Precertificate signing certificates aren't supported, the CA
+	// signs precertificates itself.
+	OidCTPrecertSigning = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 4}
+)
+
+// Log entry types.
+const (
+	CTX509Entry    = 0
+	CTPrecertEntry = 1
+)
+
+// TLS hash and signature algorithm codes used in digitally-signed
+// structures.
+const (
+	ctHashSHA256 = 4
+	ctSigRSA     = 1
+	ctSigECDSA   = 3
+)
+
+// The critical extension which stops a precertificate being used as a
+// certificate.
+func CTPoisonExtension() pkix.Extension {
+	return pkix.Extension{
+		Id:       OidCTPoison,
+		Critical: true,
+		Value:    asn1.NullBytes,
+	}
+}
+
+// A signed certificate timestamp, a log's promise to include a
+// certificate.
+type SCT struct {
+	Version    uint8
+	LogID      [32]byte
+	Timestamp  uint64
+	Extensions []byte
+	HashAlg    uint8
+	SigAlg     uint8
+	Signature  []byte
+}
+
+// What a log entry is for, a certificate or a precertificate's TBS
+// without the poison extension.
+type CTEntry struct {
+	Type          uint16
+	Cert          []byte
+	IssuerKeyHash [32]byte
+	TBS           []byte
+}
+
+// A log ID is the SHA-256 of its public key.
+func CTLogID(pub crypto.PublicKey) ([32]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(der), nil
+}
+
+func putUint24(b *bytes.Buffer, v []byte) {
+	n := len(v)
+	b.Write([]byte{byte(n >> 16), byte(n >> 8), byte(n)})
+	b.Write(v)
+}
+
+func putUint16(b *bytes.Buffer, v []byte) {
+	binary.Write(b, binary.BigEndian, uint16(len(v)))
+	b.Write(v)
+}
+
+// The TimestampedEntry structure, which is both what SCTs sign and the
+// body of a Merkle tree leaf.
+func (e *CTEntry) timestamped(timestamp uint64, exts []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, timestamp)
+	binary.Write(&b, binary.BigEndian, e.Type)
+	if e.Type == CTPrecertEntry {
+		b.Write(e.IssuerKeyHash[:])
+		putUint24(&b, e.TBS)
+	} else {
+		putUint24(&b, e.Cert)
+	}
+	putUint16(&b, exts)
+	return b.Bytes()
+}
+
+// The MerkleTreeLeaf for an entry.
+func (e *CTEntry) Leaf(timestamp uint64) []byte {
+	return append([]byte{0, 0}, e.timestamped(timestamp, nil)...)
+}
+
+// The data an SCT signature covers.
+func (e *CTEntry) signed(s *SCT) []byte {
+	return append([]byte{s.Version, 0},
+		e.timestamped(s.Timestamp, s.Extensions)...)
+}
+
+// Makes a log entry for a certificate.
+func NewCTEntry(cert []byte) *CTEntry {
+	return &CTEntry{Type: CTX509Entry, Cert: cert}
+}
+
+// Makes a log entry for a precertificate signed directly by its issuer.
+func NewCTPrecertEntry(precert []byte, issuer *x509.Certificate) (*CTEntry, error) {
+
+	c, err := x509.ParseCertificate(precert)
+	if err != nil {
+		return nil, err
+	}
+
+	tbs, err := removeTBSExtension(c.RawTBSCertificate, OidCTPoison)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CTEntry{
+		Type:          CTPrecertEntry,
+		IssuerKeyHash: sha256.Sum256(issuer.RawSubjectPublicKeyInfo),
+		TBS:           tbs,
+	}, nil
+
+}
+
+// Makes the precertificate log entry a final certificate corresponds to,
+// for checking its embedded SCTs.
+func NewCTEmbeddedEntry(cert *x509.Certificate, issuer *x509.Certificate) (*CTEntry, error) {
+
+	tbs, err := removeTBSExtension(cert.RawTBSCertificate, OidCTSCTList)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CTEntry{
+		Type:          CTPrecertEntry,
+		IssuerKeyHash: sha256.Sum256(issuer.RawSubjectPublicKeyInfo),
+		TBS:           tbs,
+	}, nil
+
+}
+
+type tbsCertificate struct {
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       *big.Int
+	SignatureAlgorithm asn1.RawValue
+	Issuer             asn1.RawValue
+	Validity           asn1.RawValue
+	Subject            asn1.RawValue
+	PublicKey          asn1.RawValue
+	IssuerUniqueId     asn1.BitString   `asn1:"optional,tag:1"`
+	SubjectUniqueId    asn1.BitString   `asn1:"optional,tag:2"`
+	Extensions         []pkix.Extension `asn1:"omitempty,optional,explicit,tag:3"`
+}
+
+// Re-encodes a TBS certificate without an extension, which must be there.
+func removeTBSExtension(der []byte, oid asn1.ObjectIdentifier) ([]byte, error) {
+
+	var tbs tbsCertificate
+	rest, err := asn1.Unmarshal(der, &tbs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TBS certificate: %s", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing data after TBS certificate")
+	}
+
+	exts := []pkix.Extension{}
+	for _, e := range tbs.Extensions {
+		if !e.Id.Equal(oid) {
+			exts = append(exts, e)
+		}
+	}
+	if len(exts) == len(tbs.Extensions) {
+		return nil, fmt.Errorf("certificate has no %s extension", oid)
+	}
+	tbs.Extensions = exts
+
+	return asn1.Marshal(tbs)
+
+}
+
+// Signs a digitally-signed structure with SHA-256, as logs do.
+func ctSign(key crypto.Signer, data []byte) (uint8, []byte, error) {
+
+	var sigAlg uint8
+	switch key.Public().(type) {
+	case *ecdsa.PublicKey:
+		sigAlg = ctSigECDSA
+	case *rsa.PublicKey:
+		sigAlg = ctSigRSA
+	default:
+		return 0, nil, fmt.Errorf("log key must be ECDSA or RSA")
+	}
+
+	sum := sha256.Sum256(data)
+	sig, err := key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return sigAlg, sig, nil
+
+}
+
+func ctVerify(pub crypto.PublicKey, hashAlg, sigAlg uint8, data, sig []byte) error {
+
+	if hashAlg != ctHashSHA256 {
+		return fmt.Errorf("unsupported hash algorithm %d", hashAlg)
+	}
+	sum := sha256.Sum256(data)
+
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if sigAlg != ctSigECDSA || !ecdsa.VerifyASN1(k, sum[:], sig) {
+			return fmt.Errorf("signature doesn't verify")
+		}
+	case *rsa.PublicKey:
+		if sigAlg != ctSigRSA {
+			return fmt.Errorf("signature doesn't verify")
+		}
+		err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig)
+		if err != nil {
+			return fmt.Errorf("signature doesn't verify")
+		}
+	default:
+		return fmt.Errorf("log key must be ECDSA or RSA")
+	}
+
+	return nil
+
+}
+
+// Issues an SCT for an entry, as a log does.
+func SignSCT(key crypto.Signer, e *CTEntry, tm time.Time) (*SCT, error) {
+
+	id, err := CTLogID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SCT{
+		LogID:     id,
+		Timestamp: uint64(tm.UnixMilli()),
+		HashAlg:   ctHashSHA256,
+	}
+
+	s.SigAlg, s.Signature, err = ctSign(key, e.signed(s))
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+
+}
+
+// Checks an SCT was signed by a log for an entry.
+func (s *SCT) Verify(pub crypto.PublicKey, e *CTEntry) error {
+
+	id, err := CTLogID(pub)
+	if err != nil {
+		return err
+	}
+	if id != s.LogID {
+		return fmt.Errorf("SCT is from a different log")
+	}
+
+	return ctVerify(pub, s.HashAlg, s.SigAlg, e.signed(s), s.Signature)
+
+}
+
+// The TLS encoding of the signature.
+func (s *SCT) digitallySigned() []byte {
+	var b bytes.Buffer
+	b.Write([]byte{s.HashAlg, s.SigAlg})
+	putUint16(&b, s.Signature)
+	return b.Bytes()
+}
+
+func parseDigitallySigned(b []byte) (uint8, uint8, []byte, error) {
+	if len(b) < 4 {
+		return 0, 0, nil, fmt.Errorf("signature is truncated")
+	}
+	n := int(binary.BigEndian.Uint16(b[2:]))
+	if len(b) != 4+n {
+		return 0, 0, nil, fmt.Errorf("signature has the wrong length")
+	}
+	return b[0], b[1], b[4:], nil
+}
+
+// The TLS encoding of an SCT.
+func (s *SCT) Marshal() []byte {
+	var b bytes.Buffer
+	b.WriteByte(s.Version)
+	b.Write(s.LogID[:])
+	binary.Write(&b, binary.BigEndian, s.Timestamp)
+	putUint16(&b, s.Extensions)
+	b.Write(s.digitallySigned())
+	return b.Bytes()
+}
+
+// Parses the TLS encoding of an SCT.
+func ParseSCT(b []byte) (*SCT, error) {
+
+	if len(b) < 43 {
+		return nil, fmt.Errorf("SCT is truncated")
+	}
+
+	s := &SCT{Version: b[0]}
+	if s.Version != 0 {
+		return nil, fmt.Errorf("unsupported SCT version %d", s.Version)
+	}
+	copy(s.LogID[:], b[1:33])
+	s.Timestamp = binary.BigEndian.Uint64(b[33:])
+
+	n := int(binary.BigEndian.Uint16(b[41:]))
+	if len(b) < 43+n {
+		return nil, fmt.Errorf("SCT is truncated")
+	}
+	s.Extensions = b[43 : 43+n]
+
+	var err error
+	s.HashAlg, s.SigAlg, s.Signature, err =
+		parseDigitallySigned(b[43+n:])
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+
+}
+
+// The extension carrying SCTs in a certificate.
+func SCTListExtension(scts []*SCT) (pkix.Extension, error) {
+
+	var list bytes.Buffer
+	for _, s := range scts {
+		putUint16(&list, s.Marshal())
+	}
+
+	var b bytes.Buffer
+	putUint16(&b, list.Bytes())
+
+	value, err := asn1.Marshal(b.Bytes())
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+
+	return pkix.Extension{Id: OidCTSCTList, Value: value}, nil
+
+}
+
+// Gets the SCTs embedded in a certificate, nil if there are none.
+func CertificateSCTs(cert *x509.Certificate) ([]*SCT, error) {
+
+	for _, e := range cert.Extensions {
+
+		if !e.Id.Equal(OidCTSCTList) {
+			continue
+		}
+
+		var b []byte
+		if _, err := asn1.Unmarshal(e.Value, &b); err != nil {
+			return nil, fmt.Errorf("failed to parse SCT list: %s", err)
+		}
+		if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+			return nil, fmt.Errorf("SCT list has the wrong length")
+		}
+		b = b[2:]
+
+		scts := []*SCT{}
+		for len(b) > 0 {
+			if len(b) < 2 {
+				return nil, fmt.Errorf("SCT list is truncated")
+			}
+			n := int(binary.BigEndian.Uint16(b))
+			if len(b) < 2+n {
+				return nil, fmt.Errorf("SCT list is truncated")
+			}
+			s, err := ParseSCT(b[2 : 2+n])
+			if err != nil {
+				return nil, err
+			}
+			scts = append(scts, s)
+			b = b[2+n:]
+		}
+
+		return scts, nil
+
+	}
+
+	return nil, nil
+
+}
+
+// RFC 6962 JSON forms.
+type CTAddChainRequest struct {
+	Chain [][]byte `json:"chain"`
+}
+
+type CTAddChainResponse struct {
+	Version    uint8  `json:"sct_version"`
+	ID         []byte `json:"id"`
+	Timestamp  uint64 `json:"timestamp"`
+	Extensions []byte `json:"extensions"`
+	Signature  []byte `json:"signature"`
+}
+
+// The JSON response a log gives for an SCT.
+func (s *SCT) Response() *CTAddChainResponse {
+	return &CTAddChainResponse{
+		Version:    s.Version,
+		ID:         s.LogID[:],
+		Timestamp:  s.Timestamp,
+		Extensions: s.Extensions,
+		Signature:  s.digitallySigned(),
+	}
+}
+
+// A CT log to submit to.  If the key is known, SCTs are checked.
+type CTLog struct {
+	URL string
+	Key crypto.PublicKey
+}
+
+// Parses URL[,KEY-FILE].
+func ParseCTLog(s string) (*CTLog, error) {
+
+	parts := strings.SplitN(s, ",", 2)
+	l := &CTLog{URL: strings.TrimRight(parts[0], "/")}
+	if l.URL == "" {
+		return nil, fmt.Errorf("CT log URL is empty")
+	}
+
+	if len(parts) > 1 {
+		key, err := ReadPublicKeyFromFile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CT log key: %s",
+				err)
+		}
+		l.Key = key
+	}
+
+	return l, nil
+
+}
+
+// Submits a certificate or precertificate chain, the issuer first after
+// the leaf, and returns the SCT.
+func (l *CTLog) Submit(chain [][]byte, precert bool) (*SCT, error) {
+
+	path := "/ct/v1/add-chain"
+	if precert {
+		path = "/ct/v1/add-pre-chain"
+	}
+
+	body, err := json.Marshal(&CTAddChainRequest{Chain: chain})
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(l.URL+path, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s: %s", l.URL, resp.Status,
+			strings.TrimSpace(string(raw)))
+	}
+
+	var r CTAddChainResponse
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, fmt.Errorf("%s: failed to parse response: %s",
+			l.URL, err)
+	}
+
+	if r.Version != 0 || len(r.ID) != 32 {
+		return nil, fmt.Errorf("%s: invalid SCT", l.URL)
+	}
+
+	s := &SCT{
+		Version:    r.Version,
+		Timestamp:  r.Timestamp,
+		Extensions: r.Extensions,
+	}
+	copy(s.LogID[:], r.ID)
+
+	s.HashAlg, s.SigAlg, s.Signature, err =
+		parseDigitallySigned(r.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", l.URL, err)
+	}
+
+	return s, nil
+
+}
+
+// Merkle tree hashing, RFC 6962 section 2.1.
+func CTLeafHash(leaf []byte) [32]byte {
+	return sha256.Sum256(append([]byte{0}, leaf...))
+}
+
+// The root hash of a tree of leaf hashes.
+func CTTreeHash(leaves [][32]byte) [32]byte {
+
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+
+	l := CTTreeHash(leaves[:k])
+	r := CTTreeHash(leaves[k:])
+
+	return sha256.Sum256(append(append([]byte{1}, l[:]...), r[:]...))
+
+}
+
+// A signed tree head.
+type CTTreeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	Timestamp uint64 `json:"timestamp"`
+	RootHash  []byte `json:"sha256_root_hash"`
+	Signature []byte `json:"tree_head_signature"`
+}
+
+func (h *CTTreeHead) signed() []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0, 1})
+	binary.Write(&b, binary.BigEndian, h.Timestamp)
+	binary.Write(&b, binary.BigEndian, h.TreeSize)
+	b.Write(h.RootHash)
+	return b.Bytes()
+}
+
+// Signs a tree head for a set of leaf hashes.
+func SignTreeHead(key crypto.Signer, leaves [][32]byte, tm time.Time) (*CTTreeHead, error) {
+
+	root := CTTreeHash(leaves)
+
+	h := &CTTreeHead{
+		TreeSize:  uint64(len(leaves)),
+		Timestamp: uint64(tm.UnixMilli()),
+		RootHash:  root[:],
+	}
+
+	sigAlg, sig, err := ctSign(key, h.signed())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SCT{HashAlg: ctHashSHA256, SigAlg: sigAlg, Signature: sig}
+	h.Signature = s.digitallySigned()
+
+	return h, nil
+
+}
+
+// Checks a tree head's signature.
+func (h *CTTreeHead) Verify(pub crypto.PublicKey) error {
+	hashAlg, sigAlg, sig, err := parseDigitallySigned(h.Signature)
+	if err != nil {
+		return err
+	}
+	return ctVerify(pub, hashAlg, sigAlg, h.signed(), sig)
+}
+
+// Describes an SCT for the user.
+func (s *SCT) String() string {
+	tm := time.UnixMilli(int64(s.Timestamp)).UTC()
+	return fmt.Sprintf("log %s at %s",
+		base64.StdEncoding.EncodeToString(s.LogID[:]),
+		tm.Format(time.RFC3339))
+}
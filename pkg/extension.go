@@ -0,0 +1,157 @@
+package cert_tools
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Extensions which the tools construct themselves from profiles and
+// options.  Anything else is a custom extension.
+var StandardExtensions = map[string]string{
+	"2.5.29.14":         "subjectKeyIdentifier",
+	"2.5.29.15":         "keyUsage",
+	"2.5.29.17":         "subjectAltName",
+	"2.5.29.19":         "basicConstraints",
+	"2.5.29.30":         "nameConstraints",
+	"2.5.29.31":         "cRLDistributionPoints",
+	"2.5.29.32":         "certificatePolicies",
+	"2.5.29.35":         "authorityKeyIdentifier",
+	"2.5.29.37":         "extKeyUsage",
+	"1.3.6.1.5.5.7.1.1": "authorityInfoAccess",
+}
+
+// Returns true if the extension is one the tools build themselves.
+func IsStandardExtension(oid asn1.ObjectIdentifier) bool {
+	_, ok := StandardExtensions[oid.String()]
+	return ok
+}
+
+// Parses an extension from the command line form OID[,critical]=VALUE.
+// VALUE is either hex-encoded DER, or TYPE:VALUE where TYPE is one of
+// utf8, ia5, printable, int, bool, oid, octets, der or hex, or the word
+// null.
+func ParseExtension(s string) (pkix.Extension, error) {
+
+	lhs, rhs, ok := strings.Cut(s, "=")
+	if !ok {
+		return pkix.Extension{},
+			fmt.Errorf("extension %q not of form OID[,critical]=VALUE", s)
+	}
+
+	ext := pkix.Extension{}
+
+	oidStr, flag, hasFlag := strings.Cut(lhs, ",")
+	if hasFlag {
+		if strings.TrimSpace(flag) != "critical" {
+			return pkix.Extension{},
+				fmt.Errorf("extension %q: unknown flag %q", s, flag)
+		}
+		ext.Critical = true
+	}
+
+	oid, err := ParseOID(strings.TrimSpace(oidStr))
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	ext.Id = oid
+
+	ext.Value, err = EncodeASN1Spec(rhs)
+	if err != nil {
+		return pkix.Extension{}, fmt.Errorf("extension %q: %s", s, err)
+	}
+
+	return ext, nil
+
+}
+
+// Encodes a simple ASN.1 value specification as DER.
+func EncodeASN1Spec(spec string) ([]byte, error) {
+
+	if spec == "null" {
+		return asn1.Marshal(asn1.NullRawValue)
+	}
+
+	typ, val, ok := strings.Cut(spec, ":")
+	if !ok {
+		typ, val = "der", spec
+	}
+
+	switch typ {
+	case "utf8":
+		return asn1.MarshalWithParams(val, "utf8")
+	case "ia5":
+		return asn1.MarshalWithParams(val, "ia5")
+	case "printable":
+		return asn1.MarshalWithParams(val, "printable")
+	case "int":
+		n, ok := new(big.Int).SetString(val, 0)
+		if !ok {
+			return nil, fmt.Errorf("invalid integer %q", val)
+		}
+		return asn1.Marshal(n)
+	case "bool":
+		switch val {
+		case "true":
+			return asn1.Marshal(true)
+		case "false":
+			return asn1.Marshal(false)
+		}
+		return nil, fmt.Errorf("invalid boolean %q", val)
+	case "oid":
+		oid, err := ParseOID(val)
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(oid)
+	case "octets":
+		b, err := hex.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex %q", val)
+		}
+		return asn1.Marshal(b)
+	case "der", "hex":
+		b, err := hex.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex %q", val)
+		}
+		var raw asn1.RawValue
+		rest, err := asn1.Unmarshal(b, &raw)
+		if err != nil || len(rest) != 0 {
+			return nil, fmt.Errorf("value is not a single DER object")
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("unknown ASN.1 type %q", typ)
+
+}
+
+// Parses a list of command line extensions.
+func ParseExtensions(specs []string) ([]pkix.Extension, error) {
+	exts := []pkix.Extension{}
+	for _, s := range specs {
+		ext, err := ParseExtension(s)
+		if err != nil {
+			return nil, err
+		}
+		exts, err = AddExtension(exts, ext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return exts, nil
+}
+
+// Adds an extension to a list, refusing duplicates.
+func AddExtension(exts []pkix.Extension, ext pkix.Extension) ([]pkix.Extension, error) {
+	for _, e := range exts {
+		if e.Id.Equal(ext.Id) {
+			return nil, fmt.Errorf("duplicate extension %s", ext.Id)
+		}
+	}
+	return append(exts, ext), nil
+}
@@ -0,0 +1,383 @@
+package cert_tools
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"github.com/google/uuid"
+	"math/big"
+	"time"
+)
+
+// A CA certificate and the key it signs with.
+type Issuer struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// Settings for issuing a certificate from a request.
+type IssueOptions struct {
+	Validity time.Duration
+	Profiles []*Profile
+
+	// Signature algorithm name, empty to follow the CA key.
+	SignatureAlgorithm string
+
+	// "yes" or "no" to override the profile, empty to follow it.
+	EmailInSubject string
+
+	// CA-supplied extensions, these take precedence over the request.
+	Extensions       []pkix.Extension
+	CopyExtensions   bool
+	StrictExtensions bool
+
+	// Distribution URIs, default to the CA's own.
+	CrlUri []string
+	CaUri  []string
+
+	// Certificate Transparency.  A precertificate carries the poison
+	// extension instead of being usable.  If logs are given, a
+	// precertificate is submitted to each and the SCTs they return are
+	// embedded in the certificate.
+	Precertificate bool
+	CTLogs         []*CTLog
+
+	// Called with the certificate as it will be issued, signed by a
+	// throwaway key, before anything is signed or logged.  Issuing
+	// stops if it returns an error.
+	Lint func(cert *x509.Certificate) error
+}
+
+// The outcome of issuing a certificate.
+type Issued struct {
+	Raw         []byte
+	Certificate *x509.Certificate
+
+	// What was done with each extension in the request.
+	Extensions []ExtensionResult
+
+	// Things the caller may want to tell the user about.
+	Warnings []string
+
+	// The precertificate logged and the SCTs embedded.
+	Precertificate []byte
+	SCTs           []*SCT
+}
+
+// Creates an issuer from a CA key, a file, PKCS #11 URI or signer
+// plugin, and certificate file.
+func ReadIssuer(keyFile, certFile string) (*Issuer, error) {
+
+	key, err := ReadKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %s", err)
+	}
+
+	cert, err := ReadCertificateFromFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate file: %s",
+			err)
+	}
+
+	return &Issuer{Cert: cert, Key: key.Signer()}, nil
+
+}
+
+// Makes up a random serial number.
+func NewSerial() (*big.Int, error) {
+
+	uuidVal, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	uuidBytes, err := uuidVal.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(uuidBytes), nil
+
+}
+
+// Signs a certificate for a request under the profiles.  The request
+// signature must already have been checked.  If extensions can't be
+// honoured under StrictExtensions, the extension results are returned with
+// the error.
+func (i *Issuer) Issue(csr *x509.CertificateRequest, opts IssueOptions) (*Issued, error) {
+
+	issued := &Issued{}
+
+	// Signature algorithm follows the CA key, not the requester's,
+	// unless overridden.
+	sigAlg, err := SignatureAlgorithm(i.Key.Public(),
+		opts.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	// Certificate validity period starts now.
+	notBefore := time.Now().UTC()
+	notAfter := notBefore.Add(opts.Validity)
+
+	serial, err := NewSerial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial: %s", err)
+	}
+
+	// Get the full set of SANs from the request, crypto/x509 ignores
+	// otherName entries.
+	sans, err := SANsFromExtensions(csr.Extensions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request "+
+			"SANs: %s", err)
+	}
+	if sans == nil {
+		sans = &SANs{}
+	}
+
+	// Check the request against the profiles.
+	for _, p := range opts.Profiles {
+		if p.Check == nil {
+			continue
+		}
+		if err := p.Check(csr, sans); err != nil {
+			return nil, fmt.Errorf("certificate request fails %s "+
+				"profile: %s", p.Name, err)
+		}
+	}
+
+	// Populate certificate template
+	template := x509.Certificate{
+		SignatureAlgorithm: sigAlg,
+
+		PublicKey: csr.PublicKey,
+
+		SerialNumber: serial,
+		Issuer:       i.Cert.Subject,
+
+		Subject:    csr.Subject,
+		RawSubject: csr.RawSubject,
+
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+
+		KeyUsage: x509.KeyUsageDigitalSignature,
+
+		ExtKeyUsage: []x509.ExtKeyUsage{},
+
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+
+		DNSNames:       sans.DNSNames,
+		IPAddresses:    sans.IPAddresses,
+		EmailAddresses: sans.EmailAddresses,
+		URIs:           sans.URIs,
+	}
+
+	pk, err := x509.MarshalPKIXPublicKey(template.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Public Key bytes: %s", err)
+	}
+
+	pkSum := sha256.Sum256(pk)
+	template.SubjectKeyId = pkSum[:]
+
+	// Add profile usages.
+	for _, p := range opts.Profiles {
+		p.Apply(&template)
+	}
+
+	// Some profiles carry the email address in the subject as well as
+	// the SAN, which can be overridden either way.
+	emailInSubject := false
+	for _, p := range opts.Profiles {
+		if p.EmailInSubject {
+			emailInSubject = true
+		}
+	}
+	switch opts.EmailInSubject {
+	case "yes":
+		emailInSubject = true
+	case "no":
+		emailInSubject = false
+	}
+
+	if emailInSubject {
+		if len(sans.EmailAddresses) == 0 {
+			issued.Warnings = append(issued.Warnings,
+				"request has no email address, subject left "+
+					"as requested")
+		} else {
+			rawSubj, _, err := AddEmailToSubject(csr.RawSubject,
+				sans.EmailAddresses[0])
+			if err != nil {
+				return nil, fmt.Errorf("failed to add email to "+
+					"subject: %s", err)
+			}
+			template.RawSubject = rawSubj
+		}
+	}
+
+	// CA-supplied extensions.
+	template.ExtraExtensions = append([]pkix.Extension{},
+		opts.Extensions...)
+
+	// Honour extensions asked for in the request where the profile
+	// allows.  Custom extensions are only copied if asked for, and
+	// CA-supplied extensions take precedence.
+	if opts.CopyExtensions {
+		for _, p := range opts.Profiles {
+			if !p.CopyExtensions {
+				return nil, fmt.Errorf("profile %s does not "+
+					"allow copying extensions", p.Name)
+			}
+		}
+	}
+
+	issued.Extensions = ApplyRequestedExtensions(csr, &template,
+		opts.CopyExtensions)
+
+	if opts.StrictExtensions {
+		for _, r := range issued.Extensions {
+			if r.Decision != ExtensionAccepted {
+				return issued, fmt.Errorf("not all requested " +
+					"extensions can be honoured")
+			}
+		}
+	}
+
+	// crypto/x509 can't encode otherName SANs and drops other
+	// GeneralName types, so the extension is built here if the request
+	// has any.
+	if len(sans.OtherNames) > 0 || len(sans.Raw) > 0 {
+		var rdns pkix.RDNSequence
+		_, err := asn1.Unmarshal(template.RawSubject, &rdns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse subject: %s", err)
+		}
+		ext, err := sans.Extension(len(rdns) == 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode SANs: %s", err)
+		}
+		template.ExtraExtensions, err = AddExtension(
+			template.ExtraExtensions, ext)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.CrlUri) > 0 {
+		template.CRLDistributionPoints = opts.CrlUri
+	} else {
+		template.CRLDistributionPoints = i.Cert.CRLDistributionPoints
+	}
+
+	if len(opts.CaUri) > 0 {
+		template.IssuingCertificateURL = opts.CaUri
+	} else {
+		template.IssuingCertificateURL = i.Cert.IssuingCertificateURL
+	}
+
+	if opts.Lint != nil {
+		cert, err := presign(&template, i.Cert, csr.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := opts.Lint(cert); err != nil {
+			return nil, err
+		}
+	}
+
+	// A precertificate is the certificate with the poison extension
+	// last, logs take it out again to get the TBS their SCTs cover.
+	if opts.Precertificate || len(opts.CTLogs) > 0 {
+
+		exts := template.ExtraExtensions
+		template.ExtraExtensions = append(exts[:len(exts):len(exts)],
+			CTPoisonExtension())
+
+		issued.Precertificate, err = x509.CreateCertificate(rand.Reader,
+			&template, i.Cert, csr.PublicKey, i.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create "+
+				"precertificate: %s", err)
+		}
+
+		template.ExtraExtensions = exts
+
+	}
+
+	if opts.Precertificate {
+		issued.Raw = issued.Precertificate
+	} else if len(opts.CTLogs) > 0 {
+
+		issued.SCTs, err = i.logPrecertificate(issued.Precertificate,
+			opts.CTLogs)
+		if err != nil {
+			return nil, err
+		}
+
+		// The SCT list goes where the poison was, so the TBS is the
+		// same once each is removed.
+		ext, err := SCTListExtension(issued.SCTs)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+
+	}
+
+	// Create certificate from template and CA public key
+	if issued.Raw == nil {
+		issued.Raw, err = x509.CreateCertificate(rand.Reader,
+			&template, i.Cert, csr.PublicKey, i.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create certificate: %s",
+				err)
+		}
+	}
+
+	issued.Certificate, err = x509.ParseCertificate(issued.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return issued, nil
+
+}
+
+// Submits a precertificate to each log, checking SCTs where the log's
+// key is known.
+func (i *Issuer) logPrecertificate(precert []byte, logs []*CTLog) ([]*SCT, error) {
+
+	entry, err := NewCTPrecertEntry(precert, i.Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := [][]byte{precert, i.Cert.Raw}
+
+	scts := []*SCT{}
+	for _, l := range logs {
+		sct, err := l.Submit(chain, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to log precertificate: %s",
+				err)
+		}
+		if l.Key != nil {
+			if err := sct.Verify(l.Key, entry); err != nil {
+				return nil, fmt.Errorf("%s: invalid SCT: %s",
+					l.URL, err)
+			}
+		}
+		scts = append(scts, sct)
+	}
+
+	return scts, nil
+
+}
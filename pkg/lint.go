@@ -0,0 +1,404 @@
+package cert_tools
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// How serious a lint finding is.
+type LintLevel string
+
+const (
+	LintError   LintLevel = "error"
+	LintWarning LintLevel = "warning"
+	LintNotice  LintLevel = "notice"
+)
+
+var lintRanks = map[LintLevel]int{
+	LintNotice: 1, LintWarning: 2, LintError: 3,
+}
+
+// Parses a lint level name.
+func ParseLintLevel(s string) (LintLevel, error) {
+	l := LintLevel(strings.ToLower(s))
+	if _, ok := lintRanks[l]; !ok {
+		return "", fmt.Errorf("unknown lint level %q, levels are "+
+			"error, warning and notice", s)
+	}
+	return l, nil
+}
+
+// Whether the level is as serious as another, or more.
+func (l LintLevel) AtLeast(m LintLevel) bool {
+	return lintRanks[l] >= lintRanks[m]
+}
+
+// Something a lint check found.  Check names are stable, so they can be
+// filtered on.
+type LintFinding struct {
+	Level   LintLevel `json:"level"`
+	Check   string    `json:"check"`
+	Message string    `json:"message"`
+}
+
+func (f LintFinding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Level, f.Check, f.Message)
+}
+
+// CA/Browser Forum Baseline Requirements limits.
+const (
+	maxServerValidity = 398 * 24 * time.Hour
+	maxLeafValidity   = 825 * 24 * time.Hour
+	minSerialBits     = 64
+	maxSerialOctets   = 20
+)
+
+type linter struct {
+	cert     *x509.Certificate
+	findings []LintFinding
+}
+
+func (l *linter) add(level LintLevel, check string, format string,
+	args ...interface{}) {
+	l.findings = append(l.findings, LintFinding{
+		Level:   level,
+		Check:   check,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Checks a certificate against RFC 5280 and the CA/Browser Forum
+// Baseline Requirements.
+func LintCertificate(cert *x509.Certificate) []LintFinding {
+
+	l := &linter{cert: cert}
+	l.serial()
+	l.validity()
+	l.keyIdentifiers()
+	l.names()
+	l.signature()
+	l.usage()
+	l.key()
+
+	return l.findings
+
+}
+
+// Checks a certificate request's signature, names, signature algorithm
+// and key.
+func LintRequest(csr *x509.CertificateRequest) []LintFinding {
+
+	// The checks which apply to a request work on what it would give
+	// a certificate.
+	l := &linter{cert: &x509.Certificate{
+		Subject:            csr.Subject,
+		RawSubject:         csr.RawSubject,
+		DNSNames:           csr.DNSNames,
+		EmailAddresses:     csr.EmailAddresses,
+		IPAddresses:        csr.IPAddresses,
+		URIs:               csr.URIs,
+		Extensions:         csr.Extensions,
+		PublicKey:          csr.PublicKey,
+		PublicKeyAlgorithm: csr.PublicKeyAlgorithm,
+		SignatureAlgorithm: csr.SignatureAlgorithm,
+	}}
+
+	if err := csr.CheckSignature(); err != nil {
+		l.add(LintError, "request-signature", "request signature "+
+			"doesn't verify: %s", err)
+	}
+	l.names()
+	l.signature()
+	l.key()
+
+	return l.findings
+
+}
+
+// The most serious level found, empty if nothing was.
+func WorstLint(findings []LintFinding) LintLevel {
+	var worst LintLevel
+	for _, f := range findings {
+		if lintRanks[f.Level] > lintRanks[worst] {
+			worst = f.Level
+		}
+	}
+	return worst
+}
+
+func (l *linter) serial() {
+
+	serial := l.cert.SerialNumber
+	if serial == nil || serial.Sign() <= 0 {
+		l.add(LintError, "serial-positive", "serial number must be "+
+			"positive")
+		return
+	}
+
+	// DER adds a zero octet when the top bit is set.
+	if octets := serial.BitLen()/8 + 1; octets > maxSerialOctets {
+		l.add(LintError, "serial-size", "serial number is %d octets, "+
+			"at most %d are allowed", octets, maxSerialOctets)
+	}
+
+	if serial.BitLen() < minSerialBits {
+		l.add(LintError, "serial-entropy", "serial number is %d bits, "+
+			"at least %d random bits are needed", serial.BitLen(),
+			minSerialBits)
+	}
+
+}
+
+func (l *linter) validity() {
+
+	cert := l.cert
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	if validity <= 0 {
+		l.add(LintError, "validity-order", "certificate expires "+
+			"before it is valid")
+		return
+	}
+
+	if cert.IsCA {
+		return
+	}
+
+	days := int64(validity.Hours() / 24)
+	if hasExtKeyUsage(cert.ExtKeyUsage, x509.ExtKeyUsageServerAuth) &&
+		validity > maxServerValidity {
+		l.add(LintError, "validity-server", "server certificate is "+
+			"valid for %d days, at most %d are allowed", days,
+			int64(maxServerValidity.Hours()/24))
+	} else if validity > maxLeafValidity {
+		l.add(LintWarning, "validity-long", "certificate is valid for "+
+			"%d days, more than %d", days,
+			int64(maxLeafValidity.Hours()/24))
+	}
+
+}
+
+func (l *linter) keyIdentifiers() {
+
+	cert := l.cert
+	if len(cert.SubjectKeyId) == 0 {
+		if cert.IsCA {
+			l.add(LintError, "ski-missing", "CA certificate has no "+
+				"subject key identifier")
+		} else {
+			l.add(LintNotice, "ski-missing", "certificate has no "+
+				"subject key identifier")
+		}
+	}
+
+	selfIssued := bytes.Equal(cert.RawIssuer, cert.RawSubject)
+	if len(cert.AuthorityKeyId) == 0 && !selfIssued {
+		l.add(LintError, "aki-missing", "certificate has no authority "+
+			"key identifier")
+	}
+
+}
+
+func (l *linter) names() {
+
+	cert := l.cert
+
+	var san *SANs
+	critical := false
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(OidSubjectAltName) {
+			critical = ext.Critical
+			san, _ = ParseSANs(ext.Value)
+		}
+	}
+	if san == nil {
+		san = &SANs{}
+	}
+
+	if len(cert.Subject.Names) == 0 {
+		if san.Empty() {
+			l.add(LintError, "subject-empty", "subject is empty and "+
+				"there are no SANs")
+		} else if !critical {
+			l.add(LintError, "subject-empty-san-critical", "subject "+
+				"is empty, so the SAN extension must be critical")
+		}
+	}
+
+	if hasExtKeyUsage(cert.ExtKeyUsage, x509.ExtKeyUsageServerAuth) &&
+		!cert.IsCA && len(san.DNSNames) == 0 &&
+		len(san.IPAddresses) == 0 {
+		l.add(LintError, "server-no-sans", "server certificate has no "+
+			"DNS name or IP address SANs")
+	}
+
+	// CA names needn't be SANs.
+	cn := cert.Subject.CommonName
+	if cn == "" || san.Empty() || cert.IsCA {
+		return
+	}
+	for _, n := range san.DNSNames {
+		if strings.EqualFold(n, cn) {
+			return
+		}
+	}
+	for _, e := range san.EmailAddresses {
+		if strings.EqualFold(e, cn) {
+			return
+		}
+	}
+	for _, u := range san.URIs {
+		if u.String() == cn {
+			return
+		}
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		for _, i := range san.IPAddresses {
+			if i.Equal(ip) {
+				return
+			}
+		}
+	}
+	l.add(LintWarning, "cn-not-in-sans", "common name %q is not one of "+
+		"the SANs", cn)
+
+}
+
+func (l *linter) signature() {
+
+	switch alg := l.cert.SignatureAlgorithm; alg {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA,
+		x509.DSAWithSHA1, x509.DSAWithSHA256, x509.ECDSAWithSHA1:
+		l.add(LintError, "signature-deprecated", "signature algorithm "+
+			"%s is deprecated", alg)
+	case x509.UnknownSignatureAlgorithm:
+		l.add(LintWarning, "signature-unknown", "signature algorithm "+
+			"is unknown")
+	}
+
+}
+
+func (l *linter) usage() {
+
+	cert := l.cert
+	ku := cert.KeyUsage
+
+	if cert.IsCA {
+		if !cert.BasicConstraintsValid {
+			l.add(LintError, "ca-basic-constraints", "CA certificate "+
+				"has no basic constraints")
+		}
+		if ku == 0 {
+			l.add(LintError, "ca-key-usage", "CA certificate has no "+
+				"key usage")
+		} else if ku&x509.KeyUsageCertSign == 0 {
+			l.add(LintError, "ca-key-usage", "CA certificate key "+
+				"usage doesn't include certificate signing")
+		}
+		return
+	}
+
+	if ku&x509.KeyUsageCertSign != 0 {
+		l.add(LintError, "usage-cert-sign", "certificate signing key "+
+			"usage in a certificate which isn't a CA")
+	}
+
+	if ku == 0 {
+		return
+	}
+
+	_, isRSA := cert.PublicKey.(*rsa.PublicKey)
+
+	if hasExtKeyUsage(cert.ExtKeyUsage, x509.ExtKeyUsageServerAuth) &&
+		ku&(x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment) == 0 {
+		l.add(LintWarning, "usage-server-auth", "server "+
+			"authentication without digital signature or key "+
+			"encipherment key usage")
+	}
+
+	if hasExtKeyUsage(cert.ExtKeyUsage, x509.ExtKeyUsageClientAuth) &&
+		ku&(x509.KeyUsageDigitalSignature|x509.KeyUsageKeyAgreement) == 0 {
+		l.add(LintWarning, "usage-client-auth", "client "+
+			"authentication without digital signature or key "+
+			"agreement key usage")
+	}
+
+	if hasExtKeyUsage(cert.ExtKeyUsage, x509.ExtKeyUsageCodeSigning) &&
+		ku&x509.KeyUsageDigitalSignature == 0 {
+		l.add(LintWarning, "usage-code-signing", "code signing "+
+			"without digital signature key usage")
+	}
+
+	if !isRSA && ku&(x509.KeyUsageKeyEncipherment|x509.KeyUsageDataEncipherment) != 0 {
+		l.add(LintNotice, "usage-encipherment", "encipherment key "+
+			"usage with an %s key, which can't encipher",
+			cert.PublicKeyAlgorithm)
+	}
+
+}
+
+func (l *linter) key() {
+
+	switch pub := l.cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			l.add(LintError, "key-weak", "RSA key is %d bits, at "+
+				"least 2048 are needed", pub.N.BitLen())
+		}
+		if pub.E < 65537 || pub.E%2 == 0 {
+			l.add(LintWarning, "key-rsa-exponent", "RSA public "+
+				"exponent %d is small or even", pub.E)
+		}
+	case *ecdsa.PublicKey:
+		if bits := pub.Curve.Params().BitSize; bits < 256 {
+			l.add(LintError, "key-weak", "EC key is %d bits, at "+
+				"least 256 are needed", bits)
+		}
+	case *dsa.PublicKey:
+		l.add(LintError, "key-weak", "DSA keys are deprecated")
+	case ed25519.PublicKey:
+	default:
+		l.add(LintWarning, "key-unknown", "public key type is unknown")
+	}
+
+}
+
+// Makes the certificate a template will give, signed by a throwaway key
+// of the same type as the issuer's, so it can be linted before the real
+// signature exists.
+func presign(template, parent *x509.Certificate, pub interface{}) (*x509.Certificate, error) {
+
+	gen := KeyAlgorithms["ecdsa-p256"]
+	switch signatureKeyAlgorithm(template.SignatureAlgorithm) {
+	case x509.RSA:
+		gen = KeyAlgorithms["rsa-2048"]
+	case x509.Ed25519:
+		gen = KeyAlgorithms["ed25519"]
+	}
+
+	key, err := gen()
+	if err != nil {
+		return nil, err
+	}
+
+	p := *parent
+	p.PublicKey = key.Public()
+
+	der, err := x509.CreateCertificate(rand.Reader, template, &p,
+		pub, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate to "+
+			"lint: %s", err)
+	}
+
+	return x509.ParseCertificate(der)
+
+}
@@ -0,0 +1,1028 @@
+package cert_tools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// A manifest describes a whole hierarchy, CAs and the certificates they
+// issue, in YAML or JSON.  Planning it works out what brings the files in
+// line with it, so it can be applied again safely.
+type Manifest struct {
+	// Where files go, relative to the manifest.  Default is the
+	// manifest's directory.
+	Directory string `yaml:"directory"`
+
+	// Settings for entries which don't give them.
+	Defaults ManifestEntry `yaml:"defaults"`
+
+	Certificates []*ManifestEntry `yaml:"certificates"`
+
+	dir string
+}
+
+// A certificate in a manifest.  Its files are NAME.key, NAME.pem, the
+// certificate, NAME-chain.pem, the certificate followed by its issuers,
+// and, if asked for, NAME.crl and NAME.p12.
+type ManifestEntry struct {
+	Name string `yaml:"name"`
+
+	// Name of the issuing entry, empty for a self-signed root.
+	Issuer string `yaml:"issuer"`
+
+	// Key to use instead of NAME.key, a file relative to the directory
+	// or a pkcs11:, plugin:, unix: or shares: key.  Otherwise the key is
+	// created if it doesn't exist.
+	Key          string `yaml:"key"`
+	KeyAlgorithm string `yaml:"key-algorithm"`
+
+	SignatureAlgorithm string `yaml:"signature-algorithm"`
+
+	Subject            string   `yaml:"subject"`
+	CommonName         string   `yaml:"common-name"`
+	Country            []string `yaml:"country"`
+	Province           []string `yaml:"province"`
+	Locality           []string `yaml:"locality"`
+	OrganizationalUnit []string `yaml:"organisational-unit"`
+	Organization       []string `yaml:"organisation"`
+	Attributes         []string `yaml:"attributes"`
+
+	Email      []string `yaml:"email"`
+	Hosts      []string `yaml:"hosts"`
+	URIs       []string `yaml:"uris"`
+	OtherNames []string `yaml:"other-names"`
+
+	// Profiles for issued certificates, a root is always a CA.
+	Profiles   []string `yaml:"profiles"`
+	Extensions []string `yaml:"extensions"`
+
+	// Validity in days, and how many days before expiry to issue again,
+	// default is a third of the validity.
+	Validity    int64 `yaml:"validity"`
+	RenewBefore int64 `yaml:"renew-before"`
+
+	CrlUri []string `yaml:"crl-distribution"`
+	CaUri  []string `yaml:"ca-issuers-distribution"`
+
+	// For CAs, CRL validity in days to keep NAME.crl up to date, listing
+	// the revocations in NAME.revoked.  Zero for no CRL.
+	CRLValidity int64 `yaml:"crl-validity"`
+
+	// Whether to write NAME.p12 with the key and chain.
+	P12         bool   `yaml:"p12"`
+	P12Password string `yaml:"p12-password"`
+
+	// Whether the certificate is revoked, which adds it to the issuer's
+	// NAME.revoked.  It isn't issued again.
+	Revoked bool `yaml:"revoked"`
+}
+
+// Settings defaults don't give.
+var manifestOwnFields = map[string]bool{
+	"name": true, "issuer": true, "key": true, "crl-validity": true,
+	"revoked": true,
+}
+
+// Reads a manifest, checking each entry's issuer is a CA in it, and
+// ordering entries so issuers come first.
+func ReadManifest(file string) (*Manifest, error) {
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(m); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	m.dir = filepath.Join(filepath.Dir(file), m.Directory)
+
+	entries := map[string]*ManifestEntry{}
+	for _, e := range m.Certificates {
+		if e.Name == "" || strings.ContainsAny(e.Name, "/\\") ||
+			strings.HasPrefix(e.Name, ".") {
+			return nil, fmt.Errorf("invalid certificate name %q",
+				e.Name)
+		}
+		if entries[e.Name] != nil {
+			return nil, fmt.Errorf("certificate %s given twice",
+				e.Name)
+		}
+		entries[e.Name] = e
+		e.applyDefaults(&m.Defaults)
+	}
+
+	for _, e := range m.Certificates {
+		if e.Issuer == "" {
+			if e.Revoked {
+				return nil, fmt.Errorf("%s: roots can't be "+
+					"revoked", e.Name)
+			}
+			continue
+		}
+		issuer := entries[e.Issuer]
+		if issuer == nil {
+			return nil, fmt.Errorf("%s: no issuer %s", e.Name,
+				e.Issuer)
+		}
+		if !issuer.IsCA() {
+			return nil, fmt.Errorf("%s: issuer %s isn't a CA",
+				e.Name, e.Issuer)
+		}
+		if len(e.Profiles) == 0 {
+			return nil, fmt.Errorf("%s: no profiles", e.Name)
+		}
+	}
+
+	for _, e := range m.Certificates {
+		if e.CRLValidity != 0 && !e.IsCA() {
+			return nil, fmt.Errorf("%s: only CAs have CRLs", e.Name)
+		}
+		if e.P12 && e.Key != "" && !isFileKey(e.Key) {
+			return nil, fmt.Errorf("%s: a p12 needs the key in a "+
+				"file", e.Name)
+		}
+	}
+
+	// Issuers first.
+	ordered := []*ManifestEntry{}
+	state := map[string]int{}
+	var visit func(e *ManifestEntry) error
+	visit = func(e *ManifestEntry) error {
+		switch state[e.Name] {
+		case 1:
+			return fmt.Errorf("%s: issuers form a loop", e.Name)
+		case 2:
+			return nil
+		}
+		state[e.Name] = 1
+		if e.Issuer != "" {
+			if err := visit(entries[e.Issuer]); err != nil {
+				return err
+			}
+		}
+		state[e.Name] = 2
+		ordered = append(ordered, e)
+		return nil
+	}
+	for _, e := range m.Certificates {
+		if err := visit(e); err != nil {
+			return nil, err
+		}
+	}
+	m.Certificates = ordered
+
+	return m, nil
+
+}
+
+func (e *ManifestEntry) applyDefaults(d *ManifestEntry) {
+	v := reflect.ValueOf(e).Elem()
+	dv := reflect.ValueOf(d).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("yaml")
+		if manifestOwnFields[name] || !v.Field(i).IsZero() {
+			continue
+		}
+		v.Field(i).Set(dv.Field(i))
+	}
+	if e.Validity == 0 {
+		e.Validity = 90
+	}
+	if e.KeyAlgorithm == "" {
+		e.KeyAlgorithm = "ecdsa-p256"
+	}
+}
+
+// Whether the entry is a root or has the ca profile.
+func (e *ManifestEntry) IsCA() bool {
+	if e.Issuer == "" {
+		return true
+	}
+	for _, p := range e.Profiles {
+		if p == "ca" {
+			return true
+		}
+	}
+	return false
+}
+
+func isFileKey(name string) bool {
+	return !IsSharesKey(name) && !IsPluginKey(name) && !IsPKCS11URI(name)
+}
+
+// Something to do to a file to bring it in line with a manifest.
+type ManifestAction struct {
+	File string
+
+	// "create" for keys, "issue" for certificates and CRLs, "write" for
+	// chains and p12 files, or "revoke" for revocation lists.
+	Action string
+	Reason string
+
+	// For issued and revoked certificates, the certificate and its
+	// issuer, and the profiles of issued certificates.  For issued
+	// CRLs, the issuer and the serials the CRL revokes.
+	Certificate *x509.Certificate
+	Issuer      *x509.Certificate
+	Profiles    []string
+	Revoked     []string
+
+	data []byte
+	perm os.FileMode
+}
+
+func (a *ManifestAction) String() string {
+	return fmt.Sprintf("%s: %s, %s", a.File, a.Action, a.Reason)
+}
+
+// What building a manifest would do, worked out without changing
+// anything.  New keys and certificates are held in the plan until it's
+// applied.
+type ManifestPlan struct {
+	Dir     string
+	Actions []*ManifestAction
+
+	keys []*Key
+}
+
+type manifestBuild struct {
+	m     *Manifest
+	now   time.Time
+	keys  map[string]*Key
+	certs map[string]*x509.Certificate
+	plan  *ManifestPlan
+
+	// Files as the plan leaves them.
+	files map[string][]byte
+}
+
+// Works out what brings the files in line with the manifest: keys to
+// create, certificates to issue because they are missing, expiring or no
+// longer match the manifest, chains, CRLs and p12 files to write, and
+// certificates to revoke.  Existing keys are reused.
+func (m *Manifest) Plan() (*ManifestPlan, error) {
+
+	b := &manifestBuild{
+		m:     m,
+		now:   time.Now(),
+		keys:  map[string]*Key{},
+		certs: map[string]*x509.Certificate{},
+		plan:  &ManifestPlan{Dir: m.dir},
+		files: map[string][]byte{},
+	}
+
+	fail := func(e *ManifestEntry, err error) (*ManifestPlan, error) {
+		b.plan.Zeroise()
+		return nil, fmt.Errorf("%s: %s", e.Name, err)
+	}
+
+	for _, e := range m.Certificates {
+		if err := b.entry(e); err != nil {
+			return fail(e, err)
+		}
+	}
+
+	// CRLs last, so they include this plan's revocations.
+	for _, e := range m.Certificates {
+		if e.CRLValidity == 0 || b.certs[e.Name] == nil {
+			continue
+		}
+		if err := b.crl(e); err != nil {
+			return fail(e, err)
+		}
+	}
+
+	return b.plan, nil
+
+}
+
+// Carries out the plan's actions in order, and returns how many were
+// done, which on error is those before it.  Keys are created only if
+// they still don't exist.
+func (p *ManifestPlan) Apply() (int, error) {
+
+	if err := os.MkdirAll(p.Dir, 0755); err != nil {
+		return 0, err
+	}
+
+	for n, a := range p.Actions {
+
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if a.Action == "create" {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		}
+
+		f, err := os.OpenFile(a.File, flags, a.perm)
+		if err != nil {
+			return n, err
+		}
+		_, err = f.Write(a.data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return n, err
+		}
+
+	}
+
+	return len(p.Actions), nil
+
+}
+
+// Overwrites the keys the plan holds, and the key data it would write.
+func (p *ManifestPlan) Zeroise() {
+	for _, k := range p.keys {
+		k.Zeroise()
+	}
+	for _, a := range p.Actions {
+		if a.Action == "create" {
+			zero(a.data)
+		}
+	}
+}
+
+func (b *manifestBuild) path(name string) string {
+	return filepath.Join(b.m.dir, name)
+}
+
+// A file's contents once the plan so far is applied.
+func (b *manifestBuild) read(file string) ([]byte, error) {
+	if data, ok := b.files[file]; ok {
+		return data, nil
+	}
+	return os.ReadFile(file)
+}
+
+// Adds writing a file to the plan, if its contents change.
+func (b *manifestBuild) write(file, action, reason string, data []byte, perm os.FileMode) *ManifestAction {
+	a := &ManifestAction{
+		File:   file,
+		Action: action,
+		Reason: reason,
+		data:   data,
+		perm:   perm,
+	}
+	b.plan.Actions = append(b.plan.Actions, a)
+	b.files[file] = data
+	return a
+}
+
+func (b *manifestBuild) entry(e *ManifestEntry) error {
+
+	key, err := b.key(e)
+	if err != nil {
+		return err
+	}
+	b.keys[e.Name] = key
+
+	var issuer *Issuer
+	if e.Issuer != "" {
+		if b.certs[e.Issuer] == nil || b.keys[e.Issuer] == nil {
+			return fmt.Errorf("issuer %s has no certificate or key",
+				e.Issuer)
+		}
+		issuer = &Issuer{
+			Cert: b.certs[e.Issuer],
+			Key:  b.keys[e.Issuer].Signer(),
+		}
+	}
+
+	file := b.path(e.Name + ".pem")
+
+	// Revoked certificates are left as they are.  There's nothing to
+	// revoke if none was issued, but one which can't be read or wasn't
+	// issued by this issuer is an error, not a revocation left out.
+	if e.Revoked {
+		cert, err := b.readCertificate(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if err := cert.CheckSignatureFrom(issuer.Cert); err != nil {
+			return fmt.Errorf("%s wasn't issued by %s: %s", file,
+				e.Issuer, err)
+		}
+		b.certs[e.Name] = cert
+		return b.revoke(e, cert, issuer.Cert)
+	}
+
+	if key == nil {
+		return fmt.Errorf("no key")
+	}
+
+	cert, reason := b.current(e, file, key, issuer)
+
+	if reason != "" {
+		if issuer == nil {
+			cert, err = e.selfSign(key)
+		} else {
+			cert, err = e.issue(key, issuer)
+		}
+		if err != nil {
+			return err
+		}
+		a := b.write(file, "issue", reason, pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+		a.Certificate = cert
+		a.Issuer = cert
+		a.Profiles = e.Profiles
+		if issuer != nil {
+			a.Issuer = issuer.Cert
+		}
+	}
+	b.certs[e.Name] = cert
+
+	// The certificate then its issuers.
+	chain := []*x509.Certificate{cert}
+	for n := e.Issuer; n != ""; n = b.entryByName(n).Issuer {
+		chain = append(chain, b.certs[n])
+	}
+
+	var buf bytes.Buffer
+	for _, c := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	file = b.path(e.Name + "-chain.pem")
+	chainChanged := false
+	if old, err := b.read(file); err != nil || !bytes.Equal(old, buf.Bytes()) {
+		b.write(file, "write", fileReason(err, "chain changed"),
+			buf.Bytes(), 0644)
+		chainChanged = true
+	}
+
+	// The p12 holds the chain too.
+	if e.P12 {
+		file = b.path(e.Name + ".p12")
+		if _, err := b.read(file); chainChanged || err != nil {
+			p12, perr := pkcs12.Modern.Encode(key.Signer(), cert,
+				chain[1:], e.P12Password)
+			if perr != nil {
+				return perr
+			}
+			b.write(file, "write", fileReason(err, "chain changed"),
+				p12, 0600)
+		}
+	}
+
+	return nil
+
+}
+
+// Why a file is written, given the error from reading it.
+func fileReason(err error, reason string) string {
+	if os.IsNotExist(err) {
+		return "missing"
+	}
+	return reason
+}
+
+func (b *manifestBuild) entryByName(name string) *ManifestEntry {
+	for _, e := range b.m.Certificates {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+func (b *manifestBuild) readCertificate(file string) (*x509.Certificate, error) {
+	raw, err := b.read(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// The entry's key, created if it doesn't exist, unless the entry is
+// revoked.
+func (b *manifestBuild) key(e *ManifestEntry) (*Key, error) {
+
+	if e.Key != "" && !isFileKey(e.Key) {
+		return ReadKey(e.Key)
+	}
+
+	file := b.path(e.Name + ".key")
+	if e.Key != "" {
+		file = b.path(e.Key)
+	}
+
+	if _, err := os.Stat(file); err == nil {
+		key, err := ReadKeyFromFile(file)
+		if err == nil {
+			b.plan.keys = append(b.plan.keys, key)
+		}
+		return key, err
+	}
+
+	if e.Revoked {
+		return nil, nil
+	}
+
+	key, err := GenerateKey(e.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	b.plan.keys = append(b.plan.keys, key)
+
+	var buf bytes.Buffer
+	if err := key.OutputPem(&buf); err != nil {
+		return nil, err
+	}
+	b.write(file, "create", e.KeyAlgorithm+" key", buf.Bytes(), 0600)
+
+	return key, nil
+
+}
+
+// An existing certificate, and why it needs issuing again if it does.
+func (b *manifestBuild) current(e *ManifestEntry, file string, key *Key, issuer *Issuer) (*x509.Certificate, string) {
+
+	if _, err := b.read(file); err != nil {
+		return nil, fileReason(err, "unreadable")
+	}
+
+	cert, err := b.readCertificate(file)
+	if err != nil {
+		return nil, "unreadable"
+	}
+
+	if !publicKeysEqual(cert.PublicKey, key.Public()) {
+		return cert, "key changed"
+	}
+
+	signer := cert
+	if issuer != nil {
+		signer = issuer.Cert
+	}
+	if !bytes.Equal(cert.RawIssuer, signer.RawSubject) ||
+		cert.CheckSignatureFrom(signer) != nil {
+		return cert, "issuer changed"
+	}
+
+	if b.now.After(cert.NotAfter) {
+		return cert, "expired"
+	}
+
+	renew := time.Duration(e.RenewBefore*24) * time.Hour
+	if e.RenewBefore == 0 {
+		renew = time.Duration(e.Validity*24) * time.Hour / 3
+	}
+	if left := cert.NotAfter.Sub(b.now); left < renew {
+		return cert, fmt.Sprintf("expires in %d days",
+			int(left.Hours()/24))
+	}
+
+	if reason, err := e.differences(cert, issuer); err != nil {
+		return cert, err.Error()
+	} else if reason != "" {
+		return cert, reason
+	}
+
+	return cert, ""
+
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(x crypto.PublicKey) bool })
+	if !ok {
+		return false
+	}
+	return k.Equal(b)
+}
+
+// How a certificate differs from what the entry describes, in subject,
+// SANs, usages and distribution points.
+func (e *ManifestEntry) differences(cert *x509.Certificate, issuer *Issuer) (string, error) {
+
+	rdns, err := e.subject()
+	if err != nil {
+		return "", err
+	}
+	subject, err := asn1.Marshal(rdns)
+	if err != nil {
+		return "", err
+	}
+
+	sans, err := e.sans()
+	if err != nil {
+		return "", err
+	}
+
+	profiles := []*Profile{}
+	if issuer != nil {
+		profiles, err = GetProfiles(e.Profiles)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Some profiles put the email address in the subject.
+	for _, p := range profiles {
+		if p.EmailInSubject && len(sans.EmailAddresses) > 0 {
+			subject, _, err = AddEmailToSubject(subject,
+				sans.EmailAddresses[0])
+			if err != nil {
+				return "", err
+			}
+			break
+		}
+	}
+
+	if !bytes.Equal(cert.RawSubject, subject) {
+		return "subject changed", nil
+	}
+
+	have := &SANs{}
+	if s, err := SANsFromExtensions(cert.Extensions); err == nil && s != nil {
+		have = s
+	}
+	if missing, extra := stringsDiff(sans.Strings(), have.Strings()); len(missing) > 0 {
+		return "SANs missing " + strings.Join(missing, " "), nil
+	} else if len(extra) > 0 {
+		return "SANs not wanted " + strings.Join(extra, " "), nil
+	}
+
+	// Usages the profiles give, or a root has.
+	want := x509.Certificate{}
+	if issuer == nil {
+		want.KeyUsage = x509.KeyUsageCertSign |
+			x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign
+		want.IsCA = true
+	} else {
+		want.KeyUsage = x509.KeyUsageDigitalSignature
+		for _, p := range profiles {
+			p.Apply(&want)
+		}
+	}
+	if cert.KeyUsage != want.KeyUsage || cert.IsCA != want.IsCA ||
+		!sameExtKeyUsage(cert.ExtKeyUsage, want.ExtKeyUsage) {
+		return "profiles changed", nil
+	}
+
+	crlUri, caUri := e.CrlUri, e.CaUri
+	if issuer != nil && len(crlUri) == 0 {
+		crlUri = issuer.Cert.CRLDistributionPoints
+	}
+	if issuer != nil && len(caUri) == 0 {
+		caUri = issuer.Cert.IssuingCertificateURL
+	}
+	if !sameStrings(cert.CRLDistributionPoints, crlUri) ||
+		!sameStrings(cert.IssuingCertificateURL, caUri) {
+		return "distribution points changed", nil
+	}
+
+	return "", nil
+
+}
+
+// Strings in a but not b, and in b but not a.
+func stringsDiff(a, b []string) ([]string, []string) {
+	in := func(s string, l []string) bool {
+		for _, v := range l {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+	missing, extra := []string{}, []string{}
+	for _, s := range a {
+		if !in(s, b) {
+			missing = append(missing, s)
+		}
+	}
+	for _, s := range b {
+		if !in(s, a) {
+			extra = append(extra, s)
+		}
+	}
+	return missing, extra
+}
+
+func sameStrings(a, b []string) bool {
+	missing, extra := stringsDiff(a, b)
+	return len(missing) == 0 && len(extra) == 0
+}
+
+func sameExtKeyUsage(a, b []x509.ExtKeyUsage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, u := range a {
+		if !hasExtKeyUsage(b, u) {
+			return false
+		}
+	}
+	return true
+}
+
+// Adds a certificate to its issuer's revocation list, unless it's there.
+func (b *manifestBuild) revoke(e *ManifestEntry, cert, issuer *x509.Certificate) error {
+
+	file := b.path(e.Issuer + ".revoked")
+
+	old, err := b.read(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	revoked, err := parseRevoked(bytes.NewReader(old))
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	for _, r := range revoked {
+		if r.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return nil
+		}
+	}
+
+	data := append(append([]byte{}, old...), []byte(fmt.Sprintf(
+		"%X,%s\n", cert.SerialNumber,
+		b.now.UTC().Format(time.RFC3339)))...)
+
+	a := b.write(file, "revoke", fmt.Sprintf("%s serial %X", e.Name,
+		cert.SerialNumber), data, 0644)
+	a.Certificate = cert
+	a.Issuer = issuer
+
+	return nil
+
+}
+
+func (e *ManifestEntry) subject() (pkix.RDNSequence, error) {
+	return BuildSubject(e.Subject, pkix.Name{
+		Country:            e.Country,
+		Province:           e.Province,
+		Locality:           e.Locality,
+		OrganizationalUnit: e.OrganizationalUnit,
+		Organization:       e.Organization,
+		CommonName:         e.CommonName,
+	}, e.Attributes)
+}
+
+func (e *ManifestEntry) sans() (*SANs, error) {
+	sans := &SANs{EmailAddresses: e.Email}
+	sans.AddHosts(e.Hosts)
+	if err := sans.AddURIs(e.URIs); err != nil {
+		return nil, err
+	}
+	if err := sans.AddOtherNames(e.OtherNames); err != nil {
+		return nil, err
+	}
+	return sans, nil
+}
+
+// Issues the entry's certificate from a request made with its key.
+func (e *ManifestEntry) issue(key *Key, issuer *Issuer) (*x509.Certificate, error) {
+
+	rdns, err := e.subject()
+	if err != nil {
+		return nil, err
+	}
+	rawSubject, err := asn1.Marshal(rdns)
+	if err != nil {
+		return nil, err
+	}
+
+	sans, err := e.sans()
+	if err != nil {
+		return nil, err
+	}
+	if len(rdns) == 0 && sans.Empty() {
+		return nil, fmt.Errorf("needs a subject or at least one SAN")
+	}
+
+	template := x509.CertificateRequest{RawSubject: rawSubject}
+	if !sans.Empty() {
+		ext, err := sans.Extension(len(rdns) == 0)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = []pkix.Extension{ext}
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template,
+		key.Signer())
+	if err != nil {
+		return nil, err
+	}
+	csr, err := ParseCSR(der)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, err := GetProfiles(e.Profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	extensions, err := ParseExtensions(e.Extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	issued, err := issuer.Issue(csr, IssueOptions{
+		Validity:           time.Duration(e.Validity*24) * time.Hour,
+		Profiles:           profiles,
+		SignatureAlgorithm: e.SignatureAlgorithm,
+		Extensions:         extensions,
+		CrlUri:             e.CrlUri,
+		CaUri:              e.CaUri,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return issued.Certificate, nil
+
+}
+
+// Creates a root CA certificate, as create-ca-cert does.
+func (e *ManifestEntry) selfSign(key *Key) (*x509.Certificate, error) {
+
+	sigAlg, err := SignatureAlgorithm(key.Public(), e.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := NewSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	rdns, err := e.subject()
+	if err != nil {
+		return nil, err
+	}
+	if len(rdns) == 0 {
+		return nil, fmt.Errorf("CA certificate needs a subject")
+	}
+	rawSubject, err := asn1.Marshal(rdns)
+	if err != nil {
+		return nil, err
+	}
+
+	sans, err := e.sans()
+	if err != nil {
+		return nil, err
+	}
+
+	extensions, err := ParseExtensions(e.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	if len(sans.OtherNames) > 0 {
+		ext, err := sans.Extension(false)
+		if err != nil {
+			return nil, err
+		}
+		extensions, err = AddExtension(extensions, ext)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	ski := sha256.Sum256(pub)
+
+	notBefore := time.Now().UTC()
+
+	template := x509.Certificate{
+		SignatureAlgorithm: sigAlg,
+
+		SerialNumber: serial,
+		RawSubject:   rawSubject,
+
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(time.Duration(e.Validity*24) * time.Hour),
+
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCRLSign,
+
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+
+		SubjectKeyId: ski[:],
+
+		EmailAddresses: sans.EmailAddresses,
+		DNSNames:       sans.DNSNames,
+		IPAddresses:    sans.IPAddresses,
+		URIs:           sans.URIs,
+
+		CRLDistributionPoints: e.CrlUri,
+		IssuingCertificateURL: e.CaUri,
+
+		ExtraExtensions: extensions,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		key.Public(), key.Signer())
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+
+}
+
+// Keeps a CA's CRL current: it's issued again when missing, signed by an
+// older CA certificate, past half its validity or out of step with the
+// revocation list.
+func (b *manifestBuild) crl(e *ManifestEntry) error {
+
+	ca := &Issuer{Cert: b.certs[e.Name], Key: b.keys[e.Name].Signer()}
+	file := b.path(e.Name + ".crl")
+	validity := time.Duration(e.CRLValidity*24) * time.Hour
+
+	raw, err := b.read(b.path(e.Name + ".revoked"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	revoked, err := parseRevoked(bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("%s.revoked: %s", e.Name, err)
+	}
+
+	reason := ""
+	if raw, err := b.read(file); err != nil {
+		reason = fileReason(err, "unreadable")
+	} else if block, _ := pem.Decode(raw); block == nil {
+		reason = "unreadable"
+	} else if crl, err := x509.ParseRevocationList(block.Bytes); err != nil {
+		reason = "unreadable"
+	} else if crl.CheckSignatureFrom(ca.Cert) != nil {
+		reason = "CA certificate changed"
+	} else if crl.NextUpdate.Sub(crl.ThisUpdate) != validity {
+		reason = "validity changed"
+	} else if b.now.After(crl.ThisUpdate.Add(validity / 2)) {
+		reason = "due for update"
+	} else if !sameRevoked(crl.RevokedCertificateEntries, revoked) {
+		reason = "revocations changed"
+	}
+
+	if reason == "" {
+		return nil
+	}
+
+	der, err := ca.CreateCRL(revoked, validity)
+	if err != nil {
+		return err
+	}
+	a := b.write(file, "issue", reason, pem.EncodeToMemory(
+		&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+	a.Issuer = ca.Cert
+	a.Revoked = []string{}
+	for _, r := range revoked {
+		a.Revoked = append(a.Revoked, fmt.Sprintf("%X", r.SerialNumber))
+	}
+
+	return nil
+
+}
+
+func sameRevoked(have []x509.RevocationListEntry, want []pkix.RevokedCertificate) bool {
+	if len(have) != len(want) {
+		return false
+	}
+	reasons := map[string]int{}
+	for _, r := range have {
+		reasons[r.SerialNumber.String()] = r.ReasonCode
+	}
+	for _, r := range want {
+		reason, ok := reasons[r.SerialNumber.String()]
+		if !ok || reason != entryReason(r) {
+			return false
+		}
+	}
+	return true
+}
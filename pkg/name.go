@@ -0,0 +1,253 @@
+package cert_tools
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Attribute type short names recognised in distinguished names, RFC 4514
+// section 3 plus the common extras.
+var attributeTypes = map[string]asn1.ObjectIdentifier{
+	"CN":           {2, 5, 4, 3},
+	"SN":           {2, 5, 4, 4},
+	"SERIALNUMBER": {2, 5, 4, 5},
+	"C":            {2, 5, 4, 6},
+	"L":            {2, 5, 4, 7},
+	"ST":           {2, 5, 4, 8},
+	"STREET":       {2, 5, 4, 9},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+	"TITLE":        {2, 5, 4, 12},
+	"POSTALCODE":   {2, 5, 4, 17},
+	"GN":           {2, 5, 4, 42},
+	"UID":          {0, 9, 2342, 19200300, 100, 1, 1},
+	"DC":           {0, 9, 2342, 19200300, 100, 1, 25},
+	"EMAILADDRESS": {1, 2, 840, 113549, 1, 9, 1},
+	"E":            {1, 2, 840, 113549, 1, 9, 1},
+}
+
+// Attributes which must be IA5String rather than PrintableString or
+// UTF8String.
+var ia5Attributes = []asn1.ObjectIdentifier{
+	{0, 9, 2342, 19200300, 100, 1, 25},
+	{1, 2, 840, 113549, 1, 9, 1},
+}
+
+// Parses an attribute type, either a short name or a dotted OID.
+func ParseAttributeType(s string) (asn1.ObjectIdentifier, error) {
+	s = strings.TrimSpace(s)
+	if oid, ok := attributeTypes[strings.ToUpper(s)]; ok {
+		return oid, nil
+	}
+	oid, err := ParseOID(strings.TrimPrefix(strings.ToUpper(s), "OID."))
+	if err != nil {
+		return nil, fmt.Errorf("unknown attribute type %q", s)
+	}
+	return oid, nil
+}
+
+// Parses a single TYPE=VALUE attribute, using RFC 4514 value syntax.
+func ParseAttribute(s string) (pkix.AttributeTypeAndValue, error) {
+
+	typ, val, ok := strings.Cut(s, "=")
+	if !ok {
+		return pkix.AttributeTypeAndValue{},
+			fmt.Errorf("attribute %q not of form TYPE=VALUE", s)
+	}
+
+	oid, err := ParseAttributeType(typ)
+	if err != nil {
+		return pkix.AttributeTypeAndValue{}, err
+	}
+
+	// A value beginning # is hex-encoded BER.
+	if strings.HasPrefix(val, "#") {
+		der, err := hex.DecodeString(val[1:])
+		if err != nil {
+			return pkix.AttributeTypeAndValue{},
+				fmt.Errorf("attribute %q: invalid hex value", s)
+		}
+		var raw asn1.RawValue
+		rest, err := asn1.Unmarshal(der, &raw)
+		if err != nil || len(rest) != 0 {
+			return pkix.AttributeTypeAndValue{},
+				fmt.Errorf("attribute %q: invalid BER value", s)
+		}
+		return pkix.AttributeTypeAndValue{Type: oid, Value: raw}, nil
+	}
+
+	str, err := unescapeDNValue(val)
+	if err != nil {
+		return pkix.AttributeTypeAndValue{},
+			fmt.Errorf("attribute %q: %s", s, err)
+	}
+
+	for _, ia5 := range ia5Attributes {
+		if oid.Equal(ia5) {
+			for _, c := range str {
+				if c > 127 {
+					return pkix.AttributeTypeAndValue{},
+						fmt.Errorf("attribute %q must be ASCII", s)
+				}
+			}
+			return pkix.AttributeTypeAndValue{
+				Type: oid,
+				Value: asn1.RawValue{
+					Tag: asn1.TagIA5String, Bytes: []byte(str),
+				},
+			}, nil
+		}
+	}
+
+	return pkix.AttributeTypeAndValue{Type: oid, Value: str}, nil
+
+}
+
+// Parses an RFC 4514 distinguished name string.  The string form lists the
+// most specific RDN first, which is the reverse of the ASN.1 order, so the
+// returned sequence is reversed.
+func ParseDN(s string) (pkix.RDNSequence, error) {
+
+	seq := pkix.RDNSequence{}
+
+	if strings.TrimSpace(s) == "" {
+		return seq, nil
+	}
+
+	for _, r := range splitUnescaped(s, ',') {
+		rdn := pkix.RelativeDistinguishedNameSET{}
+		for _, a := range splitUnescaped(r, '+') {
+			atv, err := ParseAttribute(a)
+			if err != nil {
+				return nil, err
+			}
+			rdn = append(rdn, atv)
+		}
+		seq = append(pkix.RDNSequence{rdn}, seq...)
+	}
+
+	return seq, nil
+
+}
+
+// Builds a subject from an optional RFC 4514 string, the individual name
+// fields and a list of extra TYPE=VALUE attributes, in that order.
+func BuildSubject(dn string, fields pkix.Name, attrs []string) (pkix.RDNSequence, error) {
+
+	seq, err := ParseDN(dn)
+	if err != nil {
+		return nil, err
+	}
+
+	seq = append(seq, fields.ToRDNSequence()...)
+
+	for _, a := range attrs {
+		atv, err := ParseAttribute(a)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, pkix.RelativeDistinguishedNameSET{atv})
+	}
+
+	return seq, nil
+
+}
+
+// OID of the emailAddress attribute.
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// Appends an emailAddress attribute to a DER subject, unless it already
+// has one.  Returns the new subject and whether it was changed.
+func AddEmailToSubject(raw []byte, email string) ([]byte, bool, error) {
+
+	var rdns pkix.RDNSequence
+	rest, err := asn1.Unmarshal(raw, &rdns)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(rest) != 0 {
+		return nil, false, fmt.Errorf("trailing data after subject")
+	}
+
+	for _, rdn := range rdns {
+		for _, atv := range rdn {
+			if atv.Type.Equal(oidEmailAddress) {
+				return raw, false, nil
+			}
+		}
+	}
+
+	// emailAddress is an IA5String, as ParseAttribute makes it.
+	rdns = append(rdns, pkix.RelativeDistinguishedNameSET{
+		{Type: oidEmailAddress, Value: asn1.RawValue{
+			Tag: asn1.TagIA5String, Bytes: []byte(email),
+		}},
+	})
+
+	out, err := asn1.Marshal(rdns)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return out, true, nil
+
+}
+
+// Splits on a separator, ignoring separators escaped with a backslash.
+func splitUnescaped(s string, sep byte) []string {
+	parts := []string{}
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == sep {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Removes RFC 4514 escaping from a value: \ followed by a special
+// character or by two hex digits.  Unescaped leading and trailing spaces
+// are dropped.
+func unescapeDNValue(s string) (string, error) {
+
+	s = strings.TrimLeft(s, " ")
+	for strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "\\ ") {
+		s = s[:len(s)-1]
+	}
+
+	out := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("trailing backslash")
+		}
+		if i+2 < len(s) {
+			if b, err := hex.DecodeString(s[i+1 : i+3]); err == nil {
+				out = append(out, b[0])
+				i += 2
+				continue
+			}
+		}
+		out = append(out, s[i+1])
+		i++
+	}
+
+	if !utf8.Valid(out) {
+		return "", fmt.Errorf("value is not valid UTF-8")
+	}
+
+	return string(out), nil
+
+}
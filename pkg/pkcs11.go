@@ -0,0 +1,149 @@
+package cert_tools
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A PKCS #11 key URI, RFC 7512.  The module comes from module-path, or
+// CERT_TOOLS_PKCS11_MODULE, and the PIN from pin-value, pin-source or
+// CERT_TOOLS_PKCS11_PIN.
+type PKCS11URI struct {
+	Token        string
+	Manufacturer string
+	Serial       string
+	Model        string
+	SlotID       *uint
+	Object       string
+	ID           []byte
+	Type         string
+
+	ModulePath string
+	PIN        string
+}
+
+// Whether a key name is a PKCS #11 URI rather than a file.
+func IsPKCS11URI(s string) bool {
+	return strings.HasPrefix(s, "pkcs11:")
+}
+
+// Parses a PKCS #11 URI.  Attribute values are percent-encoded.
+func ParsePKCS11URI(s string) (*PKCS11URI, error) {
+
+	if !IsPKCS11URI(s) {
+		return nil, fmt.Errorf("not a pkcs11: URI")
+	}
+
+	path, query, _ := strings.Cut(strings.TrimPrefix(s, "pkcs11:"), "?")
+
+	u := &PKCS11URI{}
+	pinSource := ""
+
+	attrs := func(s, sep string, set func(k, v string) error) error {
+		if s == "" {
+			return nil
+		}
+		for _, a := range strings.Split(s, sep) {
+			k, v, ok := strings.Cut(a, "=")
+			if !ok {
+				return fmt.Errorf("invalid PKCS #11 URI "+
+					"attribute %q", a)
+			}
+			v, err := url.PathUnescape(v)
+			if err != nil {
+				return fmt.Errorf("invalid PKCS #11 URI "+
+					"attribute %q", a)
+			}
+			if err := set(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := attrs(path, ";", func(k, v string) error {
+		switch k {
+		case "token":
+			u.Token = v
+		case "manufacturer":
+			u.Manufacturer = v
+		case "serial":
+			u.Serial = v
+		case "model":
+			u.Model = v
+		case "object":
+			u.Object = v
+		case "id":
+			u.ID = []byte(v)
+		case "type":
+			u.Type = v
+		case "slot-id":
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid slot-id %q", v)
+			}
+			id := uint(n)
+			u.SlotID = &id
+		case "library-manufacturer", "library-description",
+			"library-version", "slot-manufacturer",
+			"slot-description":
+		default:
+			return fmt.Errorf("unknown PKCS #11 URI attribute %q",
+				k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = attrs(query, "&", func(k, v string) error {
+		switch k {
+		case "module-path":
+			u.ModulePath = v
+		case "pin-value":
+			u.PIN = v
+		case "pin-source":
+			pinSource = strings.TrimPrefix(v, "file:")
+		default:
+			return fmt.Errorf("unsupported PKCS #11 URI query "+
+				"attribute %q", k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if u.ModulePath == "" {
+		u.ModulePath = os.Getenv("CERT_TOOLS_PKCS11_MODULE")
+	}
+	if u.ModulePath == "" {
+		return nil, fmt.Errorf("no PKCS #11 module, give module-path " +
+			"or set CERT_TOOLS_PKCS11_MODULE")
+	}
+
+	if pinSource != "" {
+		raw, err := os.ReadFile(pinSource)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PIN: %s", err)
+		}
+		u.PIN = strings.TrimRight(string(raw), "\r\n")
+	}
+	if u.PIN == "" {
+		u.PIN = os.Getenv("CERT_TOOLS_PKCS11_PIN")
+	}
+
+	if u.Object == "" && u.ID == nil {
+		return nil, fmt.Errorf("PKCS #11 URI needs an object or id")
+	}
+	if u.Type != "" && u.Type != "private" {
+		return nil, fmt.Errorf("PKCS #11 URI must name a private key")
+	}
+
+	return u, nil
+
+}
@@ -0,0 +1,495 @@
+//go:build cgo
+
+package cert_tools
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// Modules stay loaded for the life of the process, they can only be
+// initialised once.
+var pkcs11Modules = struct {
+	sync.Mutex
+	ctx map[string]*pkcs11.Ctx
+}{ctx: map[string]*pkcs11.Ctx{}}
+
+func loadPKCS11Module(path string) (*pkcs11.Ctx, error) {
+
+	pkcs11Modules.Lock()
+	defer pkcs11Modules.Unlock()
+
+	if ctx, ok := pkcs11Modules.ctx[path]; ok {
+		return ctx, nil
+	}
+
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS #11 module %s",
+			path)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, fmt.Errorf("failed to initialise PKCS #11 "+
+			"module: %s", err)
+	}
+
+	pkcs11Modules.ctx[path] = ctx
+	return ctx, nil
+
+}
+
+// Opens a logged-in session on the token the URI names.
+func (u *PKCS11URI) open(rw bool) (*pkcs11.Ctx, pkcs11.SessionHandle, error) {
+
+	ctx, err := loadPKCS11Module(u.ModulePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list PKCS #11 slots: %s",
+			err)
+	}
+
+	matches := []uint{}
+	for _, slot := range slots {
+		if u.SlotID != nil && *u.SlotID != slot {
+			continue
+		}
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if (u.Token != "" && u.Token != strings.TrimSpace(info.Label)) ||
+			(u.Manufacturer != "" &&
+				u.Manufacturer != strings.TrimSpace(info.ManufacturerID)) ||
+			(u.Serial != "" &&
+				u.Serial != strings.TrimSpace(info.SerialNumber)) ||
+			(u.Model != "" && u.Model != strings.TrimSpace(info.Model)) {
+			continue
+		}
+		matches = append(matches, slot)
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, 0, fmt.Errorf("no PKCS #11 token matches the URI")
+	case 1:
+	default:
+		return nil, 0, fmt.Errorf("%d PKCS #11 tokens match the URI",
+			len(matches))
+	}
+
+	flags := uint(pkcs11.CKF_SERIAL_SESSION)
+	if rw {
+		flags |= pkcs11.CKF_RW_SESSION
+	}
+
+	session, err := ctx.OpenSession(matches[0], flags)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open PKCS #11 session: %s",
+			err)
+	}
+
+	if u.PIN != "" {
+		err := ctx.Login(session, pkcs11.CKU_USER, u.PIN)
+		if err != nil && err != pkcs11.Error(
+			pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			ctx.CloseSession(session)
+			return nil, 0, fmt.Errorf("PKCS #11 login failed: %s",
+				err)
+		}
+	}
+
+	return ctx, session, nil
+
+}
+
+// Objects of a class matching the URI's label and ID.
+func (u *PKCS11URI) find(ctx *pkcs11.Ctx, session pkcs11.SessionHandle,
+	class uint, label string, id []byte) ([]pkcs11.ObjectHandle, error) {
+
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+	}
+	if label != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+	if id != nil {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+
+	if err := ctx.FindObjectsInit(session, tmpl); err != nil {
+		return nil, err
+	}
+	defer ctx.FindObjectsFinal(session)
+
+	objs, _, err := ctx.FindObjects(session, 10)
+	return objs, err
+
+}
+
+// A private key on a PKCS #11 token.
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+
+	// Sessions can't be used concurrently.
+	mutex sync.Mutex
+}
+
+// Opens a signer for the private key a PKCS #11 URI names.
+func OpenPKCS11Signer(uri string) (crypto.Signer, error) {
+
+	u, err := ParsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, session, err := u.open(false)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := u.signer(ctx, session)
+	if err != nil {
+		ctx.CloseSession(session)
+		return nil, err
+	}
+
+	return s, nil
+
+}
+
+func (u *PKCS11URI) signer(ctx *pkcs11.Ctx, session pkcs11.SessionHandle) (*pkcs11Signer, error) {
+
+	keys, err := u.find(ctx, session, pkcs11.CKO_PRIVATE_KEY, u.Object,
+		u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find PKCS #11 key: %s", err)
+	}
+	switch len(keys) {
+	case 0:
+		return nil, fmt.Errorf("no PKCS #11 private key matches the " +
+			"URI, is the PIN given?")
+	case 1:
+	default:
+		return nil, fmt.Errorf("%d PKCS #11 private keys match the URI",
+			len(keys))
+	}
+
+	// The public key is found by the private key's ID or label.
+	attrs, err := ctx.GetAttributeValue(session, keys[0],
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PKCS #11 key: %s", err)
+	}
+
+	keyType := bytesToUint(attrs[0].Value)
+	id, label := attrs[1].Value, string(attrs[2].Value)
+	if len(id) == 0 {
+		id = nil
+	} else {
+		label = ""
+	}
+
+	pubs, err := u.find(ctx, session, pkcs11.CKO_PUBLIC_KEY, label, id)
+	if err != nil || len(pubs) != 1 {
+		return nil, fmt.Errorf("no single PKCS #11 public key for the " +
+			"private key")
+	}
+
+	pub, err := pkcs11PublicKey(ctx, session, pubs[0], keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pkcs11Signer{
+		ctx:     ctx,
+		session: session,
+		key:     keys[0],
+		pub:     pub,
+	}, nil
+
+}
+
+func bytesToUint(b []byte) uint {
+	// PKCS #11 uses host byte order, little endian on the platforms
+	// this runs on.
+	n := uint(0)
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint(b[i])
+	}
+	return n
+}
+
+// Curves by OID, for CKA_EC_PARAMS.
+var pkcs11Curves = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+var pkcs11CurveOIDs = map[string]asn1.ObjectIdentifier{
+	"ecdsa-p256": {1, 2, 840, 10045, 3, 1, 7},
+	"ecdsa-p384": {1, 3, 132, 0, 34},
+	"ecdsa-p521": {1, 3, 132, 0, 35},
+}
+
+var pkcs11RSABits = map[string]int{
+	"rsa-2048": 2048,
+	"rsa-3072": 3072,
+	"rsa-4096": 4096,
+}
+
+func pkcs11PublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle,
+	obj pkcs11.ObjectHandle, keyType uint) (crypto.PublicKey, error) {
+
+	switch keyType {
+
+	case pkcs11.CKK_EC:
+		attrs, err := ctx.GetAttributeValue(session, obj,
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+				pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+			})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PKCS #11 public "+
+				"key: %s", err)
+		}
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(attrs[0].Value, &oid); err != nil {
+			return nil, fmt.Errorf("unsupported EC parameters")
+		}
+		curve, ok := pkcs11Curves[oid.String()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", oid)
+		}
+		// The point is an OCTET STRING, though some modules give it
+		// bare.
+		point := attrs[1].Value
+		var inner []byte
+		if rest, err := asn1.Unmarshal(point, &inner); err == nil &&
+			len(rest) == 0 {
+			point = inner
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, fmt.Errorf("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case pkcs11.CKK_RSA:
+		attrs, err := ctx.GetAttributeValue(session, obj,
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+				pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+			})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PKCS #11 public "+
+				"key: %s", err)
+		}
+		e := new(big.Int).SetBytes(attrs[1].Value)
+		if !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, fmt.Errorf("invalid RSA public exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(e.Int64()),
+		}, nil
+
+	}
+
+	return nil, fmt.Errorf("unsupported PKCS #11 key type %d", keyType)
+
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// DigestInfo prefixes for PKCS #1 v1.5 signatures, which the token
+// doesn't add with CKM_RSA_PKCS.
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var pkcs11PSSHashes = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// Signs a digest on the token.  ECDSA signatures come back as r and s
+// and are DER-encoded here.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+
+	var mech *pkcs11.Mechanism
+	data := digest
+
+	switch pub := s.pub.(type) {
+
+	case *ecdsa.PublicKey:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			h, ok := pkcs11PSSHashes[pss.Hash]
+			if !ok {
+				return nil, fmt.Errorf("unsupported PSS hash %s",
+					pss.Hash)
+			}
+			salt := pss.SaltLength
+			if salt == rsa.PSSSaltLengthEqualsHash ||
+				salt == rsa.PSSSaltLengthAuto {
+				salt = pss.Hash.Size()
+			}
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS,
+				pkcs11.NewPSSParams(h[0], h[1], uint(salt)))
+		} else {
+			prefix, ok := pkcs1Prefixes[opts.HashFunc()]
+			if !ok {
+				return nil, fmt.Errorf("unsupported hash %s",
+					opts.HashFunc())
+			}
+			data = append(append([]byte{}, prefix...), digest...)
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mech}, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS #11 sign failed: %s", err)
+	}
+	sig, err := s.ctx.Sign(s.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS #11 sign failed: %s", err)
+	}
+
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		n := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:n]),
+			new(big.Int).SetBytes(sig[n:]),
+		})
+	}
+
+	return sig, nil
+
+}
+
+// Generates a key pair on the token the URI names, labelled with the
+// URI's object.  The private key can't be extracted, only the public
+// key is returned.
+func GeneratePKCS11Key(uri, algorithm string) (crypto.PublicKey, error) {
+
+	u, err := ParsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Object == "" {
+		return nil, fmt.Errorf("PKCS #11 URI needs an object to label " +
+			"the key")
+	}
+
+	ctx, session, err := u.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.CloseSession(session)
+
+	existing, err := u.find(ctx, session, pkcs11.CKO_PRIVATE_KEY, u.Object,
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("token already has a key labelled %q",
+			u.Object)
+	}
+
+	id := u.ID
+	if id == nil {
+		id = make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+	}
+
+	pubTmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.Object),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	privTmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.Object),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+
+	var mech *pkcs11.Mechanism
+	if oid, ok := pkcs11CurveOIDs[algorithm]; ok {
+		params, err := asn1.Marshal(oid)
+		if err != nil {
+			return nil, err
+		}
+		mech = pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)
+		pubTmpl = append(pubTmpl,
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+	} else if bits, ok := pkcs11RSABits[algorithm]; ok {
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)
+		pubTmpl = append(pubTmpl,
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT,
+				[]byte{1, 0, 1}))
+	} else {
+		return nil, fmt.Errorf("key algorithm %q can't be generated "+
+			"on a PKCS #11 token", algorithm)
+	}
+
+	_, _, err = ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{mech},
+		pubTmpl, privTmpl)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS #11 key generation failed: %s", err)
+	}
+
+	s, err := u.signer(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.pub, nil
+
+}
@@ -0,0 +1,28 @@
+//go:build !cgo
+
+package cert_tools
+
+import (
+	"crypto"
+	"fmt"
+)
+
+// PKCS #11 modules are C libraries, so tokens need a cgo build.
+var errNoPKCS11 = fmt.Errorf("PKCS #11 keys need cert-tools built " +
+	"with cgo")
+
+// Opens a signer for the private key a PKCS #11 URI names.
+func OpenPKCS11Signer(uri string) (crypto.Signer, error) {
+	if _, err := ParsePKCS11URI(uri); err != nil {
+		return nil, err
+	}
+	return nil, errNoPKCS11
+}
+
+// Generates a key pair on the token the URI names.
+func GeneratePKCS11Key(uri, algorithm string) (crypto.PublicKey, error) {
+	if _, err := ParsePKCS11URI(uri); err != nil {
+		return nil, err
+	}
+	return nil, errNoPKCS11
+}
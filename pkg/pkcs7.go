@@ -0,0 +1,634 @@
+package cert_tools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// PKCS #7 / CMS content types, RFC 5652.
+var (
+	OidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	OidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	OidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+)
+
+// Signed attributes, RFC 5652 section 11.
+var (
+	OidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	OidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	OidAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+)
+
+// Content encryption algorithms for EnvelopedData.
+var (
+	OidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	OidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	OidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	OidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+var (
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+// Digest algorithms usable in SignedData.
+var digestAlgorithms = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   {1, 3, 14, 3, 2, 26},
+	crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+	crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+	crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+}
+
+var ecdsaSignatureAlgorithms = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   oidECDSAWithSHA1,
+	crypto.SHA256: oidECDSAWithSHA256,
+	crypto.SHA384: oidECDSAWithSHA384,
+	crypto.SHA512: oidECDSAWithSHA512,
+}
+
+type contentCipher struct {
+	keySize int
+	block   func(key []byte) (cipher.Block, error)
+}
+
+var contentCiphers = map[string]contentCipher{
+	OidDESEDE3CBC.String(): {24, des.NewTripleDESCipher},
+	OidAES128CBC.String():  {16, aes.NewCipher},
+	OidAES192CBC.String():  {24, aes.NewCipher},
+	OidAES256CBC.String():  {32, aes.NewCipher},
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+// An attribute, as used in SignerInfo and certificate requests.
+type Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerial           issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type encapsulatedContent struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      encapsulatedContent
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerial        issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+// A verified SignedData.
+type SignedData struct {
+	ContentType asn1.ObjectIdentifier
+
+	// Encapsulated content, nil if there is none.
+	Content []byte
+
+	Certificates []*x509.Certificate
+	Signer       *x509.Certificate
+	Hash         crypto.Hash
+	Attributes   []Attribute
+}
+
+// Wraps DER content in a ContentInfo.  crypto/asn1 ignores tagging on a
+// RawValue, so the explicit [0] is built by hand.
+func wrapContentInfo(typ asn1.ObjectIdentifier, content []byte) ([]byte, error) {
+	return asn1.Marshal(contentInfo{
+		ContentType: typ,
+		Content:     explicitTag(content),
+	})
+}
+
+// Unwraps a ContentInfo, checking the content type.
+func unwrapContentInfo(der []byte, typ asn1.ObjectIdentifier) ([]byte, error) {
+
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(der, &ci)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS #7: %s", err)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after PKCS #7")
+	}
+	if ci.Content.Class != asn1.ClassContextSpecific || ci.Content.Tag != 0 {
+		return nil, fmt.Errorf("PKCS #7 has no content")
+	}
+	if !ci.ContentType.Equal(typ) {
+		return nil, fmt.Errorf("PKCS #7 content is %s, expected %s",
+			ci.ContentType, typ)
+	}
+
+	return ci.Content.Bytes, nil
+
+}
+
+// Context-specific [0] around DER content.
+func explicitTag(content []byte) asn1.RawValue {
+	return asn1.RawValue{
+		Class: asn1.ClassContextSpecific, Tag: 0,
+		IsCompound: true, Bytes: content,
+	}
+}
+
+func certificateSet(certs []*x509.Certificate) asn1.RawValue {
+	raw := []byte{}
+	for _, c := range certs {
+		raw = append(raw, c.Raw...)
+	}
+	return asn1.RawValue{
+		Class: asn1.ClassContextSpecific, Tag: 0,
+		IsCompound: true, Bytes: raw,
+	}
+}
+
+// Creates an attribute with a single value.
+func NewAttribute(typ asn1.ObjectIdentifier, value interface{}) (Attribute, error) {
+	raw, err := asn1.Marshal(value)
+	if err != nil {
+		return Attribute{}, err
+	}
+	return Attribute{
+		Type:   typ,
+		Values: []asn1.RawValue{{FullBytes: raw}},
+	}, nil
+}
+
+// Returns the first value of an attribute, nil if it isn't present.
+func FindAttribute(attrs []Attribute, typ asn1.ObjectIdentifier) *asn1.RawValue {
+	for _, a := range attrs {
+		if a.Type.Equal(typ) && len(a.Values) > 0 {
+			return &a.Values[0]
+		}
+	}
+	return nil
+}
+
+// Builds a degenerate certs-only SignedData, the form used for .p7b/.p7c
+// files and by EST for certificate responses.
+func CertsOnly(certs []*x509.Certificate) ([]byte, error) {
+
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{},
+		ContentInfo:      encapsulatedContent{ContentType: OidData},
+		Certificates:     certificateSet(certs),
+		SignerInfos:      []signerInfo{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapContentInfo(OidSignedData, sd)
+
+}
+
+// Returns the certificates in a SignedData, signed or degenerate.
+func ParseCertsOnly(der []byte) ([]*x509.Certificate, error) {
+
+	raw, err := unwrapContentInfo(der, OidSignedData)
+	if err != nil {
+		return nil, err
+	}
+
+	var sd signedData
+	_, err = asn1.Unmarshal(raw, &sd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SignedData: %s", err)
+	}
+
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+
+}
+
+// Signs content as a SignedData with one signer.  Content type, message
+// digest and signing time attributes are added to attrs.  The signer's
+// certificate is included along with certs.
+func Sign(content []byte, signer *x509.Certificate, key crypto.Signer,
+	hash crypto.Hash, attrs []Attribute, certs []*x509.Certificate) ([]byte, error) {
+
+	digestAlg, ok := digestAlgorithms[hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %s", hash)
+	}
+
+	var sigAlg pkix.AlgorithmIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{
+			Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue,
+		}
+	case *ecdsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{
+			Algorithm: ecdsaSignatureAlgorithms[hash],
+		}
+	default:
+		return nil, fmt.Errorf("PKCS #7 signing needs an RSA or ECDSA "+
+			"key, not %T", key.Public())
+	}
+
+	h := hash.New()
+	h.Write(content)
+
+	standard := []struct {
+		typ   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{OidAttributeContentType, OidData},
+		{OidAttributeMessageDigest, h.Sum(nil)},
+		{OidAttributeSigningTime, time.Now().UTC()},
+	}
+	all := []Attribute{}
+	for _, s := range standard {
+		a, err := NewAttribute(s.typ, s.value)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, a)
+	}
+	all = append(all, attrs...)
+
+	// The signature is over the attributes encoded as a SET OF, they're
+	// carried as an implicit [0].
+	signed, err := asn1.MarshalWithParams(all, "set")
+	if err != nil {
+		return nil, err
+	}
+
+	h = hash.New()
+	h.Write(signed)
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %s", err)
+	}
+
+	implicit := append([]byte{}, signed...)
+	implicit[0] = 0xa0
+
+	sd := signedData{
+		Version: 1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{
+			{Algorithm: digestAlg, Parameters: asn1.NullRawValue},
+		},
+		ContentInfo:  encapsulatedContent{ContentType: OidData},
+		Certificates: certificateSet(append([]*x509.Certificate{signer}, certs...)),
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerial: issuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: signer.RawIssuer},
+				Serial: signer.SerialNumber,
+			},
+			DigestAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm: digestAlg, Parameters: asn1.NullRawValue,
+			},
+			AuthenticatedAttributes:   asn1.RawValue{FullBytes: implicit},
+			DigestEncryptionAlgorithm: sigAlg,
+			EncryptedDigest:           sig,
+		}},
+	}
+
+	if content != nil {
+		octets, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		sd.ContentInfo.Content = explicitTag(octets)
+	}
+
+	raw, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapContentInfo(OidSignedData, raw)
+
+}
+
+// Parses a SignedData with one signer and verifies the signature.  The
+// signer's certificate is looked for in the SignedData and then in certs.
+func ParseSignedData(der []byte, certs []*x509.Certificate) (*SignedData, error) {
+
+	raw, err := unwrapContentInfo(der, OidSignedData)
+	if err != nil {
+		return nil, err
+	}
+
+	var sd signedData
+	_, err = asn1.Unmarshal(raw, &sd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SignedData: %s", err)
+	}
+
+	res := &SignedData{ContentType: sd.ContentInfo.ContentType}
+
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		_, err = asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &res.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SignedData "+
+				"content: %s", err)
+		}
+	}
+
+	res.Certificates, err = x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SignedData "+
+			"certificates: %s", err)
+	}
+
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("SignedData has %d signers, expected 1",
+			len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	for _, c := range append(res.Certificates, certs...) {
+		if bytes.Equal(c.RawIssuer, si.IssuerAndSerial.Issuer.FullBytes) &&
+			c.SerialNumber.Cmp(si.IssuerAndSerial.Serial) == 0 {
+			res.Signer = c
+			break
+		}
+	}
+	if res.Signer == nil {
+		return nil, fmt.Errorf("SignedData signer certificate not found")
+	}
+
+	for h, oid := range digestAlgorithms {
+		if oid.Equal(si.DigestAlgorithm.Algorithm) {
+			res.Hash = h
+		}
+	}
+	if res.Hash == 0 {
+		return nil, fmt.Errorf("unsupported digest algorithm %s",
+			si.DigestAlgorithm.Algorithm)
+	}
+
+	if len(si.AuthenticatedAttributes.FullBytes) == 0 {
+		return nil, fmt.Errorf("SignedData has no signed attributes")
+	}
+	signed := append([]byte{}, si.AuthenticatedAttributes.FullBytes...)
+	signed[0] = 0x31
+
+	_, err = asn1.UnmarshalWithParams(signed, &res.Attributes, "set")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signed attributes: %s",
+			err)
+	}
+
+	var digest []byte
+	if v := FindAttribute(res.Attributes, OidAttributeMessageDigest); v != nil {
+		asn1.Unmarshal(v.FullBytes, &digest)
+	}
+	h := res.Hash.New()
+	h.Write(res.Content)
+	if !bytes.Equal(digest, h.Sum(nil)) {
+		return nil, fmt.Errorf("SignedData message digest doesn't match")
+	}
+
+	h = res.Hash.New()
+	h.Write(signed)
+	sum := h.Sum(nil)
+
+	switch pub := res.Signer.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, res.Hash, sum, si.EncryptedDigest)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, sum, si.EncryptedDigest) {
+			err = fmt.Errorf("ECDSA verification failure")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", pub)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SignedData signature: %s", err)
+	}
+
+	return res, nil
+
+}
+
+// Encrypts content for an RSA recipient as an EnvelopedData, using one of
+// the DES-EDE3 or AES CBC content encryption algorithms.
+func Envelope(content []byte, recipient *x509.Certificate,
+	alg asn1.ObjectIdentifier) ([]byte, error) {
+
+	pub, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("enveloping needs an RSA recipient, "+
+			"not %T", recipient.PublicKey)
+	}
+
+	cc, ok := contentCiphers[alg.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encryption "+
+			"algorithm %s", alg)
+	}
+
+	key := make([]byte, cc.keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := cc.block(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	// PKCS #7 padding, always at least one byte.
+	pad := block.BlockSize() - len(content)%block.BlockSize()
+	ciphertext := append(append([]byte{}, content...),
+		bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+	encKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := asn1.Marshal(envelopedData{
+		Version: 0,
+		RecipientInfos: []recipientInfo{{
+			Version: 0,
+			IssuerAndSerial: issuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: recipient.RawIssuer},
+				Serial: recipient.SerialNumber,
+			},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue,
+			},
+			EncryptedKey: encKey,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType: OidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  alg,
+				Parameters: asn1.RawValue{FullBytes: params},
+			},
+			EncryptedContent: asn1.RawValue{
+				Class: asn1.ClassContextSpecific, Tag: 0,
+				Bytes: ciphertext,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapContentInfo(OidEnvelopedData, raw)
+
+}
+
+// Decrypts an EnvelopedData for an RSA recipient.  The content encryption
+// algorithm is returned so a reply can use the same one.
+func OpenEnvelope(der []byte, recipient *x509.Certificate,
+	key crypto.Decrypter) ([]byte, asn1.ObjectIdentifier, error) {
+
+	raw, err := unwrapContentInfo(der, OidEnvelopedData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ed envelopedData
+	_, err = asn1.Unmarshal(raw, &ed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse EnvelopedData: %s",
+			err)
+	}
+
+	var ri *recipientInfo
+	for i, r := range ed.RecipientInfos {
+		if bytes.Equal(r.IssuerAndSerial.Issuer.FullBytes,
+			recipient.RawIssuer) &&
+			r.IssuerAndSerial.Serial.Cmp(recipient.SerialNumber) == 0 {
+			ri = &ed.RecipientInfos[i]
+		}
+	}
+	if ri == nil {
+		return nil, nil, fmt.Errorf("EnvelopedData isn't for %s",
+			recipient.Subject)
+	}
+
+	eci := ed.EncryptedContentInfo
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+	cc, ok := contentCiphers[alg.String()]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported content encryption "+
+			"algorithm %s", alg)
+	}
+
+	cek, err := key.Decrypt(rand.Reader, ri.EncryptedKey, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt content key: %s",
+			err)
+	}
+	if len(cek) != cc.keySize {
+		return nil, nil, fmt.Errorf("content key is the wrong size")
+	}
+
+	var iv []byte
+	_, err = asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes,
+		&iv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse IV: %s", err)
+	}
+
+	// Encrypted content may be split into constructed OCTET STRINGs.
+	ciphertext := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		ciphertext = []byte{}
+		rest := eci.EncryptedContent.Bytes
+		for len(rest) > 0 {
+			var part []byte
+			rest, err = asn1.Unmarshal(rest, &part)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse "+
+					"encrypted content: %s", err)
+			}
+			ciphertext = append(ciphertext, part...)
+		}
+	}
+
+	block, err := cc.block(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 ||
+		len(ciphertext)%block.BlockSize() != 0 {
+		return nil, nil, fmt.Errorf("encrypted content is malformed")
+	}
+
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ciphertext)
+
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() ||
+		!bytes.Equal(plain[len(plain)-pad:],
+			bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, nil, fmt.Errorf("failed to decrypt content")
+	}
+
+	return plain[:len(plain)-pad], alg, nil
+
+}
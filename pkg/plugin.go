@@ -0,0 +1,250 @@
+package cert_tools
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Signer plugins hold a key the tools never see.  A plugin is either a
+// command, plugin:COMMAND ARGS..., run for as long as the key is needed,
+// or a service on a Unix socket, unix:PATH.  Both speak JSON lines: a
+// request, then its response.
+type PluginRequest struct {
+	// "public" or "sign".
+	Op string `json:"op"`
+
+	// For sign, the digest, or the message for Ed25519, with the hash
+	// name as crypto.Hash has it, e.g. SHA-256.  Salt length is set for
+	// RSA-PSS.
+	Digest     []byte `json:"digest,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	PSS        bool   `json:"pss,omitempty"`
+	SaltLength int    `json:"salt_length,omitempty"`
+}
+
+type PluginResponse struct {
+	// DER SubjectPublicKeyInfo, for public.
+	PublicKey []byte `json:"public_key,omitempty"`
+
+	Signature []byte `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+var pluginHashes = []crypto.Hash{
+	crypto.SHA1, crypto.SHA224, crypto.SHA256, crypto.SHA384,
+	crypto.SHA512,
+}
+
+func pluginHash(name string) (crypto.Hash, error) {
+	if name == "" {
+		return crypto.Hash(0), nil
+	}
+	for _, h := range pluginHashes {
+		if h.String() == name {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hash %q", name)
+}
+
+// Whether a key name is a signer plugin rather than a file.
+func IsPluginKey(s string) bool {
+	return strings.HasPrefix(s, "plugin:") || strings.HasPrefix(s, "unix:")
+}
+
+type pluginSigner struct {
+	enc *json.Encoder
+	dec *json.Decoder
+	pub crypto.PublicKey
+
+	// One request at a time.
+	mutex sync.Mutex
+}
+
+// Starts or connects to a signer plugin and gets its public key.
+func OpenPluginSigner(name string) (crypto.Signer, error) {
+
+	var r io.Reader
+	var w io.Writer
+
+	if path, ok := strings.CutPrefix(name, "unix:"); ok {
+
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to signer: %s",
+				err)
+		}
+		r, w = conn, conn
+
+	} else {
+
+		args := strings.Fields(strings.TrimPrefix(name, "plugin:"))
+		if len(args) == 0 {
+			return nil, fmt.Errorf("signer plugin command is empty")
+		}
+
+		// The plugin exits when its stdin closes, as this process
+		// does.
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start signer plugin: "+
+				"%s", err)
+		}
+		r, w = out, in
+
+	}
+
+	s := &pluginSigner{
+		enc: json.NewEncoder(w),
+		dec: json.NewDecoder(bufio.NewReader(r)),
+	}
+
+	resp, err := s.call(&PluginRequest{Op: "public"})
+	if err != nil {
+		return nil, err
+	}
+
+	s.pub, err = x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("signer plugin public key: %s", err)
+	}
+
+	return s, nil
+
+}
+
+func (s *pluginSigner) call(req *PluginRequest) (*PluginResponse, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.enc.Encode(req); err != nil {
+		return nil, fmt.Errorf("signer plugin: %s", err)
+	}
+
+	var resp PluginResponse
+	if err := s.dec.Decode(&resp); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("signer plugin: %s", err)
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("signer plugin: %s", resp.Error)
+	}
+
+	return &resp, nil
+
+}
+
+func (s *pluginSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *pluginSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+
+	req := &PluginRequest{Op: "sign", Digest: digest}
+	if h := opts.HashFunc(); h != 0 {
+		req.Hash = h.String()
+	}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		req.PSS = true
+		req.SaltLength = pss.SaltLength
+		if req.SaltLength == rsa.PSSSaltLengthEqualsHash ||
+			req.SaltLength == rsa.PSSSaltLengthAuto {
+			req.SaltLength = pss.Hash.Size()
+		}
+	}
+
+	resp, err := s.call(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Signature, nil
+
+}
+
+// Answers plugin requests with a key until the input ends, for plugins
+// written in Go.
+func ServePlugin(r io.Reader, w io.Writer, key crypto.Signer) error {
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	enc := json.NewEncoder(w)
+
+	for {
+
+		var req PluginRequest
+		if err := dec.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		resp := &PluginResponse{}
+		if err := pluginRequest(&req, key, resp); err != nil {
+			resp = &PluginResponse{Error: err.Error()}
+		}
+
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+
+	}
+
+}
+
+func pluginRequest(req *PluginRequest, key crypto.Signer, resp *PluginResponse) error {
+
+	switch req.Op {
+
+	case "public":
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return err
+		}
+		resp.PublicKey = der
+
+	case "sign":
+		h, err := pluginHash(req.Hash)
+		if err != nil {
+			return err
+		}
+		var opts crypto.SignerOpts = h
+		if req.PSS {
+			opts = &rsa.PSSOptions{SaltLength: req.SaltLength, Hash: h}
+		}
+		resp.Signature, err = key.Sign(rand.Reader, req.Digest, opts)
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown operation %q", req.Op)
+
+	}
+
+	return nil
+
+}
@@ -0,0 +1,233 @@
+package cert_tools
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A certificate profile describes the usages granted to a certificate, and
+// any checks the request must pass before it is signed.
+type Profile struct {
+	Name        string
+	Description string
+
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+	IsCA        bool
+
+	// Whether custom extensions in the request may be copied into the
+	// certificate.
+	CopyExtensions bool
+
+	// Whether the request's first email address is added to the subject
+	// as an emailAddress attribute.
+	EmailInSubject bool
+
+	// Optional check applied to the request subject and SANs.
+	Check func(csr *x509.CertificateRequest, sans *SANs) error
+}
+
+var Profiles = map[string]*Profile{
+	"server": {
+		Name:        "server",
+		Description: "TLS server",
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		CopyExtensions: true,
+	},
+	"client": {
+		Name:        "client",
+		Description: "TLS client",
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		CopyExtensions: true,
+		EmailInSubject: true,
+	},
+	"device": {
+		Name:        "device",
+		Description: "TLS client for a device or machine, identity is the common name or a URI",
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Check:       checkDevice,
+	},
+	"code-signing": {
+		Name:        "code-signing",
+		Description: "Code signing",
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		CopyExtensions: true,
+		EmailInSubject: true,
+	},
+	"ca": {
+		Name:        "ca",
+		Description: "Intermediate CA",
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA: true,
+	},
+	"crl": {
+		Name:        "crl",
+		Description: "CRL issuer",
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCRLSign,
+	},
+	"spiffe": {
+		Name:        "spiffe",
+		Description: "SPIFFE X509-SVID, identity is a single spiffe:// URI",
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		Check: checkSpiffe,
+	},
+}
+
+// Looks up a profile by name.
+func GetProfile(name string) (*Profile, error) {
+	p, ok := Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q, known profiles: %s",
+			name, strings.Join(ProfileNames(), ", "))
+	}
+	return p, nil
+}
+
+// Looks up a list of profiles by name.
+func GetProfiles(names []string) ([]*Profile, error) {
+	profiles := []*Profile{}
+	for _, name := range names {
+		p, err := GetProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// Sorted list of profile names.
+func ProfileNames() []string {
+	names := []string{}
+	for n := range Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Applies the profile's usages to a certificate template.  Profiles are
+// additive, so several can be applied to the same template.
+func (p *Profile) Apply(template *x509.Certificate) {
+	template.KeyUsage |= p.KeyUsage
+	for _, u := range p.ExtKeyUsage {
+		if !hasExtKeyUsage(template.ExtKeyUsage, u) {
+			template.ExtKeyUsage = append(template.ExtKeyUsage, u)
+		}
+	}
+	if p.IsCA {
+		template.IsCA = true
+	}
+}
+
+func hasExtKeyUsage(l []x509.ExtKeyUsage, u x509.ExtKeyUsage) bool {
+	for _, v := range l {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+// Devices are identified by common name or URI, not by a person's email
+// address.
+func checkDevice(csr *x509.CertificateRequest, sans *SANs) error {
+
+	if csr.Subject.CommonName == "" && len(sans.URIs) == 0 {
+		return fmt.Errorf("device certificate needs a common name or " +
+			"a URI SAN")
+	}
+
+	if len(sans.EmailAddresses) > 0 {
+		return fmt.Errorf("device certificate must not have an " +
+			"email address")
+	}
+
+	return nil
+
+}
+
+// SPIFFE X509-SVID rules: exactly one URI SAN which is a valid SPIFFE ID,
+// and no identity carried in the subject common name.
+func checkSpiffe(csr *x509.CertificateRequest, sans *SANs) error {
+
+	if len(sans.URIs) != 1 {
+		return fmt.Errorf("SPIFFE SVID must have exactly one URI SAN, "+
+			"request has %d", len(sans.URIs))
+	}
+
+	if err := CheckSpiffeID(sans.URIs[0].String()); err != nil {
+		return err
+	}
+
+	if csr.Subject.CommonName != "" {
+		return fmt.Errorf("SPIFFE SVID must not carry an identity in " +
+			"the subject common name")
+	}
+
+	return nil
+
+}
+
+// Checks a SPIFFE ID is well-formed according to the SPIFFE ID
+// specification: spiffe://trust-domain/path with a lowercase trust domain,
+// no port, user info, query or fragment, and no empty, '.' or '..' path
+// segments.
+func CheckSpiffeID(id string) error {
+
+	const prefix = "spiffe://"
+	if !strings.HasPrefix(id, prefix) {
+		return fmt.Errorf("SPIFFE ID %q does not begin with %s", id,
+			prefix)
+	}
+
+	rest := id[len(prefix):]
+	td, path, _ := strings.Cut(rest, "/")
+
+	if td == "" {
+		return fmt.Errorf("SPIFFE ID %q has no trust domain", id)
+	}
+	for _, c := range td {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') &&
+			c != '.' && c != '-' && c != '_' {
+			return fmt.Errorf("SPIFFE ID %q has invalid character "+
+				"%q in trust domain", id, c)
+		}
+	}
+
+	if !strings.Contains(rest, "/") {
+		return nil
+	}
+
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return fmt.Errorf("SPIFFE ID %q has an invalid path "+
+				"segment", id)
+		}
+		for _, c := range seg {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+				!(c >= '0' && c <= '9') &&
+				c != '.' && c != '-' && c != '_' {
+				return fmt.Errorf("SPIFFE ID %q has invalid "+
+					"character %q in path", id, c)
+			}
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,111 @@
+package cert_tools
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// Reads a PEM certificate file, the first certificate is returned.
+func ReadCertificateFromFile(file string) (*x509.Certificate, error) {
+
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	certPem, _ := pem.Decode(raw)
+	if certPem == nil {
+		return nil, fmt.Errorf("no PEM data in certificate file")
+	}
+
+	return x509.ParseCertificate(certPem.Bytes)
+
+}
+
+// Reads all certificates in a PEM file.
+func ReadCertificatesFromFile(file string) ([]*x509.Certificate, error) {
+
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, raw = pem.Decode(raw)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+
+	return certs, nil
+
+}
+
+// Reads a PEM certificate request file and checks its signature.
+func ReadCSRFromFile(file string) (*x509.CertificateRequest, error) {
+
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	csrPem, _ := pem.Decode(raw)
+	if csrPem == nil {
+		return nil, fmt.Errorf("no PEM data in CSR file")
+	}
+
+	return ParseCSR(csrPem.Bytes)
+
+}
+
+// Parses a DER certificate request and checks its signature.
+func ParseCSR(der []byte) (*x509.CertificateRequest, error) {
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request: %s",
+			err)
+	}
+
+	if err = csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("failed to check certificate request "+
+			"signing: %s", err)
+	}
+
+	return csr, nil
+
+}
+
+// Reads a PEM public key file.
+func ReadPublicKeyFromFile(file string) (crypto.PublicKey, error) {
+
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("no PEM public key in %s", file)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+
+}
@@ -0,0 +1,367 @@
+package cert_tools
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+)
+
+// What happened to an extension asked for in a certificate request.
+type ExtensionDecision int
+
+const (
+	ExtensionAccepted ExtensionDecision = iota
+	ExtensionModified
+	ExtensionRejected
+)
+
+func (d ExtensionDecision) String() string {
+	switch d {
+	case ExtensionAccepted:
+		return "accepted"
+	case ExtensionModified:
+		return "modified"
+	case ExtensionRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// The outcome for one requested extension.
+type ExtensionResult struct {
+	Id       asn1.ObjectIdentifier
+	Decision ExtensionDecision
+	Reason   string
+}
+
+func (r ExtensionResult) String() string {
+	s := ExtensionName(r.Id) + ": " + r.Decision.String()
+	if r.Reason != "" {
+		s += ", " + r.Reason
+	}
+	return s
+}
+
+// Name of an extension for reporting, the OID if it's not a standard one.
+func ExtensionName(oid asn1.ObjectIdentifier) string {
+	if n, ok := StandardExtensions[oid.String()]; ok {
+		return n + " (" + oid.String() + ")"
+	}
+	return oid.String()
+}
+
+// Extended key usage OIDs.
+var extKeyUsageOIDs = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageAny:             {2, 5, 29, 37, 0},
+	x509.ExtKeyUsageServerAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	x509.ExtKeyUsageClientAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	x509.ExtKeyUsageCodeSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	x509.ExtKeyUsageEmailProtection: {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	x509.ExtKeyUsageTimeStamping:    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	x509.ExtKeyUsageOCSPSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+}
+
+// Applies the extensions asked for in a request to a certificate template
+// which already has its profile usages.  Key usage, extended key usage and
+// basic constraints requests are honoured where the profile allows, custom
+// extensions are copied if copyExtensions is set.  Extensions already in
+// template.ExtraExtensions, e.g. from the command line, take precedence.
+// Returns what was done with each requested extension.
+func ApplyRequestedExtensions(csr *x509.CertificateRequest,
+	template *x509.Certificate, copyExtensions bool) []ExtensionResult {
+
+	results := []ExtensionResult{}
+
+	for _, ext := range csr.Extensions {
+
+		res := ExtensionResult{Id: ext.Id}
+
+		switch {
+
+		case oidInExtensions(ext.Id, template.ExtraExtensions):
+			res.Decision = ExtensionModified
+			res.Reason = "replaced by CA-supplied extension"
+
+		case ext.Id.Equal(OidSubjectAltName):
+			res.Decision = ExtensionAccepted
+
+		case ext.Id.Equal(oidKeyUsage):
+			res.Decision, res.Reason = applyKeyUsage(ext, template)
+
+		case ext.Id.Equal(oidExtKeyUsage):
+			res.Decision, res.Reason = applyExtKeyUsage(ext, template)
+
+		case ext.Id.Equal(oidBasicConstraints):
+			res.Decision, res.Reason =
+				applyBasicConstraints(ext, template)
+
+		case ext.Id.Equal(oidSubjectKeyId):
+			var ski []byte
+			_, err := asn1.Unmarshal(ext.Value, &ski)
+			if err == nil && string(ski) == string(template.SubjectKeyId) {
+				res.Decision = ExtensionAccepted
+			} else {
+				res.Decision = ExtensionModified
+				res.Reason = "replaced by key identifier computed " +
+					"by the CA"
+			}
+
+		case IsStandardExtension(ext.Id):
+			res.Decision = ExtensionRejected
+			res.Reason = "set by the CA"
+
+		case !copyExtensions:
+			res.Decision = ExtensionRejected
+			res.Reason = "custom extensions are not being copied"
+
+		default:
+			template.ExtraExtensions =
+				append(template.ExtraExtensions, ext)
+			res.Decision = ExtensionAccepted
+
+		}
+
+		results = append(results, res)
+
+	}
+
+	return results
+
+}
+
+var (
+	oidSubjectKeyId     = asn1.ObjectIdentifier{2, 5, 29, 14}
+	oidKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+	oidExtKeyUsage      = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// The usage extensions of an existing certificate, key usage, extended
+// key usage and basic constraints, to ask for again when renewing it.
+func UsageExtensions(cert *x509.Certificate) []pkix.Extension {
+	exts := []pkix.Extension{}
+	for _, e := range cert.Extensions {
+		if e.Id.Equal(oidKeyUsage) || e.Id.Equal(oidExtKeyUsage) ||
+			e.Id.Equal(oidBasicConstraints) {
+			exts = append(exts, e)
+		}
+	}
+	return exts
+}
+
+func oidInExtensions(oid asn1.ObjectIdentifier, exts []pkix.Extension) bool {
+	for _, e := range exts {
+		if e.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key usage is narrowed to what was asked for, within what the profile
+// grants.
+func applyKeyUsage(ext pkix.Extension, template *x509.Certificate) (ExtensionDecision, string) {
+
+	var bits asn1.BitString
+	_, err := asn1.Unmarshal(ext.Value, &bits)
+	if err != nil {
+		return ExtensionRejected, "can't parse: " + err.Error()
+	}
+
+	var requested x509.KeyUsage
+	for i := 0; i < 9; i++ {
+		if bits.At(i) != 0 {
+			requested |= x509.KeyUsage(1 << uint(i))
+		}
+	}
+
+	granted := requested & template.KeyUsage
+	if granted == 0 {
+		return ExtensionRejected, "no requested key usage is " +
+			"allowed by the profile"
+	}
+
+	template.KeyUsage = granted
+	if granted != requested {
+		return ExtensionModified, "key usages not allowed by the " +
+			"profile were dropped"
+	}
+
+	return ExtensionAccepted, ""
+
+}
+
+// Extended key usage is narrowed to what was asked for, within what the
+// profile grants.
+func applyExtKeyUsage(ext pkix.Extension, template *x509.Certificate) (ExtensionDecision, string) {
+
+	var oids []asn1.ObjectIdentifier
+	_, err := asn1.Unmarshal(ext.Value, &oids)
+	if err != nil {
+		return ExtensionRejected, "can't parse: " + err.Error()
+	}
+
+	granted := []x509.ExtKeyUsage{}
+	dropped := []string{}
+
+	for _, oid := range oids {
+		found := false
+		for _, u := range template.ExtKeyUsage {
+			if extKeyUsageOIDs[u].Equal(oid) {
+				granted = append(granted, u)
+				found = true
+				break
+			}
+		}
+		if !found {
+			dropped = append(dropped, oid.String())
+		}
+	}
+
+	if len(granted) == 0 {
+		return ExtensionRejected, "no requested extended key usage " +
+			"is allowed by the profile"
+	}
+
+	template.ExtKeyUsage = granted
+	if len(dropped) > 0 {
+		return ExtensionModified, "dropped " +
+			strings.Join(dropped, ", ")
+	}
+
+	return ExtensionAccepted, ""
+
+}
+
+// Basic constraints must agree with the profile, a path length is honoured
+// for CA certificates.
+func applyBasicConstraints(ext pkix.Extension, template *x509.Certificate) (ExtensionDecision, string) {
+
+	var bc struct {
+		IsCA       bool `asn1:"optional"`
+		MaxPathLen int  `asn1:"optional,default:-1"`
+	}
+	_, err := asn1.Unmarshal(ext.Value, &bc)
+	if err != nil {
+		return ExtensionRejected, "can't parse: " + err.Error()
+	}
+
+	if bc.IsCA != template.IsCA {
+		return ExtensionRejected, fmt.Sprintf("profile sets CA=%t",
+			template.IsCA)
+	}
+
+	if bc.IsCA && bc.MaxPathLen >= 0 {
+		template.MaxPathLen = bc.MaxPathLen
+		template.MaxPathLenZero = bc.MaxPathLen == 0
+	}
+
+	return ExtensionAccepted, ""
+
+}
+
+type tbsCertificateRequest struct {
+	Version    int
+	Subject    asn1.RawValue
+	PublicKey  asn1.RawValue
+	Attributes asn1.RawValue `asn1:"tag:0"`
+}
+
+type certificateRequest struct {
+	TBS                asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+// Returns a request's attributes.  crypto/x509 only parses attributes
+// holding extensions, challengePassword and friends are strings.
+func RequestAttributes(csr *x509.CertificateRequest) ([]Attribute, error) {
+
+	var tbs tbsCertificateRequest
+	_, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request: %s",
+			err)
+	}
+
+	attrs := []Attribute{}
+	rest := tbs.Attributes.Bytes
+	for len(rest) > 0 {
+		var a Attribute
+		rest, err = asn1.Unmarshal(rest, &a)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse request "+
+				"attribute: %s", err)
+		}
+		attrs = append(attrs, a)
+	}
+
+	return attrs, nil
+
+}
+
+// Adds attributes to a DER certificate request and signs it again with
+// the same algorithm.
+func AddRequestAttributes(der []byte, key crypto.Signer, attrs []Attribute) ([]byte, error) {
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+
+	var req certificateRequest
+	_, err = asn1.Unmarshal(der, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	var tbs tbsCertificateRequest
+	_, err = asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy, appending in place would overwrite the signature algorithm.
+	content := append([]byte{}, tbs.Attributes.Bytes...)
+	for _, a := range attrs {
+		raw, err := asn1.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, raw...)
+	}
+	tbs.Attributes, err = implicitSet(content)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := signTBS(key, csr.SignatureAlgorithm, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(certificateRequest{
+		TBS:                asn1.RawValue{FullBytes: raw},
+		SignatureAlgorithm: req.SignatureAlgorithm,
+		Signature:          asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+
+}
+
+// Encodes content as an implicit [0], crypto/asn1 won't do this for a
+// RawValue.
+func implicitSet(content []byte) (asn1.RawValue, error) {
+	raw, err := asn1.Marshal(asn1.RawValue{
+		Class: asn1.ClassContextSpecific, Tag: 0,
+		IsCompound: true, Bytes: content,
+	})
+	return asn1.RawValue{FullBytes: raw}, err
+}
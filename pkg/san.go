@@ -0,0 +1,350 @@
+package cert_tools
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// OID of the subject alternative name extension.
+var OidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// OID of the Microsoft User Principal Name otherName.
+var OidUPN = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+
+// GeneralName tags, RFC 5280 section 4.2.1.6.
+const (
+	nameTypeOther = 0
+	nameTypeEmail = 1
+	nameTypeDNS   = 2
+	nameTypeURI   = 6
+	nameTypeIP    = 7
+)
+
+// Names of the GeneralName types kept as they are, as openssl shows them.
+var rawNameTypes = map[int]string{
+	3: "X400Name", 4: "DirName", 5: "EdiPartyName", 8: "RID",
+}
+
+// An otherName SAN entry.  Only UTF8String values are supported, which
+// covers UPN and most other uses.
+type OtherName struct {
+	Type  asn1.ObjectIdentifier
+	Value string
+}
+
+// Parses an otherName from the command line form TYPE=VALUE, where TYPE
+// is 'upn' or a dotted OID.
+func ParseOtherName(s string) (OtherName, error) {
+
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return OtherName{}, fmt.Errorf("other name %q not of form TYPE=VALUE", s)
+	}
+
+	if strings.ToLower(parts[0]) == "upn" {
+		return OtherName{Type: OidUPN, Value: parts[1]}, nil
+	}
+
+	oid, err := ParseOID(parts[0])
+	if err != nil {
+		return OtherName{}, err
+	}
+
+	return OtherName{Type: oid, Value: parts[1]}, nil
+
+}
+
+func (o OtherName) String() string {
+	if o.Type.Equal(OidUPN) {
+		return "upn=" + o.Value
+	}
+	return o.Type.String() + "=" + o.Value
+}
+
+// Parses a dotted-decimal OID.
+func ParseOID(s string) (asn1.ObjectIdentifier, error) {
+
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, p := range parts {
+		_, err := fmt.Sscanf(p, "%d", &oid[i])
+		if err != nil || oid[i] < 0 || fmt.Sprint(oid[i]) != p {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+	}
+
+	return oid, nil
+
+}
+
+// The full set of subject alternative names, including the otherName
+// entries which crypto/x509 doesn't handle.
+type SANs struct {
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	OtherNames     []OtherName
+
+	// Other GeneralName types, e.g. directory names, kept as they are
+	// so they aren't lost when the extension is rebuilt.
+	Raw []asn1.RawValue
+}
+
+// Sorts command line host arguments into DNS names and IP addresses.
+func (s *SANs) AddHosts(hosts []string) {
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			s.IPAddresses = append(s.IPAddresses, ip)
+		} else {
+			s.DNSNames = append(s.DNSNames, h)
+		}
+	}
+}
+
+// Parses command line URI arguments.
+func (s *SANs) AddURIs(uris []string) error {
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid URI %q: %s", u, err)
+		}
+		if parsed.Scheme == "" {
+			return fmt.Errorf("URI %q has no scheme", u)
+		}
+		s.URIs = append(s.URIs, parsed)
+	}
+	return nil
+}
+
+// Parses command line otherName arguments.
+func (s *SANs) AddOtherNames(names []string) error {
+	for _, n := range names {
+		o, err := ParseOtherName(n)
+		if err != nil {
+			return err
+		}
+		s.OtherNames = append(s.OtherNames, o)
+	}
+	return nil
+}
+
+func (s *SANs) Empty() bool {
+	return len(s.DNSNames) == 0 && len(s.EmailAddresses) == 0 &&
+		len(s.IPAddresses) == 0 && len(s.URIs) == 0 &&
+		len(s.OtherNames) == 0 && len(s.Raw) == 0
+}
+
+// The names as TYPE:VALUE strings, e.g. DNS:www.example.org.
+func (s *SANs) Strings() []string {
+	names := []string{}
+	for _, n := range s.DNSNames {
+		names = append(names, "DNS:"+n)
+	}
+	for _, e := range s.EmailAddresses {
+		names = append(names, "email:"+e)
+	}
+	for _, ip := range s.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, u := range s.URIs {
+		names = append(names, "URI:"+u.String())
+	}
+	for _, o := range s.OtherNames {
+		names = append(names, "otherName:"+o.String())
+	}
+	for _, r := range s.Raw {
+		names = append(names, fmt.Sprintf("%s:%X", rawNameTypes[r.Tag],
+			r.Bytes))
+	}
+	return names
+}
+
+// Marshals the names as a subject alternative name extension.  RFC 5280
+// requires the extension to be critical if the subject is empty.
+func (s *SANs) Extension(critical bool) (pkix.Extension, error) {
+
+	var names []asn1.RawValue
+
+	for _, o := range s.OtherNames {
+		oid, err := asn1.Marshal(o.Type)
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		val, err := asn1.MarshalWithParams(o.Value, "utf8,explicit,tag:0")
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		names = append(names, asn1.RawValue{
+			Class: asn1.ClassContextSpecific, Tag: nameTypeOther,
+			IsCompound: true, Bytes: append(oid, val...),
+		})
+	}
+	for _, e := range s.EmailAddresses {
+		names = append(names, asn1.RawValue{
+			Class: asn1.ClassContextSpecific, Tag: nameTypeEmail,
+			Bytes: []byte(e),
+		})
+	}
+	for _, d := range s.DNSNames {
+		names = append(names, asn1.RawValue{
+			Class: asn1.ClassContextSpecific, Tag: nameTypeDNS,
+			Bytes: []byte(d),
+		})
+	}
+	for _, u := range s.URIs {
+		names = append(names, asn1.RawValue{
+			Class: asn1.ClassContextSpecific, Tag: nameTypeURI,
+			Bytes: []byte(u.String()),
+		})
+	}
+	for _, ip := range s.IPAddresses {
+		b := ip.To4()
+		if b == nil {
+			b = ip
+		}
+		names = append(names, asn1.RawValue{
+			Class: asn1.ClassContextSpecific, Tag: nameTypeIP,
+			Bytes: b,
+		})
+	}
+	names = append(names, s.Raw...)
+
+	val, err := asn1.Marshal(names)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+
+	return pkix.Extension{
+		Id: OidSubjectAltName, Critical: critical, Value: val,
+	}, nil
+
+}
+
+// Parses a subject alternative name extension value.
+func ParseSANs(der []byte) (*SANs, error) {
+
+	var names []asn1.RawValue
+	rest, err := asn1.Unmarshal(der, &names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SAN extension: %s", err)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after SAN extension")
+	}
+
+	s := &SANs{}
+
+	for _, n := range names {
+
+		if n.Class != asn1.ClassContextSpecific {
+			return nil, fmt.Errorf("invalid SAN entry")
+		}
+
+		switch n.Tag {
+		case nameTypeOther:
+			var o struct {
+				Type  asn1.ObjectIdentifier
+				Value asn1.RawValue `asn1:"explicit,tag:0"`
+			}
+			_, err := asn1.UnmarshalWithParams(n.FullBytes, &o,
+				"tag:0")
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse other name: %s", err)
+			}
+			var v string
+			_, err = asn1.Unmarshal(o.Value.Bytes, &v)
+			if err != nil {
+				return nil, fmt.Errorf("other name %s is not a string",
+					o.Type)
+			}
+			s.OtherNames = append(s.OtherNames,
+				OtherName{Type: o.Type, Value: v})
+		case nameTypeEmail:
+			s.EmailAddresses = append(s.EmailAddresses,
+				string(n.Bytes))
+		case nameTypeDNS:
+			s.DNSNames = append(s.DNSNames, string(n.Bytes))
+		case nameTypeURI:
+			u, err := url.Parse(string(n.Bytes))
+			if err != nil {
+				return nil, fmt.Errorf("invalid URI SAN: %s", err)
+			}
+			s.URIs = append(s.URIs, u)
+		case nameTypeIP:
+			if len(n.Bytes) != net.IPv4len &&
+				len(n.Bytes) != net.IPv6len {
+				return nil, fmt.Errorf("invalid IP SAN")
+			}
+			s.IPAddresses = append(s.IPAddresses, net.IP(n.Bytes))
+		default:
+			if _, ok := rawNameTypes[n.Tag]; !ok {
+				return nil, fmt.Errorf("invalid SAN type %d", n.Tag)
+			}
+			s.Raw = append(s.Raw, n)
+		}
+
+	}
+
+	return s, nil
+
+}
+
+// Finds and parses the SAN extension in a list of extensions, returns
+// nil if there isn't one.
+func SANsFromExtensions(exts []pkix.Extension) (*SANs, error) {
+	for _, e := range exts {
+		if e.Id.Equal(OidSubjectAltName) {
+			return ParseSANs(e.Value)
+		}
+	}
+	return nil, nil
+}
+
+// True if two lists of extensions have the same SANs, of every type and
+// in any order.
+func SameSANs(a, b []pkix.Extension) (bool, error) {
+
+	set := func(exts []pkix.Extension) (map[string]bool, error) {
+		sans, err := SANsFromExtensions(exts)
+		if err != nil {
+			return nil, err
+		}
+		names := map[string]bool{}
+		if sans != nil {
+			for _, n := range sans.Strings() {
+				names[n] = true
+			}
+		}
+		return names, nil
+	}
+
+	aNames, err := set(a)
+	if err != nil {
+		return false, err
+	}
+	bNames, err := set(b)
+	if err != nil {
+		return false, err
+	}
+
+	if len(aNames) != len(bNames) {
+		return false, nil
+	}
+	for n := range aNames {
+		if !bNames[n] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+
+}
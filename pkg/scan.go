@@ -0,0 +1,356 @@
+package cert_tools
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// A certificate found in a file.
+type FoundCertificate struct {
+	Path        string
+	Certificate *x509.Certificate
+}
+
+// A CRL found in a file.
+type FoundCRL struct {
+	Path string
+	CRL  *x509.RevocationList
+}
+
+// A certificate request found in a file.  Its signature isn't checked.
+type FoundRequest struct {
+	Path    string
+	Request *x509.CertificateRequest
+}
+
+// Certificates, CRLs and requests found by scanning files.
+type Scan struct {
+	Certificates []*FoundCertificate
+	CRLs         []*FoundCRL
+	Requests     []*FoundRequest
+
+	// Glob patterns file names in directories must match, all files if
+	// there are none.  Files given by name are always read.
+	Names []string
+
+	// Passwords tried for p12 files, after an empty password.
+	Passwords []string
+
+	// Called for files which are skipped because they can't be read or
+	// parsed.  Other files in directories, keys and the like, are
+	// skipped quietly.
+	Warn func(path string, err error)
+
+	// Files and directories already read, by their real path, so
+	// symlinks don't repeat them or loop.
+	seen map[string]bool
+}
+
+// File name extensions of certificate files, which are warned about if
+// they hold nothing usable.
+var certFileExtensions = map[string]bool{
+	".pem": true, ".crt": true, ".cer": true, ".der": true, ".crl": true,
+	".p7b": true, ".p7c": true, ".p12": true, ".pfx": true, ".csr": true,
+	".req": true,
+}
+
+// Scans files, and directories recursively following symlinks, for
+// certificates, CRLs and requests: PEM bundles, DER, PKCS #7 and p12
+// files.  Paths may be glob patterns.
+func (s *Scan) Paths(paths []string) error {
+
+	if s.seen == nil {
+		s.seen = map[string]bool{}
+	}
+
+	for _, p := range paths {
+
+		matches := []string{p}
+		if strings.ContainsAny(p, "*?[") {
+			var err error
+			matches, err = filepath.Glob(p)
+			if err != nil {
+				return fmt.Errorf("%s: %s", p, err)
+			}
+			if len(matches) == 0 {
+				return fmt.Errorf("%s: no matching files", p)
+			}
+		}
+
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				s.dir(m)
+			} else {
+				s.file(m, true)
+			}
+		}
+
+	}
+
+	return nil
+
+}
+
+func (s *Scan) warn(path string, err error) {
+	if s.Warn != nil {
+		s.Warn(path, err)
+	}
+}
+
+// Whether a file or directory has been read already, marking it read.
+func (s *Scan) visited(path string) bool {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		real = path
+	}
+	if s.seen[real] {
+		return true
+	}
+	s.seen[real] = true
+	return false
+}
+
+// Reads a directory recursively.
+func (s *Scan) dir(path string) {
+
+	if s.visited(path) {
+		return
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		s.warn(path, err)
+		return
+	}
+
+	for _, e := range entries {
+
+		p := filepath.Join(path, e.Name())
+
+		// Symlinks are followed, broken ones skipped.
+		info, err := os.Stat(p)
+		if err != nil {
+			s.warn(p, err)
+			continue
+		}
+
+		if info.IsDir() {
+			s.dir(p)
+		} else if info.Mode().IsRegular() && s.wanted(e.Name()) {
+			s.file(p, false)
+		}
+
+	}
+
+}
+
+// Whether a file name in a directory matches the name patterns.
+func (s *Scan) wanted(name string) bool {
+	if len(s.Names) == 0 {
+		return true
+	}
+	for _, n := range s.Names {
+		if ok, _ := filepath.Match(n, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads a file, warning if it should hold certificates and doesn't.
+func (s *Scan) file(path string, given bool) {
+
+	if s.visited(path) {
+		return
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		s.warn(path, err)
+		return
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	expected := given || certFileExtensions[ext]
+
+	var found int
+	if ext == ".p12" || ext == ".pfx" {
+		found, err = s.p12(path, raw)
+	} else {
+		found, err = s.parse(path, raw)
+	}
+	if err != nil {
+		s.warn(path, err)
+	} else if found == 0 && expected {
+		s.warn(path, fmt.Errorf("no certificates, CRLs or requests"))
+	}
+
+}
+
+func (s *Scan) addCertificates(path string, certs []*x509.Certificate) {
+	for _, cert := range certs {
+		s.Certificates = append(s.Certificates,
+			&FoundCertificate{path, cert})
+	}
+}
+
+// Adds the certificates from a p12 file, its own and its chain, or those
+// of a trust store.
+func (s *Scan) p12(path string, raw []byte) (int, error) {
+
+	var err error
+	for _, password := range append([]string{""}, s.Passwords...) {
+
+		var cert *x509.Certificate
+		var chain []*x509.Certificate
+		_, cert, chain, err = pkcs12.DecodeChain(raw, password)
+		if err == nil {
+			certs := append([]*x509.Certificate{cert}, chain...)
+			s.addCertificates(path, certs)
+			return len(certs), nil
+		}
+
+		certs, terr := pkcs12.DecodeTrustStore(raw, password)
+		if terr == nil {
+			s.addCertificates(path, certs)
+			return len(certs), nil
+		}
+
+	}
+
+	return 0, err
+
+}
+
+// Adds what a file holds, and returns how many there were.
+func (s *Scan) parse(path string, raw []byte) (int, error) {
+
+	found := 0
+
+	if block, _ := pem.Decode(raw); block == nil {
+
+		// DER, a certificate, a CRL, a request or a PKCS #7 bundle.
+		if cert, err := x509.ParseCertificate(raw); err == nil {
+			s.addCertificates(path, []*x509.Certificate{cert})
+			return 1, nil
+		}
+		if crl, err := x509.ParseRevocationList(raw); err == nil {
+			s.CRLs = append(s.CRLs, &FoundCRL{path, crl})
+			return 1, nil
+		}
+		if csr, err := x509.ParseCertificateRequest(raw); err == nil {
+			s.Requests = append(s.Requests, &FoundRequest{path, csr})
+			return 1, nil
+		}
+		if certs, err := ParseCertsOnly(raw); err == nil {
+			s.addCertificates(path, certs)
+			return len(certs), nil
+		}
+		return 0, nil
+
+	}
+
+	for rest := raw; ; {
+
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return found, fmt.Errorf("certificate %d: %s",
+					found+1, err)
+			}
+			s.addCertificates(path, []*x509.Certificate{cert})
+			found++
+		case "X509 CRL":
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				return found, fmt.Errorf("CRL %d: %s", found+1,
+					err)
+			}
+			s.CRLs = append(s.CRLs, &FoundCRL{path, crl})
+			found++
+		case "CERTIFICATE REQUEST", "NEW CERTIFICATE REQUEST":
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				return found, fmt.Errorf("request %d: %s", found+1,
+					err)
+			}
+			s.Requests = append(s.Requests, &FoundRequest{path, csr})
+			found++
+		case "PKCS7":
+			certs, err := ParseCertsOnly(block.Bytes)
+			if err != nil {
+				return found, fmt.Errorf("PKCS #7 %d: %s",
+					found+1, err)
+			}
+			s.addCertificates(path, certs)
+			found += len(certs)
+		}
+
+	}
+
+	return found, nil
+
+}
+
+// The certificates found, each once.  Chains and bundles repeat
+// certificates, they're given the path of a file of their own if there
+// is one.
+func (s *Scan) UniqueCertificates() []*FoundCertificate {
+
+	inFile := map[string]int{}
+	for _, c := range s.Certificates {
+		inFile[c.Path]++
+	}
+
+	unique := []*FoundCertificate{}
+	byHash := map[[32]byte]*FoundCertificate{}
+	for _, c := range s.Certificates {
+		id := sha256.Sum256(c.Certificate.Raw)
+		if prev, ok := byHash[id]; ok {
+			if inFile[c.Path] == 1 && inFile[prev.Path] > 1 {
+				prev.Path = c.Path
+			}
+			continue
+		}
+		byHash[id] = &FoundCertificate{c.Path, c.Certificate}
+		unique = append(unique, byHash[id])
+	}
+
+	return unique
+
+}
+
+// The CRLs found, each once.
+func (s *Scan) UniqueCRLs() []*FoundCRL {
+
+	unique := []*FoundCRL{}
+	seen := map[[32]byte]bool{}
+	for _, c := range s.CRLs {
+		id := sha256.Sum256(c.CRL.Raw)
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, c)
+		}
+	}
+
+	return unique
+
+}
@@ -0,0 +1,210 @@
+package cert_tools
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+)
+
+// SCEP signed attributes, RFC 8894 section 3.2.1.
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+)
+
+// Certificate request challengePassword attribute, RFC 2985.
+var OidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+// SCEP message types.
+const (
+	SCEPCertRep    = "3"
+	SCEPRenewalReq = "17"
+	SCEPPKCSReq    = "19"
+	SCEPCertPoll   = "20"
+	SCEPGetCert    = "21"
+	SCEPGetCRL     = "22"
+)
+
+// SCEP pkiStatus values.
+const (
+	SCEPSuccess = "0"
+	SCEPFailure = "2"
+	SCEPPending = "3"
+)
+
+// SCEP failInfo values.
+const (
+	SCEPBadAlg          = "0"
+	SCEPBadMessageCheck = "1"
+	SCEPBadRequest      = "2"
+	SCEPBadTime         = "3"
+	SCEPBadCertId       = "4"
+)
+
+var scepFailInfoNames = map[string]string{
+	SCEPBadAlg:          "badAlg",
+	SCEPBadMessageCheck: "badMessageCheck",
+	SCEPBadRequest:      "badRequest",
+	SCEPBadTime:         "badTime",
+	SCEPBadCertId:       "badCertId",
+}
+
+// Name of a SCEP failInfo value.
+func SCEPFailInfoName(info string) string {
+	if n, ok := scepFailInfoNames[info]; ok {
+		return n
+	}
+	return "failInfo " + info
+}
+
+// A SCEP pkiMessage, RFC 8894 section 3.2.
+type SCEPMessage struct {
+	MessageType    string
+	TransactionID  string
+	SenderNonce    []byte
+	RecipientNonce []byte
+	PKIStatus      string
+	FailInfo       string
+
+	// pkcsPKIEnvelope, an EnvelopedData, nil if there isn't one.
+	Envelope []byte
+
+	// Set on parsed messages.
+	Signer *x509.Certificate
+	Hash   crypto.Hash
+}
+
+// Parses a pkiMessage and verifies its signature.  The signer's
+// certificate is looked for in the message and then in certs.
+func ParseSCEPMessage(der []byte, certs []*x509.Certificate) (*SCEPMessage, error) {
+
+	sd, err := ParseSignedData(der, certs)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SCEPMessage{
+		Envelope: sd.Content,
+		Signer:   sd.Signer,
+		Hash:     sd.Hash,
+	}
+
+	texts := []struct {
+		oid asn1.ObjectIdentifier
+		val *string
+	}{
+		{oidSCEPMessageType, &m.MessageType},
+		{oidSCEPTransactionID, &m.TransactionID},
+		{oidSCEPPKIStatus, &m.PKIStatus},
+		{oidSCEPFailInfo, &m.FailInfo},
+	}
+	for _, s := range texts {
+		if v := FindAttribute(sd.Attributes, s.oid); v != nil {
+			if _, err := asn1.Unmarshal(v.FullBytes, s.val); err != nil {
+				return nil, fmt.Errorf("failed to parse SCEP "+
+					"attribute %s: %s", s.oid, err)
+			}
+		}
+	}
+
+	octets := []struct {
+		oid asn1.ObjectIdentifier
+		val *[]byte
+	}{
+		{oidSCEPSenderNonce, &m.SenderNonce},
+		{oidSCEPRecipientNonce, &m.RecipientNonce},
+	}
+	for _, o := range octets {
+		if v := FindAttribute(sd.Attributes, o.oid); v != nil {
+			if _, err := asn1.Unmarshal(v.FullBytes, o.val); err != nil {
+				return nil, fmt.Errorf("failed to parse SCEP "+
+					"attribute %s: %s", o.oid, err)
+			}
+		}
+	}
+
+	if m.MessageType == "" || m.TransactionID == "" {
+		return nil, fmt.Errorf("SCEP message has no message type or " +
+			"transaction ID")
+	}
+
+	return m, nil
+
+}
+
+// Encodes and signs a pkiMessage.
+func (m *SCEPMessage) Marshal(cert *x509.Certificate, key crypto.Signer,
+	hash crypto.Hash) ([]byte, error) {
+
+	attrs := []Attribute{}
+	add := func(oid asn1.ObjectIdentifier, value interface{}) error {
+		a, err := NewAttribute(oid, value)
+		if err == nil {
+			attrs = append(attrs, a)
+		}
+		return err
+	}
+
+	printable := func(s string) asn1.RawValue {
+		return asn1.RawValue{Tag: asn1.TagPrintableString,
+			Bytes: []byte(s)}
+	}
+
+	if err := add(oidSCEPMessageType, printable(m.MessageType)); err != nil {
+		return nil, err
+	}
+	if err := add(oidSCEPTransactionID, printable(m.TransactionID)); err != nil {
+		return nil, err
+	}
+	if m.PKIStatus != "" {
+		if err := add(oidSCEPPKIStatus, printable(m.PKIStatus)); err != nil {
+			return nil, err
+		}
+	}
+	if m.FailInfo != "" {
+		if err := add(oidSCEPFailInfo, printable(m.FailInfo)); err != nil {
+			return nil, err
+		}
+	}
+	if m.SenderNonce != nil {
+		if err := add(oidSCEPSenderNonce, m.SenderNonce); err != nil {
+			return nil, err
+		}
+	}
+	if m.RecipientNonce != nil {
+		if err := add(oidSCEPRecipientNonce, m.RecipientNonce); err != nil {
+			return nil, err
+		}
+	}
+
+	return Sign(m.Envelope, cert, key, hash, attrs, nil)
+
+}
+
+// Returns a request's challengePassword, empty if there isn't one.
+func ChallengePassword(csr *x509.CertificateRequest) (string, error) {
+
+	attrs, err := RequestAttributes(csr)
+	if err != nil {
+		return "", err
+	}
+
+	v := FindAttribute(attrs, OidChallengePassword)
+	if v == nil {
+		return "", nil
+	}
+
+	var password string
+	if _, err := asn1.Unmarshal(v.FullBytes, &password); err != nil {
+		return "", fmt.Errorf("failed to parse challenge password: %s",
+			err)
+	}
+
+	return password, nil
+
+}
@@ -0,0 +1,326 @@
+package cert_tools
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Shamir secret sharing over GF(2^8), each byte of the key split
+// separately.  Shares are PEM, holding the share's x coordinate then its
+// y values, with headers saying which key they belong to.
+const SharePemType = "CERT TOOLS KEY SHARE"
+
+var gfExp [510]byte
+var gfLog [256]byte
+
+func init() {
+	// Generator 3 under the AES polynomial.
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfExp[i+255] = x
+		gfLog[x] = byte(i)
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// Splits a secret into n shares, any t of which recover it.
+func splitSecret(secret []byte, n, t int) ([][]byte, error) {
+
+	if t < 2 || t > n || n > 255 {
+		return nil, fmt.Errorf("need 2 <= threshold <= shares <= 255")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coef := make([]byte, t)
+	defer zero(coef)
+
+	for j, s := range secret {
+		coef[0] = s
+		if _, err := rand.Read(coef[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := shares[i][0]
+			y := byte(0)
+			for k := t - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coef[k]
+			}
+			shares[i][j+1] = y
+		}
+	}
+
+	return shares, nil
+
+}
+
+// Recovers a secret from shares by interpolating at zero.
+func combineSecret(shares [][]byte) ([]byte, error) {
+
+	for i, s := range shares {
+		if len(s) != len(shares[0]) || len(s) < 2 || s[0] == 0 {
+			return nil, fmt.Errorf("invalid share")
+		}
+		for _, o := range shares[:i] {
+			if o[0] == s[0] {
+				return nil, fmt.Errorf("share %d given twice", s[0])
+			}
+		}
+	}
+
+	secret := make([]byte, len(shares[0])-1)
+	for i, si := range shares {
+		// Lagrange basis at zero.
+		l := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				l = gfMul(l, gfDiv(sj[0], sj[0]^si[0]))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(l, si[k+1])
+		}
+	}
+
+	return secret, nil
+
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Identifies a key by its public key, so shares of different keys
+// aren't mixed.
+func keyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// Splits a key into n PEM shares, any t of which recover it.
+func (k *Key) Split(n, t int) ([][]byte, error) {
+
+	der, err := k.ToPem()
+	if err != nil {
+		return nil, err
+	}
+	defer zero(der)
+
+	id, err := keyID(k.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	shares, err := splitSecret(der, n, t)
+	if err != nil {
+		return nil, err
+	}
+
+	out := [][]byte{}
+	for _, s := range shares {
+		out = append(out, pem.EncodeToMemory(&pem.Block{
+			Type: SharePemType,
+			Headers: map[string]string{
+				"Key-Id":    id,
+				"Key-Type":  k.PemType(),
+				"Share":     strconv.Itoa(int(s[0])),
+				"Shares":    strconv.Itoa(n),
+				"Threshold": strconv.Itoa(t),
+			},
+			Bytes: s,
+		}))
+	}
+
+	return out, nil
+
+}
+
+// Whether a key name is a list of share files.
+func IsSharesKey(s string) bool {
+	return strings.HasPrefix(s, "shares:")
+}
+
+// Recovers a key from share files, shares:FILE,FILE,...  The key is only
+// held in memory, and the caller should zeroise it when done.
+func ReadKeyFromShares(name string) (*Key, error) {
+
+	files := strings.Split(strings.TrimPrefix(name, "shares:"), ",")
+
+	var id, typ string
+	threshold := 0
+	shares := [][]byte{}
+
+	defer func() {
+		for _, s := range shares {
+			zero(s)
+		}
+	}()
+
+	for _, f := range files {
+
+		raw, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(raw)
+		zero(raw)
+		if block == nil || block.Type != SharePemType {
+			return nil, fmt.Errorf("%s is not a key share", f)
+		}
+		shares = append(shares, block.Bytes)
+
+		t, err := strconv.Atoi(block.Headers["Threshold"])
+		if err != nil {
+			return nil, fmt.Errorf("%s has no threshold", f)
+		}
+
+		if id == "" {
+			id, typ, threshold = block.Headers["Key-Id"],
+				block.Headers["Key-Type"], t
+		} else if block.Headers["Key-Id"] != id {
+			return nil, fmt.Errorf("%s is a share of a different key",
+				f)
+		}
+
+	}
+
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("%d shares given, %d needed",
+			len(shares), threshold)
+	}
+
+	der, err := combineSecret(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(der)
+
+	key, err := parseKeyDER(typ, der)
+	if err != nil {
+		return nil, fmt.Errorf("shares don't recover a key, some may "+
+			"be damaged: %s", err)
+	}
+
+	got, err := keyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(id)) != 1 {
+		key.Zeroise()
+		return nil, fmt.Errorf("shares recover the wrong key, some " +
+			"may be damaged")
+	}
+
+	return key, nil
+
+}
+
+func zeroInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	w := n.Bits()
+	for i := range w {
+		w[i] = 0
+	}
+	n.SetInt64(0)
+}
+
+// Overwrites the private part of a key held in memory, as far as Go
+// allows.  Keys on tokens and in plugins aren't affected.
+func (k *Key) Zeroise() {
+	zeroiseSigner(k.key)
+}
+
+// Overwrites the CA's private key, if it's held in memory.
+func (i *Issuer) Zeroise() {
+	zeroiseSigner(i.Key)
+}
+
+func zeroiseSigner(s crypto.Signer) {
+	switch key := s.(type) {
+	case *ecdsa.PrivateKey:
+		zeroInt(key.D)
+	case *rsa.PrivateKey:
+		zeroInt(key.D)
+		for _, p := range key.Primes {
+			zeroInt(p)
+		}
+		zeroInt(key.Precomputed.Dp)
+		zeroInt(key.Precomputed.Dq)
+		zeroInt(key.Precomputed.Qinv)
+	case ed25519.PrivateKey:
+		zero(key)
+	}
+}
+
+// Writes shares to PREFIX-N.share files, which mustn't exist already,
+// and returns their names.
+func WriteShares(prefix string, shares [][]byte) ([]string, error) {
+
+	files := []string{}
+	for i, s := range shares {
+		file := fmt.Sprintf("%s-%d.share", prefix, i+1)
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			0600)
+		if err != nil {
+			return files, err
+		}
+		_, err = f.Write(s)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+
+}
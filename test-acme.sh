@@ -0,0 +1,91 @@
+#!/bin/sh
+# Regression test for the ACME server.  Orders with http-01 and dns-01,
+# the latter through the server's file resolver, checks the certificate
+# names come from the order, and that requests carrying anything else,
+# or identifiers which aren't host names, are refused.
+
+BIN=../go/bin
+PORT=18081
+HTTP_PORT=18082
+URL=http://127.0.0.1:${PORT}/directory
+
+rm -rf test-acme
+mkdir test-acme
+cd test-acme
+
+PID=
+stop() {
+    [ -n "${PID}" ] && kill ${PID} 2> /dev/null
+    PID=
+}
+trap stop EXIT
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+: > records
+
+${BIN}/create-key > ca.key || exit 1
+${BIN}/create-ca-cert -k ca.key -E ca@example.org -N "ACME CA" > ca.pem || exit 1
+
+${BIN}/acme-server -l 127.0.0.1:${PORT} -k ca.key -c ca.pem \
+    --http-port ${HTTP_PORT} --dns-records records --audit-log audit.log 2> server.log &
+PID=$!
+sleep 1
+
+${BIN}/create-key > server.key || exit 1
+
+# http-01, fetched from localhost
+${BIN}/create-cert-request -k server.key -N localhost > http.req || exit 1
+${BIN}/acme-client -u ${URL} -r http.req -l 127.0.0.1:${HTTP_PORT} > http.pem || exit 1
+openssl verify -CAfile ca.pem http.pem || exit 1
+openssl x509 -in http.pem -noout -ext subjectAltName | grep -q 'DNS:localhost' ||
+    fail "http-01 certificate doesn't name localhost"
+
+# dns-01, names in a different case and order to the identifiers
+${BIN}/create-cert-request -k server.key -N WWW.example.org -H example.org -H www.example.org > dns.req || exit 1
+${BIN}/acme-client -u ${URL} -r dns.req --dns-records records > dns.pem || exit 1
+openssl verify -CAfile ca.pem dns.pem || exit 1
+openssl x509 -in dns.pem -noout -subject -nameopt RFC2253 | grep -qx 'subject=CN=www.example.org' ||
+    fail "dns-01 certificate subject isn't just the common name"
+openssl x509 -in dns.pem -noout -ext subjectAltName > dns.sans
+grep -q 'DNS:www.example.org' dns.sans && grep -q 'DNS:example.org' dns.sans ||
+    fail "dns-01 certificate doesn't name the identifiers: $(cat dns.sans)"
+
+# No other subject attributes
+${BIN}/create-cert-request -k server.key -N www.example.org -O "Example Ltd" > org.req || exit 1
+${BIN}/acme-client -u ${URL} -r org.req --dns-records records > /dev/null 2>&1 &&
+    fail "request with an organisation was accepted"
+
+# No SANs beyond DNS names
+${BIN}/create-cert-request -k server.key -N www.example.org -H 127.0.0.1 > ip.req || exit 1
+${BIN}/acme-client -u ${URL} -r ip.req --dns-records records > /dev/null 2>&1 &&
+    fail "request with an IP address was accepted"
+
+${BIN}/create-cert-request -k server.key -N www.example.org -u spiffe://example.org/x > uri.req || exit 1
+${BIN}/acme-client -u ${URL} -r uri.req --dns-records records > /dev/null 2>&1 &&
+    fail "request with a URI was accepted"
+
+# Identifiers must be host names
+for name in 'evil@127.0.0.1' '127.0.0.1:18082/x' '127.0.0.1' 'www..example.org'; do
+    ${BIN}/create-cert-request -k server.key -N "${name}" > bad.req || exit 1
+    ${BIN}/acme-client -u ${URL} -r bad.req -l 127.0.0.1:${HTTP_PORT} > /dev/null 2>&1 &&
+        fail "identifier ${name} was accepted"
+    grep -q "new order .*${name}" server.log && fail "order for ${name} was created"
+done
+
+# Unanswered challenges fail
+${BIN}/create-cert-request -k server.key -N other.example.org > other.req || exit 1
+${BIN}/acme-client -u ${URL} -r other.req -l 127.0.0.1:${HTTP_PORT} -t 10 > /dev/null 2>&1 &&
+    fail "unanswered challenge was accepted"
+
+stop
+
+# Issued certificates are audited
+[ $(grep -c '"operation":"acme-server finalize","operator":[^}]*"result":"success"' audit.log) = 2 ] ||
+    fail "orders not audited: $(cat audit.log)"
+${BIN}/verify-audit -f audit.log > /dev/null || exit 1
+
+exit 0
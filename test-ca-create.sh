@@ -8,6 +8,12 @@
 #   ca1.crl - CA1 CRL revoking baduser's cert signed by the Intermediate
 #   crlchain.pem - root.pem + ca1.pem + root.crl + ca1.crl
 #   revoke_list - Input into create-crl that lists the one cert to revoke
+#   workload.cert/workload.key - SPIFFE SVID issued by the Intermediate
+#   device.cert/device.key - device cert with custom subject and extension
+#   machine.cert/machine.key - machine client cert with no email address
+#   workload2.cert/workload2.key - workload cert renewed with a new key
+#   machine2.cert - machine cert renewed with an extra SAN
+#   audit.log - hash-chained audit log of every CA operation
 
 rm -rf test-ca
 mkdir test-ca
@@ -15,6 +21,10 @@ cp $0 test-ca/README
 cd test-ca
 chmod -x ./README
 
+# Every CA operation below is audited
+CERT_TOOLS_AUDIT_LOG=audit.log
+export CERT_TOOLS_AUDIT_LOG
+
 # Create the root CA
 ../go/bin/create-key > root.key || exit 1
 ../go/bin/create-ca-cert -k root.key -v 180 -E cyberprobe@trustnetworks.com -C US -O "Trust Networks" -N "Trust Networks CA root" > root.pem || exit 1
@@ -30,7 +40,6 @@ rm ca1.req
 ../go/bin/create-key > testuser.key || exit 1
 ../go/bin/create-cert-request -E testuser@trustnetworks.com -N "M. Test User" -C US -O "Trust Networks" -k testuser.key > testuser.req || exit 1
 ../go/bin/create-cert -k ca1.key -c ca1.pem  -r testuser.req -C > testuser.cert || exit 1
-rm testuser.req
 
 echo "testuser.p12 Password is: foo"
 openssl pkcs12 -export -passout pass:foo -inkey testuser.key -in testuser.cert -caname 'Trust Networks CA1'  -certfile ca1.pem -out testuser.p12 || exit 1
@@ -44,12 +53,82 @@ rm baduser.req
 echo "baduser.p12 Password is: foo"
 openssl pkcs12 -export -passout pass:foo -inkey baduser.key -in baduser.cert -caname 'Trust Networks CA1'  -certfile ca1.pem -out baduser.p12 || exit 1
 
+# Create a SPIFFE workload cert
+../go/bin/create-key > workload.key || exit 1
+../go/bin/create-cert-request -u spiffe://trustnetworks.com/ns/test/sa/workload -o upn=workload@TRUSTNETWORKS.COM -k workload.key > workload.req || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r workload.req -p spiffe > workload.cert || exit 1
+rm workload.req
+
+# SAN types without their own fields, e.g. directory names, are kept
+# alongside otherName entries
+cat > dirname.cnf <<CNF
+[req]
+distinguished_name = dn
+[dn]
+[dir_sect]
+O = Trust Networks
+CN = Directory Entry
+CNF
+openssl req -new -key workload.key -subj /CN=dir.trustnetworks.com -config dirname.cnf \
+    -addext 'subjectAltName=DNS:dir.trustnetworks.com,dirName:dir_sect,otherName:1.3.6.1.4.1.311.20.2.3;UTF8:dir@TRUSTNETWORKS.COM' > dirname.req || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r dirname.req -S > dirname.cert || exit 1
+openssl x509 -in dirname.cert -noout -ext subjectAltName > dirname.sans
+grep -q 'DirName:.*CN *= *Directory Entry' dirname.sans && grep -q 'DNS:dir.trustnetworks.com' dirname.sans &&
+    grep -q 'othername: *UPN' dirname.sans || { echo "SANs lost: $(cat dirname.sans)"; exit 1; }
+../go/bin/create-cert-request -k workload.key -c dirname.cert > dirname-renew.req || exit 1
+openssl req -in dirname-renew.req -noout -text | grep -q 'DirName:.*CN *= *Directory Entry' ||
+    { echo "renewal request lost the directory name"; exit 1; }
+rm dirname.cnf dirname.req dirname.cert dirname.sans dirname-renew.req
+
+# SPIFFE profile must refuse a common name
+../go/bin/create-cert-request -N workload -u spiffe://trustnetworks.com/ns/test/sa/workload -k workload.key > badworkload.req || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r badworkload.req -p spiffe > /dev/null && exit 1
+rm badworkload.req
+
+# Create a device cert with a custom subject and extension copied from
+# the request
+../go/bin/create-key > device.key || exit 1
+../go/bin/create-cert-request -s 'CN=device1,OU=Things,O=Trust Networks,DC=trustnetworks,DC=com' -a serialNumber=ABC123 -x 1.3.6.1.4.1.99999.1=utf8:rack12 -E device@trustnetworks.com -k device.key > device.req || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r device.req -C -X > device.cert || exit 1
+openssl x509 -in device.cert -noout -text | grep -q 1.3.6.1.4.1.99999.1 || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r device.req -A -X > /dev/null && exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r device.req -C -E > /dev/null && exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r device.req -C -X -E > /dev/null || exit 1
+rm device.req
+
+# Create a machine client cert with no email address
+../go/bin/create-key > machine.key || exit 1
+../go/bin/create-cert-request -N machine1.trustnetworks.com -C US -O "Trust Networks" -k machine.key > machine.req || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r machine.req -p device > machine.cert || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r machine.req -C > /dev/null || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r testuser.req -p device > /dev/null && exit 1
+rm machine.req
+rm testuser.req
+
+# Renew the workload and machine certs from the old certs, keeping
+# their identity
+../go/bin/create-key > workload2.key || exit 1
+../go/bin/create-cert-request -c workload.cert -k workload2.key > workload2.req || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r workload2.req -p spiffe > workload2.cert || exit 1
+for f in workload machine; do
+    openssl x509 -in ${f}.cert -noout -subject -ext subjectAltName,keyUsage,extendedKeyUsage > ${f}.old
+done
+openssl x509 -in workload2.cert -noout -subject -ext subjectAltName,keyUsage,extendedKeyUsage | cmp -s - workload.old || exit 1
+../go/bin/create-cert-request -c machine.cert -k machine.key -H machine2.trustnetworks.com > machine2.req || exit 1
+../go/bin/create-cert -k ca1.key -c ca1.pem -r machine2.req -p device > machine2.cert || exit 1
+openssl x509 -in machine2.cert -noout -subject -ext subjectAltName | grep -q machine2.trustnetworks.com || exit 1
+openssl x509 -in machine2.cert -noout -subject | grep -q "CN = machine1.trustnetworks.com" || exit 1
+rm workload.old machine.old workload2.req machine2.req
+
 # Verify all of the certs
 openssl verify -CAfile root.pem root.pem || exit 1
 openssl verify -CAfile root.pem ca1.pem  || exit 1
 cat root.pem ca1.pem > chain.pem
 openssl verify -CAfile chain.pem testuser.cert  || exit 1
 openssl verify -CAfile chain.pem baduser.cert || exit 1
+openssl verify -CAfile chain.pem workload.cert || exit 1
+openssl verify -CAfile chain.pem device.cert || exit 1
+openssl verify -CAfile chain.pem machine.cert || exit 1
 
 # Create and Verify the CRL
 ../go/bin/create-crl -k root.key -c root.pem -r /dev/null > root.crl || exit 1
@@ -65,6 +144,12 @@ cat chain.pem root.crl ca1.crl > crlchain.pem || exit 1
 openssl verify -crl_check -CAfile crlchain.pem testuser.cert || exit 1
 openssl verify -crl_check -CAfile crlchain.pem baduser.cert  && exit 1
 
+# The audit log chains, and editing a record breaks it
+../go/bin/verify-audit -f audit.log -n 10 || exit 1
+sed -e '1s/Trust Networks CA root/Evil CA root/' audit.log > tampered.log
+../go/bin/verify-audit -f tampered.log && exit 1
+rm tampered.log
+
 # Test create-rand
 N=$(../go/bin/create-rand -b 16 -c 64 | wc -c | sed -e"s/ //g")
 if [ "$N" != "1024" ]; then
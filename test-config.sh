@@ -0,0 +1,83 @@
+#!/bin/sh
+# Regression test for config files.  Shared and per-command settings
+# are used by create-ca-cert, create-cert-request and create-cert, and
+# options on the command line override them.
+
+BIN=../go/bin
+
+rm -rf test-config
+mkdir test-config
+cd test-config
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+cat > ca.yaml <<CONF
+# Settings for every command
+country: GB
+organisation: "Example Ltd"
+crl-distribution:
+  - http://ca.example.org/ca.crl
+  - http://ca2.example.org/ca.crl
+validity: 30
+
+create-ca-cert:
+  email: ca@example.org
+  validity: 365
+
+create-cert:
+  key: ca.key
+  ca-certificate: ca.pem
+  profile: [server]
+CONF
+
+${BIN}/create-key > ca.key || exit 1
+${BIN}/create-ca-cert --config ca.yaml -k ca.key -N "Example CA" > ca.pem || exit 1
+
+openssl x509 -in ca.pem -noout -subject | grep -q 'C = GB, O = Example Ltd, CN = Example CA' ||
+    fail "CA subject doesn't come from the config"
+openssl x509 -in ca.pem -noout -checkend $((300 * 86400)) > /dev/null ||
+    fail "CA validity doesn't come from the command's section"
+
+${BIN}/create-key > server.key || exit 1
+CERT_TOOLS_CONFIG=ca.yaml ${BIN}/create-cert-request -k server.key -N www -H www.example.org > server.req || exit 1
+openssl req -in server.req -noout -subject | grep -q 'O = Example Ltd' ||
+    fail "CERT_TOOLS_CONFIG isn't read"
+
+${BIN}/create-cert --config ca.yaml -r server.req > server.pem || exit 1
+openssl verify -CAfile ca.pem server.pem || exit 1
+openssl x509 -in server.pem -noout -ext extendedKeyUsage | grep -q 'Server Authentication' ||
+    fail "profile doesn't come from the config"
+openssl x509 -in server.pem -noout -ext crlDistributionPoints | grep -q ca2.example.org ||
+    fail "repeated settings aren't all used"
+openssl x509 -in server.pem -noout -checkend $((31 * 86400)) > /dev/null &&
+    fail "shared validity isn't used"
+
+# The command line wins, and replaces lists
+${BIN}/create-cert --config ca.yaml -r server.req -v 10 -d http://other.example.org/ca.crl > other.pem || exit 1
+openssl x509 -in other.pem -noout -checkend $((11 * 86400)) > /dev/null &&
+    fail "command line validity isn't used"
+openssl x509 -in other.pem -noout -ext crlDistributionPoints | grep -q ca.example.org &&
+    fail "command line CRL URIs don't replace the config"
+
+# Printed settings can be read back
+${BIN}/create-cert --config ca.yaml -r server.req -v 10 --print-config > printed.yaml || exit 1
+grep -q '^  validity: 10$' printed.yaml || fail "printed settings are wrong"
+grep -q '^    - http://ca2.example.org/ca.crl$' printed.yaml ||
+    fail "printed settings are wrong"
+${BIN}/create-cert --config printed.yaml > printed.pem || exit 1
+openssl verify -CAfile ca.pem printed.pem || exit 1
+
+# Unknown settings in a command's section are errors
+printf 'create-cert:\n  bogus: 1\n' > bad.yaml
+${BIN}/create-cert --config bad.yaml -k ca.key -c ca.pem -r server.req -S > /dev/null 2>&1 &&
+    fail "accepted an unknown setting"
+
+# Settings must be values or lists of them
+printf 'validity:\n  days: 10\n' > nested.yaml
+${BIN}/create-cert --config nested.yaml -k ca.key -c ca.pem -r server.req -S > /dev/null 2>&1 &&
+    fail "accepted a nested setting"
+
+exit 0
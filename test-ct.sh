@@ -0,0 +1,74 @@
+#!/bin/sh
+# Regression test for Certificate Transparency.  Issues precertificates,
+# logs them to the local test log and checks the SCTs embedded in the
+# certificates.
+
+BIN=../go/bin
+URL=http://127.0.0.1:16962
+URL2=http://127.0.0.1:16963
+
+rm -rf test-ct
+mkdir test-ct
+cd test-ct
+
+PIDS=
+stop() {
+    [ -n "${PIDS}" ] && kill ${PIDS} 2> /dev/null
+    PIDS=
+}
+trap stop EXIT
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+${BIN}/create-key > ca.key || exit 1
+${BIN}/create-ca-cert -k ca.key -E ca@example.org -N "CT CA" > ca.pem || exit 1
+${BIN}/create-key > other-ca.key || exit 1
+${BIN}/create-ca-cert -k other-ca.key -E ca@example.org -N "Other CA" > other-ca.pem || exit 1
+
+# Two logs, one with an RSA key
+${BIN}/create-key > log.key || exit 1
+${BIN}/create-key -a rsa-2048 > log2.key || exit 1
+${BIN}/ct-log -k log.key -r ca.pem -P log.pub -l 127.0.0.1:16962 2> log.out &
+PIDS="$!"
+${BIN}/ct-log -k log2.key -r ca.pem -P log2.pub -l 127.0.0.1:16963 2> log2.out &
+PIDS="${PIDS} $!"
+sleep 1
+
+${BIN}/create-key > server.key || exit 1
+${BIN}/create-cert-request -k server.key -N www -H www.example.org > server.req || exit 1
+
+# A precertificate can't be used as a certificate
+${BIN}/create-cert -k ca.key -c ca.pem -r server.req -S --precertificate > server.pre || exit 1
+openssl x509 -in server.pre -noout -text | grep -q "CT Precertificate Poison: critical" ||
+    fail "precertificate has no poison extension"
+
+# Logged, the SCT is checked with the log key and embedded
+${BIN}/create-cert -k ca.key -c ca.pem -r server.req -S --ct-log ${URL},log.pub > server.pem || exit 1
+openssl verify -CAfile ca.pem server.pem || exit 1
+openssl x509 -in server.pem -noout -text | grep -q "CT Precertificate SCTs" ||
+    fail "certificate has no SCTs"
+openssl x509 -in server.pem -noout -text | grep -q "Poison" &&
+    fail "certificate has the poison extension"
+
+# Two logs, two SCTs
+${BIN}/create-cert -k ca.key -c ca.pem -r server.req -S --ct-log ${URL},log.pub --ct-log ${URL2},log2.pub > two.pem || exit 1
+[ $(openssl x509 -in two.pem -noout -text | grep -c "Signed Certificate Timestamp:") = 2 ] ||
+    fail "expected two SCTs"
+
+# SCTs from a log with a different key are refused
+${BIN}/create-cert -k ca.key -c ca.pem -r server.req -S --ct-log ${URL2},log.pub > /dev/null 2>&1 &&
+    fail "SCT checked against the wrong log key"
+
+# The log only takes chains to its roots
+${BIN}/create-cert -k other-ca.key -c other-ca.pem -r server.req -S --ct-log ${URL} > /dev/null 2>&1 &&
+    fail "log accepted a chain to an unknown root"
+
+curl -s ${URL}/ct/v1/get-sth | grep -q '"tree_size":2' ||
+    fail "expected 2 entries in the first log"
+curl -s ${URL2}/ct/v1/get-sth | grep -q '"tree_size":2' ||
+    fail "expected 2 entries in the second log"
+
+exit 0
@@ -0,0 +1,93 @@
+#!/bin/sh
+# Regression test for the EST server.  Enrolls with basic authentication
+# and re-enrolls with the issued certificate, SANs in any order, checks
+# bad passwords and changed identities are refused, and the audit log.
+
+BIN=../go/bin
+PORT=18443
+URL=https://127.0.0.1:${PORT}/.well-known/est
+
+rm -rf test-est
+mkdir test-est
+cd test-est
+
+PID=
+stop() {
+    [ -n "${PID}" ] && kill ${PID} 2> /dev/null
+    PID=
+}
+trap stop EXIT
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+# POSTs a request as base64 PKCS #10 and writes the certificate as PEM.
+post() {
+    operation=$1
+    req=$2
+    shift 2
+    openssl req -in ${req} -outform DER | openssl base64 > ${req}.b64
+    curl -sf --cacert ca.pem -H 'Content-Type: application/pkcs10' \
+        --data-binary @${req}.b64 "$@" ${URL}/${operation} > ${req}.p7 &&
+        openssl base64 -d -in ${req}.p7 | openssl pkcs7 -inform DER -print_certs |
+        sed -n '/BEGIN/,/END/p'
+}
+
+${BIN}/create-key > ca.key || exit 1
+${BIN}/create-ca-cert -k ca.key -E ca@example.org -N "EST CA" > ca.pem || exit 1
+${BIN}/create-key > tls.key || exit 1
+${BIN}/create-cert-request -k tls.key -N 127.0.0.1 -H 127.0.0.1 > tls.req || exit 1
+${BIN}/create-cert -k ca.key -c ca.pem -r tls.req -S > tls.pem || exit 1
+
+echo secret | ${BIN}/hash-password -u device > users || exit 1
+
+${BIN}/est-server -l 127.0.0.1:${PORT} -k ca.key -c ca.pem \
+    --tls-certificate tls.pem --tls-key tls.key -u users --audit-log audit.log 2> server.log &
+PID=$!
+sleep 1
+
+# CA certificates
+curl -sf --cacert ca.pem ${URL}/cacerts | openssl base64 -d |
+    openssl pkcs7 -inform DER -print_certs | sed -n '/BEGIN/,/END/p' > cacerts.pem
+cmp -s cacerts.pem ca.pem || fail "cacerts doesn't return the CA"
+
+# Enrollment with basic authentication
+${BIN}/create-key > device.key || exit 1
+${BIN}/create-cert-request -k device.key -N device1 -H device1.example.org -H device1.example.net -H 192.0.2.1 > device.req || exit 1
+post simpleenroll device.req -u device:secret > device.pem || exit 1
+openssl verify -CAfile ca.pem device.pem || exit 1
+
+post simpleenroll device.req -u device:wrong > /dev/null &&
+    fail "wrong password was accepted"
+post simpleenroll device.req -u nobody:secret > /dev/null &&
+    fail "unknown user was accepted"
+
+# Re-enrollment with the certificate, SANs in a different order
+${BIN}/create-key > renew.key || exit 1
+${BIN}/create-cert-request -k renew.key -N device1 -H 192.0.2.1 -H device1.example.net -H device1.example.org > renew.req || exit 1
+post simplereenroll renew.req --cert device.pem --key device.key > renew.pem || exit 1
+openssl verify -CAfile ca.pem renew.pem || exit 1
+
+# Re-enrollment needs the certificate and can't change the identity
+post simplereenroll renew.req -u device:secret > /dev/null &&
+    fail "re-enrollment without a certificate was accepted"
+
+${BIN}/create-cert-request -k renew.key -N device1 -H device1.example.org -H 192.0.2.1 > fewer.req || exit 1
+post simplereenroll fewer.req --cert device.pem --key device.key > /dev/null &&
+    fail "re-enrollment dropping a SAN was accepted"
+
+${BIN}/create-cert-request -k renew.key -N device2 -H 192.0.2.1 -H device1.example.net -H device1.example.org > other.req || exit 1
+post simplereenroll other.req --cert device.pem --key device.key > /dev/null &&
+    fail "re-enrollment changing the subject was accepted"
+
+stop
+
+# Enrollments and re-enrollments are audited
+[ $(grep -c '"operation":"est-server enroll","operator":[^}]*"result":"success"' audit.log) = 1 ] &&
+    [ $(grep -c '"operation":"est-server re-enroll","operator":[^}]*"result":"success"' audit.log) = 1 ] ||
+    fail "enrollments not audited: $(cat audit.log)"
+${BIN}/verify-audit -f audit.log > /dev/null || exit 1
+
+exit 0
@@ -0,0 +1,129 @@
+#!/bin/sh
+# Regression test for check-expiry.  A hierarchy made by create-pki has
+# a certificate near expiry, one outliving its CA and a CRL due soon,
+# and the alerts, exit status and metrics are checked.
+
+BIN=../go/bin
+URL=http://127.0.0.1:19115
+
+rm -rf test-expiry
+mkdir test-expiry
+cd test-expiry
+
+PIDS=
+stop() {
+    [ -n "${PIDS}" ] && kill ${PIDS} 2> /dev/null
+    PIDS=
+}
+trap stop EXIT
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+cat > pki.yaml <<MANIFEST
+directory: out
+
+certificates:
+  - name: root
+    common-name: Expiry Root
+    validity: 3650
+
+  - name: ca1
+    issuer: root
+    common-name: Expiry CA1
+    profiles: [ca]
+    validity: 200
+    crl-validity: 60
+
+  - name: www
+    issuer: ca1
+    common-name: www
+    hosts: [www.example.org]
+    profiles: [server]
+    validity: 100
+
+  - name: soon
+    issuer: ca1
+    common-name: soon
+    hosts: [soon.example.org]
+    profiles: [server]
+    validity: 20
+
+  - name: long
+    issuer: ca1
+    common-name: long
+    hosts: [long.example.org]
+    profiles: [server]
+    validity: 300
+MANIFEST
+
+${BIN}/create-pki -m pki.yaml > pki.out 2>&1 || fail "$(cat pki.out)"
+
+# Nothing near expiry
+${BIN}/check-expiry out/root.pem out/www.pem out/ca1.crl > ok.out || fail "$(cat ok.out)"
+[ -s ok.out ] && fail "alerts when nothing expires: $(cat ok.out)"
+${BIN}/check-expiry -v out/root.pem out/www.pem > verbose.out || fail "verbose failed"
+[ $(grep -c '^OK ' verbose.out) = 2 ] || fail "verbose output is wrong: $(cat verbose.out)"
+
+# Warnings for expiry and outliving the issuer, scanning the directory
+${BIN}/check-expiry out > warn.out
+[ $? = 1 ] || fail "expected warning status: $(cat warn.out)"
+grep -q '^WARNING  out/soon.pem: certificate CN=soon, serial [0-9A-F]*, expires in 19 days' warn.out ||
+    fail "no warning for soon.pem: $(cat warn.out)"
+grep -q '^WARNING  out/long.pem: .*outlives its issuer CN=Expiry CA1' warn.out ||
+    fail "no warning for long.pem: $(cat warn.out)"
+[ $(wc -l < warn.out) = 2 ] || fail "unexpected alerts: $(cat warn.out)"
+
+# Thresholds make warnings critical, and the CRL due
+${BIN}/check-expiry -c 21 -w 90 out > crit.out
+[ $? = 2 ] || fail "expected critical status: $(cat crit.out)"
+grep -q '^CRITICAL out/soon.pem:' crit.out || fail "soon.pem not critical: $(cat crit.out)"
+grep -q '^WARNING  out/ca1.crl: CRL from CN=Expiry CA1, next update due in 59 days' crit.out ||
+    fail "no warning for the CRL: $(cat crit.out)"
+
+# Errors are unknown, not warnings
+${BIN}/check-expiry missing.pem > /dev/null 2>&1
+[ $? = 3 ] || fail "expected unknown status for a missing file"
+${BIN}/check-expiry -r missing out > /dev/null 2>&1
+[ $? = 3 ] || fail "expected unknown status for a missing revoked file"
+${BIN}/check-expiry --bogus out > /dev/null 2>&1
+[ $? = 3 ] || fail "expected unknown status for a bad flag"
+
+# Revoked certificates aren't checked
+SERIAL=$(openssl x509 -in out/soon.pem -noout -serial | sed 's/serial=//')
+echo "${SERIAL},2024-01-01T00:00:00Z" > revoked
+${BIN}/check-expiry -r revoked out/soon.pem > revoked.out || fail "revoked certificate checked: $(cat revoked.out)"
+
+# Bundles are checked once per certificate, other files are skipped
+cat out/soon.pem out/soon.pem out/root.pem > bundle.pem
+${BIN}/check-expiry bundle.pem > bundle.out
+[ $(wc -l < bundle.out) = 1 ] || fail "bundle checked wrongly: $(cat bundle.out)"
+echo junk > junk.pem
+${BIN}/check-expiry junk.pem out/root.pem > junk.out 2> junk.log || fail "junk stopped the check"
+grep -q 'skipped junk.pem' junk.log || fail "junk not reported: $(cat junk.log)"
+${BIN}/check-expiry > /dev/null 2>&1 && fail "ran with nothing to check"
+
+# Metrics
+${BIN}/check-expiry -l 127.0.0.1:19115 out 2> daemon.log &
+PIDS="$!"
+sleep 1
+
+curl -s ${URL}/metrics > metrics.out || fail "no metrics"
+NOT_AFTER=$(openssl x509 -in out/www.pem -noout -enddate | sed 's/notAfter=//')
+NOT_AFTER=$(date -d "${NOT_AFTER}" +%s)
+WWW_SERIAL=$(openssl x509 -in out/www.pem -noout -serial | sed 's/serial=0*//')
+grep -q "^cert_not_after_seconds{subject=\"CN=www\",serial=\"${WWW_SERIAL}\",issuer=\"CN=Expiry CA1\",path=\"out/www.pem\"} ${NOT_AFTER}$" metrics.out ||
+    fail "no metric for www.pem: $(cat metrics.out)"
+grep -q '^crl_next_update_seconds{issuer="CN=Expiry CA1",path="out/ca1.crl"} ' metrics.out ||
+    fail "no metric for the CRL: $(cat metrics.out)"
+grep -q '^check_expiry_alerts{level="warning"} 2$' metrics.out ||
+    fail "alerts counted wrongly: $(cat metrics.out)"
+
+# Each scrape rescans
+rm out/soon.pem out/soon-chain.pem
+curl -s ${URL}/metrics | grep -q '^check_expiry_alerts{level="warning"} 1$' ||
+    fail "metrics not rescanned"
+
+exit 0
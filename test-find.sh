@@ -0,0 +1,285 @@
+#!/bin/sh
+# Regression test for find-cert.  Certificates from a small hierarchy,
+# most without email addresses, are found by SANs, usages, profiles,
+# dates, serials and key identifiers, and in a tree of bundles, DER,
+# PKCS #7 and p12 files, symlinks and files that aren't certificates.
+
+BIN=../go/bin
+
+rm -rf test-find
+mkdir test-find
+cd test-find
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+cat > pki.yaml <<MANIFEST
+directory: out
+
+certificates:
+  - name: root
+    common-name: Find Root
+    validity: 3650
+
+  - name: ca1
+    issuer: root
+    common-name: Find CA1
+    organisation: [Example Ltd]
+    profiles: [ca]
+    validity: 365
+
+  - name: www
+    issuer: ca1
+    common-name: www
+    hosts: [www.example.org, 10.1.2.3]
+    profiles: [server]
+    validity: 30
+
+  - name: alice
+    issuer: ca1
+    common-name: Alice
+    email: [alice@example.org]
+    profiles: [client]
+    validity: 200
+    p12: true
+    p12-password: secret
+
+  - name: dev1
+    issuer: ca1
+    common-name: dev1
+    uris: [urn:example:device:1]
+    profiles: [device]
+    validity: 60
+MANIFEST
+
+${BIN}/create-pki -m pki.yaml > pki.out 2>&1 || fail "$(cat pki.out)"
+mkdir certs
+for n in root ca1 www alice dev1; do
+    cp out/${n}.pem certs/${n}.pem
+done
+
+serial() {
+    openssl x509 -in out/$1.pem -noout -serial | sed 's/serial=0*//'
+}
+
+# find QUERY NAME... checks the query finds exactly those certificates
+find() {
+    q="$1"
+    shift
+    ${BIN}/find-cert -d certs -p '' -q "${q}" > found 2> found.log ||
+        fail "query ${q} failed: $(cat found.log)"
+    for n in "$@"; do
+        grep -q "^0*$(serial ${n})," found || fail "query ${q} didn't find ${n}: $(cat found)"
+    done
+    [ $(wc -l < found) = $# ] || fail "query ${q} found too much: $(cat found)"
+}
+
+# Certificates without email are found
+${BIN}/find-cert -d certs -p '' > all || fail "find-cert failed"
+[ $(wc -l < all) = 5 ] || fail "expected 5 certificates: $(cat all)"
+
+find 'dns=www.example.org' www
+find 'dns~EXAMPLE.org' www
+find 'ip=10.1.2.3' www
+find 'ip=10.0.0.0/8' www
+find 'uri~device' dev1
+find 'email=alice@example.org' alice
+find 'cn=alice' alice
+find 'subject~"Example Ltd"' ca1
+find 'issuer~"Find CA1"' www alice dev1
+find 'usage=client-auth' alice dev1
+find 'usage=cert-sign and not subject~Root' ca1
+find 'profile=server or profile=client' www alice
+find 'profile=device and not usage=key-encipherment' dev1
+find 'ca' root ca1
+find 'not ca and (expires-before=+45 or uri~device)' www dev1
+find 'expires-after=+100 and issued-after=2000-01-01 and not ca' alice
+find 'expired'
+find 'valid and issued-before=1999-12-31'
+
+# Serials, fingerprints and key identifiers, in any hex form
+S=$(serial www | sed 's/\(..\)/\1:/g; s/:$//' | tr A-F a-f)
+find "serial=00:${S}" www
+FP=$(openssl x509 -in out/alice.pem -noout -pubkey | openssl pkey -pubin -outform der | sha256sum | cut -d' ' -f1)
+find "fingerprint=${FP}" alice
+SKI=$(openssl x509 -in out/ca1.pem -noout -ext subjectKeyIdentifier | tail -1 | tr -d ' ')
+find "ski=${SKI}" ca1
+find "aki=${SKI}" www alice dev1
+
+# Several queries, -e and -s must all match
+${BIN}/find-cert -d certs -p '' -q 'not ca' -q 'dns~www' > found || fail "find-cert failed"
+[ $(wc -l < found) = 1 ] || fail "-q not combined: $(cat found)"
+${BIN}/find-cert -d certs -p '' -e alice@example.org -q 'not ca' > found || fail "find-cert failed"
+grep -q "^0*$(serial alice)," found && [ $(wc -l < found) = 1 ] || fail "-e not combined: $(cat found)"
+${BIN}/find-cert -d certs -p '' -s 'Example Ltd' > found || fail "find-cert failed"
+grep -q "^0*$(serial ca1)," found && [ $(wc -l < found) = 1 ] || fail "-s failed: $(cat found)"
+
+# Bad queries are refused
+for q in 'bogus=1' 'usage=flying' 'profile=nothing' '(dns=x' 'dns=x and' 'dns=x or or' \
+    'expires-before=soon' 'serial=xyz' 'dns="x'; do
+    ${BIN}/find-cert -d certs -p '' -q "${q}" > /dev/null 2>&1 &&
+        fail "query ${q} accepted"
+done
+
+# A tree of other file types, each certificate is found once
+mkdir -p tree/sub/deeper other
+cp out/www-chain.pem tree/www-chain.pem
+cp out/www.key tree/www.key
+cp out/www.pem tree/sub/deeper/www.crt
+openssl x509 -in out/ca1.pem -outform der -out tree/ca1.der || exit 1
+openssl crl2pkcs7 -nocrl -certfile out/dev1.pem -out tree/dev1.p7b || exit 1
+openssl crl2pkcs7 -nocrl -certfile out/dev1.pem -outform der -out tree/sub/dev1.p7c || exit 1
+cp out/alice.p12 tree/sub/alice.p12
+cp out/root.pem other/root.pem
+ln -s ../../other tree/sub/other
+ln -s .. tree/sub/deeper/loop
+ln -s ../www-chain.pem tree/sub/www-link.pem
+ln -s missing.pem tree/broken.pem
+echo junk > tree/junk.pem
+
+${BIN}/find-cert -d tree --p12-password secret > found 2> found.log || fail "find-cert failed: $(cat found.log)"
+for n in root ca1 www alice dev1; do
+    grep -q "^0*$(serial ${n})," found || fail "${n} not found in tree: $(cat found)"
+done
+[ $(wc -l < found) = 5 ] || fail "certificates found more than once: $(cat found)"
+grep -q 'skipped tree/junk.pem' found.log || fail "junk not reported: $(cat found.log)"
+grep -q 'skipped tree/broken.pem' found.log || fail "broken link not reported: $(cat found.log)"
+grep -q 'www.key' found.log && fail "key file reported: $(cat found.log)"
+
+${BIN}/find-cert -d tree > found 2> found.log || fail "find-cert failed: $(cat found.log)"
+grep -q 'skipped tree/sub/alice.p12' found.log || fail "p12 without password not reported: $(cat found.log)"
+[ $(wc -l < found) = 4 ] || fail "certificates from the p12 found without its password: $(cat found)"
+
+# The certificate's own file is reported over a bundle
+${BIN}/find-cert -v -d tree -q 'cn=www' 2>&1 > /dev/null | grep -q ' tree/sub/deeper/www.crt|' ||
+    fail "bundle reported over the certificate's own file"
+
+# Names, prefixes, globs and files
+${BIN}/find-cert -d tree -n '*.crt' -n '*.der' > found 2> /dev/null || fail "find-cert failed"
+[ $(wc -l < found) = 2 ] || fail "-n didn't filter names: $(cat found)"
+${BIN}/find-cert -d tree -p dev1 > found 2> /dev/null || fail "find-cert failed"
+grep -q "^0*$(serial dev1)," found && [ $(wc -l < found) = 1 ] || fail "-p didn't filter names: $(cat found)"
+${BIN}/find-cert 'tree/*.p7b' tree/ca1.der > found 2> /dev/null || fail "find-cert failed"
+[ $(wc -l < found) = 2 ] || fail "globs and files not searched: $(cat found)"
+${BIN}/find-cert 'tree/*.none' > /dev/null 2>&1 && fail "glob matching nothing accepted"
+${BIN}/find-cert > /dev/null 2>&1 && fail "ran with nothing to search"
+
+# Output formats, serials in full
+WWW=$(serial www | sed 's/^0*//')
+NB=$(date -u -d "$(openssl x509 -in out/www.pem -noout -startdate | sed 's/notBefore=//')" +%Y-%m-%dT%H:%M:%SZ)
+NA=$(date -u -d "$(openssl x509 -in out/www.pem -noout -enddate | sed 's/notAfter=//')" +%Y-%m-%dT%H:%M:%SZ)
+${BIN}/find-cert -d certs -o csv -q 'cn=www or cn~ca1' > found.csv || fail "CSV output failed"
+[ "$(head -1 found.csv)" = "path,serial,subject,issuer,sans,not_before,not_after" ] ||
+    fail "CSV header is wrong: $(cat found.csv)"
+grep -qx "certs/www.pem,${WWW},CN=www,\"CN=Find CA1,O=Example Ltd\",DNS:www.example.org;IP:10.1.2.3,${NB},${NA}" found.csv ||
+    fail "CSV is wrong: $(cat found.csv)"
+[ $(wc -l < found.csv) = 3 ] || fail "CSV has the wrong rows: $(cat found.csv)"
+${BIN}/find-cert -v -d certs -o csv -q 'cn=www or cn~ca1' 2> /dev/null | cmp -s - found.csv ||
+    fail "verbose output spoils the CSV"
+
+${BIN}/find-cert -d certs -o json -q 'cn=www' > found.json || fail "JSON output failed"
+grep -q "\"serial\": \"${WWW}\"" found.json && grep -q '"path": "certs/www.pem"' found.json &&
+    grep -q '"DNS:www.example.org",' found.json && grep -q "\"not_after\": \"${NA}\"" found.json ||
+    fail "JSON is wrong: $(cat found.json)"
+${BIN}/find-cert -d certs -o json -q expired > found.json || fail "JSON output failed"
+[ "$(cat found.json)" = "[]" ] || fail "JSON with nothing found is wrong: $(cat found.json)"
+
+${BIN}/find-cert -d certs -o table > found.table || fail "table output failed"
+head -1 found.table | grep -q '^PATH  *SERIAL  *SUBJECT  *ISSUER  *SANS  *NOT_BEFORE  *NOT_AFTER$' ||
+    fail "table header is wrong: $(cat found.table)"
+[ $(wc -l < found.table) = 6 ] || fail "table has the wrong rows: $(cat found.table)"
+${BIN}/find-cert -d certs -o xml > /dev/null 2>&1 && fail "unknown output format accepted"
+
+# Superseded certificates, grouped by SANs, common name or key, are
+# revoked
+mkdir reissue
+${BIN}/create-key > reissue/ca.key || exit 1
+${BIN}/create-ca-cert -k reissue/ca.key -E ca@example.org -N "Reissue CA" > reissue/ca.pem || exit 1
+${BIN}/create-key > a.key || exit 1
+${BIN}/create-key > b.key || exit 1
+${BIN}/create-key > c.key || exit 1
+${BIN}/create-cert-request -k a.key -N www -H www.example.org -H api.example.org > req || exit 1
+${BIN}/create-cert -k reissue/ca.key -c reissue/ca.pem -r req -S > reissue/w1.pem || exit 1
+sleep 1
+${BIN}/create-cert-request -k b.key -N www2 -H api.example.org -H www.example.org > req || exit 1
+${BIN}/create-cert -k reissue/ca.key -c reissue/ca.pem -r req -S > reissue/w2.pem || exit 1
+${BIN}/create-cert-request -k c.key -N dev1 > req || exit 1
+${BIN}/create-cert -k reissue/ca.key -c reissue/ca.pem -r req -p device > reissue/d1.pem || exit 1
+sleep 1
+${BIN}/create-cert -k reissue/ca.key -c reissue/ca.pem -r req -p device > reissue/d2.pem || exit 1
+
+rserial() {
+    openssl x509 -in reissue/$1.pem -noout -serial | sed 's/serial=0*//'
+}
+
+# group -l|-L KEYS NAME... checks the certificates found
+group() {
+    ${BIN}/find-cert -d reissue -q 'not ca' $1 -g "$2" > found 2> found.log ||
+        fail "grouping by $2 failed: $(cat found.log)"
+    what="$1 $2"
+    shift 2
+    for n in "$@"; do
+        grep -q "^0*$(rserial ${n})," found || fail "${what} didn't find ${n}: $(cat found)"
+    done
+    [ $(wc -l < found) = $# ] || fail "${what} found too much: $(cat found)"
+}
+
+group -l sans w1 d1
+group -L sans w2 d2
+group -l cn d1
+group -L cn w1 w2 d2
+group -l key d1
+group -l subject d1
+group -l email d1
+group -l dns w1 d1
+group -l issuer w1 w2 d1
+group -l issuer,cn d1
+group -l 'sans, key' d1
+${BIN}/find-cert -d reissue -l -g bogus > /dev/null 2>&1 && fail "unknown group key accepted"
+
+# Only certificates the CA signed are revoked, not those of another CA
+# with the same name, or the CA itself, and superseded certificates are
+# revoked when they were superseded
+mkdir foreign
+${BIN}/create-key > foreign/ca.key || exit 1
+${BIN}/create-ca-cert -k foreign/ca.key -E ca@example.org -N "Reissue CA" > foreign/ca.pem || exit 1
+cmp -s reissue/ca.pem foreign/ca.pem && fail "CAs are the same"
+sleep 1
+${BIN}/create-cert-request -k a.key -N www -H www.example.org -H api.example.org > req || exit 1
+${BIN}/create-cert -k foreign/ca.key -c foreign/ca.pem -r req -S > reissue/foreign.pem || exit 1
+
+${BIN}/find-cert -d reissue -c reissue/ca.pem -l -g sans > revoke || exit 1
+W2=$(date -u -d "$(openssl x509 -in reissue/w2.pem -noout -startdate | sed 's/notBefore=//')" +%Y-%m-%dT%H:%M:%SZ)
+D2=$(date -u -d "$(openssl x509 -in reissue/d2.pem -noout -startdate | sed 's/notBefore=//')" +%Y-%m-%dT%H:%M:%SZ)
+grep -qx "0*$(rserial w1),${W2},superseded" revoke || fail "w1 not superseded by w2: $(cat revoke)"
+grep -qx "0*$(rserial d1),${D2},superseded" revoke || fail "d1 not superseded by d2: $(cat revoke)"
+[ $(wc -l < revoke) = 2 ] || fail "certificates of other CAs revoked: $(cat revoke)"
+${BIN}/find-cert -d reissue -c foreign/ca.pem > found || exit 1
+grep -q "^0*$(openssl x509 -in reissue/foreign.pem -noout -serial | sed 's/serial=0*//')," found &&
+    [ $(wc -l < found) = 1 ] || fail "-c didn't check signatures: $(cat found)"
+
+${BIN}/create-crl -k reissue/ca.key -c reissue/ca.pem -r revoke > reissue.crl || exit 1
+openssl crl -in reissue.crl -noout -text > reissue.txt
+grep -q "Serial Number: 0*$(rserial w1)" reissue.txt || fail "superseded certificate not in the CRL"
+grep -q "Superseded" reissue.txt || fail "no revocation reason in the CRL: $(cat reissue.txt)"
+grep -q "Revocation Date: $(openssl x509 -in reissue/w2.pem -noout -startdate | sed 's/notBefore=//')" reissue.txt ||
+    fail "wrong revocation time in the CRL: $(cat reissue.txt)"
+
+# Reasons and times can be given
+${BIN}/find-cert -d reissue -c reissue/ca.pem -q 'cn=dev1' -R key-compromise -t 2026-01-02T03:04:05Z > revoke || exit 1
+grep -qx "0*$(rserial d1),2026-01-02T03:04:05Z,key-compromise" revoke && [ $(wc -l < revoke) = 2 ] ||
+    fail "reason and time not used: $(cat revoke)"
+${BIN}/create-crl -k reissue/ca.key -c reissue/ca.pem -r revoke | openssl crl -noout -text | grep -q "Key Compromise" ||
+    fail "key compromise not in the CRL"
+${BIN}/find-cert -d reissue -c reissue/ca.pem -q 'cn=dev1' -R unspecified > revoke || exit 1
+${BIN}/create-crl -k reissue/ca.key -c reissue/ca.pem -r revoke | openssl crl -noout -text | grep -q "Reason Code" &&
+    fail "unspecified reason in the CRL"
+${BIN}/find-cert -d reissue -R remove-from-crl > /dev/null 2>&1 && fail "remove-from-crl accepted"
+${BIN}/find-cert -d reissue -R stolen > /dev/null 2>&1 && fail "unknown reason accepted"
+${BIN}/find-cert -d reissue -t yesterday > /dev/null 2>&1 && fail "invalid time accepted"
+echo "$(rserial w1),2026-01-02T03:04:05Z,stolen" > bad.revoked
+${BIN}/create-crl -k reissue/ca.key -c reissue/ca.pem -r bad.revoked > /dev/null 2>&1 && fail "create-crl accepted an unknown reason"
+
+exit 0
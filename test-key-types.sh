@@ -0,0 +1,64 @@
+#!/bin/sh
+# Regression test for CA and leaf key type combinations.  Every CA key
+# type signs a request from every leaf key type, the certificate must
+# verify and carry the signature algorithm of the CA key, not the
+# requester's.
+
+BIN=../go/bin
+TYPES="ecdsa-p256 ecdsa-p384 rsa-2048 ed25519"
+
+rm -rf test-key-types
+mkdir test-key-types
+cd test-key-types
+
+sigalg() {
+    case $1 in
+        ecdsa-*) echo "ecdsa-with-SHA512" ;;
+        rsa-*) echo "sha256WithRSAEncryption" ;;
+        ed25519) echo "ED25519" ;;
+    esac
+}
+
+for ca in ${TYPES}
+do
+
+    ${BIN}/create-key -a ${ca} > ca-${ca}.key || exit 1
+    ${BIN}/create-ca-cert -k ca-${ca}.key -E ca@example.org -N "CA ${ca}" > ca-${ca}.pem || exit 1
+    openssl verify -CAfile ca-${ca}.pem ca-${ca}.pem > /dev/null || exit 1
+
+    # CRL signed by each CA type
+    ${BIN}/create-crl -k ca-${ca}.key -c ca-${ca}.pem -r /dev/null > ca-${ca}.crl || exit 1
+    openssl crl -verify -CAfile ca-${ca}.pem -in ca-${ca}.crl -noout 2> /dev/null || exit 1
+
+    for leaf in ${TYPES}
+    do
+
+        [ -f leaf-${leaf}.key ] || ${BIN}/create-key -a ${leaf} > leaf-${leaf}.key || exit 1
+        ${BIN}/create-cert-request -k leaf-${leaf}.key -N "leaf ${leaf}" -H leaf.example.org > leaf-${leaf}.req || exit 1
+
+        cert=leaf-${leaf}-by-${ca}.pem
+        ${BIN}/create-cert -k ca-${ca}.key -c ca-${ca}.pem -r leaf-${leaf}.req -S > ${cert} || exit 1
+        openssl verify -CAfile ca-${ca}.pem ${cert} > /dev/null || exit 1
+
+        alg=$(openssl x509 -in ${cert} -noout -text | grep -m 1 "Signature Algorithm" | sed -e 's/.*: //')
+        if [ "${alg}" != "$(sigalg ${ca})" ]; then
+            echo "${cert}: signature algorithm ${alg}, expected $(sigalg ${ca})"
+            exit 1
+        fi
+
+        echo "${leaf} signed by ${ca}: OK"
+
+    done
+
+done
+
+# Signature algorithm override must suit the CA key
+${BIN}/create-cert -k ca-rsa-2048.key -c ca-rsa-2048.pem -r leaf-ecdsa-p256.req -S -g SHA256-RSAPSS > pss.pem || exit 1
+openssl verify -CAfile ca-rsa-2048.pem pss.pem > /dev/null || exit 1
+openssl x509 -in pss.pem -noout -text | grep -q rsassaPss || exit 1
+${BIN}/create-cert -k ca-ecdsa-p256.key -c ca-ecdsa-p256.pem -r leaf-rsa-2048.req -S -g ECDSA-SHA256 > ecdsa256.pem || exit 1
+openssl x509 -in ecdsa256.pem -noout -text | grep -q ecdsa-with-SHA256 || exit 1
+${BIN}/create-cert -k ca-ecdsa-p256.key -c ca-ecdsa-p256.pem -r leaf-rsa-2048.req -S -g SHA256-RSA > /dev/null 2>&1 && exit 1
+
+echo "key types: OK"
+exit 0
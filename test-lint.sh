@@ -0,0 +1,119 @@
+#!/bin/sh
+# Regression test for lint-cert and create-cert --lint.  Certificates
+# and requests made by the tools pass, ones made by openssl with a
+# short serial, weak key, SHA-1 signature and long validity don't.
+
+BIN=../go/bin
+
+rm -rf test-lint
+mkdir test-lint
+cd test-lint
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+# Checks found in a lint-cert report.
+checks() {
+    sed -e 's/.*: \([a-z-]*\): .*/\1/' $1 | sort -u | tr '\n' ' '
+}
+
+# ----- Good certificates -----
+
+${BIN}/create-key > ca.key || exit 1
+${BIN}/create-ca-cert -k ca.key -E ca@example.org -N "Lint CA" > ca.pem || exit 1
+${BIN}/create-key -a rsa-2048 > rsa-ca.key || exit 1
+${BIN}/create-ca-cert -k rsa-ca.key -E ca@example.org -N "Lint RSA CA" > rsa-ca.pem || exit 1
+
+${BIN}/create-key > www.key || exit 1
+${BIN}/create-cert-request -k www.key -N www.example.org -H www.example.org > www.req || exit 1
+${BIN}/create-cert -k ca.key -c ca.pem -r www.req -S --lint warning > www.pem || exit 1
+${BIN}/create-cert -k rsa-ca.key -c rsa-ca.pem -r www.req -S --lint warning > rsa-www.pem || exit 1
+
+${BIN}/lint-cert -l warning ca.pem rsa-ca.pem www.pem rsa-www.pem www.req > good.out
+[ $? -eq 0 ] || fail "good certificates: $(cat good.out)"
+[ -s good.out ] && fail "good certificates: $(cat good.out)"
+echo "good certificates: OK"
+
+# ----- Bad certificate and request -----
+
+cat > bad.cnf <<CONFIG
+[req]
+distinguished_name = dn
+x509_extensions = ext
+prompt = no
+[dn]
+CN = bad.example.org
+[ext]
+basicConstraints = CA:FALSE
+keyUsage = digitalSignature
+extendedKeyUsage = serverAuth
+subjectAltName = DNS:other.example.org
+CONFIG
+
+openssl req -x509 -config bad.cnf -newkey rsa:1024 -nodes -keyout bad.key \
+    -sha1 -set_serial 1 -days 1000 -out bad.pem 2> /dev/null || exit 1
+openssl req -new -config bad.cnf -key bad.key -sha1 -out bad.req 2> /dev/null || exit 1
+
+${BIN}/lint-cert bad.pem > bad.out
+[ $? -eq 2 ] || fail "bad certificate: expected exit status 2"
+[ "$(checks bad.out)" = "cn-not-in-sans key-weak serial-entropy signature-deprecated validity-server " ] || \
+    fail "bad certificate: $(cat bad.out)"
+echo "bad certificate: OK"
+
+${BIN}/lint-cert bad.req > bad-req.out
+[ $? -eq 2 ] || fail "bad request: expected exit status 2"
+[ "$(checks bad-req.out)" = "key-weak signature-deprecated " ] || \
+    fail "bad request: $(cat bad-req.out)"
+echo "bad request: OK"
+
+# Level and skipped checks
+${BIN}/lint-cert -l error -x key-weak -x signature-deprecated bad.pem > errors.out
+[ "$(checks errors.out)" = "serial-entropy validity-server " ] || \
+    fail "errors only: $(cat errors.out)"
+${BIN}/lint-cert -l warning -x serial-entropy -x key-weak -x signature-deprecated -x validity-server bad.pem > warnings.out
+[ $? -eq 1 ] || fail "warnings only: expected exit status 1"
+echo "levels: OK"
+
+# DER and JSON
+openssl x509 -in bad.pem -outform DER -out bad.der || exit 1
+${BIN}/lint-cert -o json bad.der > bad.json
+grep -q '"check": "key-weak"' bad.json || fail "JSON: $(cat bad.json)"
+grep -q '"type": "certificate"' bad.json || fail "JSON: $(cat bad.json)"
+grep -q '"serial": "1"' bad.json || fail "JSON: $(cat bad.json)"
+echo "JSON: OK"
+
+# Directories are scanned for certificates and requests, files which
+# can't be read are a failure rather than a finding.
+mkdir dir
+cp bad.pem bad.req www.pem dir/ || exit 1
+${BIN}/lint-cert -l error dir > dir.out
+[ $? -eq 2 ] || fail "directory: expected exit status 2"
+[ $(grep -c ' dir/bad.pem: certificate ' dir.out) = 4 ] && [ $(grep -c ' dir/bad.req: request ' dir.out) = 2 ] ||
+    fail "directory: $(cat dir.out)"
+${BIN}/lint-cert missing.pem > /dev/null 2>&1
+[ $? -eq 3 ] || fail "missing file: expected exit status 3"
+echo "junk" > junk.pem
+${BIN}/lint-cert www.pem junk.pem > /dev/null 2>&1
+[ $? -eq 3 ] || fail "unparseable file: expected exit status 3"
+echo "failures: OK"
+
+# ----- Linting before signing -----
+
+# A common name which isn't a SAN is a warning, a server certificate
+# valid for too long an error.
+${BIN}/create-cert-request -k www.key -N "Web Server" -H www.example.org > cn.req || exit 1
+${BIN}/create-cert -k ca.key -c ca.pem -r cn.req -S --lint error > cn.pem 2> cn.log || \
+    fail "lint errors only: $(cat cn.log)"
+grep -q "lint warning: cn-not-in-sans" cn.log || fail "lint warning: $(cat cn.log)"
+${BIN}/create-cert -k ca.key -c ca.pem -r cn.req -S --lint warning > cn2.pem 2> cn2.log && \
+    fail "lint warning: signed"
+[ -s cn2.pem ] && fail "lint warning: certificate output"
+grep -q "certificate fails 1 lint checks" cn2.log || fail "lint warning: $(cat cn2.log)"
+${BIN}/create-cert -k rsa-ca.key -c rsa-ca.pem -r www.req -S -v 1000 --lint error > long.pem 2> long.log && \
+    fail "lint error: signed"
+grep -q "lint error: validity-server" long.log || fail "lint error: $(cat long.log)"
+echo "create-cert --lint: OK"
+
+exit 0
@@ -0,0 +1,73 @@
+#!/bin/sh
+# Regression test for CA keys on a PKCS #11 token, using SoftHSM.  Keys
+# are generated on the token and used to sign CA certificates,
+# certificates and CRLs.  Skipped if SoftHSM isn't installed.
+
+BIN=../go/bin
+
+LIB=
+for l in /usr/lib/softhsm/libsofthsm2.so \
+         /usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so \
+         /usr/lib64/pkcs11/libsofthsm2.so \
+         /usr/local/lib/softhsm/libsofthsm2.so; do
+    [ -f ${l} ] && LIB=${l} && break
+done
+
+if [ -z "${LIB}" ] || ! which softhsm2-util > /dev/null 2>&1; then
+    echo "SoftHSM not found, skipping PKCS #11 tests"
+    exit 0
+fi
+
+rm -rf test-pkcs11
+mkdir test-pkcs11
+cd test-pkcs11
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+mkdir tokens
+echo "directories.tokendir = $(pwd)/tokens" > softhsm2.conf
+export SOFTHSM2_CONF=$(pwd)/softhsm2.conf
+
+softhsm2-util --init-token --free --label test-ca --pin 1234 --so-pin 5678 || exit 1
+
+export CERT_TOOLS_PKCS11_MODULE=${LIB}
+export CERT_TOOLS_PKCS11_PIN=1234
+
+ROOT="pkcs11:token=test-ca;object=root"
+RSA="pkcs11:token=test-ca;object=rsa-ca"
+
+# EC root generated on the token, only the public key comes out
+${BIN}/create-key -t "${ROOT}" > root.pub || exit 1
+${BIN}/create-key -t "${ROOT}" > /dev/null 2>&1 &&
+    fail "key generated over an existing label"
+
+${BIN}/create-ca-cert -k "${ROOT}" -E ca@example.org -N "Token Root" > root.pem || exit 1
+openssl x509 -in root.pem -noout -pubkey | cmp -s - root.pub ||
+    fail "root certificate doesn't have the token's key"
+
+${BIN}/create-key > server.key || exit 1
+${BIN}/create-cert-request -k server.key -N www -H www.example.org > server.req || exit 1
+${BIN}/create-cert -k "${ROOT}" -c root.pem -r server.req -S > server.pem || exit 1
+openssl verify -CAfile root.pem server.pem || exit 1
+
+# RSA intermediate on the token, with its CSR signed there too
+${BIN}/create-key -a rsa-2048 -t "${RSA}" > rsa-ca.pub || exit 1
+${BIN}/create-cert-request -k "${RSA}" -N "Token RSA CA" > rsa-ca.req || exit 1
+${BIN}/create-cert -k "${ROOT}" -c root.pem -r rsa-ca.req -A > rsa-ca.pem || exit 1
+
+${BIN}/create-cert -k "${RSA}" -c rsa-ca.pem -r server.req -S > rsa-server.pem || exit 1
+${BIN}/create-cert -k "${RSA}" -c rsa-ca.pem -r server.req -S -g SHA256-RSAPSS > pss-server.pem || exit 1
+cat root.pem rsa-ca.pem > chain.pem
+openssl verify -CAfile chain.pem rsa-server.pem pss-server.pem || exit 1
+
+${BIN}/create-crl -k "${RSA}" -c rsa-ca.pem -r /dev/null > rsa-ca.crl || exit 1
+openssl crl -in rsa-ca.crl -CAfile chain.pem -noout || exit 1
+
+# Without the PIN the key can't be found
+CERT_TOOLS_PKCS11_PIN= ${BIN}/create-cert -k "${ROOT}" -c root.pem -r server.req -S > /dev/null 2>&1 &&
+    fail "signed without the PIN"
+
+exit 0
@@ -0,0 +1,171 @@
+#!/bin/sh
+# Regression test for create-pki.  A manifest describes a root, an
+# intermediate with a CRL, a server and a client with a p12.  Running it
+# again changes nothing, only what's missing or differs from the manifest
+# is made again, and plans change nothing.
+
+BIN=../go/bin
+
+rm -rf test-pki
+mkdir test-pki
+cd test-pki
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+cat > pki.yaml <<MANIFEST
+directory: out
+
+defaults:
+  country: [GB]
+  organisation: [Example Ltd]
+  validity: 30
+
+certificates:
+  - name: root
+    common-name: Example Root
+    validity: 3650
+    key-algorithm: ecdsa-p384
+    crl-validity: 7
+
+  - name: ca1
+    issuer: root
+    common-name: Example CA1
+    profiles: [ca]
+    validity: 365
+    crl-validity: 7
+    crl-distribution: [http://ca.example.org/ca1.crl]
+
+  - name: www
+    issuer: ca1
+    common-name: www
+    hosts: [www.example.org, 10.0.0.1]
+    profiles: [server]
+
+  - name: alice
+    issuer: ca1
+    common-name: Alice
+    email: [alice@example.org]
+    profiles: [client]
+    key-algorithm: rsa-2048
+    p12: true
+    p12-password: foo
+MANIFEST
+
+${BIN}/create-pki -m pki.yaml -n > plan1.out 2> plan1.log || fail "$(cat plan1.log)"
+[ -d out ] && fail "plan made files"
+grep -q '^out/www.pem: issue, missing$' plan1.out || fail "plan is wrong: $(cat plan1.out)"
+
+${BIN}/create-pki -m pki.yaml --audit-log audit.log > build1.out 2> build1.log || fail "$(cat build1.log)"
+grep -q '"operation":"create-pki crl","operator":"[^"]*","ca":"CN=' audit.log || fail "CRL not audited: $(cat audit.log)"
+${BIN}/verify-audit -f audit.log > /dev/null || exit 1
+cmp -s plan1.out build1.out || fail "applied something other than the plan"
+cd out
+
+for f in root ca1 www alice; do
+    [ -f ${f}.key -a -f ${f}.pem -a -f ${f}-chain.pem ] || fail "${f} files missing"
+done
+[ -f root.crl -a -f ca1.crl -a -f alice.p12 ] || fail "CRL or p12 missing"
+[ -f www.p12 -o -f www.crl ] && fail "unasked for files"
+
+openssl verify -CAfile root.pem -untrusted ca1.pem www.pem alice.pem || exit 1
+openssl verify -CAfile root.pem -untrusted ca1-chain.pem www-chain.pem || exit 1
+openssl crl -in ca1.crl -CAfile ca1-chain.pem -noout || exit 1
+openssl x509 -in www.pem -noout -subject | grep -q 'C = GB, O = Example Ltd, CN = www' ||
+    fail "defaults not applied"
+openssl x509 -in www.pem -noout -ext subjectAltName | grep -q 'IP Address:10.0.0.1' ||
+    fail "SANs missing"
+openssl x509 -in www.pem -noout -ext crlDistributionPoints | grep -q ca1.crl ||
+    fail "CRL distribution not inherited from the CA"
+openssl x509 -in alice.pem -noout -ext extendedKeyUsage | grep -q 'Client Authentication' ||
+    fail "profile not applied"
+openssl pkcs12 -in alice.p12 -passin pass:foo -nokeys 2> /dev/null | grep -q 'subject=.*CN *= *Example CA1' ||
+    fail "p12 chain missing"
+
+cd ..
+cp -r out before
+
+# A second run does nothing
+${BIN}/create-pki -m pki.yaml > build2.out 2>&1 || fail "$(cat build2.out)"
+grep -q '^0 changes$' build2.out || fail "second run changed: $(cat build2.out)"
+diff -r before out > /dev/null || fail "second run changed files"
+
+# A missing certificate is issued again with its key, a new CA key
+# means what it signed is issued again
+rm out/www.pem out/root.key
+${BIN}/create-pki -m pki.yaml > build3.log 2>&1 || fail "$(cat build3.log)"
+cmp -s before/www.key out/www.key || fail "key not reused"
+cmp -s before/www.pem out/www.pem && fail "certificate not issued"
+cmp -s before/root.pem out/root.pem && fail "root not issued with its new key"
+cmp -s before/ca1.pem out/ca1.pem && fail "intermediate not issued under the new root"
+cmp -s before/root.crl out/root.crl && fail "root CRL not issued"
+cmp -s before/alice.pem out/alice.pem || fail "certificate issued needlessly"
+cmp -s before/alice.p12 out/alice.p12 && fail "p12 not written with the new chain"
+openssl verify -CAfile out/root.pem -untrusted out/ca1.pem out/www.pem out/alice.pem || exit 1
+
+# Revocations are picked up by the CRL
+echo "$(openssl x509 -in out/alice.pem -noout -serial | cut -d= -f2),2024-01-01T00:00:00Z" > out/ca1.revoked
+${BIN}/create-pki -m pki.yaml > build4.log 2>&1 || fail "$(cat build4.log)"
+grep -q 'ca1.crl: issue, revocations changed' build4.log || fail "CRL not issued: $(cat build4.log)"
+openssl verify -crl_check -CAfile out/root.pem -untrusted out/ca1.pem -CRLfile out/ca1.crl out/alice.pem > /dev/null 2>&1 &&
+    fail "revoked certificate verifies"
+
+# Changes to the manifest are planned, and applying the plan carries
+# them out
+cp -r out before2
+sed -e 's/hosts: \[www.example.org, 10.0.0.1\]/hosts: [www.example.org, api.example.org]/' \
+    -e 's/profiles: \[client\]/profiles: [client, code-signing]/' \
+    -e 's/validity: 365/validity: 365\n    renew-before: 400/' pki.yaml > pki2.yaml
+cat >> pki2.yaml <<MANIFEST
+
+  - name: old
+    issuer: ca1
+    common-name: old
+    profiles: [client]
+    revoked: true
+MANIFEST
+
+${BIN}/create-pki -m pki2.yaml -n > plan5.out 2>&1 || fail "$(cat plan5.out)"
+diff -r before2 out > /dev/null || fail "plan changed files"
+grep -q '^out/www.pem: issue, SANs missing DNS:api.example.org$' plan5.out || fail "SAN change not planned: $(cat plan5.out)"
+grep -q '^out/alice.pem: issue, profiles changed$' plan5.out || fail "profile change not planned: $(cat plan5.out)"
+grep -q '^out/ca1.pem: issue, expires in 36[45] days$' plan5.out || fail "renewal not planned: $(cat plan5.out)"
+grep -q 'old.pem' plan5.out && fail "revoked certificate would be issued"
+
+# A revoked entry's certificate goes on its issuer's CRL
+cp out/www.pem out/old.pem
+${BIN}/create-pki -m pki2.yaml > build6.log 2>&1 || fail "$(cat build6.log)"
+grep -q '^out/ca1.revoked: revoke, old serial ' build6.log || fail "revocation not planned: $(cat build6.log)"
+openssl x509 -in out/www.pem -noout -ext subjectAltName | grep -q api.example.org || fail "SANs not updated"
+openssl x509 -in out/alice.pem -noout -ext extendedKeyUsage | grep -q 'Code Signing' || fail "profiles not updated"
+openssl verify -crl_check -CAfile out/root.pem -untrusted out/ca1.pem -CRLfile out/ca1.crl out/old.pem > /dev/null 2>&1 &&
+    fail "revoked certificate verifies"
+openssl verify -crl_check -CAfile out/root.pem -untrusted out/ca1.pem -CRLfile out/ca1.crl out/www.pem || exit 1
+sed -i -e 's/renew-before: 400/renew-before: 30/' pki2.yaml
+${BIN}/create-pki -m pki2.yaml > build7.out 2>&1 || fail "$(cat build7.out)"
+grep -q '^0 changes$' build7.out || fail "revocation not idempotent: $(cat build7.out)"
+
+# A revoked certificate from another issuer, or one which can't be read,
+# is an error rather than left off the CRL
+cp out/old.pem old.pem
+cp out/ca1.revoked ca1.revoked
+cp out/root.pem out/old.pem
+${BIN}/create-pki -m pki2.yaml > build8.out 2>&1 && fail "revoked another issuer's certificate"
+grep -q "out/old.pem wasn't issued by ca1" build8.out || fail "wrong error: $(cat build8.out)"
+echo junk > out/old.pem
+${BIN}/create-pki -m pki2.yaml > build8.out 2>&1 && fail "unreadable revoked certificate ignored"
+cmp -s out/ca1.revoked ca1.revoked || fail "revocation list changed"
+cp old.pem out/old.pem
+
+# JSON manifests work too, and mistakes are caught
+echo '{"certificates": [{"name": "x", "issuer": "www", "profiles": ["server"], "common-name": "x"}, {"name": "www", "issuer": "root"}]}' > bad.json
+${BIN}/create-pki -m bad.json > /dev/null 2>&1 && fail "accepted a bad manifest"
+echo '{"certificates": [{"name": "r", "common-name": "R", "valdity": 3}]}' > typo.json
+${BIN}/create-pki -m typo.json > /dev/null 2>&1 && fail "accepted an unknown setting"
+echo '{"directory": "json", "certificates": [{"name": "r", "common-name": "R"}]}' > good.json
+${BIN}/create-pki -m good.json > /dev/null 2>&1 || fail "JSON manifest failed"
+openssl x509 -in json/r.pem -noout -subject | grep -q 'CN = R' || fail "JSON manifest not built"
+
+exit 0
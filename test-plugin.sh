@@ -0,0 +1,63 @@
+#!/bin/sh
+# Regression test for signer plugins.  CA keys are only seen by the
+# reference plugin, run as a command or serving a Unix socket, and used
+# by create-ca-cert, create-cert and create-crl.
+
+BIN=../go/bin
+
+rm -rf test-plugin
+mkdir test-plugin
+cd test-plugin
+
+PID=
+stop() {
+    [ -n "${PID}" ] && kill ${PID} 2> /dev/null
+    PID=
+}
+trap stop EXIT
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+PLUGIN=$(cd ${BIN}; pwd)/signer-plugin
+
+${BIN}/create-key > server.key || exit 1
+${BIN}/create-cert-request -k server.key -N www -H www.example.org > server.req || exit 1
+
+# Each key type through a plugin command
+for alg in ecdsa-p384 rsa-2048 ed25519; do
+    ${BIN}/create-key -a ${alg} > ${alg}.key || exit 1
+    KEY="plugin:${PLUGIN} -k ${alg}.key"
+    ${BIN}/create-ca-cert -k "${KEY}" -E ca@example.org -N "${alg} CA" > ${alg}.pem || exit 1
+    ${BIN}/create-cert -k "${KEY}" -c ${alg}.pem -r server.req -S > ${alg}-server.pem || exit 1
+    openssl verify -CAfile ${alg}.pem ${alg}-server.pem || exit 1
+done
+
+${BIN}/create-cert -k "plugin:${PLUGIN} -k rsa-2048.key" -c rsa-2048.pem -r server.req -S -g SHA384-RSAPSS > pss-server.pem || exit 1
+openssl verify -CAfile rsa-2048.pem pss-server.pem || exit 1
+
+# A plugin on a Unix socket
+${BIN}/signer-plugin -k ecdsa-p384.key -l $(pwd)/signer.sock 2> signer.log &
+PID=$!
+sleep 1
+
+${BIN}/create-cert -k unix:$(pwd)/signer.sock -c ecdsa-p384.pem -r server.req -S > socket-server.pem || exit 1
+openssl verify -CAfile ecdsa-p384.pem socket-server.pem || exit 1
+${BIN}/create-crl -k unix:$(pwd)/signer.sock -c ecdsa-p384.pem -r /dev/null > ca.crl || exit 1
+openssl crl -in ca.crl -CAfile ecdsa-p384.pem -noout || exit 1
+
+# The plugin's key must match the CA certificate
+${BIN}/create-cert -k unix:$(pwd)/signer.sock -c rsa-2048.pem -r server.req -S > /dev/null 2>&1 &&
+    fail "signed with a plugin key not matching the CA"
+
+# A plugin key only signs, so SCEP needs an RA to decrypt
+timeout 5 ${BIN}/scep-server -l 127.0.0.1:18081 -k "plugin:${PLUGIN} -k rsa-2048.key" -c rsa-2048.pem > scep.log 2>&1 &&
+    fail "SCEP server started without a key to decrypt with"
+grep -q "use --ra-key" scep.log || fail "SCEP server: $(cat scep.log)"
+
+${BIN}/create-cert -k "plugin:/nonexistent" -c rsa-2048.pem -r server.req -S > /dev/null 2>&1 &&
+    fail "signed with a missing plugin"
+
+exit 0
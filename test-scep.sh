@@ -0,0 +1,100 @@
+#!/bin/sh
+# Regression test for the SCEP server and client.  Enrolls with a
+# challenge password through an RA and directly with an RSA CA, checks
+# one-time and wrong passwords are refused, and renews.
+
+BIN=../go/bin
+PORT=18080
+URL=http://127.0.0.1:${PORT}/scep
+
+rm -rf test-scep
+mkdir test-scep
+cd test-scep
+
+PID=
+stop() {
+    [ -n "${PID}" ] && kill ${PID} 2> /dev/null
+    PID=
+}
+trap stop EXIT
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+start() {
+    ${BIN}/scep-server -l 127.0.0.1:${PORT} -P challenges "$@" 2> server.log &
+    PID=$!
+    sleep 1
+}
+
+printf 'first\nsecond\n' > challenges
+
+# EC CA, so SCEP goes through an RSA RA
+${BIN}/create-key > ca.key || exit 1
+${BIN}/create-ca-cert -k ca.key -E ca@example.org -N "SCEP CA" > ca.pem || exit 1
+${BIN}/create-key -a rsa-2048 > ra.key || exit 1
+${BIN}/create-cert-request -k ra.key -N "SCEP RA" > ra.req || exit 1
+${BIN}/create-cert -k ca.key -c ca.pem -r ra.req -C > ra.pem || exit 1
+
+start -k ca.key -c ca.pem --ra-key ra.key --ra-certificate ra.pem --one-time --audit-log audit.log
+
+${BIN}/create-key -a rsa-2048 > device.key || exit 1
+${BIN}/create-cert-request -k device.key -N device1 -H device1.example.org -w first > device.req || exit 1
+${BIN}/scep-client -u ${URL} -c ca.pem -k device.key -r device.req > device.pem || exit 1
+openssl verify -CAfile ca.pem device.pem || exit 1
+
+# Challenge passwords are one-time
+${BIN}/scep-client -u ${URL} -c ca.pem -k device.key -r device.req > /dev/null 2>&1 &&
+    fail "reused challenge password was accepted"
+
+${BIN}/create-cert-request -k device.key -N device1 -w wrong > wrong.req || exit 1
+${BIN}/scep-client -u ${URL} -c ca.pem -k device.key -r wrong.req > /dev/null 2>&1 &&
+    fail "wrong challenge password was accepted"
+
+# Renewal with a new key, signed by the current certificate
+${BIN}/create-key -a rsa-2048 > renew.key || exit 1
+${BIN}/create-cert-request -k renew.key -N device1 -H device1.example.org > renew.req || exit 1
+${BIN}/scep-client -u ${URL} -c ca.pem -k renew.key -r renew.req -s device.pem --signer-key device.key > renew.pem || exit 1
+openssl verify -CAfile ca.pem renew.pem || exit 1
+
+# Renewal can't change the subject
+${BIN}/create-cert-request -k renew.key -N device2 > other.req || exit 1
+${BIN}/scep-client -u ${URL} -c ca.pem -k renew.key -r other.req -s device.pem --signer-key device.key > /dev/null 2>&1 &&
+    fail "renewal changed the subject"
+
+# Or add SANs
+${BIN}/create-cert-request -k renew.key -N device1 -H device1.example.org -H other.example.org > more.req || exit 1
+${BIN}/scep-client -u ${URL} -c ca.pem -k renew.key -r more.req -s device.pem --signer-key device.key > /dev/null 2>&1 &&
+    fail "renewal added a SAN"
+
+stop
+
+# Used challenge passwords stay used after a restart
+start -k ca.key -c ca.pem --ra-key ra.key --ra-certificate ra.pem --one-time
+${BIN}/scep-client -u ${URL} -c ca.pem -k device.key -r device.req > /dev/null 2>&1 &&
+    fail "used challenge password was accepted after a restart"
+stop
+
+# Enrolments and renewals are audited
+[ $(grep -c '"operation":"scep-server enroll","operator":[^}]*"result":"success"' audit.log) = 1 ] &&
+    [ $(grep -c '"operation":"scep-server renew","operator":[^}]*"result":"success"' audit.log) = 1 ] ||
+    fail "enrolments not audited: $(cat audit.log)"
+${BIN}/verify-audit -f audit.log > /dev/null || exit 1
+
+# RSA CA without an RA
+${BIN}/create-key -a rsa-2048 > rsa-ca.key || exit 1
+${BIN}/create-ca-cert -k rsa-ca.key -E ca@example.org -N "SCEP RSA CA" > rsa-ca.pem || exit 1
+
+start -k rsa-ca.key -c rsa-ca.pem
+
+${BIN}/create-cert-request -k device.key -N device3 -w second > device3.req || exit 1
+${BIN}/scep-client -u ${URL} -c rsa-ca.pem -k device.key -r device3.req > device3.pem || exit 1
+openssl verify -CAfile rsa-ca.pem device3.pem || exit 1
+
+# Client refuses an unexpected CA
+${BIN}/scep-client -u ${URL} -c ca.pem -k device.key -r device3.req > /dev/null 2>&1 &&
+    fail "client accepted the wrong CA"
+
+exit 0
@@ -0,0 +1,58 @@
+#!/bin/sh
+# Regression test for key shares.  A root key is made as shares without
+# ever being written whole, and signing commands recover it from any
+# threshold of shares.
+
+BIN=../go/bin
+
+rm -rf test-shares
+mkdir test-shares
+cd test-shares
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+${BIN}/create-key -a ecdsa-p384 -n 5 -m 3 -o root > root.pub || exit 1
+[ $(ls root-*.share | wc -l) = 5 ] || fail "expected 5 shares"
+
+ROOT=shares:root-1.share,root-3.share,root-5.share
+
+${BIN}/create-ca-cert -k ${ROOT} -E ca@example.org -N "Shared Root" > root.pem || exit 1
+openssl x509 -in root.pem -noout -pubkey | cmp -s - root.pub ||
+    fail "root certificate doesn't have the shared key"
+
+${BIN}/create-key > server.key || exit 1
+${BIN}/create-cert-request -k server.key -N www -H www.example.org > server.req || exit 1
+${BIN}/create-cert -k shares:root-2.share,root-4.share,root-5.share -c root.pem -r server.req -S > server.pem || exit 1
+openssl verify -CAfile root.pem server.pem || exit 1
+${BIN}/create-crl -k shares:root-5.share,root-4.share,root-3.share,root-1.share -c root.pem -r /dev/null > root.crl || exit 1
+openssl crl -in root.crl -CAfile root.pem -noout || exit 1
+
+# Too few shares, repeated shares and damaged shares are refused
+${BIN}/create-cert -k shares:root-1.share,root-2.share -c root.pem -r server.req -S > /dev/null 2>&1 &&
+    fail "key recovered from too few shares"
+${BIN}/create-cert -k shares:root-1.share,root-1.share,root-2.share -c root.pem -r server.req -S > /dev/null 2>&1 &&
+    fail "key recovered from a repeated share"
+sed '9y/ABCDEFGHIJKLMNOPQRSTUVWXYZ/BCDEFGHIJKLMNOPQRSTUVWXYZA/' root-2.share > damaged.share
+${BIN}/create-cert -k shares:root-1.share,damaged.share,root-3.share -c root.pem -r server.req -S > /dev/null 2>&1 &&
+    fail "key recovered from a damaged share"
+
+# Splitting an existing key, and shares of different keys don't mix
+for alg in rsa-2048 ed25519; do
+    ${BIN}/create-key -a ${alg} > ${alg}.key || exit 1
+    ${BIN}/split-key -k ${alg}.key -n 3 -m 2 -o ${alg} || exit 1
+    ${BIN}/create-ca-cert -k shares:${alg}-3.share,${alg}-1.share -E ca@example.org -N "${alg} CA" > ${alg}.pem || exit 1
+    openssl x509 -in ${alg}.pem -noout -pubkey > ${alg}.cert.pub
+    openssl pkey -in ${alg}.key -pubout | cmp -s - ${alg}.cert.pub ||
+        fail "${alg} shares recover a different key"
+done
+
+${BIN}/create-cert -k shares:rsa-2048-1.share,ed25519-2.share -c root.pem -r server.req -S > /dev/null 2>&1 &&
+    fail "shares of different keys mixed"
+
+${BIN}/split-key -k rsa-2048.key -n 3 -m 2 -o rsa-2048 > /dev/null 2>&1 &&
+    fail "existing shares overwritten"
+
+exit 0
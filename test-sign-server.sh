@@ -0,0 +1,120 @@
+#!/bin/sh
+# Regression test for the signing API.  Signs requests as PEM and JSON
+# with client certificates, checks profiles and revocation are limited
+# to the clients allowed them, that clients can't be impersonated, that
+# revoked certificates reach the CRL, and the audit log.
+
+BIN=../go/bin
+PORT=18444
+URL=https://127.0.0.1:${PORT}/v1
+
+rm -rf test-sign-server
+mkdir test-sign-server
+cd test-sign-server
+
+PID=
+stop() {
+    [ -n "${PID}" ] && kill ${PID} 2> /dev/null
+    PID=
+}
+trap stop EXIT
+
+fail() {
+    echo "$@" 1>&2
+    exit 1
+}
+
+# Makes a key and client certificate with the CN given.
+client() {
+    ${BIN}/create-key > $1.key || exit 1
+    ${BIN}/create-cert-request -k $1.key -N $1 > $1.req || exit 1
+    ${BIN}/create-cert -k clients-ca.key -c clients-ca.pem -r $1.req -C > $1.pem || exit 1
+}
+
+# Calls the API as a client.
+api() {
+    name=$1
+    shift
+    curl -sf --cacert ca.pem --cert ${name}.pem --key ${name}.key "$@"
+}
+
+${BIN}/create-key > ca.key || exit 1
+${BIN}/create-ca-cert -k ca.key -E ca@example.org -N "Signing CA" > ca.pem || exit 1
+${BIN}/create-key > tls.key || exit 1
+${BIN}/create-cert-request -k tls.key -N 127.0.0.1 -H 127.0.0.1 > tls.req || exit 1
+${BIN}/create-cert -k ca.key -c ca.pem -r tls.req -S > tls.pem || exit 1
+${BIN}/create-key > clients-ca.key || exit 1
+${BIN}/create-ca-cert -k clients-ca.key -E ca@example.org -N "Clients CA" > clients-ca.pem || exit 1
+
+client builder
+client ops
+client stranger
+
+printf 'builder server client\nops * revoke\n' > clients
+: > revoked
+mkdir issued
+
+# The signing CA can't vouch for clients
+${BIN}/sign-server -l 127.0.0.1:${PORT} -k ca.key -c ca.pem -o issued -r revoked \
+    -a clients --client-ca ca.pem --tls-certificate tls.pem --tls-key tls.key > /dev/null 2>&1 &&
+    fail "signing CA was accepted as the client CA"
+
+${BIN}/sign-server -l 127.0.0.1:${PORT} -k ca.key -c ca.pem -o issued -r revoked \
+    -a clients --client-ca clients-ca.pem -L audit.log \
+    --tls-certificate tls.pem --tls-key tls.key 2> server.log &
+PID=$!
+sleep 1
+
+${BIN}/create-key > www.key || exit 1
+${BIN}/create-cert-request -k www.key -N www.example.org -H www.example.org > www.req || exit 1
+
+# PEM in and out
+api builder -H 'Accept: application/x-pem-file' --data-binary @www.req \
+    "${URL}/sign?profile=server" > www.pem || fail "PEM signing failed"
+openssl verify -CAfile ca.pem -purpose sslserver www.pem || exit 1
+
+# JSON in and out
+${BIN}/create-cert-request -k www.key -N service > service.req || exit 1
+printf '{"profile": "client", "csr": "%s"}' "$(awk '{printf "%s\\n", $0}' service.req)" > sign.json
+api builder -H 'Content-Type: application/json' --data-binary @sign.json \
+    ${URL}/sign > signed.json || fail "JSON signing failed"
+serial=$(sed -n 's/^ *"serial": "\([0-9A-F]*\)",*$/\1/p' signed.json)
+[ -n "${serial}" ] && [ -f issued/${serial}.pem ] ||
+    fail "issued certificate not kept: $(cat signed.json)"
+openssl verify -CAfile ca.pem -purpose sslclient issued/${serial}.pem || exit 1
+
+# Clients are limited to their profiles and permissions
+api builder --data-binary @www.req "${URL}/sign?profile=code-signing" > /dev/null &&
+    fail "profile not allowed for the client was signed"
+api stranger --data-binary @www.req "${URL}/sign?profile=server" > /dev/null &&
+    fail "unknown client was allowed to sign"
+curl -sf --cacert ca.pem --data-binary @www.req "${URL}/sign?profile=server" > /dev/null &&
+    fail "client without a certificate was allowed to sign"
+api builder -d "{\"serial\": \"${serial}\"}" ${URL}/revoke > /dev/null &&
+    fail "client without revoke permission revoked"
+${BIN}/create-cert-request -k www.key -N ops > ops.req || exit 1
+api builder --data-binary @ops.req "${URL}/sign?profile=client" > /dev/null &&
+    fail "certificate with a client's name was signed"
+
+# The CRL is only signed again when revocations change
+curl -sf --cacert ca.pem "${URL}/crl?format=der" > before.der || fail "failed to fetch the CRL"
+curl -sf --cacert ca.pem "${URL}/crl?format=der" > again.der || fail "failed to fetch the CRL"
+cmp -s before.der again.der || fail "unchanged CRL was signed again"
+
+# Revocation reaches the CRL
+api ops -d "{\"serial\": \"${serial}\"}" ${URL}/revoke > /dev/null || fail "revocation failed"
+curl -sf --cacert ca.pem "${URL}/crl?format=der" > crl.der || fail "failed to fetch the CRL"
+openssl crl -inform DER -in crl.der -CAfile ca.pem -noout 2> /dev/null || fail "CRL doesn't verify"
+openssl crl -inform DER -in crl.der -noout -text | grep -Eq "Serial Number: 0*${serial}$" ||
+    fail "revoked certificate isn't in the CRL"
+
+stop
+
+# Requests are audited, refused ones too
+[ $(grep -c '"operation":"sign-server sign",[^}]*"result":"success"' audit.log) = 2 ] &&
+    [ $(grep -c '"operation":"sign-server revoke",[^}]*"result":"success"' audit.log) = 1 ] &&
+    [ $(grep -c '"result":"failure"' audit.log) = 4 ] ||
+    fail "requests not audited: $(cat audit.log)"
+${BIN}/verify-audit -f audit.log > /dev/null || exit 1
+
+exit 0